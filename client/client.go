@@ -14,6 +14,7 @@ import (
 	"github.com/netsys-lab/bittorrent-over-scion/dht_node"
 	"github.com/netsys-lab/bittorrent-over-scion/handshake"
 	"github.com/netsys-lab/bittorrent-over-scion/message"
+	ps "github.com/netsys-lab/bittorrent-over-scion/pathselection"
 	"github.com/netsys-lab/bittorrent-over-scion/peers"
 
 	smp "github.com/netsys-lab/scion-path-discovery/api"
@@ -41,23 +42,35 @@ type Client struct {
 //LastSelection users could add more fields
 type ClientSelection struct {
 	lastSelectedPathSet pathselection.PathSet
+	policy              ps.PathPolicy
+	filter              *ps.PathFilter
 }
 
 //CustomPathSelectAlg this is where the user actually wants to implement its logic in
 func (lastSel *ClientSelection) CustomPathSelectAlg(pathSet *pathselection.PathSet) (*pathselection.PathSet, error) {
-	// Connect via shortest path
-	return pathSet.GetPathSmallHopCount(3), nil
+	pathSet, err := lastSel.filter.FilterPathSet(pathSet)
+	if err != nil {
+		return nil, err
+	}
+	// Connect via three paths chosen by the policy
+	return lastSel.policy.Select(pathSet, 3), nil
 }
 
 //LastSelection users could add more fields
 type ClientInitiatedSelection struct {
 	lastSelectedPathSet pathselection.PathSet
+	policy              ps.PathPolicy
+	filter              *ps.PathFilter
 }
 
 //CustomPathSelectAlg this is where the user actually wants to implement its logic in
 func (lastSel *ClientInitiatedSelection) CustomPathSelectAlg(pathSet *pathselection.PathSet) (*pathselection.PathSet, error) {
-	// Connect via shortest path
-	return pathSet.GetPathSmallHopCount(1), nil
+	pathSet, err := lastSel.filter.FilterPathSet(pathSet)
+	if err != nil {
+		return nil, err
+	}
+	// Connect via the best path according to the policy
+	return lastSel.policy.Select(pathSet, 1), nil
 }
 
 // send BitTorrent handshake and wait for response, ping remotes DHT Node when existing as specified in BEP5
@@ -119,7 +132,10 @@ func recvBitfield(conn packets.UDPConn) (bitfield.Bitfield, error) {
 
 type MPClient struct {
 	Client
-	mpSock *smp.MPPeerSock
+	mpSock      *smp.MPPeerSock
+	PathPolicy  string          // Name of the pathselection.PathPolicy used to dial the peer
+	PathFilter  *ps.PathFilter  // Optional: Restricts the paths used to dial the peer
+	PathHistory *ps.PathHistory // Optional: Prefer paths that performed well before
 }
 
 func NewMPClient() *MPClient {
@@ -161,7 +177,14 @@ func (mp *MPClient) DialAndWaitForConnectBack(
 	localSocketAddr.Host.Port, _ = freeport.GetFreePort()
 	localSocketAddrStr := localSocketAddr.String()
 
-	sel := ClientInitiatedSelection{}
+	policy, err := ps.NewPathPolicy(mp.PathPolicy)
+	if err != nil {
+		return nil, err
+	}
+	sel := ClientInitiatedSelection{
+		policy: ps.WithHistory(policy, mp.PathHistory),
+		filter: mp.PathFilter,
+	}
 	log.Debugf("Dialing from %s to %s", localSocketAddrStr, address)
 	mpSock := smp.NewMPPeerSock(localSocketAddrStr, address, &smp.MPSocketOptions{
 		Transport:                   "QUIC",
@@ -175,6 +198,17 @@ func (mp *MPClient) DialAndWaitForConnectBack(
 		return nil, err
 	}
 
+	// Fail before connecting if no path is allowed, the selection would have nothing to dial
+	if mp.PathFilter != nil {
+		paths, err := mpSock.GetAvailablePaths()
+		if err != nil {
+			return nil, err
+		}
+		if _, err = mp.PathFilter.FilterPaths(paths); err != nil {
+			return nil, fmt.Errorf("can not dial %s: %w", address, err)
+		}
+	}
+
 	// Connect via one path
 	err = mpSock.Connect(&sel, &socket.ConnectOptions{
 		DontWaitForIncoming:     true,
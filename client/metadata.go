@@ -0,0 +1,78 @@
+package client
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"time"
+
+	"github.com/netsys-lab/bittorrent-over-scion/message"
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxMetadataSize is the largest info dictionary accepted from peers
+const MaxMetadataSize = 16 * 1024 * 1024
+
+// MetadataTimeout is the time the peer has to deliver the whole metadata
+const MetadataTimeout = 30 * time.Second
+
+// FetchMetadata requests the info dictionary of the torrent from the peer piece by piece, as
+// specified in BEP9, and verifies it against the info-hash
+func (c *Client) FetchMetadata() ([]byte, error) {
+	c.Conn.SetDeadline(time.Now().Add(MetadataTimeout))
+	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
+
+	var metadata []byte
+	for piece := 0; piece == 0 || piece*message.MetadataPieceSize < len(metadata); piece++ {
+		req, err := message.FormatMetadata(&message.Metadata{Type: message.MetadataRequest, Piece: piece})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := c.Conn.Write(req.Serialize()); err != nil {
+			return nil, err
+		}
+
+		m, err := c.readMetadata()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case m.Type == message.MetadataReject:
+			return nil, fmt.Errorf("peer %s rejected the metadata request", c.Peer)
+		case m.Type != message.MetadataData || m.Piece != piece:
+			return nil, fmt.Errorf("unexpected metadata message %d for piece %d", m.Type, m.Piece)
+		case m.TotalSize <= 0 || m.TotalSize > MaxMetadataSize:
+			return nil, fmt.Errorf("invalid metadata size %d", m.TotalSize)
+		}
+		if metadata == nil {
+			metadata = make([]byte, m.TotalSize)
+		}
+		begin := piece * message.MetadataPieceSize
+		if len(metadata) != m.TotalSize || begin+len(m.Data) > len(metadata) {
+			return nil, fmt.Errorf("metadata piece %d does not fit the metadata size", piece)
+		}
+		copy(metadata[begin:], m.Data)
+	}
+
+	if sha1.Sum(metadata) != c.InfoHash {
+		return nil, fmt.Errorf("metadata of %s does not match the info-hash %x", c.Peer, c.InfoHash)
+	}
+	log.Debugf("Fetched %d bytes of metadata from %s", len(metadata), c.Peer)
+	return metadata, nil
+}
+
+// readMetadata skips messages until the next metadata message
+func (c *Client) readMetadata() (*message.Metadata, error) {
+	for {
+		msg, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != message.MsgExtended {
+			continue
+		}
+		return message.ParseMetadata(msg)
+	}
+}
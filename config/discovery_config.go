@@ -3,6 +3,11 @@ package config
 // SPDX-License-Identifier: GPL-3.0-only
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
 	"github.com/netsys-lab/dht"
 )
 
@@ -11,6 +16,11 @@ type PeerDiscoveryConfig struct {
 	DhtPort       uint16
 	EnableTracker bool // TODO: implementation currently doesnt support SCION-trackers
 	DhtNodes      []dht.Addr
+	DhtStateDir   string // directory to keep node ids and routing tables across restarts, disabled if empty
+
+	DhtAnnounceInterval time.Duration // interval in which torrents are announced and looked up, the dht_node default if 0
+	DhtRetryInterval    time.Duration // first delay before failed lookups are retried, the dht_node default if 0
+	DhtReadOnly         bool          // leechers only look up peers, neither announcing nor answering other nodes
 }
 
 // DefaultPeerDisoveryConfig use all supported dynamic peer discovery techniques
@@ -19,5 +29,23 @@ func DefaultPeerDisoveryConfig() PeerDiscoveryConfig {
 		EnableDht:     true,
 		EnableTracker: false,
 		DhtPort:       7000,
+		DhtStateDir:   defaultDhtStateDir(),
+	}
+}
+
+func defaultDhtStateDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "bittorrent-over-scion", "dht")
+}
+
+// DhtNodeStateDir returns the state directory of the dht node running on DhtPort, so that
+// seeder and leecher on the same host keep separate node ids
+func (c *PeerDiscoveryConfig) DhtNodeStateDir() string {
+	if c.DhtStateDir == "" {
+		return ""
 	}
+	return filepath.Join(c.DhtStateDir, fmt.Sprintf("node-%d", c.DhtPort))
 }
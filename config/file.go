@@ -0,0 +1,169 @@
+package config
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"github.com/scionproto/scion/go/lib/snet"
+
+	"github.com/netsys-lab/bittorrent-over-scion/pathselection"
+)
+
+// File holds the settings of a configuration file in TOML format, see config.example.toml
+type File struct {
+	Local     string        `toml:"local"`     // Local SCION address, of format ISD-AS,[IP]:Port
+	Dir       string        `toml:"dir"`       // Directory torrents are downloaded to by the daemon
+	LogLevel  string        `toml:"log_level"` // TRACE, DEBUG, INFO, WARN, ERROR or FATAL
+	Server    ServerFile    `toml:"server"`
+	Discovery DiscoveryFile `toml:"discovery"`
+	Paths     PathsFile     `toml:"paths"`
+	Limits    LimitsFile    `toml:"limits"`
+	Metrics   MetricsFile   `toml:"metrics"`
+	Daemon    DaemonFile    `toml:"daemon"`
+	Scion     ScionFile     `toml:"scion"`
+}
+
+// ServerFile mirrors server.ServerConfig
+type ServerFile struct {
+	NumPaths          int    `toml:"num_paths"`            // Paths per leecher, 0 to distribute paths fairly among leechers
+	DialBackStartPort int    `toml:"dial_back_start_port"` // Start port of the connections dialing back to leechers
+	PathAllocation    string `toml:"path_allocation"`      // equal, priority, remaining or bandwidth
+	PeerPriorities    string `toml:"peer_priorities"`      // Semicolon separated peer=priority pairs
+	RebalancePaths    bool   `toml:"rebalance_paths"`      // Replace paths that perform consistently worse
+}
+
+// DiscoveryFile mirrors PeerDiscoveryConfig
+type DiscoveryFile struct {
+	EnableDht        bool          `toml:"enable_dht"`
+	DhtPort          int           `toml:"dht_port"`
+	Bootstrap        []string      `toml:"bootstrap"` // SCION addresses of dht nodes to join
+	StateDir         string        `toml:"state_dir"`
+	AnnounceInterval time.Duration `toml:"announce_interval"`
+	RetryInterval    time.Duration `toml:"retry_interval"`
+	ReadOnly         bool          `toml:"read_only"`
+}
+
+// PathsFile configures the path selection
+type PathsFile struct {
+	Policy  string `toml:"policy"`  // One of pathselection.PathPolicyNames
+	Allow   string `toml:"allow"`   // Comma separated rules of pathselection.ParsePathFilterRule
+	Deny    string `toml:"deny"`    // Comma separated rules of pathselection.ParsePathFilterRule
+	History string `toml:"history"` // File of the path history, disabled if empty
+}
+
+// LimitsFile limits the transfers of the daemon
+type LimitsFile struct {
+	MaxActiveDownloads int `toml:"max_active_downloads"` // 0 for no limit
+}
+
+// MetricsFile configures the metrics
+type MetricsFile struct {
+	Addr     string `toml:"addr"`      // Address to serve Prometheus metrics at
+	ExportTo string `toml:"export_to"` // Target per-path metrics are exported to, see exporter.New
+}
+
+// DaemonFile configures the daemon
+type DaemonFile struct {
+	Listen string `toml:"listen"` // Address of the control API
+	Token  string `toml:"token"`  // Bearer token required by the control API
+	Seed   bool   `toml:"seed"`   // Seed torrents once they are downloaded
+}
+
+// ScionFile configures the connection to the SCION host stack
+type ScionFile struct {
+	DaemonAddress    string `toml:"daemon_address"`    // Sets SCION_DAEMON_ADDRESS
+	DispatcherSocket string `toml:"dispatcher_socket"` // Sets SCION_DISPATCHER_SOCKET
+}
+
+var logLevels = []string{"TRACE", "DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+
+// LoadFile reads the configuration file into f. Settings missing in the file keep their value in
+// f, so that callers fill f with their defaults first. Unknown settings are an error.
+func LoadFile(path string, f *File) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	d := toml.NewDecoder(file)
+	d.Strict(true)
+	if err := d.Decode(f); err != nil {
+		return fmt.Errorf("could not load config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks the settings of the file
+func (f *File) Validate() error {
+	if f.Local != "" {
+		if _, err := snet.ParseUDPAddr(f.Local); err != nil {
+			return fmt.Errorf("invalid local: %w", err)
+		}
+	}
+	if f.LogLevel != "" && !contains(logLevels, f.LogLevel) {
+		return fmt.Errorf("invalid log_level %q, available: %v", f.LogLevel, logLevels)
+	}
+	if f.Server.NumPaths < 0 {
+		return errors.New("server.num_paths must not be negative")
+	}
+	if f.Server.DialBackStartPort < 0 || f.Server.DialBackStartPort > 65535 {
+		return errors.New("server.dial_back_start_port is no valid port")
+	}
+	if _, err := pathselection.NewAllocationStrategy(f.Server.PathAllocation); err != nil {
+		return fmt.Errorf("invalid server.path_allocation: %w", err)
+	}
+	if f.Discovery.DhtPort < 0 || f.Discovery.DhtPort > 65535 {
+		return errors.New("discovery.dht_port is no valid port")
+	}
+	for _, node := range f.Discovery.Bootstrap {
+		if _, err := snet.ParseUDPAddr(node); err != nil {
+			return fmt.Errorf("invalid discovery.bootstrap node %s: %w", node, err)
+		}
+	}
+	if f.Discovery.AnnounceInterval < 0 || f.Discovery.RetryInterval < 0 {
+		return errors.New("discovery intervals must not be negative")
+	}
+	if _, err := pathselection.NewPathPolicy(f.Paths.Policy); err != nil {
+		return fmt.Errorf("invalid paths.policy: %w", err)
+	}
+	if _, err := pathselection.NewPathFilter(f.Paths.Allow, f.Paths.Deny); err != nil {
+		return fmt.Errorf("invalid paths filter: %w", err)
+	}
+	if f.Limits.MaxActiveDownloads < 0 {
+		return errors.New("limits.max_active_downloads must not be negative")
+	}
+	return nil
+}
+
+// SetEnv sets the environment variables of the SCION settings that are not set yet, so that the
+// environment overrides the file
+func (f *File) SetEnv() error {
+	env := map[string]string{
+		"SCION_DAEMON_ADDRESS":    f.Scion.DaemonAddress,
+		"SCION_DISPATCHER_SOCKET": f.Scion.DispatcherSocket,
+	}
+	for key, value := range env {
+		if _, ok := os.LookupEnv(key); ok || value == "" {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	f := File{LogLevel: "INFO", Server: ServerFile{DialBackStartPort: 45000}}
+	require.NoError(t, LoadFile("../config.example.toml", &f))
+	require.NoError(t, f.Validate())
+	assert.Equal(t, "19-ffaa:1:c3f,[10.0.0.3]:43000", f.Local)
+	assert.Equal(t, []string{"19-ffaa:1:c3f,[10.0.0.1]:7000"}, f.Discovery.Bootstrap)
+	assert.Equal(t, 15*time.Minute, f.Discovery.AnnounceInterval)
+	assert.Equal(t, 2, f.Limits.MaxActiveDownloads)
+	assert.True(t, f.Daemon.Seed)
+
+	// Settings missing in the file keep their value
+	f = File{LogLevel: "DEBUG", Daemon: DaemonFile{Seed: true}}
+	require.NoError(t, LoadFile(writeConfig(t, "local = \"19-ffaa:1:c3f,[10.0.0.3]:43000\"\n"), &f))
+	assert.Equal(t, "DEBUG", f.LogLevel)
+	assert.True(t, f.Daemon.Seed)
+
+	assert.Error(t, LoadFile(writeConfig(t, "unknown = 1\n"), &f))
+	assert.Error(t, LoadFile(writeConfig(t, "[server]\nnum_paths = \"two\"\n"), &f))
+	assert.Error(t, LoadFile("missing.toml", &f))
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, (&File{}).Validate())
+	invalid := []string{
+		"local = \"10.0.0.3:43000\"",
+		"log_level = \"VERBOSE\"",
+		"[server]\nnum_paths = -1",
+		"[server]\npath_allocation = \"fastest\"",
+		"[discovery]\ndht_port = 70000",
+		"[discovery]\nbootstrap = [\"invalid\"]",
+		"[paths]\npolicy = \"fastest\"",
+		"[paths]\ndeny = \"invalid\"",
+		"[limits]\nmax_active_downloads = -1",
+	}
+	for _, content := range invalid {
+		var f File
+		require.NoError(t, LoadFile(writeConfig(t, content+"\n"), &f), content)
+		assert.Error(t, f.Validate(), content)
+	}
+}
+
+func TestSetEnv(t *testing.T) {
+	os.Unsetenv("SCION_DAEMON_ADDRESS")
+	os.Setenv("SCION_DISPATCHER_SOCKET", "/env.sock")
+	defer os.Unsetenv("SCION_DISPATCHER_SOCKET")
+	defer os.Unsetenv("SCION_DAEMON_ADDRESS")
+
+	f := File{Scion: ScionFile{DaemonAddress: "127.0.0.1:30255", DispatcherSocket: "/file.sock"}}
+	require.NoError(t, f.SetEnv())
+	assert.Equal(t, "127.0.0.1:30255", os.Getenv("SCION_DAEMON_ADDRESS"))
+	assert.Equal(t, "/env.sock", os.Getenv("SCION_DISPATCHER_SOCKET"), "the environment overrides the file")
+}
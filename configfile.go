@@ -0,0 +1,179 @@
+package main
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/tagflag"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/netsys-lab/bittorrent-over-scion/config"
+	"github.com/netsys-lab/bittorrent-over-scion/server"
+)
+
+// configEnv names the environment variable of the config file, used if -config is not given
+const configEnv = "BTSCION_CONFIG"
+
+var configValidateFlags = struct {
+	Config string `help:"Config file to validate, per default $BTSCION_CONFIG"`
+}{}
+
+// configSetting binds a setting of the config file to the flag of a command
+type configSetting struct {
+	file interface{} // Pointer to the field of config.File
+	flag interface{} // Pointer to the flag, of the same type or a semicolon separated string for lists
+}
+
+// mainConfigSettings binds the config file to the flags of the seeder and leecher
+func mainConfigSettings(f *config.File) []configSetting {
+	return []configSetting{
+		{&f.Local, &flags.Local},
+		{&f.LogLevel, &flags.LogLevel},
+		{&f.Server.NumPaths, &flags.NumPaths},
+		{&f.Server.DialBackStartPort, &flags.DialBackStartPort},
+		{&f.Server.PathAllocation, &flags.PathAllocation},
+		{&f.Server.PeerPriorities, &flags.PeerPriorities},
+		{&f.Server.RebalancePaths, &flags.RebalancePaths},
+		{&f.Discovery.EnableDht, &flags.EnableDht},
+		{&f.Discovery.DhtPort, &flags.DhtPort},
+		{&f.Discovery.Bootstrap, &flags.DhtBootstrapAddr},
+		{&f.Discovery.StateDir, &flags.DhtStateDir},
+		{&f.Discovery.AnnounceInterval, &flags.DhtAnnounceInterval},
+		{&f.Discovery.RetryInterval, &flags.DhtRetryInterval},
+		{&f.Discovery.ReadOnly, &flags.DhtReadOnly},
+		{&f.Paths.Policy, &flags.PathPolicy},
+		{&f.Paths.Allow, &flags.PathAllow},
+		{&f.Paths.Deny, &flags.PathDeny},
+		{&f.Paths.History, &flags.PathHistory},
+		{&f.Metrics.Addr, &flags.MetricsAddr},
+		{&f.Metrics.ExportTo, &flags.ExportMetricsTo},
+	}
+}
+
+// daemonConfigSettings binds the config file to the flags of the daemon
+func daemonConfigSettings(f *config.File) []configSetting {
+	return []configSetting{
+		{&f.Local, &daemonFlags.Local},
+		{&f.Dir, &daemonFlags.Dir},
+		{&f.LogLevel, &daemonFlags.LogLevel},
+		{&f.Server.NumPaths, &daemonFlags.NumPaths},
+		{&f.Server.DialBackStartPort, &daemonFlags.DialBackStartPort},
+		{&f.Discovery.EnableDht, &daemonFlags.EnableDht},
+		{&f.Discovery.DhtPort, &daemonFlags.DhtPort},
+		{&f.Discovery.Bootstrap, &daemonFlags.Bootstrap},
+		{&f.Limits.MaxActiveDownloads, &daemonFlags.MaxActiveDownloads},
+		{&f.Metrics.Addr, &daemonFlags.MetricsAddr},
+		{&f.Daemon.Listen, &daemonFlags.Listen},
+		{&f.Daemon.Token, &daemonFlags.Token},
+		{&f.Daemon.Seed, &daemonFlags.Seed},
+	}
+}
+
+// copySetting copies the value of src to dst, joining and splitting lists at semicolons
+func copySetting(dst, src interface{}) {
+	switch d := dst.(type) {
+	case *string:
+		if list, ok := src.(*[]string); ok {
+			*d = strings.Join(*list, ";")
+		} else {
+			*d = *src.(*string)
+		}
+	case *[]string:
+		*d = nil
+		for _, v := range strings.Split(*src.(*string), ";") {
+			if v = strings.TrimSpace(v); v != "" {
+				*d = append(*d, v)
+			}
+		}
+	case *int:
+		*d = *src.(*int)
+	case *bool:
+		*d = *src.(*bool)
+	case *time.Duration:
+		*d = *src.(*time.Duration)
+	default:
+		panic(fmt.Sprintf("unsupported setting type %T", dst))
+	}
+}
+
+// configPath returns the config file given with -config in args or by $BTSCION_CONFIG
+func configPath(args []string) string {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-config=") {
+			return strings.TrimPrefix(arg, "-config=")
+		}
+	}
+	return os.Getenv(configEnv)
+}
+
+// loadConfigFile sets the flags bound by settings to the values of the config file given in args,
+// if any, before the flags are parsed. Flags keep their defaults for settings missing in the file,
+// flags given in args override the file.
+func loadConfigFile(args []string, settings func(f *config.File) []configSetting) {
+	path := configPath(args)
+	if path == "" {
+		return
+	}
+	var f config.File
+	bound := settings(&f)
+	for _, s := range bound {
+		copySetting(s.file, s.flag)
+	}
+	if err := config.LoadFile(path, &f); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateConfigFile(&f); err != nil {
+		log.Fatalf("Invalid config file %s: %s", path, err)
+	}
+	if err := f.SetEnv(); err != nil {
+		log.Fatal(err)
+	}
+	for _, s := range bound {
+		copySetting(s.flag, s.file)
+	}
+}
+
+func validateConfigFile(f *config.File) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	if _, err := server.ParsePeerPriorities(f.Server.PeerPriorities); err != nil {
+		return fmt.Errorf("invalid server.peer_priorities: %w", err)
+	}
+	return nil
+}
+
+// runConfigCommand runs the config subcommand given in args
+func runConfigCommand(args []string) {
+	if len(args) > 0 && args[0] == "validate" {
+		runConfigValidateCommand(args[1:])
+		return
+	}
+	fmt.Fprintln(os.Stderr, "usage: bittorrent-over-scion config validate [flags]")
+	os.Exit(2)
+}
+
+// runConfigValidateCommand checks that the config file can be loaded and its settings are valid
+func runConfigValidateCommand(args []string) {
+	tagflag.ParseArgs(&configValidateFlags, args, tagflag.Program("bittorrent-over-scion config validate"))
+	path := configValidateFlags.Config
+	if path == "" {
+		path = os.Getenv(configEnv)
+	}
+	if path == "" {
+		log.Fatal("config is required")
+	}
+	var f config.File
+	if err := config.LoadFile(path, &f); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateConfigFile(&f); err != nil {
+		log.Fatalf("Invalid config file %s: %s", path, err)
+	}
+	fmt.Printf("%s is valid\n", path)
+}
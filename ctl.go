@@ -0,0 +1,181 @@
+package main
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/anacrolix/tagflag"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/netsys-lab/bittorrent-over-scion/daemon"
+)
+
+var ctlFlags = struct {
+	Api                string `help:"Optional: Address of the daemon control API"`
+	Token              string `help:"Optional: Bearer token of the daemon control API"`
+	Torrent            string `help:"Torrent file to upload to the daemon. Only for add"`
+	Path               string `help:"Path of a torrent file on the host of the daemon. Only for add"`
+	Magnet             string `help:"Magnet link of the torrent. Only for add"`
+	Peer               string `help:"Optional: SCION address of a peer to download from. Only for add"`
+	InfoHash           string `help:"Hex encoded info-hash of the torrent. Only for show, pause, resume and remove"`
+	DeleteFiles        bool   `help:"Optional: Delete the downloaded file as well. Only for remove"`
+	MaxActiveDownloads int    `help:"Optional: Change the number of torrents downloaded at the same time, 0 for no limit. Only for limits"`
+	NumPaths           int    `help:"Optional: Change the number of paths seeders use per leecher, 0 to share paths fairly. Only for limits"`
+}{
+	Api:                daemon.DefaultListenAddr,
+	MaxActiveDownloads: -1,
+	NumPaths:           -1,
+}
+
+const ctlUsage = "usage: bittorrent-over-scion ctl add|list|show|pause|resume|remove|limits|events [flags]"
+
+// runCtlCommand controls a running daemon via its API
+func runCtlCommand(args []string) {
+	if len(args) == 0 || len(args[0]) == 0 || args[0][0] == '-' {
+		fmt.Fprintln(os.Stderr, ctlUsage)
+		os.Exit(2)
+	}
+	command := args[0]
+	tagflag.ParseArgs(&ctlFlags, args[1:], tagflag.Program("bittorrent-over-scion ctl "+command))
+	if ctlFlags.Token == "" {
+		ctlFlags.Token = os.Getenv("BTSCION_TOKEN")
+	}
+	c := daemon.NewClient(ctlFlags.Api, ctlFlags.Token)
+
+	switch command {
+	case "add":
+		var status daemon.Status
+		var err error
+		if ctlFlags.Torrent != "" {
+			var file *os.File
+			file, err = os.Open(ctlFlags.Torrent)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer file.Close()
+			status, err = c.AddFile(file.Name(), file, ctlFlags.Peer)
+		} else {
+			status, err = c.Add(daemon.AddRequest{Path: ctlFlags.Path, Magnet: ctlFlags.Magnet, Peer: ctlFlags.Peer})
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		printTorrents([]daemon.Status{status})
+	case "list":
+		list, err := c.List()
+		if err != nil {
+			log.Fatal(err)
+		}
+		printTorrents(list)
+	case "show":
+		details, err := c.Get(requireInfoHash())
+		if err != nil {
+			log.Fatal(err)
+		}
+		printTorrentDetails(details)
+	case "pause":
+		status, err := c.Pause(requireInfoHash())
+		if err != nil {
+			log.Fatal(err)
+		}
+		printTorrents([]daemon.Status{status})
+	case "resume":
+		status, err := c.Resume(requireInfoHash())
+		if err != nil {
+			log.Fatal(err)
+		}
+		printTorrents([]daemon.Status{status})
+	case "remove":
+		if err := c.Remove(requireInfoHash(), ctlFlags.DeleteFiles); err != nil {
+			log.Fatal(err)
+		}
+	case "limits":
+		limits, err := c.Limits()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if ctlFlags.MaxActiveDownloads >= 0 || ctlFlags.NumPaths >= 0 {
+			if ctlFlags.MaxActiveDownloads >= 0 {
+				limits.MaxActiveDownloads = ctlFlags.MaxActiveDownloads
+			}
+			if ctlFlags.NumPaths >= 0 {
+				limits.NumPaths = ctlFlags.NumPaths
+			}
+			limits, err = c.SetLimits(limits)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		fmt.Printf("maxActiveDownloads: %d\n", limits.MaxActiveDownloads)
+		fmt.Printf("numPaths: %d\n", limits.NumPaths)
+	case "events":
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-signals
+			cancel()
+		}()
+		enc := json.NewEncoder(os.Stdout)
+		err := c.Events(ctx, func(e daemon.Event) {
+			enc.Encode(e)
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, ctlUsage)
+		os.Exit(2)
+	}
+}
+
+func requireInfoHash() string {
+	if ctlFlags.InfoHash == "" {
+		log.Fatal("infoHash is required")
+	}
+	return ctlFlags.InfoHash
+}
+
+func printTorrents(list []daemon.Status) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INFOHASH\tNAME\tSTATE\tDONE\tMIB\tLOCAL\tERROR")
+	for _, s := range list {
+		done := 0.0
+		if s.Pieces > 0 {
+			done = float64(s.Done) / float64(s.Pieces) * 100
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.1f%%\t%.2f\t%s\t%s\n", s.InfoHash, s.Name, s.State, done, float64(s.Length)/1024/1024, s.Local, s.Error)
+	}
+	w.Flush()
+}
+
+func printTorrentDetails(d daemon.Details) {
+	printTorrents([]daemon.Status{d.Status})
+	if len(d.Peers) == 0 {
+		return
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tSTATE\tHOPS\tMIB\tMBIT/S\tPATH")
+	for _, p := range d.Peers {
+		for _, path := range p.Paths {
+			state := "active"
+			if path.Failed {
+				state = "failed"
+			} else if !path.Active {
+				state = "done"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%.2f\t%.2f\t%s\n", p.Addr, state, path.Hops, float64(path.Bytes)/1024/1024, path.Rate, path.Path)
+		}
+	}
+	w.Flush()
+}
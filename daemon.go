@@ -0,0 +1,112 @@
+package main
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"github.com/anacrolix/tagflag"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/netsys-lab/bittorrent-over-scion/config"
+	"github.com/netsys-lab/bittorrent-over-scion/daemon"
+	"github.com/netsys-lab/bittorrent-over-scion/dht_node"
+	"github.com/netsys-lab/bittorrent-over-scion/monitoring"
+)
+
+var daemonFlags = struct {
+	Listen             string `help:"Optional: Address the control API listens on. Only expose it to other hosts together with a token"`
+	Token              string `help:"Optional: Bearer token required by the control API"`
+	Local              string `help:"Local SCION address to download and seed from, of format ISD-AS,[IP]:Port. Every torrent uses its own port counting up from this port"`
+	Dir                string `help:"Directory the torrents are downloaded to"`
+	Seed               bool   `help:"Optional: Seed torrents once they are downloaded"`
+	MaxActiveDownloads int    `help:"Optional: Number of torrents downloaded at the same time, further torrents are queued. 0 for no limit"`
+	NumPaths           int    `help:"Optional: Limit the number of paths seeders use to upload to each leecher. Per default 0, meaning paths are distributed in a fair manner to all leechers"`
+	DialBackStartPort  int    `help:"Optional: Start port of the connections seeders use to dial back to leechers"`
+	EnableDht          bool   `help:"Optional: Run a dht node shared by all torrents, required for magnet links without peers"`
+	DhtPort            int    `help:"Optional: Port of the dht node"`
+	Bootstrap          string `help:"Optional: Semicolon separated SCION addresses of dht nodes to join"`
+	MetricsAddr        string `help:"Optional: Address to serve Prometheus metrics at /metrics, e.g. :9100. Disabled if empty"`
+	LogLevel           string `help:"Optional: Change log level"`
+	Config             string `help:"Optional: Config file in TOML format, per default $BTSCION_CONFIG. Flags override its settings"`
+}{
+	Listen:            daemon.DefaultListenAddr,
+	Seed:              true,
+	DialBackStartPort: 45000,
+	DhtPort:           int(config.DefaultPeerDisoveryConfig().DhtPort),
+	LogLevel:          "INFO",
+}
+
+// runDaemonCommand downloads and seeds the torrents added via the control API until it is
+// interrupted
+func runDaemonCommand(args []string) {
+	loadConfigFile(args, daemonConfigSettings)
+	tagflag.ParseArgs(&daemonFlags, args, tagflag.Program("bittorrent-over-scion daemon"))
+	setLogging(daemonFlags.LogLevel)
+	if daemonFlags.Dir == "" || daemonFlags.Local == "" {
+		log.Fatal("dir and local are required")
+	}
+
+	pc := config.DefaultPeerDisoveryConfig()
+	pc.EnableDht = daemonFlags.EnableDht
+	var node *dht_node.DhtNode
+	if daemonFlags.EnableDht {
+		var err error
+		pc.DhtPort = uint16(daemonFlags.DhtPort)
+		pc.DhtNodes, err = parseDhtNodes(daemonFlags.Bootstrap)
+		if err != nil {
+			log.Fatal(err)
+		}
+		nodeAddr, err := dhtLocalAddr("", daemonFlags.DhtPort)
+		if err != nil {
+			log.Fatal(err)
+		}
+		node, err = dht_node.NewNode(nodeAddr, dht_node.NodeConfig{
+			StateDir:      pc.DhtNodeStateDir(),
+			StartingNodes: pc.DhtNodes,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer node.Close()
+		if daemonFlags.MetricsAddr != "" {
+			if err := monitoring.RegisterDhtNode(node, nodeAddr.String()); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if daemonFlags.MetricsAddr != "" {
+		go func() {
+			if err := monitoring.Serve(daemonFlags.MetricsAddr); err != nil {
+				log.Errorf("Could not serve metrics: %s", err)
+			}
+		}()
+	}
+
+	d, err := daemon.New(daemon.Config{
+		Local:           daemonFlags.Local,
+		Dir:             daemonFlags.Dir,
+		DiscoveryConfig: &pc,
+		DhtNode:         node,
+		Seed:            daemonFlags.Seed,
+		DialBackPort:    daemonFlags.DialBackStartPort,
+		Limits: daemon.Limits{
+			MaxActiveDownloads: daemonFlags.MaxActiveDownloads,
+			NumPaths:           daemonFlags.NumPaths,
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := signalContext(defaultShutdownTimeout)
+	go func() {
+		if err := d.ListenAndServe(daemonFlags.Listen, daemonFlags.Token); err != nil {
+			log.Fatalf("Could not serve the control API: %s", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Info("Stopping daemon")
+}
@@ -0,0 +1,280 @@
+package daemon
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultListenAddr is the default address of the API, only reachable from the local host
+const DefaultListenAddr = "127.0.0.1:7070"
+
+// maxTorrentSize is the maximum size of uploaded torrent files
+const maxTorrentSize = 16 << 20
+
+// apiError is the body of failed requests
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// Handler returns the web UI at / and the HTTP API of the daemon. If token is not empty, API
+// requests have to send it as bearer token. API requests from other origins are rejected, and
+// bodies have to be JSON or, to upload torrent files, multipart forms, so that other web sites
+// can not control the daemon from the browser.
+//
+//	GET    /api/torrents                 List torrents
+//	POST   /api/torrents                 Add a torrent, JSON AddRequest or multipart form with the fields torrent and peer
+//	GET    /api/torrents/{infoHash}      Torrent with peers and paths
+//	DELETE /api/torrents/{infoHash}      Remove a torrent, ?deleteFiles=true deletes the downloaded file
+//	POST   /api/torrents/{infoHash}/pause
+//	POST   /api/torrents/{infoHash}/resume
+//	GET    /api/limits                   Current limits
+//	PUT    /api/limits                   Change the limits
+//	GET    /api/events                   Stream of events as server-sent events
+func (d *Daemon) Handler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/torrents", d.handleTorrents)
+	mux.HandleFunc("/api/torrents/", d.handleTorrent)
+	mux.HandleFunc("/api/limits", d.handleLimits)
+	mux.HandleFunc("/api/events", d.handleEvents)
+	mux.Handle("/", webHandler())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			if !sameOrigin(r) {
+				writeError(w, http.StatusForbidden, errors.New("cross-origin requests are not allowed"))
+				return
+			}
+			if token != "" && !validToken(r, token) {
+				writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin checks that the request comes from the web UI of the daemon. Browsers send the
+// Origin header with cross-origin requests, other clients like ctl send none.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// validToken checks the bearer token of the request. Browsers can not set headers for event
+// streams, so the token may also be sent as query parameter.
+func validToken(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if auth == "" && r.URL.Query().Get("token") != "" {
+		auth = "Bearer " + r.URL.Query().Get("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) == 1
+}
+
+// ListenAndServe serves the API at addr until it fails
+func (d *Daemon) ListenAndServe(addr string, token string) error {
+	log.Infof("Serving daemon web UI and API at http://%s", addr)
+	return http.ListenAndServe(addr, d.Handler(token))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debugf("Could not write response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
+
+// errorStatus returns the HTTP status of errors returned by the daemon
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrExists), errors.Is(err, ErrInvalidState):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+}
+
+func (d *Daemon) handleTorrents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, d.List())
+	case http.MethodPost:
+		req, err := readAddRequest(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		status, err := d.Add(req)
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, status)
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// readAddRequest reads a torrent file uploaded as multipart form or a JSON AddRequest
+func readAddRequest(r *http.Request) (AddRequest, error) {
+	var req AddRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(maxTorrentSize); err != nil {
+			return req, err
+		}
+		file, _, err := r.FormFile("torrent")
+		if err != nil {
+			return req, fmt.Errorf("torrent: %w", err)
+		}
+		defer file.Close()
+		req.Torrent, err = ioutil.ReadAll(file)
+		if err != nil {
+			return req, err
+		}
+		req.Peer = r.FormValue("peer")
+		return req, nil
+	}
+	err := readJSON(r, &req)
+	return req, err
+}
+
+// readJSON decodes the JSON body of the request into v. Other content types are rejected, as
+// browsers send them cross-origin without asking the daemon first.
+func readJSON(r *http.Request, v interface{}) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return errors.New("content type must be application/json")
+	}
+	return json.NewDecoder(io.LimitReader(r.Body, maxTorrentSize)).Decode(v)
+}
+
+func (d *Daemon) handleTorrent(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/torrents/"), "/")
+	id := parts[0]
+	if len(parts) == 2 {
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, r)
+			return
+		}
+		var status Status
+		var err error
+		switch parts[1] {
+		case "pause":
+			status, err = d.Pause(id)
+		case "resume":
+			status, err = d.Resume(id)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+		return
+	}
+	if len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		details, err := d.Get(id)
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, details)
+	case http.MethodDelete:
+		if err := d.Remove(id, r.URL.Query().Get("deleteFiles") == "true"); err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+func (d *Daemon) handleLimits(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, d.Limits())
+	case http.MethodPut:
+		limits := d.Limits()
+		if err := readJSON(r, &limits); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		limits, err := d.SetLimits(limits)
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, limits)
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// handleEvents streams the events as server-sent events until the client disconnects
+func (d *Daemon) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+	events, cancel := d.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testDaemon(t *testing.T) *Daemon {
+	d, err := New(Config{
+		Local: "19-ffaa:1:c3f,[127.0.0.1]:43000",
+		Dir:   t.TempDir(),
+	})
+	require.NoError(t, err)
+	t.Cleanup(d.Close)
+	return d
+}
+
+func TestClient(t *testing.T) {
+	d := testDaemon(t)
+	srv := httptest.NewServer(d.Handler("secret"))
+	defer srv.Close()
+	c := NewClient(srv.URL, "secret")
+
+	list, err := c.List()
+	require.NoError(t, err)
+	assert.Empty(t, list)
+
+	_, err = c.Add(AddRequest{})
+	assert.EqualError(t, err, "POST /api/torrents: exactly one of torrent, path and magnet is required")
+	_, err = c.Add(AddRequest{Magnet: "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567"})
+	assert.EqualError(t, err, "POST /api/torrents: magnet links without peers require the dht")
+	_, err = c.AddFile("invalid.torrent", strings.NewReader("invalid"), "")
+	assert.Error(t, err)
+
+	_, err = c.Get("0123456789abcdef0123456789abcdef01234567")
+	assert.EqualError(t, err, "GET /api/torrents/0123456789abcdef0123456789abcdef01234567: unknown torrent")
+	_, err = c.Pause("invalid")
+	assert.EqualError(t, err, "POST /api/torrents/invalid/pause: unknown torrent")
+	assert.Error(t, c.Remove("invalid", false))
+
+	limits, err := c.SetLimits(Limits{MaxActiveDownloads: 2, NumPaths: 3})
+	require.NoError(t, err)
+	assert.Equal(t, Limits{MaxActiveDownloads: 2, NumPaths: 3}, limits)
+	limits, err = c.Limits()
+	require.NoError(t, err)
+	assert.Equal(t, Limits{MaxActiveDownloads: 2, NumPaths: 3}, limits)
+	_, err = c.SetLimits(Limits{MaxActiveDownloads: -1})
+	assert.Error(t, err)
+}
+
+func TestHandlerRequiresToken(t *testing.T) {
+	d := testDaemon(t)
+	h := d.Handler("secret")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/torrents", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/torrents", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "[]\n", w.Body.String())
+
+	// Browsers send the token of event streams as query parameter
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/limits?token=secret", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The web UI loads without token and asks for it
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "<title>BitTorrent over SCION</title>")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/app.js", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	d.Handler("").ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/api/limits", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestHandlerRejectsCrossOriginRequests(t *testing.T) {
+	h := testDaemon(t).Handler("")
+	serve := func(origin string, contentType string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "http://127.0.0.1:7070/api/limits", strings.NewReader(body))
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// Forms of other web sites are sent as simple requests without preflight
+	assert.Equal(t, http.StatusForbidden, serve("http://example.com", "application/json", `{"numPaths":3}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve("", "text/plain", `{"numPaths":3}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve("", "application/x-www-form-urlencoded", `{"numPaths":3}`).Code)
+
+	// The web UI sends its own origin, ctl none
+	assert.Equal(t, http.StatusOK, serve("http://127.0.0.1:7070", "application/json", `{"numPaths":3}`).Code)
+	assert.Equal(t, http.StatusOK, serve("", "application/json; charset=utf-8", `{"numPaths":4}`).Code)
+	assert.Equal(t, 4, testLimits(t, h).NumPaths)
+}
+
+func testLimits(t *testing.T, h http.Handler) Limits {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/limits", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var limits Limits
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &limits))
+	return limits
+}
+
+func TestAllocatePort(t *testing.T) {
+	d := testDaemon(t)
+	assert.Equal(t, 43000, d.allocatePort())
+	assert.Equal(t, 43001, d.allocatePort())
+	delete(d.ports, 43000)
+	assert.Equal(t, 43000, d.allocatePort())
+	assert.Equal(t, 43002, d.allocatePort())
+}
+
+func TestBroadcaster(t *testing.T) {
+	b := newBroadcaster()
+	ch := b.subscribe()
+	b.publish(Event{Type: EventAdded, InfoHash: "a"})
+	assert.Equal(t, "a", (<-ch).InfoHash)
+
+	// Slow subscribers miss events instead of blocking the daemon
+	for i := 0; i < eventBuffer+10; i++ {
+		b.publish(Event{Type: EventStateChanged})
+	}
+	assert.Len(t, ch, eventBuffer)
+
+	b.close()
+	for range ch {
+	}
+	_, ok := <-b.subscribe()
+	assert.False(t, ok)
+}
@@ -0,0 +1,191 @@
+package daemon
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client calls the API of a daemon
+type Client struct {
+	BaseURL string // e.g. http://127.0.0.1:7070
+	Token   string // Optional: Bearer token of the API
+	HTTP    *http.Client
+}
+
+// NewClient creates a client of the daemon API at addr, given as host:port or URL
+func NewClient(addr string, token string) *Client {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &Client{BaseURL: strings.TrimSuffix(addr, "/"), Token: token, HTTP: http.DefaultClient}
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, contentType string, body io.Reader, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var apiErr apiError
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+			return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, apiErr.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (c *Client) doJSON(method string, path string, v interface{}, result interface{}) error {
+	var body io.Reader
+	contentType := ""
+	if v != nil {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+	return c.do(context.Background(), method, path, contentType, body, result)
+}
+
+// Add adds a torrent by path on the host of the daemon, magnet link or content
+func (c *Client) Add(req AddRequest) (Status, error) {
+	var status Status
+	err := c.doJSON(http.MethodPost, "/api/torrents", req, &status)
+	return status, err
+}
+
+// AddFile uploads a torrent file to the daemon, peer is optional
+func (c *Client) AddFile(name string, content io.Reader, peer string) (Status, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("torrent", name)
+	if err != nil {
+		return Status{}, err
+	}
+	if _, err := io.Copy(part, content); err != nil {
+		return Status{}, err
+	}
+	if peer != "" {
+		if err := w.WriteField("peer", peer); err != nil {
+			return Status{}, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return Status{}, err
+	}
+	var status Status
+	err = c.do(context.Background(), http.MethodPost, "/api/torrents", w.FormDataContentType(), &body, &status)
+	return status, err
+}
+
+// List returns the status of all torrents
+func (c *Client) List() ([]Status, error) {
+	var list []Status
+	err := c.doJSON(http.MethodGet, "/api/torrents", nil, &list)
+	return list, err
+}
+
+// Get returns the torrent with its peers and paths
+func (c *Client) Get(infoHash string) (Details, error) {
+	var details Details
+	err := c.doJSON(http.MethodGet, "/api/torrents/"+url.PathEscape(infoHash), nil, &details)
+	return details, err
+}
+
+// Pause stops downloading the torrent
+func (c *Client) Pause(infoHash string) (Status, error) {
+	var status Status
+	err := c.doJSON(http.MethodPost, "/api/torrents/"+url.PathEscape(infoHash)+"/pause", nil, &status)
+	return status, err
+}
+
+// Resume continues downloading a paused or failed torrent
+func (c *Client) Resume(infoHash string) (Status, error) {
+	var status Status
+	err := c.doJSON(http.MethodPost, "/api/torrents/"+url.PathEscape(infoHash)+"/resume", nil, &status)
+	return status, err
+}
+
+// Remove removes the torrent, deleteFiles deletes the downloaded file as well
+func (c *Client) Remove(infoHash string, deleteFiles bool) error {
+	path := "/api/torrents/" + url.PathEscape(infoHash)
+	if deleteFiles {
+		path += "?deleteFiles=true"
+	}
+	return c.doJSON(http.MethodDelete, path, nil, nil)
+}
+
+// Limits returns the limits of the daemon
+func (c *Client) Limits() (Limits, error) {
+	var limits Limits
+	err := c.doJSON(http.MethodGet, "/api/limits", nil, &limits)
+	return limits, err
+}
+
+// SetLimits changes the limits of the daemon
+func (c *Client) SetLimits(limits Limits) (Limits, error) {
+	err := c.doJSON(http.MethodPut, "/api/limits", limits, &limits)
+	return limits, err
+}
+
+// Events calls handle for every event of the daemon until ctx is done or the stream ends
+func (c *Client) Events(ctx context.Context, handle func(Event)) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/api/events", nil)
+	if err != nil {
+		return err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET /api/events: %s", resp.Status)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+			return err
+		}
+		handle(e)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
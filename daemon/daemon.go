@@ -0,0 +1,544 @@
+package daemon
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/snet"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/netsys-lab/bittorrent-over-scion/config"
+	"github.com/netsys-lab/bittorrent-over-scion/dht_node"
+	"github.com/netsys-lab/bittorrent-over-scion/monitoring"
+	"github.com/netsys-lab/bittorrent-over-scion/p2p"
+	"github.com/netsys-lab/bittorrent-over-scion/peers"
+	"github.com/netsys-lab/bittorrent-over-scion/server"
+	"github.com/netsys-lab/bittorrent-over-scion/torrentfile"
+)
+
+// MetadataTimeout is the time to find a peer with the metadata of a magnet link
+const MetadataTimeout = 2 * time.Minute
+
+var (
+	ErrNotFound     = errors.New("unknown torrent")
+	ErrExists       = errors.New("torrent was added already")
+	ErrInvalidState = errors.New("operation not possible in the current state of the torrent")
+)
+
+// State of a torrent in the daemon
+type State string
+
+const (
+	StateMetadata    State = "metadata"    // Fetching the metadata of a magnet link
+	StateQueued      State = "queued"      // Waiting for a download slot
+	StateDownloading State = "downloading" // Downloading
+	StatePaused      State = "paused"      // Download stopped, the pieces downloaded so far are kept
+	StateSeeding     State = "seeding"     // Downloaded and seeded
+	StateCompleted   State = "completed"   // Downloaded, but not seeded
+	StateFailed      State = "failed"      // Fetching the metadata or downloading failed
+	StateRemoved     State = "removed"     // Removed from the daemon
+)
+
+// Limits can be changed while the daemon runs
+type Limits struct {
+	MaxActiveDownloads int `json:"maxActiveDownloads"` // Torrents downloaded at the same time, the others are queued. 0 for no limit
+	NumPaths           int `json:"numPaths"`           // Paths seeders use per leecher, 0 to share the paths fairly among leechers. Applies to seeders started afterwards
+}
+
+// Config configures a Daemon
+type Config struct {
+	Local           string                      // SCION address of the daemon, every torrent gets its own port counting up from the port of this address
+	Dir             string                      // Directory the torrents are downloaded to
+	DiscoveryConfig *config.PeerDiscoveryConfig // Peer discovery of downloads and seeders
+	DhtNode         *dht_node.DhtNode           // Optional: Dht node shared by all torrents, required for magnet links without peers
+	Seed            bool                        // Seed torrents once they are downloaded
+	DialBackPort    int                         // Start port seeders dial back to leechers from
+	Limits          Limits                      // Initial limits
+}
+
+// AddRequest adds a torrent from a torrent file, a path to a torrent file on the host of the daemon
+// or a magnet link. Exactly one of them is set.
+type AddRequest struct {
+	Torrent []byte `json:"torrent,omitempty"` // Content of a torrent file
+	Path    string `json:"path,omitempty"`
+	Magnet  string `json:"magnet,omitempty"`
+	Peer    string `json:"peer,omitempty"` // Optional: SCION address of a peer to download from, besides those found via the dht
+}
+
+// torrent is a torrent managed by the daemon
+type torrent struct {
+	infoHash [20]byte
+	name     string
+	tf       *torrentfile.TorrentFile // Nil while the metadata is fetched
+	peers    []peers.Peer             // Peers given when the torrent was added
+	local    string                   // Address the torrent is downloaded and seeded from
+	port     int
+	state    State
+	err      error
+	added    time.Time
+	cancel   context.CancelFunc // Stops fetching the metadata, the download or the seeder
+	download *p2p.Torrent       // Set while downloading
+	running  bool               // The download goroutine runs, it may still be stopping after a pause
+	done     chan struct{}      // Closed once the download goroutine wrote the file and stopped running
+	server   *server.Server     // Set while seeding
+}
+
+// Daemon downloads and seeds many torrents, controlled via its API
+type Daemon struct {
+	sync.Mutex
+	conf      Config
+	localAddr *snet.UDPAddr
+	limits    Limits
+	torrents  map[[20]byte]*torrent
+	ports     map[int]bool // Ports in use by torrents
+	events    *broadcaster
+	ctx       context.Context // Done when the daemon is closed
+	cancel    context.CancelFunc
+	workers   sync.WaitGroup // Goroutines fetching metadata, downloading or seeding
+
+	downloadToFile func(ctx context.Context, tf *torrentfile.TorrentFile, path string, opts torrentfile.DownloadOptions) error // Replaced in tests
+}
+
+// New creates a daemon that stores its torrents in the directory of the config
+func New(conf Config) (*Daemon, error) {
+	localAddr, err := snet.ParseUDPAddr(conf.Local)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local address: %w", err)
+	}
+	if conf.DiscoveryConfig == nil {
+		pc := config.DefaultPeerDisoveryConfig()
+		conf.DiscoveryConfig = &pc
+	}
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Daemon{
+		ctx:       ctx,
+		cancel:    cancel,
+		conf:      conf,
+		localAddr: localAddr,
+		limits:    conf.Limits,
+		torrents:  make(map[[20]byte]*torrent),
+		ports:     make(map[int]bool),
+		events:    newBroadcaster(),
+		downloadToFile: func(ctx context.Context, tf *torrentfile.TorrentFile, path string, opts torrentfile.DownloadOptions) error {
+			_, err := tf.DownloadToFile(ctx, path, opts)
+			return err
+		},
+	}, nil
+}
+
+// Add adds a torrent and starts downloading it once a download slot is free
+func (d *Daemon) Add(req AddRequest) (Status, error) {
+	var tf *torrentfile.TorrentFile
+	var magnet torrentfile.Magnet
+	switch {
+	case len(req.Torrent) > 0 && req.Path == "" && req.Magnet == "":
+		f, err := torrentfile.Read(bytes.NewReader(req.Torrent))
+		if err != nil {
+			return Status{}, err
+		}
+		tf = &f
+	case req.Path != "" && len(req.Torrent) == 0 && req.Magnet == "":
+		f, err := torrentfile.Open(req.Path)
+		if err != nil {
+			return Status{}, err
+		}
+		tf = &f
+	case req.Magnet != "" && len(req.Torrent) == 0 && req.Path == "":
+		var err error
+		magnet, err = torrentfile.ParseMagnet(req.Magnet)
+		if err != nil {
+			return Status{}, err
+		}
+	default:
+		return Status{}, errors.New("exactly one of torrent, path and magnet is required")
+	}
+
+	t := &torrent{
+		peers: magnet.Peers,
+		state: StateQueued,
+		added: time.Now(),
+	}
+	if tf != nil {
+		t.infoHash = tf.InfoHash
+		t.name = tf.Name
+		t.tf = tf
+	} else {
+		t.infoHash = magnet.InfoHash
+		t.name = magnet.Name
+		t.state = StateMetadata
+		if len(t.peers) == 0 && d.conf.DhtNode == nil {
+			return Status{}, errors.New("magnet links without peers require the dht")
+		}
+	}
+	if req.Peer != "" {
+		if _, err := snet.ParseUDPAddr(req.Peer); err != nil {
+			return Status{}, fmt.Errorf("invalid peer: %w", err)
+		}
+		t.peers = append(t.peers, peers.Peer{Addr: req.Peer})
+	}
+
+	d.Lock()
+	if _, ok := d.torrents[t.infoHash]; ok {
+		d.Unlock()
+		return Status{}, ErrExists
+	}
+	t.port = d.allocatePort()
+	addr := d.localAddr.Copy()
+	addr.Host.Port = t.port
+	t.local = addr.String()
+	d.torrents[t.infoHash] = t
+	status := d.status(t)
+	if t.state == StateMetadata {
+		d.startFetchMetadata(t)
+	}
+	d.Unlock()
+
+	log.Infof("Added torrent %x (%s)", t.infoHash, t.name)
+	d.events.publish(newEvent(EventAdded, status))
+	d.schedule()
+	return status, nil
+}
+
+// allocatePort returns the lowest free port of the daemon, the caller holds the mutex
+func (d *Daemon) allocatePort() int {
+	port := d.localAddr.Host.Port
+	for d.ports[port] {
+		port++
+	}
+	d.ports[port] = true
+	return port
+}
+
+// startFetchMetadata starts fetching the metadata of a torrent added by magnet link, the caller
+// holds the mutex
+func (d *Daemon) startFetchMetadata(t *torrent) {
+	ctx, cancel := context.WithTimeout(d.ctx, MetadataTimeout)
+	t.cancel = cancel
+	d.workers.Add(1)
+	go func() {
+		defer d.workers.Done()
+		defer cancel()
+		d.fetchMetadata(ctx, t)
+	}()
+}
+
+// fetchMetadata fetches the metadata of the torrent and queues it for download
+func (d *Daemon) fetchMetadata(ctx context.Context, t *torrent) {
+	tf, _, err := torrentfile.FindMetadata(ctx, t.infoHash, t.peers, d.conf.DhtNode, t.local, d.conf.DiscoveryConfig)
+	d.Lock()
+	if t.state != StateMetadata {
+		// Removed in the meantime
+		d.Unlock()
+		return
+	}
+	if err != nil {
+		d.setState(t, StateFailed, err)
+		d.Unlock()
+		return
+	}
+	t.tf = &tf
+	t.name = tf.Name
+	d.setState(t, StateQueued, nil)
+	d.Unlock()
+	d.schedule()
+}
+
+// setState changes the state of the torrent and publishes the change, the caller holds the mutex
+func (d *Daemon) setState(t *torrent, state State, err error) {
+	t.state = state
+	t.err = err
+	if err != nil {
+		log.Errorf("Torrent %x (%s) %s: %s", t.infoHash, t.name, state, err)
+	} else {
+		log.Infof("Torrent %x (%s) %s", t.infoHash, t.name, state)
+	}
+	d.events.publish(newEvent(EventStateChanged, d.status(t)))
+}
+
+// schedule starts downloading queued torrents while download slots are free, in the order they
+// were added
+func (d *Daemon) schedule() {
+	d.Lock()
+	defer d.Unlock()
+	if d.ctx.Err() != nil {
+		// Closing
+		return
+	}
+	active := 0
+	queued := make([]*torrent, 0)
+	for _, t := range d.torrents {
+		switch t.state {
+		case StateDownloading:
+			active++
+		case StateQueued:
+			if !t.running {
+				queued = append(queued, t)
+			}
+		}
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		return queued[i].added.Before(queued[j].added)
+	})
+	for _, t := range queued {
+		if d.limits.MaxActiveDownloads > 0 && active >= d.limits.MaxActiveDownloads {
+			return
+		}
+		active++
+		t.running = true
+		t.done = make(chan struct{})
+		ctx, cancel := context.WithCancel(d.ctx)
+		t.cancel = cancel
+		d.setState(t, StateDownloading, nil)
+		d.workers.Add(1)
+		go d.download(ctx, t)
+	}
+}
+
+// filePath returns the path the torrent is downloaded to
+func (d *Daemon) filePath(t *torrent) string {
+	return filepath.Join(d.conf.Dir, filepath.Base(t.tf.Name))
+}
+
+// download downloads the torrent, reusing the pieces of a paused or previous download, and
+// seeds it afterwards
+func (d *Daemon) download(ctx context.Context, t *torrent) {
+	defer d.workers.Done()
+	tf := *t.tf
+	path := d.filePath(t)
+	tf.Previous = tf.ReadPrevious(path)
+	tf.DhtNode = d.conf.DhtNode
+	tf.OnDownload = func(download *p2p.Torrent) func() {
+		d.Lock()
+		t.download = download
+		d.Unlock()
+		return nil
+	}
+	opts := torrentfile.DownloadOptions{
+		Local:           t.local,
+		DiscoveryConfig: d.conf.DiscoveryConfig,
+	}
+	if len(t.peers) > 0 {
+		opts.Peer = t.peers[0].Addr
+	}
+
+	err := d.downloadToFile(ctx, &tf, path, opts)
+
+	d.Lock()
+	t.download = nil
+	t.running = false
+	close(t.done)
+	state := t.state
+	switch {
+	case state != StateDownloading:
+		// Paused or removed
+	case errors.Is(err, p2p.ErrStopped):
+		d.setState(t, StatePaused, nil)
+	case err != nil:
+		d.setState(t, StateFailed, err)
+	case d.conf.Seed:
+		err = d.startSeeding(t, path)
+		if err != nil {
+			d.setState(t, StateFailed, err)
+		} else {
+			d.setState(t, StateSeeding, nil)
+		}
+	default:
+		d.setState(t, StateCompleted, nil)
+	}
+	d.Unlock()
+	d.schedule()
+}
+
+// startSeeding seeds the downloaded file of the torrent, the caller holds the mutex
+func (d *Daemon) startSeeding(t *torrent, path string) error {
+	tf := *t.tf
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tf.Content = content
+	s, err := server.NewServer(&server.ServerConfig{
+		LAddr:                       t.local,
+		TorrentFile:                 &tf,
+		PathSelectionResponsibility: "server",
+		NumPaths:                    d.limits.NumPaths,
+		DialBackPort:                d.conf.DialBackPort,
+		DiscoveryConfig:             d.conf.DiscoveryConfig,
+		DhtNode:                     d.conf.DhtNode,
+	})
+	if err != nil {
+		return err
+	}
+	t.server = s
+	ctx, cancel := context.WithCancel(d.ctx)
+	t.cancel = cancel
+	d.workers.Add(1)
+	go func() {
+		defer d.workers.Done()
+		if err := s.ListenHandshake(ctx); err != nil && ctx.Err() == nil {
+			d.Lock()
+			if t.server == s {
+				t.server = nil
+				d.setState(t, StateFailed, err)
+			}
+			d.Unlock()
+		}
+	}()
+	return nil
+}
+
+// find returns the torrent with the hex encoded info-hash, the caller holds the mutex
+func (d *Daemon) find(id string) (*torrent, error) {
+	var infoHash [20]byte
+	ih, err := hex.DecodeString(id)
+	if err != nil || len(ih) != len(infoHash) {
+		return nil, ErrNotFound
+	}
+	copy(infoHash[:], ih)
+	t, ok := d.torrents[infoHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return t, nil
+}
+
+// Pause stops downloading the torrent, the pieces downloaded so far are kept
+func (d *Daemon) Pause(id string) (Status, error) {
+	d.Lock()
+	defer d.Unlock()
+	t, err := d.find(id)
+	if err != nil {
+		return Status{}, err
+	}
+	switch t.state {
+	case StateDownloading:
+		d.setState(t, StatePaused, nil)
+		t.cancel()
+	case StateQueued:
+		d.setState(t, StatePaused, nil)
+	default:
+		return Status{}, ErrInvalidState
+	}
+	return d.status(t), nil
+}
+
+// Resume queues a paused or failed torrent for download again
+func (d *Daemon) Resume(id string) (Status, error) {
+	d.Lock()
+	t, err := d.find(id)
+	if err != nil {
+		d.Unlock()
+		return Status{}, err
+	}
+	switch {
+	case t.state == StatePaused, t.state == StateFailed && t.tf != nil:
+		d.setState(t, StateQueued, nil)
+	case t.state == StateFailed:
+		d.setState(t, StateMetadata, nil)
+		d.startFetchMetadata(t)
+	default:
+		d.Unlock()
+		return Status{}, ErrInvalidState
+	}
+	status := d.status(t)
+	d.Unlock()
+	d.schedule()
+	return status, nil
+}
+
+// Remove stops downloading or seeding the torrent and removes it, if deleteFile is set, the
+// downloaded file is deleted as well
+func (d *Daemon) Remove(id string, deleteFile bool) error {
+	d.Lock()
+	t, err := d.find(id)
+	if err != nil {
+		d.Unlock()
+		return err
+	}
+	running := t.running
+	done := t.done
+	seeding := t.server != nil
+	d.setState(t, StateRemoved, nil)
+	delete(d.torrents, t.infoHash)
+	if t.cancel != nil {
+		t.cancel()
+	}
+	if seeding {
+		t.server.Close()
+		t.server = nil
+	}
+	d.Unlock()
+
+	if running {
+		// The stopped download writes the partial file, wait for it so that it is not written
+		// again after it is deleted
+		<-done
+	}
+	monitoring.RemoveTorrent(t.infoHash)
+	if deleteFile && t.tf != nil {
+		path := d.filePath(t)
+		for _, p := range []string{path, torrentfile.PartialPath(path)} {
+			if removeErr := os.Remove(p); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) && err == nil {
+				err = removeErr
+			}
+		}
+	}
+	if !seeding {
+		// The listener of a seeder keeps its port until the daemon exits
+		d.Lock()
+		delete(d.ports, t.port)
+		d.Unlock()
+	}
+	d.schedule()
+	return err
+}
+
+// Limits returns the current limits
+func (d *Daemon) Limits() Limits {
+	d.Lock()
+	defer d.Unlock()
+	return d.limits
+}
+
+// SetLimits changes the limits, queued torrents are started if the limits allow it
+func (d *Daemon) SetLimits(limits Limits) (Limits, error) {
+	if limits.MaxActiveDownloads < 0 || limits.NumPaths < 0 {
+		return Limits{}, errors.New("limits must not be negative")
+	}
+	d.Lock()
+	d.limits = limits
+	d.Unlock()
+	log.Infof("Changed limits to %+v", limits)
+	d.schedule()
+	return limits, nil
+}
+
+// Close stops all downloads and seeders and waits until the partial downloads are written and
+// the leechers are disconnected
+func (d *Daemon) Close() {
+	d.cancel()
+	d.workers.Wait()
+	d.Lock()
+	defer d.Unlock()
+	for _, t := range d.torrents {
+		if t.server != nil {
+			t.server.Close()
+		}
+	}
+	d.events.close()
+}
@@ -0,0 +1,62 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsys-lab/bittorrent-over-scion/config"
+	"github.com/netsys-lab/bittorrent-over-scion/p2p"
+	"github.com/netsys-lab/bittorrent-over-scion/torrentfile"
+)
+
+// testTorrent returns a torrent file of a single piece
+func testTorrent() []byte {
+	hash := sha1.Sum(bytes.Repeat([]byte{1}, 4))
+	return []byte(fmt.Sprintf("d8:announce0:4:infod6:lengthi4e4:name8:test.bin12:piece lengthi4e6:pieces20:%see", hash[:]))
+}
+
+func TestRemoveDeletesStoppedDownload(t *testing.T) {
+	pc := config.DefaultPeerDisoveryConfig()
+	pc.EnableDht = false
+	d, err := New(Config{
+		Local:           "19-ffaa:1:c3f,[127.0.0.1]:43000",
+		Dir:             t.TempDir(),
+		DiscoveryConfig: &pc,
+	})
+	require.NoError(t, err)
+	defer d.Close()
+
+	// The stopped download writes the partial file some time after it is cancelled
+	started := make(chan struct{})
+	d.downloadToFile = func(ctx context.Context, tf *torrentfile.TorrentFile, path string, opts torrentfile.DownloadOptions) error {
+		close(started)
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		if err := ioutil.WriteFile(torrentfile.PartialPath(path), make([]byte, tf.Length), 0644); err != nil {
+			return err
+		}
+		return p2p.ErrStopped
+	}
+	status, err := d.Add(AddRequest{Torrent: testTorrent()})
+	require.NoError(t, err)
+	<-started
+
+	require.NoError(t, d.Remove(status.InfoHash, true))
+	d.Close()
+	path := filepath.Join(d.conf.Dir, "test.bin")
+	for _, p := range []string{path, torrentfile.PartialPath(path)} {
+		_, err = os.Stat(p)
+		assert.True(t, os.IsNotExist(err), p)
+	}
+	assert.Empty(t, d.ports, "the port is released once the download stopped")
+}
@@ -0,0 +1,244 @@
+package daemon
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status is the state of a torrent returned by the API
+type Status struct {
+	InfoHash string    `json:"infoHash"`
+	Name     string    `json:"name"`
+	State    State     `json:"state"`
+	Length   int       `json:"length"`
+	Pieces   int       `json:"pieces"`
+	Done     int       `json:"done"`  // Completed pieces
+	Bytes    int64     `json:"bytes"` // Bytes of the completed pieces
+	Local    string    `json:"local"` // Address the torrent is downloaded and seeded from
+	Error    string    `json:"error,omitempty"`
+	Added    time.Time `json:"added"`
+}
+
+// PathStatus is a path a torrent is downloaded or seeded over
+type PathStatus struct {
+	Path   string  `json:"path"`
+	Hops   int     `json:"hops"`
+	Bytes  int64   `json:"bytes"` // Received by downloads, sent by seeders
+	Active bool    `json:"active"`
+	Failed bool    `json:"failed"`
+	Rate   float64 `json:"rate"` // Average throughput in Mbit/s, only for downloads
+}
+
+// PeerStatus is a peer a torrent is downloaded from or seeded to
+type PeerStatus struct {
+	Addr  string       `json:"addr"`
+	Paths []PathStatus `json:"paths"`
+}
+
+// Details is the status of a torrent with its peers and paths
+type Details struct {
+	Status
+	Peers []PeerStatus `json:"peers"`
+}
+
+// status returns the status of the torrent, the caller holds the mutex
+func (d *Daemon) status(t *torrent) Status {
+	s := Status{
+		InfoHash: hex.EncodeToString(t.infoHash[:]),
+		Name:     t.name,
+		State:    t.state,
+		Local:    t.local,
+		Added:    t.added,
+	}
+	if t.err != nil {
+		s.Error = t.err.Error()
+	}
+	if t.tf != nil {
+		s.Length = t.tf.Length
+		s.Pieces = len(t.tf.PieceHashes)
+	}
+	switch {
+	case t.download != nil:
+		p := t.download.Progress()
+		s.Done = p.Done
+		s.Bytes = p.Bytes
+	case t.state == StateSeeding || t.state == StateCompleted:
+		s.Done = s.Pieces
+		s.Bytes = int64(s.Length)
+	}
+	return s
+}
+
+// details returns the status of the torrent with its peers and paths, the caller holds the mutex
+func (d *Daemon) details(t *torrent) Details {
+	details := Details{Status: d.status(t), Peers: make([]PeerStatus, 0)}
+	byAddr := make(map[string]*PeerStatus)
+	peer := func(addr string) *PeerStatus {
+		p, ok := byAddr[addr]
+		if !ok {
+			p = &PeerStatus{Addr: addr, Paths: make([]PathStatus, 0)}
+			byAddr[addr] = p
+		}
+		return p
+	}
+
+	if t.download != nil {
+		for _, path := range t.download.Progress().Paths {
+			p := peer(path.Remote)
+			p.Paths = append(p.Paths, PathStatus{
+				Path:   path.Path,
+				Hops:   path.Hops,
+				Bytes:  path.Bytes,
+				Active: path.Active,
+				Failed: path.Failed,
+				Rate:   path.Throughput(),
+			})
+		}
+	}
+	if t.server != nil {
+		for addr, paths := range t.server.Leechers() {
+			p := peer(addr)
+			for _, path := range paths {
+				hops := 0
+				if path.Path.Metadata() != nil {
+					hops = len(path.Path.Metadata().Interfaces)
+				}
+				p.Paths = append(p.Paths, PathStatus{Path: fmt.Sprint(path.Path), Hops: hops, Bytes: path.Bytes, Active: true})
+			}
+		}
+	}
+
+	for _, p := range byAddr {
+		details.Peers = append(details.Peers, *p)
+	}
+	sort.Slice(details.Peers, func(i, j int) bool {
+		return details.Peers[i].Addr < details.Peers[j].Addr
+	})
+	return details
+}
+
+// List returns the status of all torrents in the order they were added
+func (d *Daemon) List() []Status {
+	d.Lock()
+	defer d.Unlock()
+	list := make([]Status, 0, len(d.torrents))
+	for _, t := range d.torrents {
+		list = append(list, d.status(t))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Added.Before(list[j].Added)
+	})
+	return list
+}
+
+// Get returns the details of the torrent with the hex encoded info-hash
+func (d *Daemon) Get(id string) (Details, error) {
+	d.Lock()
+	defer d.Unlock()
+	t, err := d.find(id)
+	if err != nil {
+		return Details{}, err
+	}
+	return d.details(t), nil
+}
+
+// EventType is the kind of an event
+type EventType string
+
+const (
+	EventAdded        EventType = "added"
+	EventStateChanged EventType = "state"
+)
+
+// Event reports a torrent that was added or changed its state
+type Event struct {
+	Type     EventType `json:"type"`
+	InfoHash string    `json:"infoHash"`
+	Name     string    `json:"name"`
+	State    State     `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+func newEvent(typ EventType, s Status) Event {
+	return Event{
+		Type:     typ,
+		InfoHash: s.InfoHash,
+		Name:     s.Name,
+		State:    s.State,
+		Error:    s.Error,
+		Time:     time.Now(),
+	}
+}
+
+// eventBuffer is the number of events buffered per subscriber, further events are dropped
+// until the subscriber catches up
+const eventBuffer = 64
+
+// broadcaster sends events to all subscribers
+type broadcaster struct {
+	sync.Mutex
+	subscribers map[chan Event]struct{}
+	closed      bool
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{subscribers: make(map[chan Event]struct{})}
+}
+
+func (b *broadcaster) subscribe() chan Event {
+	b.Lock()
+	defer b.Unlock()
+	ch := make(chan Event, eventBuffer)
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (b *broadcaster) unsubscribe(ch chan Event) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (b *broadcaster) publish(e Event) {
+	b.Lock()
+	defer b.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (b *broadcaster) close() {
+	b.Lock()
+	defer b.Unlock()
+	for ch := range b.subscribers {
+		close(ch)
+	}
+	b.subscribers = make(map[chan Event]struct{})
+	b.closed = true
+}
+
+// Subscribe returns a channel receiving the events of all torrents, cancel stops the
+// subscription. The channel is closed when the daemon is closed.
+func (d *Daemon) Subscribe() (events <-chan Event, cancel func()) {
+	ch := d.events.subscribe()
+	return ch, func() {
+		d.events.unsubscribe(ch)
+	}
+}
@@ -0,0 +1,22 @@
+package daemon
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed web
+var web embed.FS // Static assets of the web UI
+
+// webHandler serves the web UI
+func webHandler() http.Handler {
+	assets, err := fs.Sub(web, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(assets))
+}
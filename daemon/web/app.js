@@ -0,0 +1,283 @@
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+'use strict';
+
+const refreshInterval = 1000;
+const graphWindow = 120; // Seconds of throughput shown in the graph
+const colors = ['#3a7bbf', '#e07b39', '#2e7d32', '#8e44ad', '#c0392b', '#16a085', '#7f8c8d', '#d4ac0d'];
+
+let token = localStorage.getItem('token') || '';
+let selected = null; // Info-hash of the torrent shown in the details
+let history = {}; // Throughput samples per path of the selected torrent
+
+async function api(method, path, body) {
+  const headers = {};
+  if (token) {
+    headers['Authorization'] = 'Bearer ' + token;
+  }
+  if (body !== undefined && !(body instanceof FormData)) {
+    headers['Content-Type'] = 'application/json';
+    body = JSON.stringify(body);
+  }
+  const resp = await fetch(path, {method, headers, body});
+  if (resp.status === 401) {
+    token = prompt('Token of the daemon API') || '';
+    localStorage.setItem('token', token);
+    throw new Error('invalid token');
+  }
+  if (resp.status === 204) {
+    return null;
+  }
+  const data = await resp.json();
+  if (!resp.ok) {
+    throw new Error(data.error || resp.statusText);
+  }
+  return data;
+}
+
+function setStatus(text) {
+  document.getElementById('status').textContent = text;
+}
+
+function cell(row, text, className) {
+  const td = row.insertCell();
+  td.textContent = text;
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function mib(bytes) {
+  return (bytes / 1024 / 1024).toFixed(2) + ' MiB';
+}
+
+function percent(t) {
+  return t.pieces > 0 ? t.done / t.pieces * 100 : 0;
+}
+
+function button(td, label, action) {
+  const b = document.createElement('button');
+  b.textContent = label;
+  b.onclick = async (e) => {
+    e.stopPropagation();
+    try {
+      await action();
+      await refresh();
+    } catch (err) {
+      setStatus(err.message);
+    }
+  };
+  td.appendChild(b);
+}
+
+function renderTorrents(list) {
+  const tbody = document.querySelector('#torrents tbody');
+  tbody.innerHTML = '';
+  document.getElementById('empty').hidden = list.length > 0;
+  for (const t of list) {
+    const row = tbody.insertRow();
+    row.onclick = () => select(t.infoHash);
+    if (t.infoHash === selected) {
+      row.className = 'selected';
+    }
+    cell(row, t.name || t.infoHash);
+    cell(row, t.state, 'state-' + t.state);
+    const progress = row.insertCell();
+    const bar = document.createElement('span');
+    bar.className = 'bar';
+    const fill = document.createElement('div');
+    fill.style.width = percent(t) + '%';
+    bar.appendChild(fill);
+    progress.appendChild(bar);
+    progress.appendChild(document.createTextNode(percent(t).toFixed(1) + '%'));
+    cell(row, mib(t.length));
+    cell(row, t.local);
+    const actions = row.insertCell();
+    if (t.state === 'downloading' || t.state === 'queued') {
+      button(actions, 'Pause', () => api('POST', '/api/torrents/' + t.infoHash + '/pause'));
+    }
+    if (t.state === 'paused' || t.state === 'failed') {
+      button(actions, 'Resume', () => api('POST', '/api/torrents/' + t.infoHash + '/resume'));
+    }
+    button(actions, 'Remove', () => {
+      if (!confirm('Remove ' + (t.name || t.infoHash) + '?')) {
+        return Promise.resolve();
+      }
+      const deleteFiles = confirm('Also delete the downloaded file?');
+      if (selected === t.infoHash) {
+        select(null);
+      }
+      return api('DELETE', '/api/torrents/' + t.infoHash + (deleteFiles ? '?deleteFiles=true' : ''));
+    });
+  }
+}
+
+function select(infoHash) {
+  selected = infoHash;
+  history = {};
+  document.getElementById('details').hidden = infoHash === null;
+  refresh();
+}
+
+// addSamples records the bytes of every path of the details to derive the throughput over time
+function addSamples(details, now) {
+  for (const peer of details.peers) {
+    for (const path of peer.paths) {
+      const key = peer.addr + ' ' + path.path;
+      const h = history[key] || (history[key] = {peer: peer.addr, samples: []});
+      h.path = path;
+      const last = h.samples[h.samples.length - 1];
+      let rate = 0;
+      if (last && now > last.t) {
+        rate = (path.bytes - last.bytes) * 8 / 1024 / 1024 / ((now - last.t) / 1000);
+      }
+      h.samples.push({t: now, bytes: path.bytes, rate: path.active ? Math.max(rate, 0) : 0});
+      h.samples = h.samples.filter(s => now - s.t <= graphWindow * 1000);
+    }
+  }
+}
+
+function renderGraph(now) {
+  const canvas = document.getElementById('graph');
+  const ctx = canvas.getContext('2d');
+  const pad = 40;
+  const width = canvas.width - pad - 10;
+  const height = canvas.height - 30;
+  ctx.clearRect(0, 0, canvas.width, canvas.height);
+
+  let max = 1;
+  for (const h of Object.values(history)) {
+    for (const s of h.samples) {
+      max = Math.max(max, s.rate);
+    }
+  }
+  ctx.strokeStyle = '#e3e5e8';
+  ctx.fillStyle = '#666';
+  ctx.font = '11px sans-serif';
+  for (let i = 0; i <= 4; i++) {
+    const y = 10 + height - height * i / 4;
+    ctx.beginPath();
+    ctx.moveTo(pad, y);
+    ctx.lineTo(pad + width, y);
+    ctx.stroke();
+    ctx.fillText((max * i / 4).toFixed(1), 2, y + 4);
+  }
+
+  Object.values(history).forEach((h, i) => {
+    h.color = colors[i % colors.length];
+    ctx.strokeStyle = h.color;
+    ctx.lineWidth = 2;
+    ctx.beginPath();
+    h.samples.forEach((s, j) => {
+      const x = pad + width - (now - s.t) / 1000 / graphWindow * width;
+      const y = 10 + height - s.rate / max * height;
+      if (j === 0) {
+        ctx.moveTo(x, y);
+      } else {
+        ctx.lineTo(x, y);
+      }
+    });
+    ctx.stroke();
+  });
+}
+
+function renderDetails(details) {
+  document.getElementById('details-name').textContent = (details.name || details.infoHash) + ' (' + details.state + ')';
+  document.getElementById('details-error').textContent = details.error || '';
+  const tbody = document.querySelector('#paths tbody');
+  tbody.innerHTML = '';
+  for (const h of Object.values(history)) {
+    const path = h.path;
+    const row = tbody.insertRow();
+    const swatch = document.createElement('span');
+    swatch.className = 'swatch';
+    swatch.style.background = h.color;
+    row.insertCell().appendChild(swatch);
+    cell(row, h.peer);
+    cell(row, path.failed ? 'failed' : (path.active ? 'active' : 'done'));
+    cell(row, path.hops);
+    cell(row, (path.bytes / 1024 / 1024).toFixed(2));
+    const last = h.samples[h.samples.length - 1];
+    cell(row, last ? last.rate.toFixed(2) : '0.00');
+    cell(row, path.path, 'path');
+  }
+}
+
+async function refresh() {
+  try {
+    renderTorrents(await api('GET', '/api/torrents'));
+    if (selected !== null) {
+      const details = await api('GET', '/api/torrents/' + selected);
+      const now = Date.now();
+      addSamples(details, now);
+      renderGraph(now);
+      renderDetails(details);
+    }
+    setStatus('');
+  } catch (err) {
+    setStatus(err.message);
+  }
+}
+
+async function loadLimits() {
+  try {
+    const limits = await api('GET', '/api/limits');
+    const form = document.getElementById('limits');
+    form.maxActiveDownloads.value = limits.maxActiveDownloads;
+    form.numPaths.value = limits.numPaths;
+  } catch (err) {
+    setStatus(err.message);
+  }
+}
+
+document.getElementById('add').onsubmit = async (e) => {
+  e.preventDefault();
+  const form = e.target;
+  try {
+    if (form.torrent.files.length > 0) {
+      const data = new FormData();
+      data.append('torrent', form.torrent.files[0]);
+      data.append('peer', form.peer.value.trim());
+      await api('POST', '/api/torrents', data);
+    } else {
+      const source = form.source.value.trim();
+      const req = {peer: form.peer.value.trim()};
+      if (source.startsWith('magnet:')) {
+        req.magnet = source;
+      } else {
+        req.path = source;
+      }
+      await api('POST', '/api/torrents', req);
+    }
+    form.reset();
+    await refresh();
+  } catch (err) {
+    setStatus(err.message);
+  }
+};
+
+document.getElementById('limits').onsubmit = async (e) => {
+  e.preventDefault();
+  const form = e.target;
+  try {
+    await api('PUT', '/api/limits', {
+      maxActiveDownloads: parseInt(form.maxActiveDownloads.value, 10) || 0,
+      numPaths: parseInt(form.numPaths.value, 10) || 0,
+    });
+    setStatus('Saved limits');
+  } catch (err) {
+    setStatus(err.message);
+  }
+};
+
+// State changes are pushed by the daemon, progress is polled
+const events = new EventSource('/api/events' + (token ? '?token=' + encodeURIComponent(token) : ''));
+events.addEventListener('added', refresh);
+events.addEventListener('state', refresh);
+
+document.getElementById('graph-window').textContent = graphWindow;
+loadLimits();
+refresh();
+setInterval(refresh, refreshInterval);
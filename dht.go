@@ -0,0 +1,151 @@
+package main
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/anacrolix/tagflag"
+	"github.com/netsys-lab/dht"
+	"github.com/scionproto/scion/go/lib/snet"
+	log "github.com/sirupsen/logrus"
+
+	util "github.com/netsys-lab/bittorrent-over-scion/Utils"
+	"github.com/netsys-lab/bittorrent-over-scion/config"
+	"github.com/netsys-lab/bittorrent-over-scion/dht_node"
+	"github.com/netsys-lab/bittorrent-over-scion/monitoring"
+)
+
+var dhtFlags = struct {
+	Local         string        `help:"Optional: Local SCION address the dht node listens on, of format ISD-AS,[IP]:Port. Per default the local host on port 7000"`
+	Bootstrap     string        `help:"Optional: Semicolon separated SCION addresses of other dht nodes to join"`
+	StateDir      string        `help:"Optional: Directory in which the node id, the routing table and the stored peers are kept across restarts"`
+	PersistPeers  bool          `help:"Optional: Save the peers announced to this node to the state directory and load them on startup"`
+	StatsInterval time.Duration `help:"Optional: Interval in which statistics are logged and peers are saved"`
+	MaxInfoHashes int           `help:"Optional: Maximum number of info-hashes to store announced peers for"`
+	MaxPeers      int           `help:"Optional: Maximum number of announced peers to store per info-hash"`
+	MetricsAddr   string        `help:"Optional: Address to serve Prometheus metrics at /metrics, e.g. :9100. Disabled if empty"`
+	LogLevel      string        `help:"Optional: Change log level"`
+}{
+	StateDir:      config.DefaultPeerDisoveryConfig().DhtStateDir,
+	StatsInterval: time.Minute,
+	MaxInfoHashes: dht_node.DefaultMaxInfoHashes,
+	MaxPeers:      dht_node.DefaultMaxPeersPerInfoHash,
+	LogLevel:      "INFO",
+}
+
+// parseDhtNodes parses a semicolon separated list of SCION addresses
+func parseDhtNodes(value string) ([]dht.Addr, error) {
+	nodes := make([]dht.Addr, 0)
+	for _, v := range strings.Split(value, ";") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		addr, err := snet.ParseUDPAddr(v)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, dht.NewAddr(*addr))
+	}
+	return nodes, nil
+}
+
+// dhtLocalAddr parses the local address of a dht node, per default the local host on defaultPort
+func dhtLocalAddr(value string, defaultPort int) (*snet.UDPAddr, error) {
+	if value != "" {
+		return snet.ParseUDPAddr(value)
+	}
+	nodeAddr, err := util.GetDefaultLocalAddr()
+	if err != nil {
+		return nil, err
+	}
+	nodeAddr.Host.Port = defaultPort
+	return nodeAddr, nil
+}
+
+// runDhtCommand runs a dht node without torrent until it is interrupted, e.g. to
+// operate bootstrap nodes for an ISD
+func runDhtCommand(args []string) {
+	tagflag.ParseArgs(&dhtFlags, args, tagflag.Program("bittorrent-over-scion dht"))
+	setLogging(dhtFlags.LogLevel)
+	if dhtFlags.StatsInterval <= 0 {
+		log.Fatal("statsInterval must be positive")
+	}
+
+	nodeAddr, err := dhtLocalAddr(dhtFlags.Local, 7000)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	startingNodes, err := parseDhtNodes(dhtFlags.Bootstrap)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	conf := dht_node.NodeConfig{
+		StateDir:            dhtFlags.StateDir,
+		StartingNodes:       startingNodes,
+		MaxInfoHashes:       dhtFlags.MaxInfoHashes,
+		MaxPeersPerInfoHash: dhtFlags.MaxPeers,
+	}
+	var store *dht_node.PersistentPeerStore
+	if dhtFlags.PersistPeers {
+		if dhtFlags.StateDir == "" {
+			log.Fatal("persistPeers requires a stateDir")
+		}
+		store, err = dht_node.NewPersistentPeerStore(filepath.Join(dhtFlags.StateDir, "peers.json"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Loaded %d stored peers", store.NumPeers())
+		conf.PeerStore = store
+	}
+
+	node, err := dht_node.NewNode(nodeAddr, conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Running dht node %x on %s", node.Node.ID(), nodeAddr)
+	if dhtFlags.MetricsAddr != "" {
+		if err := monitoring.RegisterDhtNode(node, nodeAddr.String()); err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := monitoring.Serve(dhtFlags.MetricsAddr); err != nil {
+				log.Errorf("Could not serve metrics: %s", err)
+			}
+		}()
+	}
+
+	savePeers := func() {
+		if store == nil {
+			return
+		}
+		if err := store.Save(); err != nil {
+			log.Errorf("Could not save peers: %s", err)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(dhtFlags.StatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			log.Infof("Stats %s", node.StatsString())
+			savePeers()
+		case <-signals:
+			savePeers()
+			node.Close()
+			return
+		}
+	}
+}
@@ -4,6 +4,8 @@ package dht_node
 // SPDX-License-Identifier: GPL-3.0-only
 
 import (
+	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,16 +17,38 @@ import (
 	"github.com/netsec-ethz/scion-apps/pkg/appnet"
 	"github.com/netsys-lab/bittorrent-over-scion/peers"
 	"github.com/netsys-lab/dht"
+	"github.com/netsys-lab/dht/krpc"
 	peerStore "github.com/netsys-lab/dht/peer-store"
 )
 
+// DefaultAnnounceInterval is the interval in which the torrents of a node are announced again,
+// to make sure we do not become questionable to other nodes and to get fresh peers
+const DefaultAnnounceInterval = 15 * time.Minute
+
+// DefaultRetryInterval is the delay before a failed lookup is retried for the first time, the
+// delay doubles with every further failure up to the announce interval
+const DefaultRetryInterval = 30 * time.Second
+
+// MinLookupInterval is the minimum time between two lookups of a torrent requested on demand
+const MinLookupInterval = 10 * time.Second
+
 type DhtNode struct {
-	Node              *dht.Server
-	stats             *dhtStats
-	infoHash          [20]byte
-	nodeAddr          dht.Addr
-	peerPort          uint16
-	onNewPeerReceived func(peer peers.Peer)
+	Node             *dht.Server
+	stats            *dhtStats
+	nodeAddr         dht.Addr
+	store            *LimitedPeerStore
+	items            *itemStore  // BEP 44 items put by other nodes
+	tokens           *itemTokens // Tokens for BEP 44 puts
+	conn             *snet.Conn
+	ready            chan struct{}            // Closed once Node is set
+	torrents         map[[20]byte]*dhtTorrent // Torrents announced and looked up by this node
+	stateDir         string                   // Keeps node id and routing table across restarts, disabled if empty
+	announceInterval time.Duration
+	retryInterval    time.Duration
+	readOnly         bool // Neither answer queries nor announce torrents
+	stop             chan struct{}
+	closeOnce        sync.Once
+	sync.Mutex
 }
 
 type dhtStats struct {
@@ -34,42 +58,131 @@ type dhtStats struct {
 	announcesStarted             uint32
 }
 
-// New creates a new DHT Node.
+// NodeConfig configures a DHT node. All fields are optional.
+type NodeConfig struct {
+	StateDir            string              // Keep the node id and the routing table across restarts
+	StartingNodes       []dht.Addr          // Other nodes to join
+	PeerStore           peerStore.Interface // Storage of announced peers, in memory if nil
+	MaxInfoHashes       int                 // Maximum number of info-hashes to store peers for, DefaultMaxInfoHashes if 0
+	MaxPeersPerInfoHash int                 // Maximum number of peers stored per info-hash, DefaultMaxPeersPerInfoHash if 0
+	MaxItems            int                 // Maximum number of BEP 44 items stored for other nodes, DefaultMaxItems if 0
+	AnnounceInterval    time.Duration       // Interval in which torrents are announced and looked up, DefaultAnnounceInterval if 0
+	RetryInterval       time.Duration       // First delay before failed lookups are retried, DefaultRetryInterval if 0
+	ReadOnly            bool                // Only look up, neither answer queries of other nodes (BEP 43) nor announce torrents
+}
+
+// NewNode creates a DHT node that accepts announces for any info-hash, up to the storage limits
+// of the config. Torrents to announce and look up are added with AddTorrent, a node without
+// torrents only serves other nodes, e.g. as entry point to the DHT for an ISD.
+func NewNode(nodeAddr *snet.UDPAddr, conf NodeConfig) (*DhtNode, error) {
+	log.Infof("creating new dht node, initial nodes: %+v, listening on: %+v", conf.StartingNodes, nodeAddr)
+	dhtNode := &DhtNode{
+		stats:    &dhtStats{},
+		nodeAddr: dht.NewAddr(*nodeAddr),
+		store:    NewLimitedPeerStore(conf.PeerStore, conf.MaxInfoHashes, conf.MaxPeersPerInfoHash),
+		items:    newItemStore(conf.MaxItems),
+		tokens:   &itemTokens{},
+		torrents: make(map[[20]byte]*dhtTorrent),
+		stateDir: conf.StateDir,
+		stop:     make(chan struct{}),
+		ready:    make(chan struct{}),
+
+		announceInterval: conf.AnnounceInterval,
+		retryInterval:    conf.RetryInterval,
+		readOnly:         conf.ReadOnly,
+	}
+	if dhtNode.announceInterval <= 0 {
+		dhtNode.announceInterval = DefaultAnnounceInterval
+	}
+	if dhtNode.retryInterval <= 0 {
+		dhtNode.retryInterval = DefaultRetryInterval
+	}
+	if dhtNode.retryInterval > dhtNode.announceInterval {
+		dhtNode.retryInterval = dhtNode.announceInterval
+	}
+
+	nodeId, startingNodes, err := withState(conf.StateDir, conf.StartingNodes)
+	if err != nil {
+		return nil, err
+	}
+	con, err := appnet.Listen(nodeAddr.Host)
+	if err != nil {
+		log.Error("error creating connection for dht node")
+		return nil, err
+	}
+	dhtNode.conn = con
+	node, err := newServer(con, nodeAddr, startingNodes, nodeId, conf.ReadOnly, dhtNode.store, dhtNode.onAnnouncePeer, dhtNode.onQuery)
+	if err != nil {
+		con.Close()
+		return nil, err
+	}
+	dhtNode.Node = node
+	close(dhtNode.ready)
+
+	if conf.StateDir != "" {
+		go dhtNode.persistLoop()
+	}
+	return dhtNode, nil
+}
+
+// New creates a new DHT Node that announces and looks up a single torrent.
 // peerPort, the port the controlling peer is listening to
 // onNewPeerReceived, a function to be executed when a new Peer was found, used for adding the new peer to the
 // controlling peers storage
+// stateDir, if not empty, the node id and the routing table are saved there and reloaded on the next start
 func New(
 	nodeAddr *snet.UDPAddr,
 	torrentInfoHash [20]byte,
 	startingNodes []dht.Addr,
 	peerPort uint16,
-	onNewPeerReceived func(peer peers.Peer)) (*DhtNode, error) {
+	onNewPeerReceived func(peer peers.Peer),
+	stateDir string) (*DhtNode, error) {
 
-	log.Infof("creating new dht node, initial nodes: %+v, listening on: %+v, peer port: %d", startingNodes, nodeAddr, peerPort)
-	stats := &dhtStats{}
-
-	con, err := appnet.Listen(nodeAddr.Host)
+	dhtNode, err := NewNode(nodeAddr, NodeConfig{
+		StateDir:      stateDir,
+		StartingNodes: startingNodes,
+	})
 	if err != nil {
-		log.Error("error creating connection for dht node")
 		return nil, err
 	}
+	dhtNode.AddTorrent(torrentInfoHash, peerPort, onNewPeerReceived)
+	return dhtNode, nil
+}
+
+// onAnnouncePeer handles announces of other peers. Peers of torrents of this node are passed
+// to the torrent right away, the peer store decides whether the peer is stored.
+func (d *DhtNode) onAnnouncePeer(infoHash metainfo.Hash, scionAddr snet.UDPAddr, port int, portOk bool) {
+	log.Debugf("handling announce for %s - %s - %d - %t", infoHash, scionAddr.String(), port, portOk)
+	if !portOk || port == 0 {
+		atomic.AddUint32(&d.stats.blockedPeers, 1)
+		log.Infof("rejected peer %s - %s - %d - %t", infoHash, scionAddr, port, portOk)
+		return
+	}
+	atomic.AddUint32(&d.stats.announcesHandled, 1)
+	d.dispatchPeer(infoHash, krpc.NodeAddr{IP: scionAddr.Host.IP, Port: port, IA: scionAddr.IA})
+}
+
+// newServer creates the dht server on the connection listening on nodeAddr. If nodeId is nil, a random id is used
+func newServer(
+	con *snet.Conn,
+	nodeAddr *snet.UDPAddr,
+	startingNodes []dht.Addr,
+	nodeId *[20]byte,
+	passive bool,
+	store peerStore.Interface,
+	onAnnouncePeer func(infoHash metainfo.Hash, scionAddr snet.UDPAddr, port int, portOk bool),
+	onQuery func(query *krpc.Msg, source snet.UDPAddr) bool) (*dht.Server, error) {
 
 	localNodeAddr := dht.NewAddr(*nodeAddr)
 	dhtConf := dht.NewDefaultServerConfig()
 	dhtConf.Conn = con
-	dhtConf.PeerStore = &peerStore.InMemory{}
+	dhtConf.PeerStore = store
 	dhtConf.Logger = dhtLog.Default.FilterLevel(dhtLog.Debug)
-
-	dhtConf.OnAnnouncePeer = func(infoHash metainfo.Hash, scionAddr snet.UDPAddr, port int, portOk bool) {
-		log.Debugf("handling announce for %s - %s - %d - %t", infoHash, scionAddr.String(), port, portOk)
-		var infoH [20]byte
-		copy(infoH[:], infoHash.Bytes())
-		if torrentInfoHash != infoH || !portOk || port == 0 {
-			atomic.AddUint32(&stats.blockedPeers, 1)
-			log.Infof("rejected peer %s - %s - %d - %t", infoHash, scionAddr, port, portOk)
-			return
-		}
-		atomic.AddUint32(&stats.announcesHandled, 1)
+	dhtConf.OnAnnouncePeer = onAnnouncePeer
+	dhtConf.OnQuery = onQuery
+	dhtConf.Passive = passive
+	if nodeId != nil {
+		dhtConf.NodeId = *nodeId
 	}
 
 	dhtConf.StartingNodes = func() ([]dht.Addr, error) {
@@ -83,23 +196,22 @@ func New(
 		log.Errorf("error creating dht node: %v", err)
 		return nil, err
 	}
-	log.Infof("created dht server with id %+v", node.ID())
+	log.Infof("created dht server with id %x", node.ID())
+	return node, nil
+}
 
-	dhtNode := DhtNode{
-		Node:              node,
-		infoHash:          torrentInfoHash,
-		onNewPeerReceived: onNewPeerReceived,
-		stats:             stats,
-		peerPort:          peerPort,
-		nodeAddr:          localNodeAddr,
+// withState loads the node id and the saved routing table of the state directory, the
+// saved nodes are added to the starting nodes
+func withState(stateDir string, startingNodes []dht.Addr) (*[20]byte, []dht.Addr, error) {
+	if stateDir == "" {
+		return nil, startingNodes, nil
 	}
-
-	go func() {
-		//dhtNode.Node.Bootstrap()
-		go dhtNode.announceLoop()
-	}()
-
-	return &dhtNode, nil
+	nodeId, savedNodes, err := loadState(stateDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load dht state of %s: %w", stateDir, err)
+	}
+	log.Infof("loaded %d dht nodes of the previous run from %s", len(savedNodes), stateDir)
+	return nodeId, append(append([]dht.Addr{}, startingNodes...), savedNodes...), nil
 }
 
 func uniqueStartingNodes(nodes []dht.Addr) []dht.Addr {
@@ -125,74 +237,67 @@ func (d *DhtNode) Port() *uint16 {
 	return &port
 }
 
-// announce every 15 min to make sure we do not become questionable to other nodes and to get fresh peers
-func (d *DhtNode) announceLoop() {
-	ps, err := d.announceAndGetPeers()
-	if err != nil {
-		log.Error(err)
-	}
-
-	ticker := time.NewTicker(15 * time.Minute)
-	for range ticker.C {
-		if ps != nil {
-			log.Info("closing traversal")
-			ps.Close()
-		}
-		ps, err = d.announceAndGetPeers()
-		if err != nil {
-			log.Error(err)
-		}
-	}
-}
-
-// announceAndGetPeers get peers via DHT and announce presence
-func (d *DhtNode) announceAndGetPeers() (*dht.Announce, error) {
-	log.Info("announcing via dht")
-	atomic.AddUint32(&d.stats.announcesStarted, 1)
-	ps, err := d.Node.Announce(d.infoHash, int(d.peerPort), false)
-	if err != nil {
-		log.Error(err)
-		return nil, err
-	}
-	go d.consumePeers(ps)
-	return ps, nil
+// Close saves the state of the node, if enabled, and stops it
+func (d *DhtNode) Close() {
+	d.closeOnce.Do(func() {
+		d.PrintStats()
+		close(d.stop)
+		d.stopTorrents()
+		d.saveState()
+		d.Node.Close()
+	})
 }
 
-func convertPeer(peer dht.Peer) peers.Peer {
-	return peers.Peer{
-		Addr:  peer.String(),
-		Index: 0,
-	}
+func (d *DhtNode) PrintStats() {
+	log.Printf("Stats %s", d.StatsString())
 }
 
-func (d *DhtNode) consumePeers(peerStream *dht.Announce) {
-	log.Info("consuming peers")
-	for v := range peerStream.Peers {
-		log.Infof("handling %+v", v)
-		for _, cp := range v.Peers {
-			log.Infof("handling cp %+v", cp)
-			atomic.AddUint32(&d.stats.receivedPeersWhileTraversing, 1)
-			if cp.Port == 0 {
-				log.Info("received zero port peer during announcing")
-				atomic.AddUint32(&d.stats.blockedPeers, 1)
-				continue
-			}
-			if cp.IP.Equal(d.nodeAddr.IP()) && cp.IA.Equal(d.nodeAddr.IA()) {
-				log.Info("received self during announcing")
-				atomic.AddUint32(&d.stats.blockedPeers, 1)
-				continue
-			}
-			d.onNewPeerReceived(convertPeer(cp))
-		}
-	}
-	log.Info("done consuming peers")
+// StatsString summarizes the announces and peers handled by the node and its routing table
+func (d *DhtNode) StatsString() string {
+	stats := d.Stats()
+	return fmt.Sprintf("torrents: %d, announces handled: %d, blocked peers: %d, peers received while traversing: %d, announces started: %d, stored info-hashes: %d, dropped peers: %d, stored items: %d, nodes: %d (good: %d), outstanding transactions: %d",
+		stats.Torrents,
+		stats.AnnouncesHandled,
+		stats.BlockedPeers,
+		stats.ReceivedPeersWhileTraversing,
+		stats.AnnouncesStarted,
+		stats.StoredInfoHashes,
+		stats.DroppedPeers,
+		stats.StoredItems,
+		stats.Nodes,
+		stats.GoodNodes,
+		stats.OutstandingTransactions)
 }
 
-func (d *DhtNode) Close() {
-	d.PrintStats()
-	d.Node.Close()
+// Stats is a snapshot of the counters of a node
+type Stats struct {
+	Torrents                     int
+	AnnouncesHandled             uint32
+	BlockedPeers                 uint32
+	ReceivedPeersWhileTraversing uint32
+	AnnouncesStarted             uint32
+	StoredInfoHashes             int
+	DroppedPeers                 uint32
+	StoredItems                  int
+	Nodes                        int
+	GoodNodes                    int
+	OutstandingTransactions      int
 }
 
-func (d *DhtNode) PrintStats() {
-	log.Printf("Stats %+v", d.stats)
+// Stats returns the current counters of the node
+func (d *DhtNode) Stats() Stats {
+	serverStats := d.Node.Stats()
+	return Stats{
+		Torrents:                     len(d.InfoHashes()),
+		AnnouncesHandled:             atomic.LoadUint32(&d.stats.announcesHandled),
+		BlockedPeers:                 atomic.LoadUint32(&d.stats.blockedPeers),
+		ReceivedPeersWhileTraversing: atomic.LoadUint32(&d.stats.receivedPeersWhileTraversing),
+		AnnouncesStarted:             atomic.LoadUint32(&d.stats.announcesStarted),
+		StoredInfoHashes:             d.store.NumInfoHashes(),
+		DroppedPeers:                 d.store.Dropped(),
+		StoredItems:                  d.items.len(),
+		Nodes:                        serverStats.Nodes,
+		GoodNodes:                    serverStats.GoodNodes,
+		OutstandingTransactions:      serverStats.OutstandingTransactions,
+	}
 }
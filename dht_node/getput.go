@@ -0,0 +1,285 @@
+package dht_node
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/netsys-lab/dht"
+	"github.com/netsys-lab/dht/int160"
+	k_nearest_nodes "github.com/netsys-lab/dht/k-nearest-nodes"
+	"github.com/netsys-lab/dht/krpc"
+	peerStore "github.com/netsys-lab/dht/peer-store"
+	"github.com/netsys-lab/dht/traversal"
+	"github.com/scionproto/scion/go/lib/snet"
+	log "github.com/sirupsen/logrus"
+)
+
+// numReturnNodes is the number of nodes closest to the target returned to get queries
+const numReturnNodes = 8
+
+// onQuery answers the BEP 44 get and put queries and BEP 33 scrapes, which the dht server does
+// not handle itself. All other queries are passed on to the server.
+func (d *DhtNode) onQuery(query *krpc.Msg, source snet.UDPAddr) bool {
+	if d.readOnly {
+		// The passive server drops the query
+		return true
+	}
+	switch {
+	case query.Q == "announce_peer" && query.A != nil:
+		if seedAnnounce(query.A) {
+			d.store.HintSeed(peerStore.InfoHash(query.A.InfoHash), krpc.NodeAddr{IP: source.Host.IP, IA: source.IA})
+		}
+		return true
+	case query.Q == "get_peers" && query.A != nil && query.A.Scrape == 1:
+		<-d.ready
+		d.handleScrape(query, source)
+		return false
+	case query.Q != "get" && query.Q != "put":
+		return true
+	}
+	<-d.ready
+	if query.A == nil {
+		d.sendError(query.T, source, krpc.Error{Code: krpc.ErrorCodeProtocolError, Msg: "missing arguments dict"})
+		return false
+	}
+	switch query.Q {
+	case "get":
+		d.handleGet(query, source)
+	case "put":
+		d.handlePut(query, source)
+	}
+	return false
+}
+
+func (d *DhtNode) handleGet(query *krpc.Msg, source snet.UDPAddr) {
+	target := query.A.Target
+	token := d.tokens.create(source)
+	r := krpc.Return{
+		ID:    d.Node.ID(),
+		Token: &token,
+	}
+	for _, n := range d.closestNodes(target, numReturnNodes) {
+		if n.Addr.IP.To4() != nil {
+			r.Nodes = append(r.Nodes, n)
+		} else {
+			r.Nodes6 = append(r.Nodes6, n)
+		}
+	}
+	if item := d.items.get(target); item != nil {
+		r.V = item.wire()
+	}
+	d.sendMsg(krpc.Msg{T: query.T, Y: "r", R: &r}, source)
+}
+
+func (d *DhtNode) handlePut(query *krpc.Msg, source snet.UDPAddr) {
+	if !d.tokens.valid(query.A.Token, source) {
+		d.sendError(query.T, source, krpc.Error{Code: krpc.ErrorCodeProtocolError, Msg: "invalid token"})
+		return
+	}
+	item, err := parseItem(query.A.V, nil)
+	if err == nil {
+		var target krpc.ID
+		target, err = item.Target()
+		if err == nil {
+			err = d.items.put(target, item)
+		}
+		if err == nil {
+			log.Debugf("stored item %x of %s", target, source.String())
+		}
+	}
+	if err != nil {
+		var kerr krpc.Error
+		if !errors.As(err, &kerr) {
+			kerr = krpc.Error{Code: krpc.ErrorCodeProtocolError, Msg: err.Error()}
+		}
+		d.sendError(query.T, source, kerr)
+		return
+	}
+	d.sendMsg(krpc.Msg{T: query.T, Y: "r", R: &krpc.Return{ID: d.Node.ID()}}, source)
+}
+
+func (d *DhtNode) sendError(t string, addr snet.UDPAddr, e krpc.Error) {
+	d.sendMsg(krpc.Msg{T: t, Y: "e", E: &e}, addr)
+}
+
+func (d *DhtNode) sendMsg(m krpc.Msg, addr snet.UDPAddr) {
+	b, err := bencode.Marshal(m)
+	if err != nil {
+		log.Errorf("could not encode dht message: %s", err)
+		return
+	}
+	appnet.SetDefaultPath(&addr)
+	if _, err := d.conn.WriteTo(b, &addr); err != nil {
+		log.Debugf("could not reply to %s: %s", addr.String(), err)
+	}
+}
+
+// closestNodes returns the k nodes of the routing table closest to the target
+func (d *DhtNode) closestNodes(target krpc.ID, k int) []krpc.NodeInfo {
+	nodes := d.Node.Nodes()
+	t := int160.FromByteArray(target)
+	sort.Slice(nodes, func(i, j int) bool {
+		return int160.Distance(int160.FromByteArray(nodes[i].ID), t).Cmp(
+			int160.Distance(int160.FromByteArray(nodes[j].ID), t)) < 0
+	})
+	if len(nodes) > k {
+		nodes = nodes[:k]
+	}
+	return nodes
+}
+
+// traverse sends the query q towards the target until no closer nodes are found or the
+// context is done. onReply is called with every reply. Only nodes that returned a token
+// are kept as closest nodes, since they are the ones accepting a put or announce.
+func (d *DhtNode) traverse(ctx context.Context, target krpc.ID, q string, args krpc.MsgArgs, onReply func(r *krpc.Return)) (*traversal.Operation, error) {
+	op := traversal.Start(traversal.OperationInput{
+		Target: target,
+		DoQuery: func(ctx context.Context, addr krpc.NodeAddr) traversal.QueryResult {
+			res := d.Node.Query(ctx, dht.NewAddr(addr.UDP()), q, dht.QueryInput{
+				MsgArgs: args,
+			})
+			if r := res.Reply.R; r != nil && onReply != nil {
+				onReply(r)
+			}
+			tqr := res.TraversalQueryResult(addr)
+			if tqr.ClosestData == nil {
+				tqr.ResponseFrom = nil
+			}
+			return tqr
+		},
+		NodeFilter: d.Node.TraversalNodeFilter,
+	})
+	nodes, err := d.Node.TraversalStartingNodes()
+	if err != nil {
+		op.Stop()
+		return nil, err
+	}
+	op.AddNodes(nodes)
+	return op, nil
+}
+
+// queryClosest waits until the traversal stalls and sends the query q with the arguments to
+// the closest nodes, passing the token of each node. It returns the number of nodes that
+// accepted the query.
+func (d *DhtNode) queryClosest(ctx context.Context, op *traversal.Operation, q string, args func(token string) krpc.MsgArgs) (int, error) {
+	select {
+	case <-op.Stalled():
+	case <-ctx.Done():
+	}
+	op.Stop()
+
+	var accepted int32
+	var lastErr atomic.Value
+	var wg sync.WaitGroup
+	op.Closest().Range(func(elem k_nearest_nodes.Elem) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := d.Node.Query(ctx, dht.NewAddr(elem.Addr.UDP()), q, dht.QueryInput{
+				MsgArgs: args(elem.Data.(string)),
+			})
+			if err := res.ToError(); err != nil {
+				log.Debugf("%s to %s failed: %s", q, elem.Addr, err)
+				lastErr.Store(err)
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+		}()
+	})
+	wg.Wait()
+
+	if accepted == 0 {
+		if err, ok := lastErr.Load().(error); ok {
+			return 0, fmt.Errorf("no node accepted %s: %w", q, err)
+		}
+		return 0, fmt.Errorf("no node accepted %s", q)
+	}
+	return int(accepted), nil
+}
+
+// Put stores the item on the nodes closest to its target. It returns the target and the number
+// of nodes that stored the item.
+func (d *DhtNode) Put(ctx context.Context, item *Item) (krpc.ID, int, error) {
+	target, err := item.Target()
+	if err != nil {
+		return target, 0, err
+	}
+	if err := item.Verify(); err != nil {
+		return target, 0, err
+	}
+	if err := d.items.put(target, item); err != nil {
+		return target, 0, err
+	}
+
+	op, err := d.traverse(ctx, target, "get", krpc.MsgArgs{Target: target}, nil)
+	if err != nil {
+		return target, 0, err
+	}
+	stored, err := d.queryClosest(ctx, op, "put", func(token string) krpc.MsgArgs {
+		return krpc.MsgArgs{
+			Token: token,
+			V:     item.wire(),
+		}
+	})
+	return target, stored, err
+}
+
+// Get looks up the item of the target. Immutable items are returned as soon as a node returns
+// them, for mutable items the one with the highest sequence number is returned.
+func (d *DhtNode) Get(ctx context.Context, target krpc.ID) (*Item, error) {
+	var lock sync.Mutex
+	best := d.items.get(target)
+	found := make(chan struct{})
+	var foundOnce sync.Once
+	onReply := func(r *krpc.Return) {
+		if r.V == nil {
+			return
+		}
+		item, err := parseItem(r.V, &target)
+		if err != nil {
+			log.Debugf("ignoring item %x: %s", target, err)
+			return
+		}
+		lock.Lock()
+		if best == nil || (item.Mutable() && item.Seq > best.Seq) {
+			best = item
+		}
+		lock.Unlock()
+		if !item.Mutable() {
+			foundOnce.Do(func() { close(found) })
+		}
+	}
+	if best != nil && !best.Mutable() {
+		return best, nil
+	}
+
+	op, err := d.traverse(ctx, target, "get", krpc.MsgArgs{Target: target}, onReply)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-op.Stalled():
+	case <-found:
+	case <-ctx.Done():
+	}
+	op.Stop()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if best == nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, ErrItemNotFound
+	}
+	return best, nil
+}
@@ -0,0 +1,335 @@
+package dht_node
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/netsys-lab/dht/krpc"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+const (
+	// ItemMaxAge is the time after which stored items are dropped, publishers have to put
+	// their items again within this time
+	ItemMaxAge = 2 * time.Hour
+	// DefaultMaxItems is the default number of items a node stores for other nodes
+	DefaultMaxItems = 1000
+	// MaxItemValueSize is the maximum size of the bencoded value of an item
+	MaxItemValueSize = 1000
+	// MaxItemSaltSize is the maximum size of the salt of a mutable item
+	MaxItemSaltSize = 64
+	// itemTokenRotation is the interval in which the secret of the put tokens changes
+	itemTokenRotation = 5 * time.Minute
+)
+
+// ErrItemNotFound is returned if no node returned an item for the target
+var ErrItemNotFound = errors.New("item not found")
+
+// Item is a BEP 44 item stored in the DHT. Immutable items are identified by the hash of their
+// value, mutable items by the hash of their public key and salt and signed with the private key.
+type Item struct {
+	V    interface{}       // Value, any bencodable value
+	K    ed25519.PublicKey // Public key of mutable items, nil for immutable items
+	Salt []byte            // Optional salt of mutable items, allows multiple items per key
+	Seq  int64             // Sequence number of mutable items, nodes only accept increasing numbers
+	Sig  []byte            // Signature of mutable items
+}
+
+// mutableItem is the encoding of a mutable item in the v field of get and put messages. The
+// krpc messages of the dht package do not contain the BEP 44 fields for mutable items, so
+// they are wrapped into the value.
+type mutableItem struct {
+	K    []byte      `bencode:"k"`
+	Salt []byte      `bencode:"salt,omitempty"`
+	Seq  int64       `bencode:"seq"`
+	Sig  []byte      `bencode:"sig"`
+	V    interface{} `bencode:"v"`
+}
+
+// NewImmutableItem creates an item identified by the hash of its value
+func NewImmutableItem(v interface{}) (*Item, error) {
+	item := &Item{V: v}
+	return item, item.Verify()
+}
+
+// NewMutableItem creates an item signed with the key, which replaces items of the same key
+// and salt with a lower sequence number
+func NewMutableItem(v interface{}, salt []byte, seq int64, key ed25519.PrivateKey) (*Item, error) {
+	buf, err := signatureBuffer(salt, seq, v)
+	if err != nil {
+		return nil, err
+	}
+	item := &Item{
+		V:    v,
+		K:    key.Public().(ed25519.PublicKey),
+		Salt: salt,
+		Seq:  seq,
+		Sig:  ed25519.Sign(key, buf),
+	}
+	return item, item.Verify()
+}
+
+// MutableTarget returns the target of the mutable items of the public key and salt
+func MutableTarget(k ed25519.PublicKey, salt []byte) krpc.ID {
+	return sha1.Sum(append(append([]byte{}, k...), salt...))
+}
+
+// Mutable returns whether the item is signed and may be replaced by newer versions
+func (i *Item) Mutable() bool {
+	return i.K != nil
+}
+
+// Target returns the id of the item in the DHT
+func (i *Item) Target() (krpc.ID, error) {
+	if i.Mutable() {
+		return MutableTarget(i.K, i.Salt), nil
+	}
+	v, err := bencode.Marshal(i.V)
+	if err != nil {
+		return krpc.ID{}, err
+	}
+	return sha1.Sum(v), nil
+}
+
+// signatureBuffer returns the data signed for mutable items as defined in BEP 44
+func signatureBuffer(salt []byte, seq int64, v interface{}) ([]byte, error) {
+	bv, err := bencode.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if len(salt) > 0 {
+		fmt.Fprintf(&buf, "4:salt%d:%s", len(salt), salt)
+	}
+	fmt.Fprintf(&buf, "3:seqi%de1:v", seq)
+	buf.Write(bv)
+	return buf.Bytes(), nil
+}
+
+// Verify checks the size limits of the item and the signature of mutable items
+func (i *Item) Verify() error {
+	v, err := bencode.Marshal(i.V)
+	if err != nil {
+		return err
+	}
+	if len(v) > MaxItemValueSize {
+		return krpc.Error{Code: krpc.ErrorCodeMessageValueFieldTooBig, Msg: "message (v field) too big"}
+	}
+	if !i.Mutable() {
+		return nil
+	}
+	if len(i.Salt) > MaxItemSaltSize {
+		return krpc.Error{Code: krpc.ErrorCodeSaltFieldTooBig, Msg: "salt (salt field) too big"}
+	}
+	if len(i.K) != ed25519.PublicKeySize {
+		return krpc.Error{Code: krpc.ErrorCodeInvalidSignature, Msg: "invalid public key"}
+	}
+	buf, err := signatureBuffer(i.Salt, i.Seq, i.V)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(i.K, buf, i.Sig) {
+		return krpc.Error{Code: krpc.ErrorCodeInvalidSignature, Msg: "invalid signature"}
+	}
+	return nil
+}
+
+// wire returns the value of the v field of get responses and put queries for the item
+func (i *Item) wire() interface{} {
+	if !i.Mutable() {
+		return i.V
+	}
+	return mutableItem{
+		K:    i.K,
+		Salt: i.Salt,
+		Seq:  i.Seq,
+		Sig:  i.Sig,
+		V:    i.V,
+	}
+}
+
+// parseItem decodes and verifies the v field of get responses and put queries. If target is
+// set, v is only taken as immutable item if it matches the target.
+func parseItem(v interface{}, target *krpc.ID) (*Item, error) {
+	b, err := bencode.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	immutable := &Item{V: v}
+	if target != nil && krpc.ID(sha1.Sum(b)) == *target {
+		return immutable, immutable.Verify()
+	}
+
+	var m mutableItem
+	if d, ok := v.(map[string]interface{}); !ok || d["k"] == nil || d["sig"] == nil || bencode.Unmarshal(b, &m) != nil {
+		if target != nil {
+			return nil, errors.New("value does not match the target")
+		}
+		return immutable, immutable.Verify()
+	}
+	item := &Item{
+		V:    m.V,
+		K:    m.K,
+		Salt: m.Salt,
+		Seq:  m.Seq,
+		Sig:  m.Sig,
+	}
+	if err := item.Verify(); err != nil {
+		return nil, err
+	}
+	if target != nil && MutableTarget(item.K, item.Salt) != *target {
+		return nil, errors.New("item does not match the target")
+	}
+	return item, nil
+}
+
+// LoadOrCreateKey reads the hex encoded ed25519 seed from the file. If the file does not exist,
+// a new key is created and its seed written to the file.
+func LoadOrCreateKey(file string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid key in %s", file)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+	return key, ioutil.WriteFile(file, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600)
+}
+
+type storedItem struct {
+	item *Item
+	time time.Time
+}
+
+// itemStore keeps the items put by other nodes until they expire
+type itemStore struct {
+	items    map[krpc.ID]storedItem
+	maxItems int
+	sync.Mutex
+}
+
+func newItemStore(maxItems int) *itemStore {
+	if maxItems <= 0 {
+		maxItems = DefaultMaxItems
+	}
+	return &itemStore{
+		items:    make(map[krpc.ID]storedItem),
+		maxItems: maxItems,
+	}
+}
+
+func (s *itemStore) get(target krpc.ID) *Item {
+	s.Lock()
+	defer s.Unlock()
+	stored, ok := s.items[target]
+	if !ok {
+		return nil
+	}
+	if time.Since(stored.time) > ItemMaxAge {
+		delete(s.items, target)
+		return nil
+	}
+	return stored.item
+}
+
+// put stores the item, mutable items only replace items with a lower sequence number
+func (s *itemStore) put(target krpc.ID, item *Item) error {
+	s.Lock()
+	defer s.Unlock()
+	if stored, ok := s.items[target]; ok && item.Mutable() && time.Since(stored.time) <= ItemMaxAge {
+		if item.Seq < stored.item.Seq {
+			return krpc.Error{Code: krpc.ErrorCodeSequenceNumberLessThanCurrent, Msg: "sequence number less than current"}
+		}
+		if item.Seq == stored.item.Seq && !bytes.Equal(item.Sig, stored.item.Sig) {
+			return krpc.Error{Code: krpc.ErrorCodeSequenceNumberLessThanCurrent, Msg: "sequence number not greater than current"}
+		}
+	}
+	if _, ok := s.items[target]; !ok && len(s.items) >= s.maxItems {
+		for k, v := range s.items {
+			if time.Since(v.time) > ItemMaxAge {
+				delete(s.items, k)
+			}
+		}
+		if len(s.items) >= s.maxItems {
+			return krpc.Error{Code: krpc.ErrorCodeServerError, Msg: "storage full"}
+		}
+	}
+	s.items[target] = storedItem{item: item, time: time.Now()}
+	return nil
+}
+
+func (s *itemStore) len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.items)
+}
+
+// itemTokens creates the tokens a node has to present to put an item, a token is bound to
+// the address of the node and valid for up to two rotations of the secret
+type itemTokens struct {
+	secret   []byte
+	previous []byte
+	rotated  time.Time
+	sync.Mutex
+}
+
+func (t *itemTokens) rotateLocked() {
+	if t.secret != nil && time.Since(t.rotated) < itemTokenRotation {
+		return
+	}
+	t.previous = t.secret
+	t.secret = make([]byte, 20)
+	rand.Read(t.secret)
+	t.rotated = time.Now()
+}
+
+func tokenFor(secret []byte, addr snet.UDPAddr) string {
+	mac := hmac.New(sha1.New, secret)
+	fmt.Fprintf(mac, "%s,%s", addr.IA, addr.Host.IP)
+	return string(mac.Sum(nil))
+}
+
+func (t *itemTokens) create(addr snet.UDPAddr) string {
+	t.Lock()
+	defer t.Unlock()
+	t.rotateLocked()
+	return tokenFor(t.secret, addr)
+}
+
+func (t *itemTokens) valid(token string, addr snet.UDPAddr) bool {
+	t.Lock()
+	defer t.Unlock()
+	t.rotateLocked()
+	if hmac.Equal([]byte(token), []byte(tokenFor(t.secret, addr))) {
+		return true
+	}
+	return t.previous != nil && hmac.Equal([]byte(token), []byte(tokenFor(t.previous, addr)))
+}
@@ -0,0 +1,111 @@
+package dht_node
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Test vectors of BEP 44
+func TestItemBep44Vectors(t *testing.T) {
+	item, err := NewImmutableItem("Hello World!")
+	require.Nil(t, err)
+	target, err := item.Target()
+	require.Nil(t, err)
+	assert.Equal(t, "e5f96f6f38320f0f33959cb4d3d656452117aadb", hex.EncodeToString(target[:]))
+
+	buf, err := signatureBuffer(nil, 1, "Hello World!")
+	require.Nil(t, err)
+	assert.Equal(t, "3:seqi1e1:v12:Hello World!", string(buf))
+	buf, err = signatureBuffer([]byte("foobar"), 1, "Hello World!")
+	require.Nil(t, err)
+	assert.Equal(t, "4:salt6:foobar3:seqi1e1:v12:Hello World!", string(buf))
+}
+
+// decodeWire returns the item as a remote node decodes it from a message
+func decodeWire(t *testing.T, item *Item) interface{} {
+	b, err := bencode.Marshal(item.wire())
+	require.Nil(t, err)
+	var v interface{}
+	require.Nil(t, bencode.Unmarshal(b, &v))
+	return v
+}
+
+func TestMutableItem(t *testing.T) {
+	key, err := LoadOrCreateKey(filepath.Join(t.TempDir(), "key"))
+	require.Nil(t, err)
+	item, err := NewMutableItem("info-hash", []byte("dataset"), 3, key)
+	require.Nil(t, err)
+	target, err := item.Target()
+	require.Nil(t, err)
+	assert.Equal(t, MutableTarget(key.Public().(ed25519.PublicKey), []byte("dataset")), target)
+
+	parsed, err := parseItem(decodeWire(t, item), &target)
+	require.Nil(t, err)
+	assert.True(t, parsed.Mutable())
+	assert.Equal(t, "info-hash", parsed.V)
+	assert.Equal(t, int64(3), parsed.Seq)
+
+	// Items put without target are recognized as mutable as well
+	parsed, err = parseItem(decodeWire(t, item), nil)
+	require.Nil(t, err)
+	assert.True(t, parsed.Mutable())
+
+	tampered := *item
+	tampered.Seq = 4
+	_, err = parseItem(decodeWire(t, &tampered), &target)
+	assert.NotNil(t, err)
+
+	other, err := NewMutableItem("info-hash", []byte("other"), 3, key)
+	require.Nil(t, err)
+	_, err = parseItem(decodeWire(t, other), &target)
+	assert.NotNil(t, err)
+
+	_, err = NewImmutableItem(string(make([]byte, MaxItemValueSize)))
+	assert.NotNil(t, err)
+}
+
+func TestItemStore(t *testing.T) {
+	key, err := LoadOrCreateKey(filepath.Join(t.TempDir(), "key"))
+	require.Nil(t, err)
+	store := newItemStore(2)
+	v1, _ := NewMutableItem("v1", nil, 1, key)
+	v2, _ := NewMutableItem("v2", nil, 2, key)
+	target, _ := v1.Target()
+
+	require.Nil(t, store.put(target, v2))
+	assert.NotNil(t, store.put(target, v1))
+	assert.Equal(t, "v2", store.get(target).V)
+	// Republishing the same item is fine
+	assert.Nil(t, store.put(target, v2))
+
+	immutable, _ := NewImmutableItem("a")
+	immutableTarget, _ := immutable.Target()
+	assert.Nil(t, store.put(immutableTarget, immutable))
+	full, _ := NewImmutableItem("b")
+	fullTarget, _ := full.Target()
+	assert.NotNil(t, store.put(fullTarget, full))
+	assert.Nil(t, store.get(fullTarget))
+}
+
+func TestItemTokens(t *testing.T) {
+	a, err := snet.ParseUDPAddr("19-ffaa:1:c3f,[10.0.0.1]:7000")
+	require.Nil(t, err)
+	b, err := snet.ParseUDPAddr("19-ffaa:1:c3f,[10.0.0.2]:7000")
+	require.Nil(t, err)
+	tokens := &itemTokens{}
+	token := tokens.create(*a)
+	assert.True(t, tokens.valid(token, *a))
+	assert.False(t, tokens.valid(token, *b))
+
+	tokens.rotated = tokens.rotated.Add(-itemTokenRotation)
+	assert.True(t, tokens.valid(token, *a))
+	tokens.rotated = tokens.rotated.Add(-itemTokenRotation)
+	assert.False(t, tokens.valid(token, *a))
+}
@@ -0,0 +1,284 @@
+package dht_node
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netsys-lab/dht/krpc"
+	peerStore "github.com/netsys-lab/dht/peer-store"
+)
+
+const (
+	// DefaultMaxInfoHashes is the default number of info-hashes a node stores peers for
+	DefaultMaxInfoHashes = 10000
+	// DefaultMaxPeersPerInfoHash is the default number of peers a node stores per info-hash
+	DefaultMaxPeersPerInfoHash = 200
+	// PeerMaxAge is the time after which a peer that did not announce again is removed,
+	// like the 30 minutes of BEP 5
+	PeerMaxAge = 30 * time.Minute
+	// maxSeedHints is the number of seed announces kept until their peer is stored
+	maxSeedHints = 1000
+	// expireInterval is the minimal time between two scans for expired peers
+	expireInterval = time.Minute
+)
+
+// LimitedPeerStore caps the number of info-hashes and peers per info-hash of a peer store,
+// so that a node accepting announces for any info-hash can not be filled up by other nodes.
+// Peers expire PeerMaxAge after their last announce. If the number of info-hashes is reached,
+// the info-hash announced least recently is evicted for a new one. Announces of peers that are
+// stored already are always passed on to refresh them.
+// Besides, it keeps track of which peers announced to be seeds, for BEP 33 scrapes.
+type LimitedPeerStore struct {
+	store               peerStore.Interface
+	maxInfoHashes       int
+	maxPeersPerInfoHash int
+	peers               map[peerStore.InfoHash]*storedInfoHash
+	seedHints           map[string]bool // Seed announces whose peer is not stored yet
+	lastExpiry          time.Time
+	now                 func() time.Time // Replaced in tests
+	dropped             uint32
+	sync.Mutex
+}
+
+type storedInfoHash struct {
+	peers     map[string]limitedPeer
+	announced time.Time // Last announce of any peer
+}
+
+type limitedPeer struct {
+	addr      krpc.NodeAddr
+	seed      bool
+	announced time.Time
+}
+
+// peerRemover is implemented by stores that can remove peers, like the PersistentPeerStore
+type peerRemover interface {
+	RemovePeer(ih peerStore.InfoHash, addr krpc.NodeAddr)
+}
+
+// NewLimitedPeerStore wraps store, limits of 0 are replaced by the defaults. Peers
+// already in an in-memory store count towards the limits. Expired and evicted peers are
+// removed from the store if it implements RemovePeer. If store is nil, peers are only
+// kept by the LimitedPeerStore.
+func NewLimitedPeerStore(store peerStore.Interface, maxInfoHashes, maxPeersPerInfoHash int) *LimitedPeerStore {
+	if maxInfoHashes <= 0 {
+		maxInfoHashes = DefaultMaxInfoHashes
+	}
+	if maxPeersPerInfoHash <= 0 {
+		maxPeersPerInfoHash = DefaultMaxPeersPerInfoHash
+	}
+	l := &LimitedPeerStore{
+		store:               store,
+		maxInfoHashes:       maxInfoHashes,
+		maxPeersPerInfoHash: maxPeersPerInfoHash,
+		peers:               make(map[peerStore.InfoHash]*storedInfoHash),
+		seedHints:           make(map[string]bool),
+		now:                 time.Now,
+	}
+	if all, ok := store.(interface {
+		GetAll() map[peerStore.InfoHash][]peerStore.NodeAndTime
+	}); ok {
+		for ih, nodes := range all.GetAll() {
+			for _, v := range nodes {
+				l.storeLocked(ih, limitedPeer{addr: v.NodeAddr, announced: v.Time})
+			}
+		}
+	}
+	return l
+}
+
+// peerKey identifies a peer the same way the in-memory store does
+func peerKey(addr krpc.NodeAddr) string {
+	return fmt.Sprintf("%s%s", addr.IA.String(), addr.IP.String())
+}
+
+func (l *LimitedPeerStore) storeLocked(ih peerStore.InfoHash, peer limitedPeer) {
+	stored, ok := l.peers[ih]
+	if !ok {
+		stored = &storedInfoHash{peers: make(map[string]limitedPeer)}
+		l.peers[ih] = stored
+	}
+	stored.peers[peerKey(peer.addr)] = peer
+	if peer.announced.After(stored.announced) {
+		stored.announced = peer.announced
+	}
+}
+
+// removeLocked removes the peers of the info-hash and returns them, so that they are
+// removed from the wrapped store after the lock is released
+func (l *LimitedPeerStore) removeLocked(ih peerStore.InfoHash, keys []string) []krpc.NodeAddr {
+	stored := l.peers[ih]
+	removed := make([]krpc.NodeAddr, 0, len(keys))
+	for _, key := range keys {
+		removed = append(removed, stored.peers[key].addr)
+		delete(stored.peers, key)
+	}
+	if len(stored.peers) == 0 {
+		delete(l.peers, ih)
+	}
+	return removed
+}
+
+// expireLocked removes the peers that did not announce within PeerMaxAge
+func (l *LimitedPeerStore) expireLocked(now time.Time) map[peerStore.InfoHash][]krpc.NodeAddr {
+	if now.Sub(l.lastExpiry) < expireInterval {
+		return nil
+	}
+	l.lastExpiry = now
+	removed := make(map[peerStore.InfoHash][]krpc.NodeAddr)
+	for ih, stored := range l.peers {
+		expired := make([]string, 0)
+		for key, peer := range stored.peers {
+			if now.Sub(peer.announced) > PeerMaxAge {
+				expired = append(expired, key)
+			}
+		}
+		if len(expired) > 0 {
+			removed[ih] = l.removeLocked(ih, expired)
+		}
+	}
+	return removed
+}
+
+// evictLocked removes all peers of the info-hash announced least recently
+func (l *LimitedPeerStore) evictLocked() (peerStore.InfoHash, []krpc.NodeAddr) {
+	var oldest peerStore.InfoHash
+	var oldestStored *storedInfoHash
+	for ih, stored := range l.peers {
+		if oldestStored == nil || stored.announced.Before(oldestStored.announced) {
+			oldest, oldestStored = ih, stored
+		}
+	}
+	keys := make([]string, 0, len(oldestStored.peers))
+	for key := range oldestStored.peers {
+		keys = append(keys, key)
+	}
+	return oldest, l.removeLocked(oldest, keys)
+}
+
+// removeFromStore removes peers from the wrapped store, if it supports it
+func (l *LimitedPeerStore) removeFromStore(removed map[peerStore.InfoHash][]krpc.NodeAddr) {
+	remover, ok := l.store.(peerRemover)
+	if !ok || len(removed) == 0 {
+		return
+	}
+	for ih, addrs := range removed {
+		for _, addr := range addrs {
+			remover.RemovePeer(ih, addr)
+		}
+	}
+}
+
+// AddPeer stores the peer, unless the number of peers of the info-hash is reached. The peer is
+// a seed if it was hinted as one by HintSeed before.
+func (l *LimitedPeerStore) AddPeer(ih peerStore.InfoHash, addr krpc.NodeAddr) {
+	l.Lock()
+	now := l.now()
+	removed := l.expireLocked(now)
+	key := peerKey(addr)
+	seed := l.seedHints[string(ih[:])+key]
+	delete(l.seedHints, string(ih[:])+key)
+	stored, known := l.peers[ih]
+	switch {
+	case known && len(stored.peers) >= l.maxPeersPerInfoHash:
+		if _, ok := stored.peers[key]; !ok {
+			l.Unlock()
+			l.removeFromStore(removed)
+			atomic.AddUint32(&l.dropped, 1)
+			return
+		}
+	case !known && len(l.peers) >= l.maxInfoHashes:
+		if removed == nil {
+			removed = make(map[peerStore.InfoHash][]krpc.NodeAddr)
+		}
+		evicted, addrs := l.evictLocked()
+		removed[evicted] = append(removed[evicted], addrs...)
+		atomic.AddUint32(&l.dropped, uint32(len(addrs)))
+	}
+	l.storeLocked(ih, limitedPeer{addr: addr, seed: seed, announced: now})
+	l.Unlock()
+	l.removeFromStore(removed)
+	if l.store != nil {
+		l.store.AddPeer(ih, addr)
+	}
+}
+
+// HintSeed marks the next announce of the peer for the info-hash as announce of a seed. The
+// dht server validates announces after they are seen by the node, so the seed flag is kept
+// until the server stores the peer.
+func (l *LimitedPeerStore) HintSeed(ih peerStore.InfoHash, addr krpc.NodeAddr) {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.seedHints) >= maxSeedHints {
+		// Hints of announces with invalid tokens are never consumed
+		l.seedHints = make(map[string]bool)
+	}
+	l.seedHints[string(ih[:])+peerKey(addr)] = true
+}
+
+// ScrapeFilters returns the BEP 33 bloom filters of the seeds and the other peers stored for
+// the info-hash. Peers are identified by ISD-AS and IP instead of the IP only.
+func (l *LimitedPeerStore) ScrapeFilters(ih peerStore.InfoHash) (seeds krpc.ScrapeBloomFilter, peers krpc.ScrapeBloomFilter) {
+	l.Lock()
+	defer l.Unlock()
+	for key, peer := range l.validPeersLocked(ih) {
+		if peer.seed {
+			seeds.AddIp(net.IP(key))
+		} else {
+			peers.AddIp(net.IP(key))
+		}
+	}
+	return seeds, peers
+}
+
+// validPeersLocked returns the peers of the info-hash that did not expire yet
+func (l *LimitedPeerStore) validPeersLocked(ih peerStore.InfoHash) map[string]limitedPeer {
+	stored, ok := l.peers[ih]
+	if !ok {
+		return nil
+	}
+	now := l.now()
+	valid := make(map[string]limitedPeer, len(stored.peers))
+	for key, peer := range stored.peers {
+		if now.Sub(peer.announced) <= PeerMaxAge {
+			valid[key] = peer
+		}
+	}
+	return valid
+}
+
+// IsSeed returns whether the peer announced to be a seed of the info-hash
+func (l *LimitedPeerStore) IsSeed(ih peerStore.InfoHash, addr krpc.NodeAddr) bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.validPeersLocked(ih)[peerKey(addr)].seed
+}
+
+// GetPeers returns the peers of the info-hash that did not expire yet
+func (l *LimitedPeerStore) GetPeers(ih peerStore.InfoHash) []krpc.NodeAddr {
+	l.Lock()
+	defer l.Unlock()
+	peers := make([]krpc.NodeAddr, 0)
+	for _, peer := range l.validPeersLocked(ih) {
+		peers = append(peers, peer.addr)
+	}
+	return peers
+}
+
+// NumInfoHashes returns the number of info-hashes peers are stored for
+func (l *LimitedPeerStore) NumInfoHashes() int {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.peers)
+}
+
+// Dropped returns the number of announces and evicted peers that were not stored because of the limits
+func (l *LimitedPeerStore) Dropped() uint32 {
+	return atomic.LoadUint32(&l.dropped)
+}
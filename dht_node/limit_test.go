@@ -0,0 +1,101 @@
+package dht_node
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/netsys-lab/dht/krpc"
+	peerStore "github.com/netsys-lab/dht/peer-store"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testNodeAddr(t *testing.T, ip string, port int) krpc.NodeAddr {
+	ia, err := addr.IAFromString("19-ffaa:1:c3f")
+	assert.Nil(t, err)
+	return krpc.NodeAddr{IP: net.ParseIP(ip), Port: port, IA: ia}
+}
+
+func TestLimitedPeerStore(t *testing.T) {
+	store := &peerStore.InMemory{}
+	first := metainfo.Hash{1}
+	store.AddPeer(first, testNodeAddr(t, "10.0.0.1", 1000))
+
+	limited := NewLimitedPeerStore(store, 2, 2)
+	now := time.Now()
+	limited.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	assert.Equal(t, 1, limited.NumInfoHashes())
+
+	limited.AddPeer(first, testNodeAddr(t, "10.0.0.2", 1000))
+	limited.AddPeer(first, testNodeAddr(t, "10.0.0.3", 1000))
+	assert.Equal(t, 2, len(limited.GetPeers(first)))
+	assert.Equal(t, uint32(1), limited.Dropped())
+
+	// Known peers are refreshed although the limit is reached
+	limited.AddPeer(first, testNodeAddr(t, "10.0.0.1", 2000))
+	assert.Equal(t, uint32(1), limited.Dropped())
+
+	// The info-hash announced least recently makes room for a new one
+	limited.AddPeer(metainfo.Hash{2}, testNodeAddr(t, "10.0.0.1", 1000))
+	limited.AddPeer(metainfo.Hash{3}, testNodeAddr(t, "10.0.0.1", 1000))
+	assert.Equal(t, 2, limited.NumInfoHashes())
+	assert.Equal(t, 1, len(limited.GetPeers(metainfo.Hash{3})))
+	assert.Equal(t, 1, len(limited.GetPeers(metainfo.Hash{2})))
+	assert.Equal(t, 0, len(limited.GetPeers(first)))
+	assert.Equal(t, uint32(3), limited.Dropped(), "the evicted peers count as dropped")
+}
+
+func TestPeerExpiry(t *testing.T) {
+	store, err := NewPersistentPeerStore(filepath.Join(t.TempDir(), "peers.json"))
+	require.Nil(t, err)
+	limited := NewLimitedPeerStore(store, 0, 0)
+	now := time.Now()
+	limited.now = func() time.Time { return now }
+	ih := metainfo.Hash{1}
+	limited.AddPeer(ih, testNodeAddr(t, "10.0.0.1", 1000))
+	now = now.Add(PeerMaxAge / 2)
+	limited.AddPeer(ih, testNodeAddr(t, "10.0.0.2", 1000))
+	assert.Equal(t, 2, len(limited.GetPeers(ih)))
+
+	// Expired peers are not handed out anymore and removed on the next announce
+	now = now.Add(PeerMaxAge/2 + time.Second)
+	assert.Equal(t, []krpc.NodeAddr{testNodeAddr(t, "10.0.0.2", 1000)}, limited.GetPeers(ih))
+	limited.AddPeer(metainfo.Hash{2}, testNodeAddr(t, "10.0.0.3", 1000))
+	assert.Equal(t, 2, store.NumPeers())
+
+	now = now.Add(PeerMaxAge)
+	limited.AddPeer(metainfo.Hash{2}, testNodeAddr(t, "10.0.0.3", 1000))
+	assert.Equal(t, 1, limited.NumInfoHashes())
+	assert.Equal(t, 1, store.NumPeers())
+	assert.Equal(t, uint32(0), limited.Dropped())
+}
+
+func TestSeedHints(t *testing.T) {
+	limited := NewLimitedPeerStore(&peerStore.InMemory{}, 0, 0)
+	ih := metainfo.Hash{1}
+	seed := testNodeAddr(t, "10.0.0.1", 1000)
+	leecher := testNodeAddr(t, "10.0.0.2", 1000)
+
+	// The hint is seen before the announce is validated and the peer is stored
+	limited.HintSeed(ih, krpc.NodeAddr{IP: seed.IP, IA: seed.IA})
+	limited.AddPeer(ih, seed)
+	limited.AddPeer(ih, leecher)
+	assert.True(t, limited.IsSeed(ih, seed))
+	assert.False(t, limited.IsSeed(ih, leecher))
+
+	// A hint is only used for one announce
+	limited.AddPeer(ih, seed)
+	assert.False(t, limited.IsSeed(ih, seed))
+
+	// Hints of other info-hashes do not count
+	limited.HintSeed(metainfo.Hash{2}, leecher)
+	limited.AddPeer(ih, leecher)
+	assert.False(t, limited.IsSeed(ih, leecher))
+}
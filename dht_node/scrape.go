@@ -0,0 +1,168 @@
+package dht_node
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/netsys-lab/dht/krpc"
+	peerStore "github.com/netsys-lab/dht/peer-store"
+	"github.com/scionproto/scion/go/lib/snet"
+	log "github.com/sirupsen/logrus"
+)
+
+// seedFlag is the value of announces of seeds. The krpc messages of the dht package do not
+// contain the BEP 33 seed field, so it is sent in the v field instead.
+const seedFlag = "seed"
+
+// ScrapeResult is the estimated size of the swarm of a torrent
+type ScrapeResult struct {
+	InfoHash [20]byte
+	Seeds    int // Estimated number of peers that announced to have the complete torrent
+	Peers    int // Estimated number of peers that are still downloading
+	Nodes    int // Number of nodes that answered the scrape
+}
+
+func seedAnnounce(args *krpc.MsgArgs) bool {
+	v, ok := args.V.(string)
+	return ok && v == seedFlag
+}
+
+// handleScrape answers get_peers queries with scrape flag with the bloom filters of the seeds
+// and peers of the info-hash. As the dht server creates the tokens for announces, scrape replies
+// contain no token and the querying node has to look up the peers again to announce.
+func (d *DhtNode) handleScrape(query *krpc.Msg, source snet.UDPAddr) {
+	ih := peerStore.InfoHash(query.A.InfoHash)
+	seeds, peers := d.store.ScrapeFilters(ih)
+	r := krpc.Return{
+		ID:   d.Node.ID(),
+		BFsd: &seeds,
+		BFpe: &peers,
+	}
+	for _, p := range d.store.GetPeers(ih) {
+		if query.A.NoSeed == 1 && d.store.IsSeed(ih, p) {
+			continue
+		}
+		r.Values = append(r.Values, p)
+	}
+	if len(r.Values) == 0 {
+		for _, n := range d.closestNodes(query.A.InfoHash, numReturnNodes) {
+			if n.Addr.IP.To4() != nil {
+				r.Nodes = append(r.Nodes, n)
+			} else {
+				r.Nodes6 = append(r.Nodes6, n)
+			}
+		}
+	}
+	d.sendMsg(krpc.Msg{T: query.T, Y: "r", R: &r}, source)
+}
+
+// estimate returns the number of entries of the bloom filter, rounded to a whole peer. The
+// estimation of krpc is 1 for empty filters.
+func estimate(f *krpc.ScrapeBloomFilter) int {
+	if *f == (krpc.ScrapeBloomFilter{}) {
+		return 0
+	}
+	return int(math.Round(f.EstimateCount()))
+}
+
+// Scrape estimates the number of seeds and peers of the torrent, by merging the bloom filters
+// returned by the nodes close to the info-hash as described in BEP 33
+func (d *DhtNode) Scrape(ctx context.Context, infoHash [20]byte) (ScrapeResult, error) {
+	var lock sync.Mutex
+	var seeds, peers krpc.ScrapeBloomFilter
+	result := ScrapeResult{InfoHash: infoHash}
+	onReply := func(r *krpc.Return) {
+		if r.BFsd == nil || r.BFpe == nil {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for i := range seeds {
+			seeds[i] |= r.BFsd[i]
+			peers[i] |= r.BFpe[i]
+		}
+		result.Nodes++
+	}
+
+	op, err := d.traverse(ctx, infoHash, "get_peers", krpc.MsgArgs{InfoHash: infoHash, Scrape: 1}, onReply)
+	if err != nil {
+		return result, err
+	}
+	select {
+	case <-op.Stalled():
+	case <-ctx.Done():
+	}
+	op.Stop()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if result.Nodes == 0 && ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	result.Seeds = estimate(&seeds)
+	result.Peers = estimate(&peers)
+	return result, nil
+}
+
+// ScrapeAll scrapes the torrents concurrently and returns the results ordered by priority: torrents
+// with the fewest seeds per downloading peer first, as they need additional seeds the most.
+// Torrents that could not be scraped are left out.
+func (d *DhtNode) ScrapeAll(ctx context.Context, infoHashes [][20]byte) []ScrapeResult {
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, ih := range infoHashes {
+		wg.Add(1)
+		go func(ih [20]byte) {
+			defer wg.Done()
+			res, err := d.Scrape(ctx, ih)
+			if err != nil {
+				log.Debugf("could not scrape %x: %s", ih, err)
+				return
+			}
+			lock.Lock()
+			results = append(results, res)
+			lock.Unlock()
+		}(ih)
+	}
+	wg.Wait()
+	SortByDemand(results)
+	return results
+}
+
+// SortByDemand orders scrape results by seeds per downloading peer, ascending
+func SortByDemand(results []ScrapeResult) {
+	demand := func(r ScrapeResult) float64 {
+		return float64(r.Seeds) / float64(r.Peers+1)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return demand(results[i]) < demand(results[j])
+	})
+}
+
+// announceSeed announces the node as seed of the torrent to the nodes closest to the info-hash
+func (d *DhtNode) announceSeed(ctx context.Context, infoHash [20]byte, peerPort uint16) error {
+	op, err := d.traverse(ctx, infoHash, "get_peers", krpc.MsgArgs{InfoHash: infoHash}, nil)
+	if err != nil {
+		return err
+	}
+	port := int(peerPort)
+	n, err := d.queryClosest(ctx, op, "announce_peer", func(token string) krpc.MsgArgs {
+		return krpc.MsgArgs{
+			InfoHash: infoHash,
+			Port:     &port,
+			Token:    token,
+			V:        seedFlag,
+		}
+	})
+	if err != nil {
+		return err
+	}
+	log.Debugf("announced seed of %x to %d nodes", infoHash, n)
+	return nil
+}
@@ -0,0 +1,42 @@
+package dht_node
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+	peerStore "github.com/netsys-lab/dht/peer-store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrapeFilters(t *testing.T) {
+	limited := NewLimitedPeerStore(&peerStore.InMemory{}, 0, 0)
+	ih := metainfo.Hash{1}
+	for i := 0; i < 20; i++ {
+		addr := testNodeAddr(t, fmt.Sprintf("10.0.0.%d", i+1), 1000)
+		if i < 5 {
+			limited.HintSeed(ih, addr)
+		}
+		limited.AddPeer(ih, addr)
+	}
+
+	seeds, peers := limited.ScrapeFilters(ih)
+	assert.Equal(t, 5, estimate(&seeds))
+	assert.Equal(t, 15, estimate(&peers))
+
+	seeds, peers = limited.ScrapeFilters(metainfo.Hash{2})
+	assert.Equal(t, 0, estimate(&seeds))
+	assert.Equal(t, 0, estimate(&peers))
+}
+
+func TestSortByDemand(t *testing.T) {
+	results := []ScrapeResult{
+		{InfoHash: [20]byte{1}, Seeds: 10, Peers: 1},
+		{InfoHash: [20]byte{2}, Seeds: 1, Peers: 10},
+		{InfoHash: [20]byte{3}, Seeds: 0, Peers: 0},
+	}
+	SortByDemand(results)
+	assert.Equal(t, [20]byte{3}, results[0].InfoHash)
+	assert.Equal(t, [20]byte{2}, results[1].InfoHash)
+	assert.Equal(t, [20]byte{1}, results[2].InfoHash)
+}
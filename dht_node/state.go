@@ -0,0 +1,275 @@
+package dht_node
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/netsys-lab/dht"
+	"github.com/netsys-lab/dht/krpc"
+	peerStore "github.com/netsys-lab/dht/peer-store"
+	"github.com/scionproto/scion/go/lib/snet"
+	log "github.com/sirupsen/logrus"
+)
+
+// PeerStoreMaxAge is the age after which stored peers are not loaded anymore, peers
+// are expected to announce themselves again within this time
+const PeerStoreMaxAge = 2 * time.Hour
+
+// LoadOrCreateNodeId reads the hex encoded node id from the file. If the file does
+// not exist, a random id is created and written to the file.
+func LoadOrCreateNodeId(file string) ([20]byte, error) {
+	var id [20]byte
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		decoded, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(decoded) != len(id) {
+			return id, fmt.Errorf("invalid node id in %s", file)
+		}
+		copy(id[:], decoded)
+		return id, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return id, err
+	}
+
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, err
+	}
+	return id, writeFile(file, []byte(hex.EncodeToString(id[:])+"\n"))
+}
+
+// writeFile writes to a temporary file first, so that the file is never left half written
+func writeFile(file string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// PersistentPeerStore is an in-memory peer store that can be saved to a file and
+// is loaded from this file on creation
+type PersistentPeerStore struct {
+	peers map[peerStore.InfoHash]map[string]peerStore.NodeAndTime
+	file  string
+	sync.RWMutex
+}
+
+type storedPeer struct {
+	InfoHash string    `json:"infoHash"`
+	Addr     string    `json:"addr"`
+	Time     time.Time `json:"time"`
+}
+
+// NewPersistentPeerStore creates the peer store and loads the peers of the file, if it exists
+func NewPersistentPeerStore(file string) (*PersistentPeerStore, error) {
+	p := &PersistentPeerStore{
+		peers: make(map[peerStore.InfoHash]map[string]peerStore.NodeAndTime),
+		file:  file,
+	}
+	data, err := ioutil.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored []storedPeer
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	for _, v := range stored {
+		if time.Since(v.Time) > PeerStoreMaxAge {
+			continue
+		}
+		var ih metainfo.Hash
+		if err := ih.FromHexString(v.InfoHash); err != nil {
+			return nil, err
+		}
+		addr, err := snet.ParseUDPAddr(v.Addr)
+		if err != nil {
+			return nil, err
+		}
+		// The store takes the time of loading as time of the announce
+		p.AddPeer(ih, krpc.NodeAddr{IP: addr.Host.IP, Port: addr.Host.Port, IA: addr.IA})
+	}
+	return p, nil
+}
+
+// AddPeer stores the peer or refreshes the time of its announce
+func (p *PersistentPeerStore) AddPeer(ih peerStore.InfoHash, addr krpc.NodeAddr) {
+	p.Lock()
+	defer p.Unlock()
+	nodes, ok := p.peers[ih]
+	if !ok {
+		nodes = make(map[string]peerStore.NodeAndTime)
+		p.peers[ih] = nodes
+	}
+	nodes[peerKey(addr)] = peerStore.NodeAndTime{NodeAddr: addr, Time: time.Now()}
+}
+
+// RemovePeer removes the peer of the info-hash
+func (p *PersistentPeerStore) RemovePeer(ih peerStore.InfoHash, addr krpc.NodeAddr) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.peers[ih], peerKey(addr))
+	if len(p.peers[ih]) == 0 {
+		delete(p.peers, ih)
+	}
+}
+
+// GetPeers returns the stored peers of the info-hash
+func (p *PersistentPeerStore) GetPeers(ih peerStore.InfoHash) []krpc.NodeAddr {
+	p.RLock()
+	defer p.RUnlock()
+	peers := make([]krpc.NodeAddr, 0, len(p.peers[ih]))
+	for _, v := range p.peers[ih] {
+		peers = append(peers, v.NodeAddr)
+	}
+	return peers
+}
+
+// GetAll returns all stored peers with the time of their announce
+func (p *PersistentPeerStore) GetAll() map[peerStore.InfoHash][]peerStore.NodeAndTime {
+	p.RLock()
+	defer p.RUnlock()
+	all := make(map[peerStore.InfoHash][]peerStore.NodeAndTime, len(p.peers))
+	for ih, nodes := range p.peers {
+		for _, v := range nodes {
+			all[ih] = append(all[ih], v)
+		}
+	}
+	return all
+}
+
+// Save writes all stored peers to the file
+func (p *PersistentPeerStore) Save() error {
+	stored := make([]storedPeer, 0)
+	for ih, nodes := range p.GetAll() {
+		for _, v := range nodes {
+			stored = append(stored, storedPeer{
+				InfoHash: ih.HexString(),
+				Addr:     v.NodeAddr.String(),
+				Time:     v.Time,
+			})
+		}
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(p.file, data)
+}
+
+// NumPeers returns the number of stored peers over all info-hashes
+func (p *PersistentPeerStore) NumPeers() int {
+	num := 0
+	for _, nodes := range p.GetAll() {
+		num += len(nodes)
+	}
+	return num
+}
+
+// StateSaveInterval is the interval in which the routing table is saved to the state directory
+const StateSaveInterval = 5 * time.Minute
+
+type storedNode struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// loadState returns the node id kept in the state directory, creating it if necessary,
+// and the nodes of the saved routing table
+func loadState(stateDir string) (*[20]byte, []dht.Addr, error) {
+	nodeId, err := LoadOrCreateNodeId(filepath.Join(stateDir, "node-id"))
+	if err != nil {
+		return nil, nil, err
+	}
+	nodes, err := loadRoutingTable(filepath.Join(stateDir, "routing-table.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &nodeId, nodes, nil
+}
+
+func loadRoutingTable(file string) ([]dht.Addr, error) {
+	nodes := make([]dht.Addr, 0)
+	data, err := ioutil.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nodes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored []storedNode
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	for _, v := range stored {
+		addr, err := snet.ParseUDPAddr(v.Addr)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, dht.NewAddr(*addr))
+	}
+	return nodes, nil
+}
+
+// saveRoutingTable writes the nodes of the routing table that are not known to be bad
+func saveRoutingTable(file string, nodes []krpc.NodeInfo) error {
+	stored := make([]storedNode, 0, len(nodes))
+	for _, v := range nodes {
+		stored = append(stored, storedNode{
+			ID:   hex.EncodeToString(v.ID[:]),
+			Addr: v.Addr.String(),
+		})
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(file, data)
+}
+
+// saveState saves the routing table to the state directory of the node
+func (d *DhtNode) saveState() {
+	if d.stateDir == "" {
+		return
+	}
+	nodes := d.Node.Nodes()
+	if err := saveRoutingTable(filepath.Join(d.stateDir, "routing-table.json"), nodes); err != nil {
+		log.Errorf("could not save dht routing table: %s", err)
+		return
+	}
+	log.Debugf("saved %d dht nodes to %s", len(nodes), d.stateDir)
+}
+
+// persistLoop periodically saves the state of the node until the node is closed
+func (d *DhtNode) persistLoop() {
+	ticker := time.NewTicker(StateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			d.saveState()
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package dht_node
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/netsys-lab/dht"
+	"github.com/netsys-lab/dht/krpc"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOrCreateNodeId(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dht", "node-id")
+	id, err := LoadOrCreateNodeId(file)
+	require.Nil(t, err)
+	assert.NotEqual(t, [20]byte{}, id)
+
+	loaded, err := LoadOrCreateNodeId(file)
+	require.Nil(t, err)
+	assert.Equal(t, id, loaded)
+}
+
+func TestPersistentPeerStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "peers.json")
+	store, err := NewPersistentPeerStore(file)
+	require.Nil(t, err)
+
+	addr, err := snet.ParseUDPAddr("19-ffaa:1:c3f,[10.0.0.1]:43000")
+	require.Nil(t, err)
+	ih := metainfo.Hash{1, 2, 3}
+	store.AddPeer(ih, krpc.NodeAddr{IP: addr.Host.IP, Port: addr.Host.Port, IA: addr.IA})
+	require.Nil(t, store.Save())
+
+	loaded, err := NewPersistentPeerStore(file)
+	require.Nil(t, err)
+	assert.Equal(t, 1, loaded.NumPeers())
+	peers := loaded.GetPeers(ih)
+	require.Equal(t, 1, len(peers))
+	assert.Equal(t, "19-ffaa:1:c3f,[10.0.0.1]:43000", peers[0].String())
+}
+
+func TestRoutingTablePersistence(t *testing.T) {
+	dir := t.TempDir()
+	addr, err := snet.ParseUDPAddr("19-ffaa:1:c3f,[10.0.0.1]:7000")
+	require.Nil(t, err)
+	nodes := []krpc.NodeInfo{{
+		ID:   krpc.ID{1, 2, 3},
+		Addr: krpc.NodeAddr{IP: addr.Host.IP, Port: addr.Host.Port, IA: addr.IA},
+	}}
+	require.Nil(t, saveRoutingTable(filepath.Join(dir, "routing-table.json"), nodes))
+
+	nodeId, loaded, err := loadState(dir)
+	require.Nil(t, err)
+	require.NotNil(t, nodeId)
+	require.Equal(t, 1, len(loaded))
+	assert.Equal(t, "19-ffaa:1:c3f,[10.0.0.1]:7000", loaded[0].String())
+
+	// The node id stays the same
+	sameId, _, err := loadState(dir)
+	require.Nil(t, err)
+	assert.Equal(t, *nodeId, *sameId)
+
+	// Saved nodes are added to the starting nodes
+	_, startingNodes, err := withState(dir, []dht.Addr{dht.NewAddr(*addr)})
+	require.Nil(t, err)
+	assert.Equal(t, 2, len(startingNodes))
+	_, startingNodes, err = withState("", nil)
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(startingNodes))
+}
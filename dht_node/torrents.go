@@ -0,0 +1,273 @@
+package dht_node
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/netsys-lab/bittorrent-over-scion/peers"
+	"github.com/netsys-lab/dht"
+	"github.com/netsys-lab/dht/krpc"
+	log "github.com/sirupsen/logrus"
+)
+
+// dhtTorrent is a torrent announced and looked up by the node
+type dhtTorrent struct {
+	peerPort          uint16 // Port the controlling peer is listening to, 0 to only look up peers
+	seed              bool   // The controlling peer has the complete torrent
+	onNewPeerReceived func(peer peers.Peer)
+	lookup            chan struct{} // Requests a lookup before the next interval
+	stop              chan struct{}
+}
+
+// AddTorrent announces the torrent via the node and looks up its peers, every peer found is passed
+// to onNewPeerReceived. With peerPort 0 or on read-only nodes, the torrent is only looked up, but
+// not announced. Adding a torrent again replaces the port and the callback.
+func (d *DhtNode) AddTorrent(infoHash [20]byte, peerPort uint16, onNewPeerReceived func(peer peers.Peer)) {
+	d.addTorrent(infoHash, &dhtTorrent{
+		peerPort:          peerPort,
+		onNewPeerReceived: onNewPeerReceived,
+	})
+}
+
+// SeedTorrent is like AddTorrent, but announces the torrent as seed, so that scrapes count
+// the peer as seed
+func (d *DhtNode) SeedTorrent(infoHash [20]byte, peerPort uint16, onNewPeerReceived func(peer peers.Peer)) {
+	d.addTorrent(infoHash, &dhtTorrent{
+		peerPort:          peerPort,
+		seed:              peerPort != 0,
+		onNewPeerReceived: onNewPeerReceived,
+	})
+}
+
+func (d *DhtNode) addTorrent(infoHash [20]byte, t *dhtTorrent) {
+	if d.readOnly {
+		t.peerPort = 0
+		t.seed = false
+	}
+	t.lookup = make(chan struct{}, 1)
+	t.stop = make(chan struct{})
+	d.Lock()
+	if old, ok := d.torrents[infoHash]; ok {
+		close(old.stop)
+	}
+	d.torrents[infoHash] = t
+	d.Unlock()
+
+	log.Infof("adding torrent %x to dht node, peer port: %d, seed: %t", infoHash, t.peerPort, t.seed)
+	go d.announceLoop(infoHash, t)
+}
+
+// RemoveTorrent stops announcing and looking up the torrent. Peers announced by others
+// for the torrent are still stored.
+func (d *DhtNode) RemoveTorrent(infoHash [20]byte) {
+	d.Lock()
+	defer d.Unlock()
+	if t, ok := d.torrents[infoHash]; ok {
+		close(t.stop)
+		delete(d.torrents, infoHash)
+	}
+}
+
+// InfoHashes returns the info-hashes of all torrents of the node
+func (d *DhtNode) InfoHashes() [][20]byte {
+	d.Lock()
+	defer d.Unlock()
+	infoHashes := make([][20]byte, 0, len(d.torrents))
+	for ih := range d.torrents {
+		infoHashes = append(infoHashes, ih)
+	}
+	return infoHashes
+}
+
+func (d *DhtNode) stopTorrents() {
+	d.Lock()
+	defer d.Unlock()
+	for ih, t := range d.torrents {
+		close(t.stop)
+		delete(d.torrents, ih)
+	}
+}
+
+// LookupPeers looks up peers of the torrent right away instead of waiting for the next
+// interval, e.g. because the download ran out of peers. Lookups requested within
+// MinLookupInterval of the previous lookup are delayed. It returns false if the node has no
+// torrent with the info-hash.
+func (d *DhtNode) LookupPeers(infoHash [20]byte) bool {
+	d.Lock()
+	t, ok := d.torrents[infoHash]
+	d.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case t.lookup <- struct{}{}:
+	default:
+		// A lookup is pending already
+	}
+	return true
+}
+
+// retryDelay returns the delay before the next lookup after failures consecutive failed
+// lookups, doubling from the retry interval up to the announce interval
+func (d *DhtNode) retryDelay(failures int) time.Duration {
+	delay := d.retryInterval
+	for i := 1; i < failures && delay < d.announceInterval; i++ {
+		delay *= 2
+	}
+	if delay > d.announceInterval {
+		delay = d.announceInterval
+	}
+	return delay
+}
+
+// announceLoop announces the torrent every announce interval and looks up its peers. Failed
+// lookups, and lookups without peers for torrents we are not seeding, are retried with
+// exponential backoff.
+func (d *DhtNode) announceLoop(infoHash [20]byte, t *dhtTorrent) {
+	var lastAnnounce, lastLookup time.Time
+	failures := 0
+	for {
+		announce := t.peerPort != 0 && (lastAnnounce.IsZero() || time.Since(lastAnnounce) >= d.announceInterval)
+		lastLookup = time.Now()
+		found, err := d.announceAndGetPeers(infoHash, t, announce)
+		select {
+		case <-t.stop:
+			return
+		default:
+		}
+		if err != nil {
+			log.Errorf("dht lookup of %x failed: %s", infoHash, err)
+		} else if announce {
+			lastAnnounce = lastLookup
+		}
+
+		delay := d.announceInterval
+		if err != nil || (found == 0 && !t.seed) {
+			failures++
+			delay = d.retryDelay(failures)
+			log.Infof("no peers found for %x, retrying in %s", infoHash, delay)
+		} else {
+			failures = 0
+		}
+		if untilAnnounce := d.announceInterval - time.Since(lastAnnounce); untilAnnounce > 0 && untilAnnounce < delay {
+			// Lookups do not delay the next announce
+			delay = untilAnnounce
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-t.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-t.lookup:
+			timer.Stop()
+			if wait := MinLookupInterval - time.Since(lastLookup); wait > 0 {
+				select {
+				case <-t.stop:
+					return
+				case <-time.After(wait):
+				}
+			}
+			log.Infof("looking up peers of %x on demand", infoHash)
+		}
+	}
+}
+
+// announceAndGetPeers gets peers via DHT and, if announce is set, announces presence. Seeds are
+// announced separately, since the announces of the dht server can not carry the seed flag. It
+// returns the number of new peers passed to the torrent, once the lookup is done.
+func (d *DhtNode) announceAndGetPeers(infoHash [20]byte, t *dhtTorrent, announce bool) (int, error) {
+	port := 0
+	if announce {
+		log.Infof("announcing %x via dht", infoHash)
+		atomic.AddUint32(&d.stats.announcesStarted, 1)
+		port = int(t.peerPort)
+	} else {
+		log.Infof("looking up %x via dht", infoHash)
+	}
+	if announce && t.seed {
+		port = 0
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), d.announceInterval)
+			defer cancel()
+			go func() {
+				select {
+				case <-t.stop:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			if err := d.announceSeed(ctx, infoHash, t.peerPort); err != nil {
+				log.Errorf("could not announce seed of %x: %s", infoHash, err)
+			}
+		}()
+	}
+	ps, err := d.Node.Announce(infoHash, port, false)
+	if err != nil {
+		return 0, err
+	}
+	defer ps.Close()
+	done := make(chan int, 1)
+	go func() {
+		done <- d.consumePeers(infoHash, ps)
+	}()
+	select {
+	case found := <-done:
+		return found, nil
+	case <-t.stop:
+		return 0, nil
+	}
+}
+
+func convertPeer(peer dht.Peer) peers.Peer {
+	return peers.Peer{
+		Addr:  peer.String(),
+		Index: 0,
+	}
+}
+
+// consumePeers dispatches the peers found by the lookup until it is done and returns their number
+func (d *DhtNode) consumePeers(infoHash [20]byte, peerStream *dht.Announce) int {
+	log.Info("consuming peers")
+	found := 0
+	for v := range peerStream.Peers {
+		log.Infof("handling %+v", v)
+		for _, cp := range v.Peers {
+			log.Infof("handling cp %+v", cp)
+			atomic.AddUint32(&d.stats.receivedPeersWhileTraversing, 1)
+			if d.dispatchPeer(infoHash, cp) {
+				found++
+			}
+		}
+	}
+	log.Info("done consuming peers")
+	return found
+}
+
+// dispatchPeer passes a peer to the torrent with the info-hash, if the node has this torrent.
+// It returns whether the peer was passed on.
+func (d *DhtNode) dispatchPeer(infoHash [20]byte, peer krpc.NodeAddr) bool {
+	d.Lock()
+	t, ok := d.torrents[infoHash]
+	d.Unlock()
+	if !ok {
+		return false
+	}
+	if peer.Port == 0 {
+		log.Info("received zero port peer")
+		atomic.AddUint32(&d.stats.blockedPeers, 1)
+		return false
+	}
+	if peer.IP.Equal(d.nodeAddr.IP()) && peer.IA.Equal(d.nodeAddr.IA()) && peer.Port == int(t.peerPort) {
+		log.Info("received self")
+		atomic.AddUint32(&d.stats.blockedPeers, 1)
+		return false
+	}
+	t.onNewPeerReceived(convertPeer(peer))
+	return true
+}
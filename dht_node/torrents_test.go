@@ -0,0 +1,68 @@
+package dht_node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/netsys-lab/bittorrent-over-scion/peers"
+	"github.com/netsys-lab/dht"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatchPeer(t *testing.T) {
+	local, err := snet.ParseUDPAddr("19-ffaa:1:c3f,[10.0.0.1]:7000")
+	assert.Nil(t, err)
+	d := &DhtNode{
+		stats:    &dhtStats{},
+		nodeAddr: dht.NewAddr(*local),
+		torrents: make(map[[20]byte]*dhtTorrent),
+	}
+	received := make(map[[20]byte][]string)
+	for _, ih := range [][20]byte{{1}, {2}} {
+		ih := ih
+		d.torrents[ih] = &dhtTorrent{
+			peerPort: 43000,
+			onNewPeerReceived: func(peer peers.Peer) {
+				received[ih] = append(received[ih], peer.Addr)
+			},
+		}
+	}
+
+	d.dispatchPeer([20]byte{1}, testNodeAddr(t, "10.0.0.2", 43000))
+	d.dispatchPeer([20]byte{2}, testNodeAddr(t, "10.0.0.3", 43000))
+	// Unknown torrent, zero port and self are not dispatched
+	d.dispatchPeer([20]byte{3}, testNodeAddr(t, "10.0.0.4", 43000))
+	d.dispatchPeer([20]byte{1}, testNodeAddr(t, "10.0.0.5", 0))
+	d.dispatchPeer([20]byte{1}, testNodeAddr(t, "10.0.0.1", 43000))
+	// Other peers on the same host are dispatched
+	d.dispatchPeer([20]byte{1}, testNodeAddr(t, "10.0.0.1", 43001))
+
+	assert.Equal(t, []string{"19-ffaa:1:c3f,[10.0.0.2]:43000", "19-ffaa:1:c3f,[10.0.0.1]:43001"}, received[[20]byte{1}])
+	assert.Equal(t, []string{"19-ffaa:1:c3f,[10.0.0.3]:43000"}, received[[20]byte{2}])
+	assert.Equal(t, uint32(2), d.stats.blockedPeers)
+}
+
+func TestRetryDelay(t *testing.T) {
+	d := &DhtNode{
+		announceInterval: 10 * time.Minute,
+		retryInterval:    time.Minute,
+	}
+	assert.Equal(t, time.Minute, d.retryDelay(1))
+	assert.Equal(t, 2*time.Minute, d.retryDelay(2))
+	assert.Equal(t, 8*time.Minute, d.retryDelay(4))
+	// Never longer than the announce interval
+	assert.Equal(t, 10*time.Minute, d.retryDelay(5))
+	assert.Equal(t, 10*time.Minute, d.retryDelay(100))
+}
+
+func TestLookupPeers(t *testing.T) {
+	d := &DhtNode{torrents: make(map[[20]byte]*dhtTorrent)}
+	d.torrents[[20]byte{1}] = &dhtTorrent{lookup: make(chan struct{}, 1)}
+
+	assert.True(t, d.LookupPeers([20]byte{1}))
+	// Requests are merged while a lookup is pending
+	assert.True(t, d.LookupPeers([20]byte{1}))
+	assert.Equal(t, 1, len(d.torrents[[20]byte{1}].lookup))
+	assert.False(t, d.LookupPeers([20]byte{2}))
+}
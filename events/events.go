@@ -0,0 +1,103 @@
+package events
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Type is the kind of an event
+type Type string
+
+const (
+	PeerConnected    Type = "peer-connected"    // Handshake with a peer completed
+	PeerDisconnected Type = "peer-disconnected" // All paths to a peer are closed
+	PathAdded        Type = "path-added"        // Started transferring over a path to a peer
+	PathRemoved      Type = "path-removed"      // Stopped transferring over a path, Err is set if the path failed
+	PieceVerified    Type = "piece-verified"    // A downloaded piece matched its hash
+	PieceFailed      Type = "piece-failed"      // A downloaded piece did not match its hash and is downloaded again
+	Choked           Type = "choked"            // The peer choked the leecher, or the seeder choked the peer
+	Unchoked         Type = "unchoked"          // The peer unchoked the leecher, or the seeder unchoked the peer
+	Completed        Type = "completed"         // All pieces of the torrent are downloaded
+	Error            Type = "error"             // An operation failed, see Err
+)
+
+// Event is something that happened to a torrent. Fields that do not apply to the type are empty.
+type Event struct {
+	Type     Type
+	Time     time.Time
+	InfoHash [20]byte
+	Peer     string // SCION address of the peer
+	ConnId   string // Connection of the path
+	Path     string // SCION path
+	Piece    int    // Index of the piece of piece events
+	Err      error
+}
+
+// Bus delivers events to subscribers. The zero value is ready to use.
+type Bus struct {
+	mutex       sync.Mutex
+	subscribers map[chan Event]struct{}
+	closed      bool
+	dropped     uint64 // Accessed atomically
+}
+
+// Subscribe returns a channel receiving all events published from now on, buffering up to
+// buffer events. Events are dropped for subscribers with a full buffer instead of blocking the
+// transfer. cancel ends the subscription and closes the channel.
+func (b *Bus) Subscribe(buffer int) (events <-chan Event, cancel func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ch := make(chan Event, buffer)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan Event]struct{})
+	}
+	b.subscribers[ch] = struct{}{}
+	return ch, func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Publish sends the event to all subscribers, Time is set if it is zero
+func (b *Bus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			atomic.AddUint64(&b.dropped, 1)
+		}
+	}
+}
+
+// Dropped returns the number of events dropped because subscribers did not keep up
+func (b *Bus) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+// Close closes the channels of all subscribers, later events are discarded
+func (b *Bus) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for ch := range b.subscribers {
+		close(ch)
+	}
+	b.subscribers = nil
+	b.closed = true
+}
@@ -0,0 +1,42 @@
+package events
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBus(t *testing.T) {
+	var b Bus
+	first, cancelFirst := b.Subscribe(1)
+	second, _ := b.Subscribe(1)
+
+	b.Publish(Event{Type: PieceVerified, Piece: 3})
+	e := <-first
+	assert.Equal(t, PieceVerified, e.Type)
+	assert.Equal(t, 3, e.Piece)
+	assert.False(t, e.Time.IsZero())
+	assert.Equal(t, e, <-second)
+
+	// Full subscribers do not block
+	b.Publish(Event{Type: PathAdded})
+	b.Publish(Event{Type: PathRemoved, Err: errors.New("timeout")})
+	assert.Equal(t, uint64(2), b.Dropped())
+	assert.Equal(t, PathAdded, (<-first).Type)
+
+	cancelFirst()
+	_, ok := <-first
+	assert.False(t, ok)
+	cancelFirst()
+
+	b.Close()
+	assert.Equal(t, PathAdded, (<-second).Type)
+	_, ok = <-second
+	assert.False(t, ok)
+	b.Publish(Event{Type: Completed})
+
+	closed, _ := b.Subscribe(1)
+	_, ok = <-closed
+	assert.False(t, ok)
+}
@@ -0,0 +1,249 @@
+package exporter
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Record is a set of metrics that can be exported, e.g. the metrics of one connection
+type Record interface {
+	GetCsvHeader() string
+	GetCsv() string
+	GetJSON() []byte
+}
+
+// Exporter writes records to a target. Records are queued and written in batches, so Export
+// does not block on the target. Close writes the queued records.
+type Exporter interface {
+	Export(r Record)
+	Close() error
+}
+
+// sink writes a batch of records to the target of an exporter
+type sink interface {
+	write(records []Record) error
+	close() error
+}
+
+// Options configure batching and retries of an exporter
+type Options struct {
+	BatchSize     int           // Records written at once, a full batch is written right away
+	FlushInterval time.Duration // Maximum time records are queued before they are written
+	Retries       int           // Attempts to write a batch again after it failed
+	RetryInterval time.Duration // First delay before a failed batch is written again, doubling per attempt
+}
+
+// DefaultOptions returns the options used for the exporters of seeders and leechers
+func DefaultOptions() Options {
+	return Options{
+		BatchSize:     32,
+		FlushInterval: 5 * time.Second,
+		Retries:       3,
+		RetryInterval: time.Second,
+	}
+}
+
+// New returns the exporter for target, selected by its URL scheme: csv:///tmp/metrics.csv and
+// jsonl:///tmp/metrics.jsonl append lines to a file, http:// and https:// URLs and shttp:// URLs
+// of SCION hosts receive batches as JSON array, noop: or an empty target drops all records.
+// File paths without scheme are accepted if they end with .csv or .jsonl.
+func New(target string, opts Options) (Exporter, error) {
+	s, err := newSink(target)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return noop{}, nil
+	}
+	return newBatchExporter(s, opts), nil
+}
+
+func newSink(target string) (sink, error) {
+	target = strings.TrimSpace(target)
+	if target == "" {
+		return nil, nil
+	}
+	scheme, rest := "", target
+	if i := strings.Index(target, ":"); i > 0 && !strings.ContainsAny(target[:i], "/\\") {
+		scheme, rest = strings.ToLower(target[:i]), target[i+1:]
+	}
+	switch scheme {
+	case "noop", "none":
+		return nil, nil
+	case "csv":
+		return newFileSink(filePath(rest), formatCsv)
+	case "jsonl":
+		return newFileSink(filePath(rest), formatJSON)
+	case "http", "https":
+		if isSCIONURL(target) {
+			// Formerly the only way to post metrics over SCION
+			return newHTTPSink(target, true), nil
+		}
+		if _, err := url.Parse(target); err != nil {
+			return nil, err
+		}
+		return newHTTPSink(target, false), nil
+	case "shttp":
+		return newHTTPSink("http:"+rest, true), nil
+	case "":
+		switch strings.ToLower(filepath.Ext(target)) {
+		case ".csv":
+			return newFileSink(target, formatCsv)
+		case ".jsonl":
+			return newFileSink(target, formatJSON)
+		}
+	}
+	return nil, fmt.Errorf("unsupported metrics export target %q, use csv://, jsonl://, http://, https://, shttp:// or noop:", target)
+}
+
+// isSCIONURL returns whether the host of the URL is a SCION address, e.g. 19-ffaa:1:c3f,[10.0.0.1]:80
+func isSCIONURL(target string) bool {
+	host := strings.TrimPrefix(target[strings.Index(target, ":")+1:], "//")
+	if i := strings.IndexAny(host, "/?"); i >= 0 {
+		host = host[:i]
+	}
+	return strings.Contains(host, ",")
+}
+
+// filePath returns the path of csv:///tmp/m.csv or csv:m.csv
+func filePath(rest string) string {
+	return strings.TrimPrefix(rest, "//")
+}
+
+// noop drops all records
+type noop struct{}
+
+func (noop) Export(Record) {}
+
+func (noop) Close() error { return nil }
+
+// batchExporter queues records and writes them to its sink in batches
+type batchExporter struct {
+	sync.Mutex
+	sink    sink
+	opts    Options
+	pending []Record
+	closed  bool
+	flush   chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newBatchExporter(s sink, opts Options) *batchExporter {
+	defaults := DefaultOptions()
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaults.BatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaults.FlushInterval
+	}
+	if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = defaults.RetryInterval
+	}
+	e := &batchExporter{
+		sink:  s,
+		opts:  opts,
+		flush: make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *batchExporter) Export(r Record) {
+	e.Lock()
+	defer e.Unlock()
+	if e.closed {
+		log.Warn("Dropping metrics exported after the exporter was closed")
+		return
+	}
+	e.pending = append(e.pending, r)
+	if len(e.pending) >= e.opts.BatchSize {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close writes the queued records and closes the target
+func (e *batchExporter) Close() error {
+	e.Lock()
+	if e.closed {
+		e.Unlock()
+		return nil
+	}
+	e.closed = true
+	e.Unlock()
+	close(e.stop)
+	<-e.done
+	return e.sink.close()
+}
+
+func (e *batchExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.flush:
+		case <-e.stop:
+			e.writePending()
+			return
+		}
+		e.writePending()
+	}
+}
+
+// writePending writes the queued records in batches
+func (e *batchExporter) writePending() {
+	e.Lock()
+	records := e.pending
+	e.pending = nil
+	e.Unlock()
+	for len(records) > 0 {
+		n := e.opts.BatchSize
+		if n > len(records) {
+			n = len(records)
+		}
+		e.writeBatch(records[:n])
+		records = records[n:]
+	}
+}
+
+// writeBatch writes the batch, retrying with exponential backoff. Batches that still fail
+// are dropped, so that an unavailable target does not queue records forever.
+func (e *batchExporter) writeBatch(batch []Record) {
+	delay := e.opts.RetryInterval
+	for attempt := 0; ; attempt++ {
+		err := e.sink.write(batch)
+		if err == nil {
+			return
+		}
+		if attempt >= e.opts.Retries {
+			log.Errorf("Could not export %d metrics records: %s", len(batch), err)
+			return
+		}
+		log.Warnf("Exporting metrics failed, retrying in %s: %s", delay, err)
+		select {
+		case <-time.After(delay):
+		case <-e.stop:
+			// Still retry once the exporter is closed, but without waiting
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,127 @@
+package exporter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testRecord struct {
+	Id int
+}
+
+func (r testRecord) GetCsvHeader() string { return "id;" }
+
+func (r testRecord) GetCsv() string { return fmt.Sprintf("%d", r.Id) }
+
+func (r testRecord) GetJSON() []byte {
+	data, _ := json.Marshal(r)
+	return data
+}
+
+func TestNewSink(t *testing.T) {
+	dir := t.TempDir()
+	for _, target := range []string{"", "noop:", "none:"} {
+		e, err := New(target, DefaultOptions())
+		assert.Nil(t, err)
+		assert.Equal(t, noop{}, e)
+	}
+
+	s, err := newSink("csv://" + filepath.Join(dir, "a.csv"))
+	assert.Nil(t, err)
+	assert.Equal(t, formatCsv, s.(*fileSink).format)
+	s, err = newSink(filepath.Join(dir, "b.jsonl"))
+	assert.Nil(t, err)
+	assert.Equal(t, formatJSON, s.(*fileSink).format)
+
+	s, err = newSink("http://localhost:8080/metrics")
+	assert.Nil(t, err)
+	assert.Nil(t, s.(*httpSink).client.Transport)
+	// SCION hosts are reached over SCION, also with http
+	for _, target := range []string{"shttp://19-ffaa:1:c3f,[10.0.0.1]:80/metrics", "http://19-ffaa:1:c3f,141.44.25.148:80/btmetrics"} {
+		s, err = newSink(target)
+		assert.Nil(t, err)
+		assert.NotNil(t, s.(*httpSink).client.Transport)
+	}
+
+	for _, target := range []string{"ftp://host/metrics", "/tmp/metrics.txt", "csv://"} {
+		_, err = newSink(target)
+		assert.NotNil(t, err, target)
+	}
+}
+
+func TestCsvExport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.csv")
+	for run := 0; run < 2; run++ {
+		e, err := New("csv://"+path, Options{BatchSize: 2, FlushInterval: time.Hour})
+		assert.Nil(t, err)
+		for i := 1; i <= 3; i++ {
+			e.Export(testRecord{Id: run*3 + i})
+		}
+		assert.Nil(t, e.Close())
+	}
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	// The header is only written to new files
+	assert.Equal(t, "id;\n1\n2\n3\n4\n5\n6\n", string(data))
+}
+
+func TestHTTPExport(t *testing.T) {
+	var lock sync.Mutex
+	batches := make([][]testRecord, 0)
+	failures := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []testRecord
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&batch))
+		batches = append(batches, batch)
+	}))
+	defer srv.Close()
+
+	e, err := New(srv.URL, Options{BatchSize: 2, FlushInterval: time.Hour, Retries: 1, RetryInterval: time.Millisecond})
+	assert.Nil(t, err)
+	for i := 1; i <= 3; i++ {
+		e.Export(testRecord{Id: i})
+	}
+	assert.Nil(t, e.Close())
+	e.Export(testRecord{Id: 4})
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, [][]testRecord{{{1}, {2}}, {{3}}}, batches)
+}
+
+type failingSink struct {
+	writes int
+}
+
+func (s *failingSink) write([]Record) error {
+	s.writes++
+	return errors.New("unavailable")
+}
+
+func (s *failingSink) close() error { return nil }
+
+func TestRetries(t *testing.T) {
+	s := &failingSink{}
+	e := newBatchExporter(s, Options{BatchSize: 1, FlushInterval: time.Hour, Retries: 2, RetryInterval: time.Millisecond})
+	e.Export(testRecord{Id: 1})
+	assert.Nil(t, e.Close())
+	// The failed batch is dropped after the retries
+	assert.Equal(t, 3, s.writes)
+}
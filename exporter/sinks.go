@@ -0,0 +1,122 @@
+package exporter
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/pkg/shttp"
+)
+
+type fileFormat int
+
+const (
+	formatCsv fileFormat = iota
+	formatJSON
+)
+
+// fileSink appends records to a file, csv files start with the header of the first record
+type fileSink struct {
+	path   string
+	format fileFormat
+	file   *os.File
+	header bool // The file has a header or needs none
+}
+
+func newFileSink(path string, format fileFormat) (*fileSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("missing file path of metrics export target")
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileSink{
+		path:   path,
+		format: format,
+		file:   f,
+		header: format != formatCsv || info.Size() > 0,
+	}, nil
+}
+
+func (s *fileSink) write(records []Record) error {
+	w := bufio.NewWriter(s.file)
+	header := s.header
+	for _, r := range records {
+		switch s.format {
+		case formatCsv:
+			if !header {
+				w.WriteString(r.GetCsvHeader())
+				w.WriteString("\n")
+				header = true
+			}
+			w.WriteString(r.GetCsv())
+		case formatJSON:
+			w.Write(r.GetJSON())
+		}
+		w.WriteString("\n")
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	s.header = header
+	return nil
+}
+
+func (s *fileSink) close() error {
+	return s.file.Close()
+}
+
+// httpSink posts batches of records as JSON array
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSink(url string, scion bool) *httpSink {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if scion {
+		client.Transport = shttp.DefaultTransport
+		url = shttp.MangleSCIONAddrURL(url)
+	}
+	return &httpSink{url: url, client: client}
+}
+
+func (s *httpSink) write(records []Record) error {
+	batch := make([]json.RawMessage, 0, len(records))
+	for _, r := range records {
+		batch = append(batch, r.GetJSON())
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("metrics post to %s resulted in %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s *httpSink) close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
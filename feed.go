@@ -0,0 +1,163 @@
+package main
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/anacrolix/tagflag"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/netsys-lab/bittorrent-over-scion/config"
+	"github.com/netsys-lab/bittorrent-over-scion/dht_node"
+	"github.com/netsys-lab/bittorrent-over-scion/feed"
+	"github.com/netsys-lab/bittorrent-over-scion/server"
+	"github.com/netsys-lab/bittorrent-over-scion/torrentfile"
+)
+
+var feedPublishFlags = struct {
+	KeyFile   string        `help:"File with the ed25519 key of the feed, created if it does not exist"`
+	Salt      string        `help:"Optional: Salt of the feed, to publish several feeds with the same key"`
+	Torrent   string        `help:"Torrent file of the version to publish"`
+	Local     string        `help:"Optional: Local SCION address of the dht node used to publish, of format ISD-AS,[IP]:Port. Per default the local host on a random port"`
+	Bootstrap string        `help:"Semicolon separated SCION addresses of dht nodes to join"`
+	Seq       int64         `help:"Optional: Sequence number of the version. Per default one more than the sequence number found in the dht"`
+	Timeout   time.Duration `help:"Optional: Time to look for the nodes to store the feed on"`
+	LogLevel  string        `help:"Optional: Change log level"`
+}{
+	Seq:      -1,
+	Timeout:  30 * time.Second,
+	LogLevel: "WARN",
+}
+
+var feedFollowFlags = struct {
+	PublicKey string        `help:"Hex encoded public key of the feed"`
+	Salt      string        `help:"Optional: Salt of the feed"`
+	Dir       string        `help:"Directory the versions are downloaded to"`
+	Local     string        `help:"Local SCION address to download and seed from, of format ISD-AS,[IP]:Port"`
+	Bootstrap string        `help:"Semicolon separated SCION addresses of dht nodes to join"`
+	DhtPort   int           `help:"Optional: Port of the dht node"`
+	Interval  time.Duration `help:"Optional: Interval in which the feed is checked for new versions"`
+	LogLevel  string        `help:"Optional: Change log level"`
+}{
+	DhtPort:  int(config.DefaultPeerDisoveryConfig().DhtPort),
+	Interval: feed.DefaultInterval,
+	LogLevel: "INFO",
+}
+
+// runFeedCommand runs the publish and follow subcommands of update feeds
+func runFeedCommand(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "publish":
+			runFeedPublishCommand(args[1:])
+			return
+		case "follow":
+			runFeedFollowCommand(args[1:])
+			return
+		}
+	}
+	fmt.Fprintln(os.Stderr, "usage: bittorrent-over-scion feed publish|follow [flags]")
+	os.Exit(2)
+}
+
+// runFeedPublishCommand points the feed of the key to the torrent
+func runFeedPublishCommand(args []string) {
+	tagflag.ParseArgs(&feedPublishFlags, args, tagflag.Program("bittorrent-over-scion feed publish"))
+	setLogging(feedPublishFlags.LogLevel)
+	if feedPublishFlags.KeyFile == "" || feedPublishFlags.Torrent == "" {
+		log.Fatal("keyFile and torrent are required")
+	}
+
+	tf, err := torrentfile.Open(feedPublishFlags.Torrent)
+	if err != nil {
+		log.Fatal(err)
+	}
+	key, err := dht_node.LoadOrCreateKey(feedPublishFlags.KeyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	node := startItemNode(feedPublishFlags.Local, feedPublishFlags.Bootstrap)
+	defer node.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), feedPublishFlags.Timeout)
+	defer cancel()
+
+	salt := []byte(feedPublishFlags.Salt)
+	seq := feedPublishFlags.Seq
+	if seq < 0 {
+		seq = nextSeq(ctx, node, key, salt)
+	}
+	item, err := dht_node.NewMutableItem(feed.Value(tf.InfoHash), salt, seq, key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	target, stored, err := node.Put(ctx, item)
+	if err != nil {
+		log.Fatalf("Could not publish feed %x: %s", target, err)
+	}
+	fmt.Printf("public key: %x\n", []byte(item.K))
+	fmt.Printf("info-hash: %x\n", tf.InfoHash)
+	fmt.Printf("seq: %d\n", item.Seq)
+	fmt.Printf("stored on %d nodes\n", stored)
+}
+
+// runFeedFollowCommand downloads every new version of the feed and seeds the latest one
+// until it is interrupted
+func runFeedFollowCommand(args []string) {
+	tagflag.ParseArgs(&feedFollowFlags, args, tagflag.Program("bittorrent-over-scion feed follow"))
+	setLogging(feedFollowFlags.LogLevel)
+	if feedFollowFlags.Dir == "" || feedFollowFlags.Local == "" {
+		log.Fatal("dir and local are required")
+	}
+	publicKey, err := hex.DecodeString(feedFollowFlags.PublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		log.Fatal("invalid publicKey")
+	}
+
+	pc := config.DefaultPeerDisoveryConfig()
+	pc.EnableDht = true
+	pc.DhtPort = uint16(feedFollowFlags.DhtPort)
+	pc.DhtNodes, err = parseDhtNodes(feedFollowFlags.Bootstrap)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	nodeAddr, err := dhtLocalAddr("", feedFollowFlags.DhtPort)
+	if err != nil {
+		log.Fatal(err)
+	}
+	node, err := dht_node.NewNode(nodeAddr, dht_node.NodeConfig{
+		StateDir:      pc.DhtNodeStateDir(),
+		StartingNodes: pc.DhtNodes,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer node.Close()
+
+	follower, err := feed.NewFollower(feed.Config{
+		PublicKey:       publicKey,
+		Salt:            []byte(feedFollowFlags.Salt),
+		Interval:        feedFollowFlags.Interval,
+		Dir:             feedFollowFlags.Dir,
+		DhtNode:         node,
+		DiscoveryConfig: &pc,
+		Server: server.ServerConfig{
+			LAddr:                       feedFollowFlags.Local,
+			PathSelectionResponsibility: "server",
+			DialBackPort:                45000,
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	follower.Run(signalContext(defaultShutdownTimeout))
+}
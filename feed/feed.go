@@ -0,0 +1,318 @@
+package feed
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/netsys-lab/bittorrent-over-scion/config"
+	"github.com/netsys-lab/bittorrent-over-scion/dht_node"
+	"github.com/netsys-lab/bittorrent-over-scion/peers"
+	"github.com/netsys-lab/bittorrent-over-scion/server"
+	"github.com/netsys-lab/bittorrent-over-scion/torrentfile"
+)
+
+// DefaultInterval is the default interval in which the feed is resolved
+const DefaultInterval = 10 * time.Minute
+
+// PeerTimeout is the time to wait for peers of a new version
+const PeerTimeout = time.Minute
+
+// stateFile keeps the version of the feed in the download directory across restarts
+const stateFile = ".feed.json"
+
+// Value returns the value of a feed item pointing to the torrent, as specified in BEP46
+func Value(infoHash [20]byte) map[string]interface{} {
+	return map[string]interface{}{
+		"ih": string(infoHash[:]),
+	}
+}
+
+// ParseValue returns the info-hash of the value of a feed item
+func ParseValue(v interface{}) ([20]byte, error) {
+	var infoHash [20]byte
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return infoHash, errors.New("feed value is not a dictionary")
+	}
+	ih, ok := d["ih"].(string)
+	if !ok || len(ih) != len(infoHash) {
+		return infoHash, errors.New("feed value contains no valid info-hash")
+	}
+	copy(infoHash[:], ih)
+	return infoHash, nil
+}
+
+// Config configures a Follower
+type Config struct {
+	PublicKey       ed25519.PublicKey                 // Key the feed is published with
+	Salt            []byte                            // Optional: Salt of the feed, to follow one of several feeds of a key
+	Interval        time.Duration                     // Optional: Interval in which the feed is resolved, defaults to DefaultInterval
+	Dir             string                            // Directory the versions are written to
+	DhtNode         *dht_node.DhtNode                 // Resolves the feed, finds peers and announces the seeded version
+	DiscoveryConfig *config.PeerDiscoveryConfig       // Peer discovery of downloads and the seeder, the dht must be enabled
+	Server          server.ServerConfig               // Seeder of the latest version, LAddr is also used to download. The torrent and the dht are set by the follower
+	Download        func(tf *torrentfile.TorrentFile) // Optional: Called before a version is downloaded, e.g. to set path selection options
+}
+
+type state struct {
+	Seq      int64  `json:"seq"`
+	InfoHash string `json:"infoHash"`
+	File     string `json:"file"`
+	Metadata []byte `json:"metadata,omitempty"` // Info dictionary of the version, to seed it again after a restart
+}
+
+// errOutdated is returned for feed items that are not newer than the saved version
+var errOutdated = errors.New("feed item is not newer than the saved version")
+
+// Follower follows a feed, downloads every new version it points to and seeds the latest one
+type Follower struct {
+	conf       Config
+	current    *torrentfile.TorrentFile
+	state      state
+	server     *server.Server
+	stopServer context.CancelFunc
+	serverDone chan struct{} // Closed once the seeder disconnected its leechers
+}
+
+// NewFollower creates a follower, continuing with the version of the last run in the directory
+func NewFollower(conf Config) (*Follower, error) {
+	if conf.DhtNode == nil || conf.DiscoveryConfig == nil || !conf.DiscoveryConfig.EnableDht {
+		return nil, errors.New("following a feed requires the dht")
+	}
+	if len(conf.PublicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key")
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = DefaultInterval
+	}
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	f := &Follower{conf: conf}
+	data, err := ioutil.ReadFile(filepath.Join(conf.Dir, stateFile))
+	if err == nil {
+		err = json.Unmarshal(data, &f.state)
+	} else if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not load the feed state of %s: %w", conf.Dir, err)
+	}
+	return f, nil
+}
+
+// Run resolves the feed every interval and downloads and seeds new versions until the context
+// is done
+func (f *Follower) Run(ctx context.Context) {
+	defer f.Close()
+	ticker := time.NewTicker(f.conf.Interval)
+	defer ticker.Stop()
+	for {
+		if err := f.Update(ctx); err != nil && ctx.Err() == nil {
+			log.Errorf("Could not update feed %x: %s", []byte(f.conf.PublicKey), err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Update resolves the feed once and, if it points to a new version, downloads and seeds it.
+// Resolving the feed and finding peers time out, the download runs until it completes or the
+// context is done.
+func (f *Follower) Update(ctx context.Context) error {
+	target := dht_node.MutableTarget(f.conf.PublicKey, f.conf.Salt)
+	getCtx, cancel := context.WithTimeout(ctx, f.conf.Interval)
+	item, err := f.conf.DhtNode.Get(getCtx, target)
+	cancel()
+	if err != nil {
+		return err
+	}
+	if !item.Mutable() {
+		return errors.New("feed item is not signed")
+	}
+	infoHash, err := ParseValue(item.V)
+	if err != nil {
+		return err
+	}
+	saved, err := f.checkItem(item.Seq, infoHash)
+	if err != nil {
+		return err
+	}
+	if saved && f.current == nil {
+		// After a restart, the saved version is seeded from the file on disk
+		tf, err := f.loadSaved()
+		if err != nil {
+			// The download reuses the pieces of the file, if any
+			log.Warnf("Could not load version %d of feed %x, downloading it again: %s", f.state.Seq, target, err)
+			saved = false
+		} else {
+			if err := f.seed(&tf); err != nil {
+				return err
+			}
+			log.Infof("Seeding version %d of feed %x from %s", f.state.Seq, target, f.conf.Dir)
+			f.current = &tf
+		}
+	}
+	if saved {
+		if item.Seq == f.state.Seq {
+			log.Debugf("Feed %x is at version %d", target, f.state.Seq)
+			return nil
+		}
+		f.state.Seq = item.Seq
+		return f.saveState()
+	}
+	log.Infof("Feed %x points to %x (version %d)", target, infoHash, item.Seq)
+
+	findCtx, cancel := context.WithTimeout(ctx, PeerTimeout)
+	tf, peer, err := torrentfile.FindMetadata(findCtx, infoHash, nil, f.conf.DhtNode, f.conf.Server.LAddr, f.conf.DiscoveryConfig)
+	cancel()
+	if err != nil {
+		return err
+	}
+	if err := f.download(ctx, &tf, peer); err != nil {
+		return err
+	}
+
+	if err := f.seed(&tf); err != nil {
+		return err
+	}
+
+	metadata, err := tf.Metadata()
+	if err != nil {
+		return err
+	}
+	f.current = &tf
+	f.state = state{
+		Seq:      item.Seq,
+		InfoHash: hex.EncodeToString(infoHash[:]),
+		File:     tf.Name,
+		Metadata: metadata,
+	}
+	return f.saveState()
+}
+
+// checkItem returns true if the feed item points to the saved version. Items older than the
+// saved version, and items of the saved version pointing to another torrent, are rejected, so
+// that nodes replaying old items can not roll the follower back.
+func (f *Follower) checkItem(seq int64, infoHash [20]byte) (bool, error) {
+	if f.state.InfoHash == "" {
+		return false, nil
+	}
+	if seq < f.state.Seq || (seq == f.state.Seq && f.state.InfoHash != hex.EncodeToString(infoHash[:])) {
+		return false, fmt.Errorf("%w: got version %d, saved %d", errOutdated, seq, f.state.Seq)
+	}
+	return f.state.InfoHash == hex.EncodeToString(infoHash[:]), nil
+}
+
+// loadSaved returns the torrent of the saved version with the content of its file
+func (f *Follower) loadSaved() (torrentfile.TorrentFile, error) {
+	var infoHash [20]byte
+	if _, err := hex.Decode(infoHash[:], []byte(f.state.InfoHash)); err != nil {
+		return torrentfile.TorrentFile{}, err
+	}
+	tf, err := torrentfile.FromMetadata(infoHash, f.state.Metadata)
+	if err != nil {
+		return torrentfile.TorrentFile{}, err
+	}
+	tf.Content, err = ioutil.ReadFile(filepath.Join(f.conf.Dir, filepath.Base(f.state.File)))
+	if err != nil {
+		return torrentfile.TorrentFile{}, err
+	}
+	if len(tf.Content) != tf.Length {
+		return torrentfile.TorrentFile{}, fmt.Errorf("%s has %d instead of %d bytes", f.state.File, len(tf.Content), tf.Length)
+	}
+	return tf, nil
+}
+
+// seed starts seeding the version, or switches the running seeder to it
+func (f *Follower) seed(tf *torrentfile.TorrentFile) error {
+	if f.server != nil {
+		f.server.SetTorrent(tf)
+		return nil
+	}
+	conf := f.conf.Server
+	conf.TorrentFile = tf
+	conf.DiscoveryConfig = f.conf.DiscoveryConfig
+	conf.DhtNode = f.conf.DhtNode
+	s, err := server.NewServer(&conf)
+	if err != nil {
+		return err
+	}
+	f.server = s
+	// The seeder outlives the update until the follower is closed
+	var serverCtx context.Context
+	serverCtx, f.stopServer = context.WithCancel(context.Background())
+	f.serverDone = make(chan struct{})
+	go func(done chan struct{}) {
+		defer close(done)
+		if err := s.ListenHandshake(serverCtx); err != nil && serverCtx.Err() == nil {
+			log.Errorf("Seeder of feed %x failed: %s", dht_node.MutableTarget(f.conf.PublicKey, f.conf.Salt), err)
+		}
+	}(f.serverDone)
+	return nil
+}
+
+// download downloads the version into the directory, reusing the pieces of the previous version
+func (f *Follower) download(ctx context.Context, tf *torrentfile.TorrentFile, peer peers.Peer) error {
+	if f.current != nil {
+		tf.Previous = f.current.Content
+	} else if f.state.File != "" {
+		previous, err := ioutil.ReadFile(filepath.Join(f.conf.Dir, filepath.Base(f.state.File)))
+		if err == nil {
+			tf.Previous = previous
+		}
+	}
+	tf.DhtNode = f.conf.DhtNode
+	if f.conf.Download != nil {
+		f.conf.Download(tf)
+	}
+
+	path := filepath.Join(f.conf.Dir, filepath.Base(tf.Name))
+	_, err := tf.DownloadToFile(ctx, path, torrentfile.DownloadOptions{
+		Peer:            peer.Addr,
+		Local:           f.conf.Server.LAddr,
+		DiscoveryConfig: f.conf.DiscoveryConfig,
+	})
+	if err != nil {
+		return err
+	}
+	tf.Previous = nil
+	tf.Content, err = ioutil.ReadFile(path)
+	return err
+}
+
+// Close stops seeding the latest version, after the leechers are disconnected
+func (f *Follower) Close() {
+	if f.server == nil {
+		return
+	}
+	f.stopServer()
+	<-f.serverDone
+	f.server.Close()
+	f.server = nil
+}
+
+func (f *Follower) saveState() error {
+	data, err := json.MarshalIndent(f.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(f.conf.Dir, stateFile), data, 0644)
+}
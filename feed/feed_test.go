@@ -0,0 +1,98 @@
+package feed
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsys-lab/bittorrent-over-scion/torrentfile"
+)
+
+func TestValue(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+	// The value is stored bencoded in the dht and decoded by the followers
+	b, err := bencode.Marshal(Value(infoHash))
+	require.NoError(t, err)
+	var v interface{}
+	require.NoError(t, bencode.Unmarshal(b, &v))
+
+	parsed, err := ParseValue(v)
+	require.NoError(t, err)
+	assert.Equal(t, infoHash, parsed)
+
+	_, err = ParseValue("not a dict")
+	assert.Error(t, err)
+	_, err = ParseValue(map[string]interface{}{"ih": "short"})
+	assert.Error(t, err)
+	_, err = ParseValue(map[string]interface{}{})
+	assert.Error(t, err)
+}
+
+func TestCheckItem(t *testing.T) {
+	saved := [20]byte{1}
+	other := [20]byte{2}
+	f := &Follower{}
+	isSaved, err := f.checkItem(1, other)
+	require.NoError(t, err)
+	assert.False(t, isSaved, "the first version is always new")
+
+	// Restarted followers have no current version, but the saved state
+	f.state = state{Seq: 5, InfoHash: hex.EncodeToString(saved[:])}
+	for _, item := range []struct {
+		seq      int64
+		infoHash [20]byte
+		saved    bool
+		outdated bool
+	}{
+		{5, saved, true, false},
+		{6, saved, true, false},
+		{6, other, false, false},
+		{5, other, false, true},
+		{4, other, false, true},
+		{4, saved, false, true},
+	} {
+		isSaved, err := f.checkItem(item.seq, item.infoHash)
+		assert.Equal(t, item.outdated, errors.Is(err, errOutdated), item)
+		assert.Equal(t, item.saved, isSaved, item)
+	}
+}
+
+func TestLoadSaved(t *testing.T) {
+	content := []byte("version")
+	tf := torrentfile.TorrentFile{
+		PieceHashes: [][20]byte{sha1.Sum(content)},
+		PieceLength: 16,
+		Length:      len(content),
+		Name:        "version.txt",
+	}
+	metadata, err := tf.Metadata()
+	require.NoError(t, err)
+	infoHash := sha1.Sum(metadata)
+
+	dir := t.TempDir()
+	f := &Follower{
+		conf:  Config{Dir: dir},
+		state: state{Seq: 1, InfoHash: hex.EncodeToString(infoHash[:]), File: tf.Name, Metadata: metadata},
+	}
+	_, err = f.loadSaved()
+	assert.Error(t, err, "the file is missing")
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, tf.Name), content, 0644))
+	loaded, err := f.loadSaved()
+	require.NoError(t, err)
+	assert.Equal(t, infoHash, loaded.InfoHash)
+	assert.Equal(t, content, loaded.Content)
+
+	// States of older versions have no metadata, the version is downloaded again
+	f.state.Metadata = nil
+	_, err = f.loadSaved()
+	assert.Error(t, err)
+}
@@ -11,10 +11,13 @@ require (
 	github.com/anacrolix/torrent v1.30.2
 	github.com/jackpal/bencode-go v1.0.0
 	github.com/lucas-clemente/quic-go v0.21.1
+	github.com/mattn/go-isatty v0.0.12
 	github.com/netsec-ethz/scion-apps v0.3.1-0.20210924130723-be84cbd98c1f
 	github.com/netsys-lab/dht v0.1.18
 	github.com/netsys-lab/scion-path-discovery v1.0.1
+	github.com/pelletier/go-toml v1.9.3
 	github.com/phayes/freeport v0.0.0-20180830031419-95f893ade6f2
+	github.com/prometheus/client_golang v1.11.0
 	github.com/scionproto/scion v0.6.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/testify v1.7.0
@@ -55,16 +58,13 @@ require (
 	github.com/marten-seemann/qtls-go1-16 v0.1.3 // indirect
 	github.com/marten-seemann/qtls-go1-17 v0.1.0-beta.1.2 // indirect
 	github.com/mattn/go-colorable v0.1.6 // indirect
-	github.com/mattn/go-isatty v0.0.12 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/netsec-ethz/rains v0.2.0 // indirect
 	github.com/netsys-lab/scion-optimized-connection v0.4.2-0.20220107124242-cc4b4825db7f // indirect
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/opentracing/opentracing-go v1.2.0 // indirect
-	github.com/pelletier/go-toml v1.9.3 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/prometheus/client_golang v1.11.0 // indirect
 	github.com/prometheus/client_model v0.2.0 // indirect
 	github.com/prometheus/common v0.29.0 // indirect
 	github.com/prometheus/procfs v0.6.0 // indirect
@@ -0,0 +1,171 @@
+package main
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/anacrolix/tagflag"
+	"github.com/netsys-lab/dht"
+	"github.com/netsys-lab/dht/krpc"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/netsys-lab/bittorrent-over-scion/dht_node"
+)
+
+var putFlags = struct {
+	Local     string        `help:"Optional: Local SCION address of the dht node used to publish, of format ISD-AS,[IP]:Port. Per default the local host on a random port"`
+	Bootstrap string        `help:"Semicolon separated SCION addresses of dht nodes to join"`
+	Value     string        `help:"Value to publish, stored as string"`
+	KeyFile   string        `help:"Optional: File with the ed25519 key of a mutable item, created if it does not exist. Without key file, an immutable item is published"`
+	Salt      string        `help:"Optional: Salt of the mutable item, to publish several items with the same key"`
+	Seq       int64         `help:"Optional: Sequence number of the mutable item. Per default one more than the sequence number found in the dht"`
+	Timeout   time.Duration `help:"Optional: Time to look for the nodes to store the item on"`
+	LogLevel  string        `help:"Optional: Change log level"`
+}{
+	Seq:      -1,
+	Timeout:  30 * time.Second,
+	LogLevel: "WARN",
+}
+
+var getFlags = struct {
+	Local     string        `help:"Optional: Local SCION address of the dht node used to look up, of format ISD-AS,[IP]:Port. Per default the local host on a random port"`
+	Bootstrap string        `help:"Semicolon separated SCION addresses of dht nodes to join"`
+	Target    string        `help:"Hex encoded target of the item, as printed by put"`
+	PublicKey string        `help:"Optional: Hex encoded public key of a mutable item, instead of the target"`
+	Salt      string        `help:"Optional: Salt of the mutable item, used together with publicKey"`
+	Timeout   time.Duration `help:"Optional: Time to look for the item"`
+	LogLevel  string        `help:"Optional: Change log level"`
+}{
+	Timeout:  30 * time.Second,
+	LogLevel: "WARN",
+}
+
+// startItemNode starts a dht node that only lives for a single command, like put or get.
+// The node joins the bootstrap nodes and the additional nodes.
+func startItemNode(local, bootstrap string, nodes ...dht.Addr) *dht_node.DhtNode {
+	nodeAddr, err := dhtLocalAddr(local, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	startingNodes, err := parseDhtNodes(bootstrap)
+	if err != nil {
+		log.Fatal(err)
+	}
+	startingNodes = append(startingNodes, nodes...)
+	if len(startingNodes) == 0 {
+		log.Fatal("bootstrap is required")
+	}
+	node, err := dht_node.NewNode(nodeAddr, dht_node.NodeConfig{StartingNodes: startingNodes})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return node
+}
+
+// nextSeq returns one more than the sequence number of the mutable item of the key and salt
+// found in the dht, or 0 if there is none
+func nextSeq(ctx context.Context, node *dht_node.DhtNode, key ed25519.PrivateKey, salt []byte) int64 {
+	current, err := node.Get(ctx, dht_node.MutableTarget(key.Public().(ed25519.PublicKey), salt))
+	if errors.Is(err, dht_node.ErrItemNotFound) {
+		return 0
+	}
+	if err != nil {
+		log.Fatalf("Could not get the current sequence number: %s", err)
+	}
+	return current.Seq + 1
+}
+
+// runPutCommand publishes an immutable item or, with key file, a signed mutable item
+func runPutCommand(args []string) {
+	tagflag.ParseArgs(&putFlags, args, tagflag.Program("bittorrent-over-scion put"))
+	setLogging(putFlags.LogLevel)
+	if putFlags.Value == "" {
+		log.Fatal("value is required")
+	}
+
+	node := startItemNode(putFlags.Local, putFlags.Bootstrap)
+	defer node.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), putFlags.Timeout)
+	defer cancel()
+
+	var item *dht_node.Item
+	var err error
+	if putFlags.KeyFile == "" {
+		item, err = dht_node.NewImmutableItem(putFlags.Value)
+	} else {
+		var key ed25519.PrivateKey
+		key, err = dht_node.LoadOrCreateKey(putFlags.KeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		seq := putFlags.Seq
+		if seq < 0 {
+			seq = nextSeq(ctx, node, key, []byte(putFlags.Salt))
+		}
+		item, err = dht_node.NewMutableItem(putFlags.Value, []byte(putFlags.Salt), seq, key)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	target, stored, err := node.Put(ctx, item)
+	if err != nil {
+		log.Fatalf("Could not put item %x: %s", target, err)
+	}
+	fmt.Printf("target: %x\n", target)
+	if item.Mutable() {
+		fmt.Printf("public key: %x\n", []byte(item.K))
+		fmt.Printf("seq: %d\n", item.Seq)
+	}
+	fmt.Printf("stored on %d nodes\n", stored)
+}
+
+// runGetCommand looks up an item and prints its value
+func runGetCommand(args []string) {
+	tagflag.ParseArgs(&getFlags, args, tagflag.Program("bittorrent-over-scion get"))
+	setLogging(getFlags.LogLevel)
+
+	var target krpc.ID
+	switch {
+	case getFlags.PublicKey != "":
+		k, err := hex.DecodeString(getFlags.PublicKey)
+		if err != nil || len(k) != ed25519.PublicKeySize {
+			log.Fatal("invalid publicKey")
+		}
+		target = dht_node.MutableTarget(k, []byte(getFlags.Salt))
+	case getFlags.Target != "":
+		t, err := hex.DecodeString(getFlags.Target)
+		if err != nil || len(t) != len(target) {
+			log.Fatal("invalid target")
+		}
+		copy(target[:], t)
+	default:
+		log.Fatal("target or publicKey is required")
+	}
+
+	node := startItemNode(getFlags.Local, getFlags.Bootstrap)
+	defer node.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), getFlags.Timeout)
+	defer cancel()
+
+	item, err := node.Get(ctx, target)
+	if err != nil {
+		log.Fatalf("Could not get item %x: %s", target, err)
+	}
+	if item.Mutable() {
+		fmt.Printf("public key: %x\n", []byte(item.K))
+		fmt.Printf("seq: %d\n", item.Seq)
+	}
+	if v, ok := item.V.(string); ok {
+		fmt.Println(v)
+	} else {
+		fmt.Printf("%v\n", item.V)
+	}
+}
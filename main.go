@@ -4,40 +4,68 @@ package main
 // SPDX-License-Identifier: GPL-3.0-only
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
+	"os"
+	"time"
 
 	"github.com/anacrolix/tagflag"
-	"github.com/netsys-lab/dht"
-	"github.com/scionproto/scion/go/lib/snet"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/netsys-lab/bittorrent-over-scion/config"
+	"github.com/netsys-lab/bittorrent-over-scion/dht_node"
+	"github.com/netsys-lab/bittorrent-over-scion/monitoring"
+	"github.com/netsys-lab/bittorrent-over-scion/p2p"
+	"github.com/netsys-lab/bittorrent-over-scion/pathselection"
+	"github.com/netsys-lab/bittorrent-over-scion/progress"
 	"github.com/netsys-lab/bittorrent-over-scion/server"
 	"github.com/netsys-lab/bittorrent-over-scion/torrentfile"
 )
 
 var flags = struct {
-	InPath            string `help:"Path to torrent file that should be processed"`
-	OutPath           string `help:"Path where BitTorrent writes the downloaded file"`
-	Peer              string `help:"Remote SCION address"`
-	Seed              bool   `help:"Start BitTorrent in Seeder mode"`
-	File              string `help:"Load the file to which the torrent of InPath refers. Only required if seed=true"`
-	Local             string `help:"Local SCION address of the seeder"`
-	NumPaths          int    `help:"Optional: Limit the number of paths the seeder uses to upload to each leecher. Per default 0, meaning the seeder aims to distribute paths in a fair manner to all leechers"`
-	DialBackStartPort int    `help:"Optional: Start port of the connections the seeder uses to dial back to the leecher."`
-	LogLevel          string `help:"Optional: Change log level"`
-	EnableDht         bool   `help:"Optional: Run a dht network to announce peers"`
-	DhtPort           int    `help:"Optional: Configure the port to run the dht network"`
-	DhtBootstrapAddr  string `help:"Optional: SCION address of the dht network"`
-	PrintMetrics      bool   `help:"Optional: Display per-path metrics at the end of the download. Only for seed=false"`
-	ExportMetricsTo   string `help:"Optional: Export per-path metrics to a particular target, at the moment a csv file (e.g. /tmp/metrics.csv)"`
+	InPath              string        `help:"Path to torrent file that should be processed"`
+	OutPath             string        `help:"Path where BitTorrent writes the downloaded file"`
+	Peer                string        `help:"Remote SCION address"`
+	Seed                bool          `help:"Start BitTorrent in Seeder mode"`
+	File                string        `help:"Load the file to which the torrent of InPath refers. Only required if seed=true"`
+	Local               string        `help:"Local SCION address of the seeder"`
+	NumPaths            int           `help:"Optional: Limit the number of paths the seeder uses to upload to each leecher. Per default 0, meaning the seeder aims to distribute paths in a fair manner to all leechers"`
+	DialBackStartPort   int           `help:"Optional: Start port of the connections the seeder uses to dial back to the leecher."`
+	LogLevel            string        `help:"Optional: Change log level"`
+	EnableDht           bool          `help:"Optional: Run a dht network to announce peers"`
+	DhtPort             int           `help:"Optional: Configure the port to run the dht network"`
+	DhtBootstrapAddr    string        `help:"Optional: Semicolon separated SCION addresses of dht nodes to join"`
+	DhtStateDir         string        `help:"Optional: Directory in which the dht node id and routing table are kept across restarts. Set to empty to disable"`
+	PrintMetrics        bool          `help:"Optional: Display per-path metrics at the end of the download. Only for seed=false"`
+	ExportMetricsTo     string        `help:"Optional: Export per-path metrics of uploads or downloads to a target selected by its scheme: csv:///tmp/metrics.csv, jsonl:///tmp/metrics.jsonl, http(s)://host/path, shttp://ISD-AS,[IP]:Port/path or noop:. Disabled if empty"`
+	PathPolicy          string        `help:"Optional: Policy to select paths to peers: shortest, latency, bandwidth, disjoint, roundrobin or random"`
+	PathAllow           string        `help:"Optional: Comma separated ISDs (17), ASes (17-ffaa:0:1101) or interfaces (17-ffaa:0:1101#2) paths may exclusively traverse"`
+	PathDeny            string        `help:"Optional: Comma separated ISDs (17), ASes (17-ffaa:0:1101) or interfaces (17-ffaa:0:1101#2) paths must never traverse"`
+	RebalancePaths      bool          `help:"Optional: Replace paths that perform consistently worse than the other paths to a leecher during the upload. Only for seed=true"`
+	PathAllocation      string        `help:"Optional: How the seeder weights leechers competing for disjoint paths: equal, priority, remaining or bandwidth. Only for seed=true"`
+	PeerPriorities      string        `help:"Optional: Semicolon separated peer=priority pairs for pathAllocation=priority, peer is an ISD-AS, ISD-AS,IP or full address (e.g. 19-ffaa:1:c3f=10)"`
+	PathHistory         string        `help:"Optional: File in which the quality of used paths is recorded to prefer good paths in future transfers. Set to empty to disable"`
+	DhtAnnounceInterval time.Duration `help:"Optional: Interval in which the torrent is announced and its peers are looked up via the dht"`
+	DhtRetryInterval    time.Duration `help:"Optional: First delay before a dht lookup that failed or found no peers is retried, doubling up to dhtAnnounceInterval"`
+	DhtReadOnly         bool          `help:"Optional: Only look up peers via the dht, without announcing the torrent or answering other nodes. Only for seed=false"`
+	MetricsAddr         string        `help:"Optional: Address to serve Prometheus metrics at /metrics, e.g. :9100. Disabled if empty"`
+	Ui                  bool          `help:"Optional: Show the progress of the download in a live view, or in periodic log lines if stdout is not a terminal. Only for seed=false"`
+	ShutdownTimeout     time.Duration `help:"Optional: Time to disconnect peers and write the partial download and metrics after SIGINT or SIGTERM before exiting anyway. A second signal exits immediately"`
+	Config              string        `help:"Optional: Config file in TOML format, per default $BTSCION_CONFIG. Flags override its settings"`
 }{
-	Seed:              false,
-	NumPaths:          0,
-	DialBackStartPort: 45000,
-	LogLevel:          "INFO",
-	PrintMetrics:      false,
-	ExportMetricsTo:   "http://19-ffaa:1:c3f,141.44.25.148:80/btmetrics",
+	Seed:                false,
+	NumPaths:            0,
+	DialBackStartPort:   45000,
+	LogLevel:            "INFO",
+	PrintMetrics:        false,
+	Ui:                  true,
+	PathPolicy:          pathselection.DefaultPathPolicy,
+	PathHistory:         pathselection.DefaultPathHistoryFile(),
+	DhtStateDir:         config.DefaultPeerDisoveryConfig().DhtStateDir,
+	DhtAnnounceInterval: dht_node.DefaultAnnounceInterval,
+	DhtRetryInterval:    dht_node.DefaultRetryInterval,
+	ShutdownTimeout:     defaultShutdownTimeout,
 }
 
 func setLogging(loglevel string) {
@@ -65,27 +93,105 @@ func setLogging(loglevel string) {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "paths":
+			runPathsCommand(os.Args[2:])
+			return
+		case "dht":
+			runDhtCommand(os.Args[2:])
+			return
+		case "put":
+			runPutCommand(os.Args[2:])
+			return
+		case "get":
+			runGetCommand(os.Args[2:])
+			return
+		case "feed":
+			runFeedCommand(os.Args[2:])
+			return
+		case "scrape":
+			runScrapeCommand(os.Args[2:])
+			return
+		case "daemon":
+			runDaemonCommand(os.Args[2:])
+			return
+		case "ctl":
+			runCtlCommand(os.Args[2:])
+			return
+		case "config":
+			runConfigCommand(os.Args[2:])
+			return
+		}
+	}
+
+	loadConfigFile(os.Args[1:], mainConfigSettings)
 	tagflag.Parse(&flags)
 	setLogging(flags.LogLevel)
 
 	log.Infof("Input %s, Output %s, Peer %s, seed %t, file %s", flags.InPath, flags.OutPath, flags.Peer, flags.Seed, flags.File)
 
+	if _, err := pathselection.NewPathPolicy(flags.PathPolicy); err != nil {
+		log.Fatal(err)
+	}
+	pathFilter, err := pathselection.NewPathFilter(flags.PathAllow, flags.PathDeny)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if pathFilter != nil {
+		log.Infof("Using path filter: %s", pathFilter)
+	}
+
+	allocationStrategy, err := pathselection.NewAllocationStrategy(flags.PathAllocation)
+	if err != nil {
+		log.Fatal(err)
+	}
+	peerPriorities, err := server.ParsePeerPriorities(flags.PeerPriorities)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var pathHistory *pathselection.PathHistory
+	if flags.PathHistory != "" {
+		pathHistory, err = pathselection.OpenPathHistory(flags.PathHistory)
+		if err != nil {
+			log.Fatalf("Could not open path history %s: %s", flags.PathHistory, err)
+		}
+	}
+
+	if flags.MetricsAddr != "" {
+		go func() {
+			if err := monitoring.Serve(flags.MetricsAddr); err != nil {
+				log.Errorf("Could not serve metrics: %s", err)
+			}
+		}()
+	}
+
 	peerDiscoveryConfig := config.DefaultPeerDisoveryConfig()
 
 	peerDiscoveryConfig.EnableDht = flags.EnableDht
-	dhtAddr, err := snet.ParseUDPAddr(flags.DhtBootstrapAddr)
-	if err == nil {
-		peerDiscoveryConfig.DhtNodes = []dht.Addr{dht.NewAddr(*dhtAddr)}
+	peerDiscoveryConfig.DhtNodes, err = parseDhtNodes(flags.DhtBootstrapAddr)
+	if err != nil {
+		log.Fatal(err)
 	}
 	if flags.DhtPort > 0 {
 		peerDiscoveryConfig.DhtPort = uint16(flags.DhtPort)
 	}
+	peerDiscoveryConfig.DhtStateDir = flags.DhtStateDir
+	peerDiscoveryConfig.DhtAnnounceInterval = flags.DhtAnnounceInterval
+	peerDiscoveryConfig.DhtRetryInterval = flags.DhtRetryInterval
+	peerDiscoveryConfig.DhtReadOnly = flags.DhtReadOnly && !flags.Seed
 
 	tf, err := torrentfile.Open(flags.InPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 	tf.PrintMetrics = flags.PrintMetrics
+	tf.ExportTarget = flags.ExportMetricsTo
+	tf.PathPolicy = flags.PathPolicy
+	tf.PathFilter = pathFilter
+	tf.PathHistory = pathHistory
+	ctx := signalContext(flags.ShutdownTimeout)
 	if flags.Seed {
 		log.Info("Loading file to RAM...")
 		tf.Content, err = ioutil.ReadFile(flags.File)
@@ -102,6 +208,15 @@ func main() {
 			DialBackPort:                flags.DialBackStartPort,
 			DiscoveryConfig:             &peerDiscoveryConfig,
 			ExportMetricsTarget:         flags.ExportMetricsTo,
+			PathPolicy:                  flags.PathPolicy,
+			PathFilter:                  pathFilter,
+			AllocationStrategy:          allocationStrategy,
+			PeerPriorities:              peerPriorities,
+			PathHistory:                 pathHistory,
+		}
+		if flags.RebalancePaths {
+			rebalanceConfig := pathselection.DefaultRebalanceConfig()
+			conf.RebalanceConfig = &rebalanceConfig
 		}
 		server, err := server.NewServer(&conf)
 		if err != nil {
@@ -110,22 +225,41 @@ func main() {
 
 		log.Info("Created Server")
 
-		err = server.ListenHandshake()
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if err != nil {
+		err = server.ListenHandshake(ctx)
+		server.Close()
+		if err != nil && !errors.Is(err, context.Canceled) {
 			log.Fatal(err)
 		}
+		log.Info("Stopped seeder")
 	} else {
-		t, err := tf.DownloadToFile(flags.OutPath, flags.Peer, flags.Local, "server", &peerDiscoveryConfig)
-		if err != nil {
-			log.Fatal(err)
+		// Continue from the pieces of an interrupted download
+		if previous := tf.ReadPrevious(flags.OutPath); previous != nil {
+			log.Infof("Resuming download to %s", flags.OutPath)
+			tf.Previous = previous
+		}
+		if flags.Ui {
+			tf.OnDownload = func(t *p2p.Torrent) func() {
+				return progress.Start(os.Stdout, t.Progress).Stop
+			}
 		}
-		if t.DhtNode != nil {
+		t, err := tf.DownloadToFile(ctx, flags.OutPath, torrentfile.DownloadOptions{
+			Peer:            flags.Peer,
+			Local:           flags.Local,
+			DiscoveryConfig: &peerDiscoveryConfig,
+		})
+		if t != nil && t.DhtNode != nil {
 			t.DhtNode.Close()
 		}
+		if errors.Is(err, p2p.ErrStopped) {
+			if err := pathHistory.Save(); err != nil {
+				log.Warnf("Could not save path history: %s", err)
+			}
+			log.Infof("Stopped download, run the same command again to resume it")
+			os.Exit(exitStopped)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 }
@@ -34,6 +34,8 @@ const (
 	MsgCancel messageID = 8
 	// MsgPort transmit port of dht node
 	MsgPort messageID = 9
+	// MsgExtended carries messages of protocol extensions as specified in BEP10
+	MsgExtended messageID = 20
 )
 
 // Message stores ID and payload of a message
@@ -103,6 +105,19 @@ func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	return len(data), nil
 }
 
+// ParseBlock parses a PIECE message and returns the index, the offset and the data of the block
+func ParseBlock(msg *Message) (int, int, []byte, error) {
+	if msg.ID != MsgPiece {
+		return 0, 0, nil, fmt.Errorf("Expected PIECE (ID %d), got ID %d", MsgPiece, msg.ID)
+	}
+	if len(msg.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("Payload too short. %d < 8", len(msg.Payload))
+	}
+	index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return index, begin, msg.Payload[8:], nil
+}
+
 // ParseHave parses a HAVE message
 func ParseHave(msg *Message) (int, error) {
 	if msg.ID != MsgHave {
@@ -197,6 +212,8 @@ func (m *Message) name() string {
 		return "Cancel"
 	case MsgPort:
 		return "Port"
+	case MsgExtended:
+		return "Extended"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
@@ -139,6 +139,27 @@ func TestParsePiece(t *testing.T) {
 	}
 }
 
+func TestParseBlock(t *testing.T) {
+	index, begin, data, err := ParseBlock(&Message{
+		ID: MsgPiece,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04, // Index
+			0x00, 0x00, 0x00, 0x02, // Begin
+			0xaa, 0xbb, 0xcc, // Block
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, index)
+	assert.Equal(t, 2, begin)
+	assert.Equal(t, []byte{0xaa, 0xbb, 0xcc}, data)
+
+	_, _, _, err = ParseBlock(&Message{ID: MsgHave, Payload: []byte{0x00, 0x00, 0x00, 0x04}})
+	assert.NotNil(t, err)
+
+	_, _, _, err = ParseBlock(&Message{ID: MsgPiece, Payload: []byte{0x00, 0x00, 0x00, 0x04, 0x00}})
+	assert.NotNil(t, err)
+}
+
 func TestParseHave(t *testing.T) {
 	tests := map[string]struct {
 		input  *Message
@@ -262,3 +283,24 @@ func TestString(t *testing.T) {
 		assert.Equal(t, test.output, s)
 	}
 }
+
+func TestFormatParseMetadata(t *testing.T) {
+	msg, err := FormatMetadata(&Metadata{Type: MetadataData, Piece: 1, TotalSize: 20000, Data: []byte("d4:name")})
+	assert.Nil(t, err)
+	assert.Equal(t, MsgExtended, msg.ID)
+	assert.Equal(t, "\x01d8:msg_typei1e5:piecei1e10:total_sizei20000ee"+"d4:name", string(msg.Payload))
+
+	m, err := ParseMetadata(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, &Metadata{Type: MetadataData, Piece: 1, TotalSize: 20000, Data: []byte("d4:name")}, m)
+
+	msg, err = FormatMetadata(&Metadata{Type: MetadataRequest, Piece: 0})
+	assert.Nil(t, err)
+	m, err = ParseMetadata(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, MetadataRequest, m.Type)
+	assert.Equal(t, 0, len(m.Data))
+
+	_, err = ParseMetadata(&Message{ID: MsgExtended, Payload: []byte{2}})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,66 @@
+package message
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+// ExtMetadata is the extended message id of metadata messages. The extension handshake of BEP10
+// is not exchanged, so both sides use this fixed id.
+const ExtMetadata = 1
+
+// MetadataPieceSize is the size of the pieces the metadata is transferred in
+const MetadataPieceSize = 16 * 1024
+
+const (
+	// MetadataRequest requests a piece of the metadata
+	MetadataRequest = 0
+	// MetadataData delivers a piece of the metadata
+	MetadataData = 1
+	// MetadataReject signals that the sender does not have the metadata
+	MetadataReject = 2
+)
+
+// Metadata is a message of the metadata exchange specified in BEP9, which is used to transfer
+// the info dictionary of a torrent that is only known by its info-hash
+type Metadata struct {
+	Type      int    `bencode:"msg_type"`
+	Piece     int    `bencode:"piece"`
+	TotalSize int    `bencode:"total_size,omitempty"`
+	Data      []byte `bencode:"-"` // Piece of the metadata, data messages only
+}
+
+// FormatMetadata creates an EXTENDED message carrying the metadata message
+func FormatMetadata(m *Metadata) (*Message, error) {
+	dict, err := bencode.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, 0, 1+len(dict)+len(m.Data))
+	payload = append(payload, ExtMetadata)
+	payload = append(payload, dict...)
+	payload = append(payload, m.Data...)
+	return &Message{ID: MsgExtended, Payload: payload}, nil
+}
+
+// ParseMetadata parses a metadata message of an EXTENDED message
+func ParseMetadata(msg *Message) (*Metadata, error) {
+	if msg.ID != MsgExtended {
+		return nil, fmt.Errorf("Expected EXTENDED (ID %d), got ID %d", MsgExtended, msg.ID)
+	}
+	if len(msg.Payload) < 1 || msg.Payload[0] != ExtMetadata {
+		return nil, fmt.Errorf("Expected metadata message")
+	}
+	d := bencode.NewDecoder(bytes.NewReader(msg.Payload[1:]))
+	var m Metadata
+	if err := d.Decode(&m); err != nil {
+		return nil, err
+	}
+	m.Data = msg.Payload[1+d.Offset:]
+	return &m, nil
+}
@@ -0,0 +1,69 @@
+package monitoring
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/netsys-lab/bittorrent-over-scion/dht_node"
+)
+
+func dhtDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "dht", name), help, []string{"node"}, nil)
+}
+
+var (
+	dhtTorrents             = dhtDesc("torrents", "Torrents announced and looked up by the node.")
+	dhtAnnouncesHandled     = dhtDesc("announces_handled_total", "Announces of other peers accepted by the node.")
+	dhtBlockedPeers         = dhtDesc("blocked_peers_total", "Peers ignored because of a zero port or because they are the local peer.")
+	dhtReceivedPeers        = dhtDesc("received_peers_total", "Peers received while looking up torrents.")
+	dhtAnnouncesStarted     = dhtDesc("announces_started_total", "Announces of torrents started by the node.")
+	dhtStoredInfoHashes     = dhtDesc("stored_info_hashes", "Info-hashes the node stores announced peers for.")
+	dhtDroppedPeers         = dhtDesc("dropped_peers_total", "Announced peers not stored because of the storage limits.")
+	dhtStoredItems          = dhtDesc("stored_items", "BEP 44 items stored for other nodes.")
+	dhtNodes                = dhtDesc("nodes", "Nodes in the routing table.")
+	dhtGoodNodes            = dhtDesc("good_nodes", "Nodes in the routing table that answered recently.")
+	dhtOutstandingTransacts = dhtDesc("outstanding_transactions", "Queries waiting for a response.")
+)
+
+// dhtCollector reads the statistics of a dht node whenever the metrics are collected
+type dhtCollector struct {
+	node *dht_node.DhtNode
+	name string
+}
+
+// RegisterDhtNode exposes the statistics of the node, labeled with name, e.g. its address
+func RegisterDhtNode(node *dht_node.DhtNode, name string) error {
+	return Registry.Register(&dhtCollector{node: node, name: name})
+}
+
+func (c *dhtCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		dhtTorrents, dhtAnnouncesHandled, dhtBlockedPeers, dhtReceivedPeers, dhtAnnouncesStarted,
+		dhtStoredInfoHashes, dhtDroppedPeers, dhtStoredItems, dhtNodes, dhtGoodNodes, dhtOutstandingTransacts,
+	} {
+		ch <- d
+	}
+}
+
+func (c *dhtCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.node.Stats()
+	gauge := func(d *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, c.name)
+	}
+	counter := func(d *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, v, c.name)
+	}
+	gauge(dhtTorrents, float64(stats.Torrents))
+	counter(dhtAnnouncesHandled, float64(stats.AnnouncesHandled))
+	counter(dhtBlockedPeers, float64(stats.BlockedPeers))
+	counter(dhtReceivedPeers, float64(stats.ReceivedPeersWhileTraversing))
+	counter(dhtAnnouncesStarted, float64(stats.AnnouncesStarted))
+	gauge(dhtStoredInfoHashes, float64(stats.StoredInfoHashes))
+	counter(dhtDroppedPeers, float64(stats.DroppedPeers))
+	gauge(dhtStoredItems, float64(stats.StoredItems))
+	gauge(dhtNodes, float64(stats.Nodes))
+	gauge(dhtGoodNodes, float64(stats.GoodNodes))
+	gauge(dhtOutstandingTransacts, float64(stats.OutstandingTransactions))
+}
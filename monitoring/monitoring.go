@@ -0,0 +1,261 @@
+package monitoring
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"encoding/hex"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const namespace = "bittorrent"
+
+// Direction of a transfer, seen from the local peer
+type Direction string
+
+const (
+	Upload   Direction = "up"
+	Download Direction = "down"
+)
+
+// Role of the local peer in a connection
+type Role string
+
+const (
+	Seeder  Role = "seeder"
+	Leecher Role = "leecher"
+)
+
+// Reasons why the paths to a peer changed
+const (
+	PathRebalanced = "rebalance"  // A badly performing path was replaced
+	PathFailed     = "failover"   // A failed path was replaced
+	PathDropped    = "drop"       // A bad or failed path was dropped without replacement
+	PathsAllocated = "allocation" // The paths of a peer changed since peers joined or left
+)
+
+var (
+	torrentBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "torrent_bytes_total",
+		Help:      "Bytes of pieces transferred per torrent.",
+	}, []string{"torrent", "direction"})
+	peerBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "peer_bytes_total",
+		Help:      "Bytes of pieces transferred per torrent and peer.",
+	}, []string{"torrent", "peer", "direction"})
+	pathBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "path_bytes_total",
+		Help:      "Bytes of pieces transferred per torrent, peer and SCION path.",
+	}, []string{"torrent", "peer", "path", "direction"})
+	activeConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connections_active",
+		Help:      "Open connections, one per path to a peer.",
+	}, []string{"role"})
+	peerChoked = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "peer_choked",
+		Help:      "1 if the last choke message of the peer choked the local peer, 0 if it unchoked it.",
+	}, []string{"torrent", "peer"})
+	piecesVerified = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pieces_verified_total",
+		Help:      "Downloaded pieces that passed the hash check.",
+	}, []string{"torrent"})
+	piecesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pieces_failed_total",
+		Help:      "Downloaded pieces that failed the hash check and are downloaded again.",
+	}, []string{"torrent"})
+	pathChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "path_changes_total",
+		Help:      "Changes of the paths used to peers, by reason.",
+	}, []string{"reason"})
+	torrentInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "torrent_info",
+		Help:      "Name of the torrents, always 1.",
+	}, []string{"torrent", "name"})
+)
+
+// Registry contains all metrics of this package and the go runtime and process metrics
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		torrentBytes, peerBytes, pathBytes,
+		activeConnections, peerChoked,
+		piecesVerified, piecesFailed,
+		pathChanges, torrentInfo,
+	)
+}
+
+// series remembers the label values in use per torrent, since series can only be deleted by
+// their full label values
+var series = struct {
+	sync.Mutex
+	names map[string]string                        // Torrent to name
+	paths map[string]map[string]map[[2]string]bool // Torrent to peer to path and direction
+}{
+	names: make(map[string]string),
+	paths: make(map[string]map[string]map[[2]string]bool),
+}
+
+// torrentLabel identifies a torrent in the labels by its hex encoded info-hash
+func torrentLabel(infoHash [20]byte) string {
+	return hex.EncodeToString(infoHash[:])
+}
+
+// AddTorrent exposes the name of the torrent
+func AddTorrent(infoHash [20]byte, name string) {
+	ih := torrentLabel(infoHash)
+	series.Lock()
+	defer series.Unlock()
+	if old, ok := series.names[ih]; ok && old != name {
+		torrentInfo.DeleteLabelValues(ih, old)
+	}
+	series.names[ih] = name
+	torrentInfo.WithLabelValues(ih, name).Set(1)
+}
+
+// RemoveTorrent deletes all series of the torrent and its peers
+func RemoveTorrent(infoHash [20]byte) {
+	ih := torrentLabel(infoHash)
+	series.Lock()
+	defer series.Unlock()
+	for peer := range series.paths[ih] {
+		removePeerLocked(ih, peer)
+	}
+	delete(series.paths, ih)
+	if name, ok := series.names[ih]; ok {
+		torrentInfo.DeleteLabelValues(ih, name)
+		delete(series.names, ih)
+	}
+	for _, direction := range []Direction{Upload, Download} {
+		torrentBytes.DeleteLabelValues(ih, string(direction))
+	}
+	piecesVerified.DeleteLabelValues(ih)
+	piecesFailed.DeleteLabelValues(ih)
+}
+
+// RemovePeer deletes the series of the peer in the torrent, e.g. once the peer disconnected
+func RemovePeer(infoHash [20]byte, peer string) {
+	ih := torrentLabel(infoHash)
+	series.Lock()
+	defer series.Unlock()
+	removePeerLocked(ih, peer)
+	delete(series.paths[ih], peer)
+}
+
+func removePeerLocked(ih string, peer string) {
+	for key := range series.paths[ih][peer] {
+		path, direction := key[0], key[1]
+		pathBytes.DeleteLabelValues(ih, peer, path, direction)
+		peerBytes.DeleteLabelValues(ih, peer, direction)
+	}
+	peerChoked.DeleteLabelValues(ih, peer)
+}
+
+// addPeerSeries remembers the label values of a series of the peer, an empty path stands for
+// series without path
+func addPeerSeries(ih string, peer string, path string, direction Direction) {
+	series.Lock()
+	defer series.Unlock()
+	peers, ok := series.paths[ih]
+	if !ok {
+		peers = make(map[string]map[[2]string]bool)
+		series.paths[ih] = peers
+	}
+	if peers[peer] == nil {
+		peers[peer] = make(map[[2]string]bool)
+	}
+	if path != "" {
+		peers[peer][[2]string{path, string(direction)}] = true
+	}
+}
+
+// Transfer counts the bytes transferred over a path to a peer. The counters are looked up once,
+// so that adding bytes is cheap.
+type Transfer struct {
+	torrent prometheus.Counter
+	peer    prometheus.Counter
+	path    prometheus.Counter
+}
+
+// NewTransfer returns the counters of the transfer of the torrent with the peer over the path
+func NewTransfer(direction Direction, infoHash [20]byte, peer, path string) *Transfer {
+	ih := torrentLabel(infoHash)
+	addPeerSeries(ih, peer, path, direction)
+	return &Transfer{
+		torrent: torrentBytes.WithLabelValues(ih, string(direction)),
+		peer:    peerBytes.WithLabelValues(ih, peer, string(direction)),
+		path:    pathBytes.WithLabelValues(ih, peer, path, string(direction)),
+	}
+}
+
+// Add counts n transferred bytes
+func (t *Transfer) Add(n int) {
+	t.torrent.Add(float64(n))
+	t.peer.Add(float64(n))
+	t.path.Add(float64(n))
+}
+
+// ConnectionOpened counts an opened connection
+func ConnectionOpened(role Role) {
+	activeConnections.WithLabelValues(string(role)).Inc()
+}
+
+// ConnectionClosed counts a closed connection
+func ConnectionClosed(role Role) {
+	activeConnections.WithLabelValues(string(role)).Dec()
+}
+
+// SetChoked sets whether the peer chokes the local peer
+func SetChoked(infoHash [20]byte, peer string, choked bool) {
+	v := 0.0
+	if choked {
+		v = 1
+	}
+	ih := torrentLabel(infoHash)
+	addPeerSeries(ih, peer, "", "")
+	peerChoked.WithLabelValues(ih, peer).Set(v)
+}
+
+// PieceVerified counts a downloaded piece with a valid hash
+func PieceVerified(infoHash [20]byte) {
+	piecesVerified.WithLabelValues(torrentLabel(infoHash)).Inc()
+}
+
+// PieceFailed counts a downloaded piece with an invalid hash
+func PieceFailed(infoHash [20]byte) {
+	piecesFailed.WithLabelValues(torrentLabel(infoHash)).Inc()
+}
+
+// PathChanged counts a change of the paths to a peer
+func PathChanged(reason string) {
+	pathChanges.WithLabelValues(reason).Inc()
+}
+
+// Handler serves the metrics of the registry in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Serve serves the metrics at /metrics of addr, e.g. ":9100", until the listener fails
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	log.Infof("Serving metrics on %s/metrics", addr)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,73 @@
+package monitoring
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	ih := [20]byte{0xab}
+	AddTorrent(ih, "dataset")
+	transfer := NewTransfer(Download, ih, "19-ffaa:1:c3f,[10.0.0.2]:43000", "19-ffaa:1:c3f 1>2 19-ffaa:1:c40")
+	transfer.Add(100)
+	transfer.Add(50)
+	ConnectionOpened(Leecher)
+	ConnectionOpened(Leecher)
+	ConnectionClosed(Leecher)
+	SetChoked(ih, "19-ffaa:1:c3f,[10.0.0.2]:43000", true)
+	PieceVerified(ih)
+	PieceFailed(ih)
+	PathChanged(PathFailed)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(rec.Body)
+	assert.Nil(t, err)
+
+	torrent := "ab00000000000000000000000000000000000000"
+	for _, line := range []string{
+		`bittorrent_torrent_info{name="dataset",torrent="` + torrent + `"} 1`,
+		`bittorrent_torrent_bytes_total{direction="down",torrent="` + torrent + `"} 150`,
+		`bittorrent_peer_bytes_total{direction="down",peer="19-ffaa:1:c3f,[10.0.0.2]:43000",torrent="` + torrent + `"} 150`,
+		`bittorrent_path_bytes_total{direction="down",path="19-ffaa:1:c3f 1>2 19-ffaa:1:c40",peer="19-ffaa:1:c3f,[10.0.0.2]:43000",torrent="` + torrent + `"} 150`,
+		`bittorrent_connections_active{role="leecher"} 1`,
+		`bittorrent_peer_choked{peer="19-ffaa:1:c3f,[10.0.0.2]:43000",torrent="` + torrent + `"} 1`,
+		`bittorrent_pieces_verified_total{torrent="` + torrent + `"} 1`,
+		`bittorrent_pieces_failed_total{torrent="` + torrent + `"} 1`,
+		`bittorrent_path_changes_total{reason="failover"} 1`,
+	} {
+		assert.Contains(t, string(body), line)
+	}
+}
+
+func TestRemovePeerAndTorrent(t *testing.T) {
+	ih := [20]byte{0xcd}
+	torrent := "cd00000000000000000000000000000000000000"
+	peer := "19-ffaa:1:c3f,[10.0.0.3]:43000"
+	other := "19-ffaa:1:c3f,[10.0.0.4]:43000"
+	AddTorrent(ih, "removed")
+	NewTransfer(Download, ih, peer, "19-ffaa:1:c3f 1>2 19-ffaa:1:c40").Add(10)
+	NewTransfer(Download, ih, peer, "19-ffaa:1:c3f 3>4 19-ffaa:1:c40").Add(10)
+	NewTransfer(Upload, ih, other, "19-ffaa:1:c3f 1>2 19-ffaa:1:c40").Add(10)
+	SetChoked(ih, peer, false)
+	PieceVerified(ih)
+
+	metrics := func() string {
+		rec := httptest.NewRecorder()
+		Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		body, err := ioutil.ReadAll(rec.Body)
+		assert.Nil(t, err)
+		return string(body)
+	}
+
+	RemovePeer(ih, peer)
+	body := metrics()
+	assert.NotContains(t, body, `peer="`+peer+`"`)
+	assert.Contains(t, body, `bittorrent_peer_bytes_total{direction="up",peer="`+other+`",torrent="`+torrent+`"} 10`)
+
+	RemoveTorrent(ih)
+	assert.NotContains(t, metrics(), torrent)
+}
@@ -0,0 +1,73 @@
+package p2p
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"sync"
+	"time"
+)
+
+// ReplacementTimeout is the time to wait for a replacement path after the last path
+// to a peer failed, before the session to the peer is given up
+const ReplacementTimeout = 10 * time.Second
+
+// pathGroup counts the paths of a session that are downloading. Other than a
+// sync.WaitGroup, paths may be added while waiting, e.g. when the peer brings up
+// a replacement for a failed path.
+type pathGroup struct {
+	sync.Mutex
+	active  int
+	changed chan struct{}
+}
+
+func newPathGroup() *pathGroup {
+	return &pathGroup{
+		changed: make(chan struct{}),
+	}
+}
+
+func (g *pathGroup) signalLocked() {
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+func (g *pathGroup) add() {
+	g.Lock()
+	defer g.Unlock()
+	g.active++
+	g.signalLocked()
+}
+
+func (g *pathGroup) done() {
+	g.Lock()
+	defer g.Unlock()
+	g.active--
+	g.signalLocked()
+}
+
+// wait returns once finished returns true and no path is active anymore, if no path
+// was active for the grace period, or once stop is closed and no path is active anymore
+func (g *pathGroup) wait(grace time.Duration, finished func() bool, stop <-chan struct{}) {
+	for {
+		g.Lock()
+		active := g.active
+		changed := g.changed
+		g.Unlock()
+
+		if active > 0 {
+			<-changed
+			continue
+		}
+		if finished() {
+			return
+		}
+		select {
+		case <-changed:
+		case <-stop:
+			return
+		case <-time.After(grace):
+			return
+		}
+	}
+}
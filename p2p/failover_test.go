@@ -0,0 +1,50 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathGroupWaitsForReplacement(t *testing.T) {
+	g := newPathGroup()
+	g.add()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		// The replacement comes up shortly after the failed path ended
+		g.done()
+		time.Sleep(10 * time.Millisecond)
+		g.add()
+		time.Sleep(10 * time.Millisecond)
+		g.done()
+	}()
+
+	start := time.Now()
+	g.wait(100*time.Millisecond, func() bool { return false }, nil)
+	assert.True(t, time.Since(start) >= 120*time.Millisecond)
+}
+
+func TestPathGroupReturnsWhenFinished(t *testing.T) {
+	g := newPathGroup()
+	g.add()
+	go g.done()
+
+	start := time.Now()
+	g.wait(time.Minute, func() bool { return true }, nil)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestPathGroupReturnsWhenStopped(t *testing.T) {
+	g := newPathGroup()
+	stop := make(chan struct{})
+	g.add()
+	go func() {
+		g.done()
+		close(stop)
+	}()
+
+	start := time.Now()
+	g.wait(time.Minute, func() bool { return false }, stop)
+	assert.True(t, time.Since(start) < time.Second)
+}
@@ -0,0 +1,168 @@
+package p2p
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/netsys-lab/scion-path-discovery/packets"
+)
+
+// DownloadConnMetrics are the metrics of downloading over one path to a peer
+type DownloadConnMetrics struct {
+	ConnId    string
+	Remote    string
+	Local     string
+	Path      string
+	Hops      int   // Interfaces traversed by the path
+	Bytes     int64 // Bytes of blocks received over the path
+	StartDate time.Time
+	EndDate   time.Time
+	Duration  time.Duration
+	Failed    bool    // The path failed before the download completed
+	Bandwidth []int64 // Read throughput of the connection in bytes per second, one value per metrics interval
+}
+
+// Throughput returns the average throughput of the path in Mbit/s
+func (m *DownloadConnMetrics) Throughput() float64 {
+	if m.Duration <= 0 {
+		return 0
+	}
+	return float64(m.Bytes*8) / m.Duration.Seconds() / 1024 / 1024
+}
+
+// PeakThroughput returns the highest throughput of the path in Mbit/s
+func (m *DownloadConnMetrics) PeakThroughput() float64 {
+	var peak int64
+	for _, b := range m.Bandwidth {
+		if b > peak {
+			peak = b
+		}
+	}
+	return float64(peak*8) / 1024 / 1024
+}
+
+func (m *DownloadConnMetrics) GetCsv() string {
+	bw := make([]string, 0, len(m.Bandwidth))
+	for _, b := range m.Bandwidth {
+		bw = append(bw, fmt.Sprintf("%d", b))
+	}
+	// id;remote;local;path;hops;bytes;downloadBw;startDate;endDate;duration;failed;bandwidth
+	return fmt.Sprintf("%s;%s;%s;%s;%d;%d;%.2f;%s;%s;%d;%t;%s", m.ConnId, m.Remote, m.Local, m.Path, m.Hops, m.Bytes, m.Throughput(), m.StartDate, m.EndDate, m.Duration, m.Failed, strings.Join(bw, ","))
+}
+
+func (m *DownloadConnMetrics) GetCsvHeader() string {
+	return "id;remote;local;path;hops;bytes;downloadBw;startDate;endDate;duration;failed;bandwidth"
+}
+
+func (m *DownloadConnMetrics) GetJSON() []byte {
+	data, _ := json.Marshal(m)
+	return data
+}
+
+// pathMetrics collects the metrics of a path download while it runs
+type pathMetrics struct {
+	conn   packets.UDPConn
+	connId string // The id of failed conns is reset, so it is kept here
+	peer   string
+	path   string
+	hops   int
+	start  time.Time
+	end    time.Time // Zero while the download is running
+	failed bool
+	bytes  int64 // Accessed atomically
+}
+
+// addPathMetrics starts collecting the metrics of a path download
+func (t *Torrent) addPathMetrics(conn packets.UDPConn, peer string, path string) *pathMetrics {
+	pm := &pathMetrics{
+		conn:   conn,
+		connId: conn.GetId(),
+		peer:   peer,
+		path:   path,
+		start:  time.Now(),
+	}
+	if p := conn.GetPath(); p != nil && *p != nil && (*p).Metadata() != nil {
+		pm.hops = len((*p).Metadata().Interfaces)
+	}
+	t.Lock()
+	t.pathMetrics = append(t.pathMetrics, pm)
+	t.Unlock()
+	return pm
+}
+
+// finishPathMetrics stops collecting the metrics of a path download
+func (t *Torrent) finishPathMetrics(pm *pathMetrics, failed bool) {
+	t.Lock()
+	defer t.Unlock()
+	pm.end = time.Now()
+	pm.failed = failed
+}
+
+// ConnMetrics returns the metrics of all paths the torrent was downloaded over so far. Paths
+// that are still in use are reported up to now.
+func (t *Torrent) ConnMetrics() []DownloadConnMetrics {
+	t.Lock()
+	defer t.Unlock()
+	metrics := make([]DownloadConnMetrics, 0, len(t.pathMetrics))
+	now := time.Now()
+	for _, pm := range t.pathMetrics {
+		metrics = append(metrics, t.connMetrics(pm, now))
+	}
+	return metrics
+}
+
+// connMetrics returns the metrics of a path download, running downloads are reported up to now.
+// The caller holds the mutex.
+func (t *Torrent) connMetrics(pm *pathMetrics, now time.Time) DownloadConnMetrics {
+	end := pm.end
+	if end.IsZero() {
+		end = now
+	}
+	m := DownloadConnMetrics{
+		ConnId:    pm.connId,
+		Remote:    pm.peer,
+		Local:     t.Local,
+		Path:      pm.path,
+		Hops:      pm.hops,
+		Bytes:     atomic.LoadInt64(&pm.bytes),
+		StartDate: pm.start,
+		EndDate:   end,
+		Duration:  end.Sub(pm.start),
+		Failed:    pm.failed,
+	}
+	if cm := pm.conn.GetMetrics(); cm != nil {
+		m.Bandwidth = append([]int64{}, cm.ReadBandwidth...)
+	}
+	return m
+}
+
+// PrintConnMetrics writes a table with the throughput of every path and the total to w
+func PrintConnMetrics(w io.Writer, metrics []DownloadConnMetrics) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PEER\tPATH\tHOPS\tMIB\tDURATION\tAVG MBIT/S\tPEAK MBIT/S\tFAILED")
+	var bytes int64
+	var start, end time.Time
+	for _, m := range metrics {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%.2f\t%s\t%.2f\t%.2f\t%t\n", m.Remote, m.Path, m.Hops, float64(m.Bytes)/1024/1024,
+			m.Duration.Round(time.Millisecond), m.Throughput(), m.PeakThroughput(), m.Failed)
+		bytes += m.Bytes
+		if start.IsZero() || m.StartDate.Before(start) {
+			start = m.StartDate
+		}
+		if m.EndDate.After(end) {
+			end = m.EndDate
+		}
+	}
+	total := DownloadConnMetrics{Bytes: bytes, Duration: end.Sub(start)}
+	fmt.Fprintf(tw, "total (%d paths)\t\t\t%.2f\t%s\t%.2f\t\t\n", len(metrics), float64(bytes)/1024/1024,
+		total.Duration.Round(time.Millisecond), total.Throughput())
+	tw.Flush()
+}
@@ -0,0 +1,45 @@
+package p2p
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadConnMetrics(t *testing.T) {
+	start := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	m := DownloadConnMetrics{
+		ConnId:    "1",
+		Remote:    "19-ffaa:1:c3f,[10.0.0.2]:43000",
+		Path:      "19-ffaa:1:c3f 1>2 19-ffaa:1:c40",
+		Bytes:     4 * 1024 * 1024,
+		StartDate: start,
+		EndDate:   start.Add(2 * time.Second),
+		Duration:  2 * time.Second,
+		Bandwidth: []int64{1024 * 1024, 3 * 1024 * 1024},
+	}
+	assert.Equal(t, 16.0, m.Throughput())
+	assert.Equal(t, 24.0, m.PeakThroughput())
+	assert.Equal(t, len(strings.Split(m.GetCsvHeader(), ";")), len(strings.Split(m.GetCsv(), ";")))
+	assert.True(t, strings.HasSuffix(m.GetCsv(), ";false;1048576,3145728"))
+
+	var out bytes.Buffer
+	PrintConnMetrics(&out, []DownloadConnMetrics{m, {
+		Remote:    "19-ffaa:1:c3f,[10.0.0.2]:43000",
+		Path:      "19-ffaa:1:c3f 3>4 19-ffaa:1:c40",
+		Bytes:     4 * 1024 * 1024,
+		StartDate: start.Add(time.Second),
+		EndDate:   start.Add(4 * time.Second),
+		Duration:  3 * time.Second,
+		Failed:    true,
+	}})
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, 4, len(lines))
+	assert.Contains(t, lines[1], "19-ffaa:1:c3f 1>2 19-ffaa:1:c40")
+	assert.Contains(t, lines[2], "true")
+	// 8 MiB in 4 seconds from the first start to the last end
+	assert.Regexp(t, `^total \(2 paths\)\s+8\.00\s+4s\s+16\.00`, lines[3])
+}
@@ -5,9 +5,12 @@ package p2p
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/netsys-lab/dht"
@@ -16,10 +19,14 @@ import (
 	"github.com/scionproto/scion/go/lib/snet"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/netsys-lab/bittorrent-over-scion/bitfield"
 	"github.com/netsys-lab/bittorrent-over-scion/client"
 	"github.com/netsys-lab/bittorrent-over-scion/config"
 	"github.com/netsys-lab/bittorrent-over-scion/dht_node"
+	"github.com/netsys-lab/bittorrent-over-scion/events"
 	"github.com/netsys-lab/bittorrent-over-scion/message"
+	"github.com/netsys-lab/bittorrent-over-scion/monitoring"
+	ps "github.com/netsys-lab/bittorrent-over-scion/pathselection"
 	"github.com/netsys-lab/bittorrent-over-scion/peers"
 )
 
@@ -29,8 +36,8 @@ const KiB = 1024
 // MaxBlockSize is the largest number of bytes a request can ask for
 const MaxBlockSize = 256 * KiB
 
-// MaxBacklog is the number of unfulfilled requests a client can have in its pipeline
-const MaxBacklog = 5
+// MaxBacklog is the largest number of unfulfilled requests a path can have in its pipeline
+const MaxBacklog = 64
 
 // Torrent holds data required to download a torrent from a list of peers
 type Torrent struct {
@@ -44,9 +51,20 @@ type Torrent struct {
 	Name                        string
 	Local                       string
 	PathSelectionResponsibility string
+	PathPolicy                  string
+	PathFilter                  *ps.PathFilter
+	PathHistory                 *ps.PathHistory
 	Conns                       []packets.UDPConn
 	DhtNode                     *dht_node.DhtNode
 	DiscoveryConfig             *config.PeerDiscoveryConfig
+	BlockSize                   int                 // Optional: Number of bytes requested at once, defaults to DefaultBlockSize
+	Previous                    []byte              // Optional: Content of a previous version, pieces found in it are not downloaded
+	activePeers                 map[peers.Peer]bool // Peers a download worker is running for
+	pathMetrics                 []*pathMetrics      // Metrics of all paths downloaded over, guarded by the mutex
+	completed                   bitfield.Bitfield   // Pieces written to the buffer, guarded by the mutex
+	started                     time.Time           // Start of the download
+	stop                        chan struct{}       // Closed by Stop, guarded by the mutex
+	events                      events.Bus          // Receives the events of the download, see Subscribe
 	workQueue                   chan *pieceWork
 	results                     chan *pieceResult
 }
@@ -57,6 +75,8 @@ type pieceWork struct {
 	index  int
 	hash   [20]byte
 	length int
+	buf    []byte // Data received before the piece was put back on the queue
+	done   []bool // Blocks of buf that were received
 }
 
 type pieceResult struct {
@@ -64,16 +84,29 @@ type pieceResult struct {
 	buf   []byte
 }
 
-type pieceProgress struct {
-	index      int
-	client     *client.Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
+// pathDownload downloads the blocks assigned by the scheduler over the path of a client
+type pathDownload struct {
+	id        string
+	infoHash  [20]byte
+	client    *client.Client
+	scheduler *blockScheduler
+	results   chan *pieceResult
+	stop      <-chan struct{}
+	events    *events.Bus
+	transfer  *monitoring.Transfer
+	metrics   *pathMetrics
 }
 
-func (state *pieceProgress) readMessage() error {
+// publish publishes an event of the path
+func (state *pathDownload) publish(e events.Event) {
+	e.InfoHash = state.infoHash
+	e.Peer = state.client.Peer.Addr
+	e.ConnId = state.id
+	e.Path = state.metrics.path
+	state.events.Publish(e)
+}
+
+func (state *pathDownload) readMessage() error {
 	msg, err := state.client.Read() // this call blocks
 	if err != nil {
 		return err
@@ -86,9 +119,13 @@ func (state *pieceProgress) readMessage() error {
 	switch msg.ID {
 	case message.MsgUnchoke:
 		state.client.Choked = false
+		monitoring.SetChoked(state.infoHash, state.client.Peer.Addr, false)
+		state.publish(events.Event{Type: events.Unchoked})
 		log.Debug("Got unchoke message")
 	case message.MsgChoke:
 		state.client.Choked = true
+		monitoring.SetChoked(state.infoHash, state.client.Peer.Addr, true)
+		state.publish(events.Event{Type: events.Choked})
 	case message.MsgHave:
 		index, err := message.ParseHave(msg)
 		if err != nil {
@@ -96,12 +133,26 @@ func (state *pieceProgress) readMessage() error {
 		}
 		state.client.Bitfield.SetPiece(index)
 	case message.MsgPiece:
-		n, err := message.ParsePiece(state.index, state.buf, msg)
+		index, begin, data, err := message.ParseBlock(msg)
 		if err != nil {
 			return err
 		}
-		state.downloaded += n
-		state.backlog--
+		res, err := state.scheduler.received(state.id, index, begin, data)
+		if err != nil {
+			return err
+		}
+		state.transfer.Add(len(data))
+		atomic.AddInt64(&state.metrics.bytes, int64(len(data)))
+		if res != nil {
+			monitoring.PieceVerified(state.infoHash)
+			state.publish(events.Event{Type: events.PieceVerified, Piece: res.index})
+			state.client.SendHave(res.index)
+			select {
+			case state.results <- res:
+			case <-state.stop:
+				return ErrStopped
+			}
+		}
 	case message.MsgPort:
 		log.Debug("got port message")
 		client := state.client
@@ -122,43 +173,92 @@ func (state *pieceProgress) readMessage() error {
 	return nil
 }
 
-func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
-	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
+// downloadOverPath requests blocks over the path of the client until nothing is left
+// to download from the peer. On errors, the requested blocks go to the other paths.
+func (t *Torrent) downloadOverPath(c *client.Client, scheduler *blockScheduler) (err error) {
+	path := "unknown"
+	if p := c.Conn.GetPath(); p != nil {
+		path = pathselection.PathToString(*p)
 	}
-
-	// Setting a deadline helps get unresponsive peers unstuck.
-	// 30 seconds is more than enough time to download a 262 KB piece
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+	state := pathDownload{
+		id:        c.Conn.GetId(),
+		infoHash:  t.InfoHash,
+		client:    c,
+		scheduler: scheduler,
+		results:   t.results,
+		stop:      t.stopped(),
+		events:    &t.events,
+		transfer:  monitoring.NewTransfer(monitoring.Download, t.InfoHash, c.Peer.Addr, path),
+		metrics:   t.addPathMetrics(c.Conn, c.Peer.Addr, path),
+	}
+	scheduler.addPath(state.id)
+	monitoring.ConnectionOpened(monitoring.Leecher)
+	state.publish(events.Event{Type: events.PathAdded})
+	defer func() {
+		monitoring.ConnectionClosed(monitoring.Leecher)
+		failed := err != nil && !errors.Is(err, ErrStopped)
+		removed := events.Event{Type: events.PathRemoved}
+		if failed {
+			removed.Err = err
+		}
+		state.publish(removed)
+		t.finishPathMetrics(state.metrics, failed)
+		t.recordPathQuality(c.Conn, scheduler.pathEstimate(state.id), failed)
+		scheduler.removePath(state.id)
+	}()
 	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
-	for state.downloaded < pw.length {
-		// If unchoked, send requests until we have enough unfulfilled requests
-		if !state.client.Choked {
-			for state.backlog < MaxBacklog && state.requested < pw.length {
-				blockSize := min(MaxBlockSize, pw.length)
-				// Last block might be shorter than the typical block
-				bytesDue := pw.length - state.requested
-				if bytesDue < blockSize {
-					blockSize = bytesDue
+
+	for {
+		select {
+		case <-state.stop:
+			return ErrStopped
+		default:
+		}
+
+		// If unchoked, send requests until the pipeline of the path is full
+		if !c.Choked {
+			for scheduler.outstanding(state.id) < scheduler.depth(state.id) {
+				req, ok := scheduler.next(state.id)
+				if !ok {
+					break
 				}
-				err := c.SendRequest(pw.index, state.requested, blockSize)
+				err := c.SendRequest(req.index, req.begin, req.length)
 				if err != nil {
-					return nil, err
+					return err
 				}
-				state.backlog++
-				state.requested += blockSize
 			}
 		}
 
+		if !c.Choked && scheduler.outstanding(state.id) == 0 {
+			if scheduler.done() {
+				return nil
+			}
+			// Wait for pieces put back by other peers or blocks of stalled paths
+			scheduler.wait(time.Second)
+			continue
+		}
+
+		// Setting a deadline helps get unresponsive peers unstuck.
+		c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
 		err := state.readMessage()
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
+}
 
-	return state.buf, nil
+// recordPathQuality adds the throughput and round trip time measured over the path of the connection to the history
+func (t *Torrent) recordPathQuality(conn packets.UDPConn, estimate pathEstimator, failed bool) {
+	path := conn.GetPath()
+	remote := conn.GetRemote()
+	if t.PathHistory == nil || path == nil || remote == nil {
+		return
+	}
+	t.PathHistory.Record(remote.IA.String(), pathselection.PathToString(*path), ps.PathObservation{
+		Throughput: int64(estimate.throughput),
+		RTT:        estimate.rtt,
+		Failed:     failed,
+	})
 }
 
 func min(a int, b int) int {
@@ -176,145 +276,190 @@ func checkIntegrity(pw *pieceWork, buf []byte) error {
 	return nil
 }
 
-func (t *Torrent) startDownloadWorker(peer peers.Peer) {
+const (
+	// workerRetryDelay is the first delay before a session to a peer that ended while
+	// pieces are left is retried, doubled for every further retry
+	workerRetryDelay = time.Second
+	// maxWorkerRetryDelay caps the delay between retries of a peer
+	maxWorkerRetryDelay = 30 * time.Second
+)
+
+// downloadFromPeer downloads from the peer, unless a worker for the peer is running already. If
+// the last worker stops before the download is complete, peers are looked up via the dht right
+// away instead of waiting for the next lookup.
+func (t *Torrent) downloadFromPeer(peer peers.Peer) {
+	t.Lock()
+	if t.activePeers == nil {
+		t.activePeers = make(map[peers.Peer]bool)
+	}
+	if t.activePeers[peer] {
+		t.Unlock()
+		return
+	}
+	t.activePeers[peer] = true
+	t.Unlock()
+
+	// Sessions to the peer may end while pieces are left, e.g. because all paths failed
+	delay := workerRetryDelay
+	for t.startDownloadWorker(peer) {
+		log.Debugf("Got not downloaded pieces, retrying %s in %s", peer, delay)
+		select {
+		case <-t.stopped():
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxWorkerRetryDelay {
+			delay = maxWorkerRetryDelay
+		}
+	}
+
+	t.Lock()
+	delete(t.activePeers, peer)
+	idle := len(t.activePeers) == 0
+	t.Unlock()
+	if idle && len(t.workQueue) > 0 && t.DhtNode != nil {
+		log.Infof("Ran out of peers for %s, looking up peers via dht", t.Name)
+		t.DhtNode.LookupPeers(t.InfoHash)
+	}
+}
+
+// startDownloadWorker downloads over the paths to the peer until all of them ended. Returns
+// true if pieces are left and the download was not stopped, so the peer should be retried.
+func (t *Torrent) startDownloadWorker(peer peers.Peer) bool {
+	select {
+	case <-t.stopped():
+		return false
+	default:
+	}
 	mpC := client.NewMPClient()
+	mpC.PathPolicy = t.PathPolicy
+	mpC.PathFilter = t.PathFilter
+	mpC.PathHistory = t.PathHistory
 	var clients []*client.Client
 	var err error
-	if t.PathSelectionResponsibility == "server" {
-		clients, err = mpC.DialAndWaitForConnectBack(t.Local, peer, t.PeerID, t.InfoHash, t.DiscoveryConfig, t.DhtNode)
-		if err != nil {
-			log.Error(err)
-			log.Errorf("Could not handshake with %s. Disconnecting", peer)
-			return
-		}
-
-		for _, c := range clients {
-			t.Lock()
-			t.Conns = append(t.Conns, c.Conn)
-			t.Unlock()
-		}
+	if t.PathSelectionResponsibility != "server" {
+		log.Error("Client based pathselection not supported")
+		return false
+	}
 
+	clients, err = mpC.DialAndWaitForConnectBack(t.Local, peer, t.PeerID, t.InfoHash, t.DiscoveryConfig, t.DhtNode)
+	if err != nil {
+		log.Error(err)
+		log.Errorf("Could not handshake with %s. Disconnecting", peer)
+		t.events.Publish(events.Event{Type: events.Error, InfoHash: t.InfoHash, Peer: peer.Addr, Err: err})
+		return false
+	}
+	t.events.Publish(events.Event{Type: events.PeerConnected, InfoHash: t.InfoHash, Peer: peer.Addr})
+
+	// All paths to the peer share the scheduler, so blocks of failed paths
+	// are requested over the remaining paths
+	scheduler := newBlockScheduler(t.workQueue, clients[0].Bitfield.HasPiece, t.BlockSize)
+	scheduler.onFailed = func(index int) {
+		monitoring.PieceFailed(t.InfoHash)
+		t.events.Publish(events.Event{Type: events.PieceFailed, InfoHash: t.InfoHash, Peer: peer.Addr, Piece: index})
+	}
+	stopMonitor := make(chan struct{})
+	go scheduler.monitor(stopMonitor)
+	paths := newPathGroup()
+
+	startPath := func(c *client.Client, handshake bool) {
+		t.Lock()
+		t.Conns = append(t.Conns, c.Conn)
+		t.Unlock()
+		paths.add()
 		go func() {
-			sock := mpC.GetSocket()
-			for {
-				conns := <-sock.OnConnectionsChange
-				log.Debugf("Got new connections %d", len(conns))
-				for i, v := range conns {
-
-					if i == len(conns)-1 { // dial conn
-						continue
-					}
-
-					connAlreadyOpen := false
-					for _, cl := range clients {
-						if cl.Conn.GetId() == v.GetId() {
-							connAlreadyOpen = true
-							log.Debugf("Got already open conn for id %s", v.GetId())
-							break
-						}
-					}
-
-					if !connAlreadyOpen {
-						c := client.Client{
-							Conn:            v,
-							Choked:          false,
-							Bitfield:        clients[0].Bitfield,
-							Peer:            clients[0].Peer,
-							InfoHash:        clients[0].InfoHash,
-							PeerID:          clients[0].PeerID,
-							DiscoveryConfig: clients[0].DiscoveryConfig,
-						}
-						clients = append(clients, &c)
-						go func(c *client.Client) {
-							log.Infof("Starting Download from new client")
-							t.Lock()
-							t.Conns = append(t.Conns, c.Conn)
-							t.Unlock()
-							c.Handshake()
-							for pw := range t.workQueue {
-								if !c.Bitfield.HasPiece(pw.index) {
-									t.workQueue <- pw // Put piece back on the queue
-									continue
-								}
-
-								// Download the piece
-								buf, err := attemptDownloadPiece(c, pw)
-								if err != nil {
-									log.Warn("Error downloading piece, retrying in a new connection...", err)
-									c.Conn.Close()
-									c.Conn.SetId("TMP")
-									t.workQueue <- pw // Put piece back on the queue
-									return
-								}
-
-								c.SendHave(pw.index)
-								t.results <- &pieceResult{pw.index, buf}
-							}
-						}(&c)
-					}
-				}
-
+			defer paths.done()
+			if handshake {
+				c.Handshake()
+			}
+			err := t.downloadOverPath(c, scheduler)
+			if err != nil {
+				log.Warnf("Path of conn %s to %s failed, continuing over the other paths: %s", c.Conn.GetId(), peer, err)
+				c.Conn.Close()
+				c.Conn.SetId("TMP")
 			}
 		}()
-	} else {
-		log.Error("Client based pathselection not supported")
-		return
 	}
 
 	log.Infof("Completed handshake with %s, got %d clients", peer, len(clients))
 	log.Infof("Starting download...")
-	var wg sync.WaitGroup
+	knownConns := make(map[string]bool)
 	for _, c := range clients {
-		wg.Add(1)
-		go func(c *client.Client) {
-			for pw := range t.workQueue {
-				if !c.Bitfield.HasPiece(pw.index) {
-					t.workQueue <- pw // Put piece back on the queue
-					continue
-				}
+		knownConns[c.Conn.GetId()] = true
+		startPath(c, false)
+	}
 
-				// Download the piece
-				buf, err := attemptDownloadPiece(c, pw)
-				if err != nil {
-					log.Warn("Error downloading piece, retrying in a new connection...", err)
-					c.Conn.Close()
-					c.Conn.SetId("TMP")
-					t.workQueue <- pw // Put piece back on the queue
-					wg.Done()
-					return
-				}
+	// Close the sockets to the peer if the download is stopped
+	workerDone := make(chan struct{})
+	defer close(workerDone)
+	go func() {
+		select {
+		case <-t.stopped():
+			mpC.GetSocket().Disconnect()
+		case <-workerDone:
+		}
+	}()
+
+	// The seeder replaces failed paths, download over the new connections as well
+	go func() {
+		sock := mpC.GetSocket()
+		for {
+			var conns []packets.UDPConn
+			select {
+			case conns = <-sock.OnConnectionsChange:
+			case <-workerDone:
+				return
+			}
+			log.Debugf("Got new connections %d", len(conns))
+			for i, v := range conns {
 
-				// fmt.Println(buf[:128])
-				err = checkIntegrity(pw, buf)
-				if err != nil {
-					log.Fatalf("Piece #%d failed integrity check\n", pw.index)
-					t.workQueue <- pw // Put piece back on the queue
+				if i == len(conns)-1 { // dial conn
 					continue
 				}
 
-				c.SendHave(pw.index)
-				t.results <- &pieceResult{pw.index, buf}
+				if knownConns[v.GetId()] {
+					log.Debugf("Got already open conn for id %s", v.GetId())
+					continue
+				}
+				knownConns[v.GetId()] = true
+
+				log.Infof("Starting Download from new client")
+				startPath(&client.Client{
+					Conn:            v,
+					Choked:          false,
+					Bitfield:        clients[0].Bitfield,
+					Peer:            clients[0].Peer,
+					InfoHash:        clients[0].InfoHash,
+					PeerID:          clients[0].PeerID,
+					DiscoveryConfig: clients[0].DiscoveryConfig,
+				}, true)
 			}
-			wg.Done()
-		}(c)
-
-	}
-	wg.Wait()
+		}
+	}()
+
+	// If all paths failed, give the seeder some time to bring up replacements
+	paths.wait(ReplacementTimeout, scheduler.done, t.stopped())
+	close(stopMonitor)
+	// Pieces not completed over this peer's paths go back to the queue, including their received blocks
+	scheduler.abort()
+	t.events.Publish(events.Event{Type: events.PeerDisconnected, InfoHash: t.InfoHash, Peer: peer.Addr})
+	monitoring.RemovePeer(t.InfoHash, peer.Addr)
 	log.Debug("Return from startDownloadWorker")
 	select {
+	case <-t.stopped():
+		return false
+	default:
+	}
+	select {
 	case p, ok := <-t.workQueue:
 		if ok {
-			log.Debug("Got not downloaded pieces, retrying...")
 			t.workQueue <- p
-			t.startDownloadWorker(peer)
-		} else {
-			log.Debug("No further pieces, done")
-			return
+			return true
 		}
+		log.Debug("No further pieces, done")
 	default:
 		log.Info("No further pieces, done")
-		return
 	}
+	return false
 }
 
 func (t *Torrent) calculateBoundsForPiece(index int) (begin int, end int) {
@@ -331,30 +476,106 @@ func (t *Torrent) calculatePieceSize(index int) int {
 	return end - begin
 }
 
-// Download downloads the torrent. This stores the entire file in memory.
-func (t *Torrent) Download() ([]byte, error) {
+// ErrStopped is returned by Download if the download was stopped
+var ErrStopped = errors.New("download stopped")
+
+// stopped returns a channel that is closed once the download is stopped
+func (t *Torrent) stopped() <-chan struct{} {
+	t.Lock()
+	defer t.Unlock()
+	if t.stop == nil {
+		t.stop = make(chan struct{})
+	}
+	return t.stop
+}
+
+// Stop aborts the download and closes its connections. Download returns ErrStopped and the
+// pieces downloaded so far, the others are zero.
+func (t *Torrent) Stop() {
+	t.stopped()
+	t.Lock()
+	select {
+	case <-t.stop:
+	default:
+		close(t.stop)
+	}
+	conns := append([]packets.UDPConn{}, t.Conns...)
+	t.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// Subscribe returns a channel receiving the events of the download, see events.Bus. The channel
+// is closed when Download returns.
+func (t *Torrent) Subscribe(buffer int) (<-chan events.Event, func()) {
+	return t.events.Subscribe(buffer)
+}
+
+// Download downloads the torrent. This stores the entire file in memory. If ctx is done before
+// the download completes, the download is stopped as by Stop.
+func (t *Torrent) Download(ctx context.Context) ([]byte, error) {
 	log.Infof("Starting download for %s", t.Name)
+	defer t.events.Close()
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.Stop()
+		case <-finished:
+		}
+	}()
+	monitoring.AddTorrent(t.InfoHash, t.Name)
 	// Init queues for workers to retrieve work and send results
 	t.workQueue = make(chan *pieceWork, len(t.PieceHashes))
 	t.results = make(chan *pieceResult)
+	buf := make([]byte, t.Length)
+	t.Lock()
+	t.completed = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	t.started = time.Now()
+	t.Unlock()
+	previous := t.previousPieces()
+	donePieces := 0
 	for index, hash := range t.PieceHashes {
 		length := t.calculatePieceSize(index)
-		t.workQueue <- &pieceWork{index, hash, length}
+		if data, ok := previous[hash]; ok && len(data) == length {
+			begin, end := t.calculateBoundsForPiece(index)
+			copy(buf[begin:end], data)
+			t.setCompleted(index)
+			donePieces++
+			continue
+		}
+		t.workQueue <- &pieceWork{index: index, hash: hash, length: length}
+	}
+	if donePieces > 0 {
+		log.Infof("Reusing %d of %d pieces of the previous version", donePieces, len(t.PieceHashes))
 	}
 
 	// Start workers
-	for peer := range t.PeerSet.Peers {
-		// time.Sleep(100 * time.Millisecond)
-		go t.startDownloadWorker(peer)
+	if donePieces < len(t.PieceHashes) {
+		for peer := range t.PeerSet.Peers {
+			// time.Sleep(100 * time.Millisecond)
+			go t.downloadFromPeer(peer)
+		}
 	}
 
 	// Collect results into a buffer until full
-	buf := make([]byte, t.Length)
-	donePieces := 0
+	stop := t.stopped()
 	for donePieces < len(t.PieceHashes) {
-		res := <-t.results
+		var res *pieceResult
+		select {
+		case res = <-t.results:
+		case <-stop:
+			log.Infof("Stopped download of %s", t.Name)
+			if err := t.PathHistory.Save(); err != nil {
+				log.Warnf("Could not save path history: %s", err)
+			}
+			return buf, ErrStopped
+		}
 		begin, end := t.calculateBoundsForPiece(res.index)
 		copy(buf[begin:end], res.buf)
+		t.setCompleted(res.index)
 		donePieces++
 
 		// numWorkers := runtime.NumGoroutine() - 1 // subtract 1 for main thread
@@ -365,34 +586,62 @@ func (t *Torrent) Download() ([]byte, error) {
 
 	}
 	close(t.workQueue)
-	for i, v := range t.Conns {
-		log.Debugf("Checking con %d for metrics", i)
-		m := v.GetMetrics()
-		if m != nil {
-			path := v.GetPath()
-			if path != nil {
-				log.Debugf("Got following bw over path %s", pathselection.PathToString(*path))
-			}
-			bwMbits := make([]int64, 0)
-			for _, b := range m.ReadBandwidth {
-				bwMbits = append(bwMbits, int64(float64(b*8)/1024/1024))
-			}
-			log.Debug(bwMbits)
-		}
+	if err := t.PathHistory.Save(); err != nil {
+		log.Warnf("Could not save path history: %s", err)
 	}
+	t.events.Publish(events.Event{Type: events.Completed, InfoHash: t.InfoHash})
 	return buf, nil
 }
 
-func (t *Torrent) EnableDht(addr *snet.UDPAddr, peerPort uint16, infoHash [20]byte, startingNodes []dht.Addr) (*dht_node.DhtNode, error) {
-	node, err := dht_node.New(addr, infoHash, startingNodes, peerPort, func(peer peers.Peer) {
-		peerKnown := t.hasPeer(peer)
-		log.Infof("received peer via dht: %s, peer already known: %t", peer, peerKnown)
-		t.PeerSet.Add(peer)
-		if !peerKnown { // dont start two worker for same peer
-			go t.startDownloadWorker(peer)
+// previousPieces returns the pieces of the previous version by their hash
+func (t *Torrent) previousPieces() map[[20]byte][]byte {
+	pieces := make(map[[20]byte][]byte)
+	if t.PieceLength <= 0 {
+		return pieces
+	}
+	for begin := 0; begin < len(t.Previous); begin += t.PieceLength {
+		end := begin + t.PieceLength
+		if end > len(t.Previous) {
+			end = len(t.Previous)
 		}
+		pieces[sha1.Sum(t.Previous[begin:end])] = t.Previous[begin:end]
+	}
+	return pieces
+}
+
+// EnableDht starts a dht node that announces the torrent with peerPort and looks up its peers.
+// With a read-only discovery config, the torrent is only looked up.
+func (t *Torrent) EnableDht(addr *snet.UDPAddr, peerPort uint16, infoHash [20]byte, startingNodes []dht.Addr) (*dht_node.DhtNode, error) {
+	node, err := dht_node.NewNode(addr, dht_node.NodeConfig{
+		StateDir:         t.DiscoveryConfig.DhtNodeStateDir(),
+		StartingNodes:    startingNodes,
+		AnnounceInterval: t.DiscoveryConfig.DhtAnnounceInterval,
+		RetryInterval:    t.DiscoveryConfig.DhtRetryInterval,
+		ReadOnly:         t.DiscoveryConfig.DhtReadOnly,
 	})
-	return node, err
+	if err != nil {
+		return nil, err
+	}
+	node.AddTorrent(infoHash, peerPort, t.onDhtPeer)
+	if err := monitoring.RegisterDhtNode(node, addr.String()); err != nil {
+		log.Warnf("Could not expose metrics of dht node %s: %s", addr, err)
+	}
+	return node, nil
+}
+
+// JoinDht looks up peers of the torrent via a dht node shared with other torrents, the torrent
+// is announced with peerPort unless it is 0
+func (t *Torrent) JoinDht(node *dht_node.DhtNode, peerPort uint16) {
+	t.DhtNode = node
+	node.AddTorrent(t.InfoHash, peerPort, t.onDhtPeer)
+}
+
+func (t *Torrent) onDhtPeer(peer peers.Peer) {
+	peerKnown := t.hasPeer(peer)
+	log.Infof("received peer via dht: %s, peer already known: %t", peer, peerKnown)
+	t.PeerSet.Add(peer)
+	// Peers that failed before are tried again, downloadFromPeer does not start two workers for the same peer
+	go t.downloadFromPeer(peer)
 }
 
 func (t *Torrent) hasPeer(peer peers.Peer) bool {
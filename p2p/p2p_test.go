@@ -0,0 +1,78 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsys-lab/bittorrent-over-scion/events"
+	"github.com/netsys-lab/bittorrent-over-scion/peers"
+)
+
+func TestStopKeepsDownloadedPieces(t *testing.T) {
+	first := bytes.Repeat([]byte{1}, 4)
+	second := bytes.Repeat([]byte{2}, 4)
+	torrent := &Torrent{
+		PeerSet:     peers.NewPeerSet(0),
+		PieceHashes: [][20]byte{sha1.Sum(first), sha1.Sum(second)},
+		PieceLength: 4,
+		Length:      8,
+		Name:        "test",
+		Previous:    first,
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		torrent.Stop()
+		// Stopping twice does nothing
+		torrent.Stop()
+	}()
+	buf, err := torrent.Download(context.Background())
+	require.ErrorIs(t, err, ErrStopped)
+	assert.Equal(t, append(first, 0, 0, 0, 0), buf)
+	assert.Equal(t, 1, torrent.Progress().Done)
+}
+
+func TestCancelStopsDownload(t *testing.T) {
+	content := bytes.Repeat([]byte{1}, 4)
+	torrent := &Torrent{
+		PeerSet:     peers.NewPeerSet(0),
+		PieceHashes: [][20]byte{sha1.Sum(content)},
+		PieceLength: 4,
+		Length:      4,
+		Name:        "test",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := torrent.Download(ctx)
+	require.ErrorIs(t, err, ErrStopped)
+	assert.Equal(t, 0, torrent.Progress().Done)
+}
+
+func TestDownloadPublishesEvents(t *testing.T) {
+	content := bytes.Repeat([]byte{1}, 4)
+	torrent := &Torrent{
+		PeerSet:     peers.NewPeerSet(0),
+		InfoHash:    [20]byte{1},
+		PieceHashes: [][20]byte{sha1.Sum(content)},
+		PieceLength: 4,
+		Length:      4,
+		Name:        "test",
+		Previous:    content,
+	}
+	ch, _ := torrent.Subscribe(8)
+	_, err := torrent.Download(context.Background())
+	require.NoError(t, err)
+
+	e := <-ch
+	assert.Equal(t, events.Completed, e.Type)
+	assert.Equal(t, torrent.InfoHash, e.InfoHash)
+	_, ok := <-ch
+	assert.False(t, ok, "the channel is closed when the download returns")
+}
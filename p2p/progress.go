@@ -0,0 +1,73 @@
+package p2p
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"time"
+
+	"github.com/netsys-lab/bittorrent-over-scion/bitfield"
+	"github.com/netsys-lab/bittorrent-over-scion/dht_node"
+)
+
+// Progress is a snapshot of a running download
+type Progress struct {
+	Name      string
+	InfoHash  [20]byte
+	Length    int
+	Pieces    int               // Number of pieces of the torrent
+	Completed bitfield.Bitfield // Pieces downloaded or taken from the previous version
+	Done      int               // Number of completed pieces
+	Bytes     int64             // Bytes of the completed pieces
+	StartDate time.Time
+	Paths     []PathProgress
+	Dht       *dht_node.Stats // Nil if the dht is not used
+}
+
+// PathProgress is the state of a path the torrent is downloaded over
+type PathProgress struct {
+	DownloadConnMetrics
+	Active bool // The path is still in use
+}
+
+// setCompleted marks the piece as written to the buffer
+func (t *Torrent) setCompleted(index int) {
+	t.Lock()
+	defer t.Unlock()
+	t.completed.SetPiece(index)
+}
+
+// Progress returns the current state of the download, e.g. to display it
+func (t *Torrent) Progress() Progress {
+	t.Lock()
+	p := Progress{
+		Name:      t.Name,
+		InfoHash:  t.InfoHash,
+		Length:    t.Length,
+		Pieces:    len(t.PieceHashes),
+		Completed: append(bitfield.Bitfield{}, t.completed...),
+		StartDate: t.started,
+		Paths:     make([]PathProgress, 0, len(t.pathMetrics)),
+	}
+	now := time.Now()
+	for _, pm := range t.pathMetrics {
+		p.Paths = append(p.Paths, PathProgress{
+			DownloadConnMetrics: t.connMetrics(pm, now),
+			Active:              pm.end.IsZero(),
+		})
+	}
+	node := t.DhtNode
+	t.Unlock()
+
+	for i := 0; i < p.Pieces; i++ {
+		if p.Completed.HasPiece(i) {
+			p.Done++
+			p.Bytes += int64(t.calculatePieceSize(i))
+		}
+	}
+	if node != nil {
+		stats := node.Stats()
+		p.Dht = &stats
+	}
+	return p
+}
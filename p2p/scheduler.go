@@ -0,0 +1,463 @@
+package p2p
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultBlockSize is the number of bytes requested at once over a path
+const DefaultBlockSize = 16 * KiB
+
+// MinBacklog is the number of unfulfilled requests a path has in its pipeline before
+// its bandwidth and latency are known
+const MinBacklog = 2
+
+// DefaultStallTimeout is the time after which the blocks requested over a path that
+// did not deliver any block are requested over the other paths
+const DefaultStallTimeout = 10 * time.Second
+
+type blockState int
+
+const (
+	blockPending blockState = iota
+	blockRequested
+	blockDone
+)
+
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+type blockKey struct {
+	index int
+	begin int
+}
+
+// activePiece is a piece whose blocks are being downloaded
+type activePiece struct {
+	work   *pieceWork
+	buf    []byte
+	blocks []blockState
+	done   int
+}
+
+// pathState tracks the requests and the performance of a single path
+type pathState struct {
+	estimator    *pathEstimator
+	outstanding  map[blockKey]time.Time // Requested blocks and when they were requested
+	lastProgress time.Time
+	stalled      bool // Set if blocks were taken away, until the path delivers again
+}
+
+// blockScheduler assigns the blocks of the pieces available at a peer to the paths to
+// this peer. Every path requests new blocks as soon as blocks arrive, so faster paths
+// get proportionally more blocks. The number of unfulfilled requests of each path
+// follows its bandwidth-delay product. Blocks requested over a path that stalls are
+// requested again over the other paths.
+type blockScheduler struct {
+	sync.Mutex
+	workQueue    chan *pieceWork
+	hasPiece     func(index int) bool
+	blockSize    int
+	stallTimeout time.Duration
+	pieces       map[int]*activePiece
+	order        []int // Active pieces in the order they were started
+	paths        map[string]*pathState
+	notify       chan struct{}
+	finished     bool // Set if the work queue was closed or the scheduler aborted
+	now          func() time.Time
+	onFailed     func(index int) // Optional: Called for pieces that failed the integrity check
+}
+
+func newBlockScheduler(workQueue chan *pieceWork, hasPiece func(index int) bool, blockSize int) *blockScheduler {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	return &blockScheduler{
+		workQueue:    workQueue,
+		hasPiece:     hasPiece,
+		blockSize:    blockSize,
+		stallTimeout: DefaultStallTimeout,
+		pieces:       make(map[int]*activePiece),
+		order:        make([]int, 0),
+		paths:        make(map[string]*pathState),
+		notify:       make(chan struct{}),
+		now:          time.Now,
+	}
+}
+
+func (s *blockScheduler) numBlocks(length int) int {
+	return (length + s.blockSize - 1) / s.blockSize
+}
+
+// notifyLocked wakes up all paths waiting for blocks, callers must hold the lock
+func (s *blockScheduler) notifyLocked() {
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// addPath registers a new path
+func (s *blockScheduler) addPath(id string) {
+	s.Lock()
+	defer s.Unlock()
+	s.paths[id] = &pathState{
+		estimator:    newPathEstimator(),
+		outstanding:  make(map[blockKey]time.Time),
+		lastProgress: s.now(),
+	}
+}
+
+// removePath removes a path, its unfulfilled requests are requested over the other paths
+func (s *blockScheduler) removePath(id string) {
+	s.Lock()
+	defer s.Unlock()
+	path, ok := s.paths[id]
+	if !ok {
+		return
+	}
+	s.releaseLocked(path)
+	delete(s.paths, id)
+}
+
+// releaseLocked marks the blocks requested over the path as pending, callers must hold the lock
+func (s *blockScheduler) releaseLocked(path *pathState) {
+	for key := range path.outstanding {
+		if piece, ok := s.pieces[key.index]; ok && piece.blocks[key.begin/s.blockSize] == blockRequested {
+			piece.blocks[key.begin/s.blockSize] = blockPending
+		}
+	}
+	if len(path.outstanding) > 0 {
+		path.outstanding = make(map[blockKey]time.Time)
+		s.notifyLocked()
+	}
+}
+
+// outstanding returns the number of unfulfilled requests of the path
+func (s *blockScheduler) outstanding(id string) int {
+	s.Lock()
+	defer s.Unlock()
+	if path, ok := s.paths[id]; ok {
+		return len(path.outstanding)
+	}
+	return 0
+}
+
+// pathEstimate returns a copy of the estimated throughput and round trip time of the path
+func (s *blockScheduler) pathEstimate(id string) pathEstimator {
+	s.Lock()
+	defer s.Unlock()
+	if path, ok := s.paths[id]; ok {
+		return *path.estimator
+	}
+	return pathEstimator{}
+}
+
+// depth returns the number of unfulfilled requests the path should have
+func (s *blockScheduler) depth(id string) int {
+	s.Lock()
+	defer s.Unlock()
+	path, ok := s.paths[id]
+	if !ok {
+		return 0
+	}
+	if path.stalled {
+		return 1
+	}
+	return path.estimator.depth(s.blockSize)
+}
+
+// done returns true if there is nothing left to download from this peer
+func (s *blockScheduler) done() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.finished && len(s.pieces) == 0
+}
+
+// wait blocks until blocks may have become available or the timeout expired
+func (s *blockScheduler) wait(timeout time.Duration) {
+	s.Lock()
+	notify := s.notify
+	s.Unlock()
+	select {
+	case <-notify:
+	case <-time.After(timeout):
+	}
+}
+
+// next returns the next block the path should request, preferring pieces that were
+// started first so that pieces complete quickly
+func (s *blockScheduler) next(id string) (blockRequest, bool) {
+	s.Lock()
+	defer s.Unlock()
+	path, ok := s.paths[id]
+	if !ok {
+		return blockRequest{}, false
+	}
+
+	for {
+		if req, ok := s.nextPendingLocked(); ok {
+			s.pieces[req.index].blocks[req.begin/s.blockSize] = blockRequested
+			path.outstanding[blockKey{req.index, req.begin}] = s.now()
+			return req, true
+		}
+		if !s.startPieceLocked() {
+			return blockRequest{}, false
+		}
+	}
+}
+
+// nextPendingLocked returns the first pending block, callers must hold the lock
+func (s *blockScheduler) nextPendingLocked() (blockRequest, bool) {
+	for _, index := range s.order {
+		piece := s.pieces[index]
+		for i, state := range piece.blocks {
+			if state != blockPending {
+				continue
+			}
+			begin := i * s.blockSize
+			return blockRequest{
+				index:  index,
+				begin:  begin,
+				length: min(s.blockSize, piece.work.length-begin),
+			}, true
+		}
+	}
+	return blockRequest{}, false
+}
+
+// startPieceLocked takes the next piece available at the peer from the work queue,
+// callers must hold the lock
+func (s *blockScheduler) startPieceLocked() bool {
+	if s.finished {
+		return false
+	}
+	// Look at each queued piece at most once, the others are put back
+	for i := len(s.workQueue); i >= 0; i-- {
+		select {
+		case pw, ok := <-s.workQueue:
+			if !ok {
+				s.finished = true
+				return false
+			}
+			if !s.hasPiece(pw.index) {
+				s.workQueue <- pw // Put piece back on the queue
+				continue
+			}
+			s.pieces[pw.index] = resumePiece(pw, s.numBlocks(pw.length))
+			s.order = append(s.order, pw.index)
+			return true
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// resumePiece creates an activePiece, keeping the blocks received before the piece was put back on the queue
+func resumePiece(pw *pieceWork, numBlocks int) *activePiece {
+	piece := &activePiece{
+		work:   pw,
+		buf:    make([]byte, pw.length),
+		blocks: make([]blockState, numBlocks),
+	}
+	if len(pw.buf) != pw.length || len(pw.done) != numBlocks {
+		return piece
+	}
+	piece.buf = pw.buf
+	for i, done := range pw.done {
+		if done {
+			piece.blocks[i] = blockDone
+			piece.done++
+		}
+	}
+	return piece
+}
+
+// received stores a block received over the path. If it completes a piece that
+// passes the integrity check, the piece is returned.
+func (s *blockScheduler) received(id string, index int, begin int, data []byte) (*pieceResult, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := blockKey{index, begin}
+	if path, ok := s.paths[id]; ok {
+		now := s.now()
+		if requestedAt, ok := path.outstanding[key]; ok {
+			path.estimator.onBlock(len(data), now.Sub(requestedAt), now)
+			delete(path.outstanding, key)
+		}
+		path.lastProgress = now
+		path.stalled = false
+	}
+
+	piece, ok := s.pieces[index]
+	if !ok || begin%s.blockSize != 0 || begin >= piece.work.length {
+		// Late block of a piece that was completed over another path
+		return nil, nil
+	}
+	block := begin / s.blockSize
+	if piece.blocks[block] == blockDone {
+		return nil, nil
+	}
+	if len(data) != min(s.blockSize, piece.work.length-begin) {
+		return nil, fmt.Errorf("unexpected length %d of block %d of piece %d", len(data), begin, index)
+	}
+
+	copy(piece.buf[begin:], data)
+	piece.blocks[block] = blockDone
+	piece.done++
+	if piece.done < len(piece.blocks) {
+		return nil, nil
+	}
+
+	if err := checkIntegrity(piece.work, piece.buf); err != nil {
+		log.Warnf("%s, downloading it again", err)
+		if s.onFailed != nil {
+			s.onFailed(index)
+		}
+		piece.blocks = make([]blockState, len(piece.blocks))
+		piece.done = 0
+		s.notifyLocked()
+		return nil, nil
+	}
+
+	s.removePieceLocked(index)
+	return &pieceResult{index, piece.buf}, nil
+}
+
+func (s *blockScheduler) removePieceLocked(index int) {
+	delete(s.pieces, index)
+	for i, v := range s.order {
+		if v == index {
+			s.order = append(s.order[:i:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// checkStalls requests the blocks of paths that did not deliver any block within the
+// stall timeout over the other paths. Returns the ids of the stalled paths.
+func (s *blockScheduler) checkStalls() []string {
+	s.Lock()
+	defer s.Unlock()
+	stalled := make([]string, 0)
+	now := s.now()
+	for id, path := range s.paths {
+		if len(path.outstanding) == 0 || now.Sub(path.lastProgress) < s.stallTimeout {
+			continue
+		}
+		s.releaseLocked(path)
+		path.stalled = true
+		stalled = append(stalled, id)
+	}
+	return stalled
+}
+
+// monitor periodically checks for stalled paths until stop is closed
+func (s *blockScheduler) monitor(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for _, id := range s.checkStalls() {
+			log.Infof("Path of conn %s stalled, requesting its blocks over other paths", id)
+		}
+	}
+}
+
+// abort puts all unfinished pieces back on the work queue, so that other peers or a new
+// session to the same peer can download their missing blocks
+func (s *blockScheduler) abort() {
+	s.Lock()
+	defer s.Unlock()
+	wasFinished := s.finished
+	s.finished = true
+	for _, index := range s.order {
+		if wasFinished {
+			break
+		}
+		piece := s.pieces[index]
+		piece.work.buf = piece.buf
+		piece.work.done = make([]bool, len(piece.blocks))
+		for i, state := range piece.blocks {
+			piece.work.done[i] = state == blockDone
+		}
+		s.workQueue <- piece.work
+	}
+	s.pieces = make(map[int]*activePiece)
+	s.order = make([]int, 0)
+	s.notifyLocked()
+}
+
+// pathEstimator estimates the throughput and the round trip time of a path from the blocks it delivers
+type pathEstimator struct {
+	rtt         time.Duration
+	throughput  float64 // Bytes per second
+	windowStart time.Time
+	windowBytes int
+}
+
+// throughputWindow is the interval over which received bytes are accumulated for a throughput sample
+const throughputWindow = 500 * time.Millisecond
+
+func newPathEstimator() *pathEstimator {
+	return &pathEstimator{}
+}
+
+func (e *pathEstimator) onBlock(bytes int, latency time.Duration, now time.Time) {
+	// The latency of a block includes the time it waited behind the other requests
+	// of the pipeline, so the lowest latency is the best estimate of the round trip time.
+	// Slowly increase the estimate to follow route changes.
+	if e.rtt == 0 || latency < e.rtt {
+		e.rtt = latency
+	} else {
+		e.rtt += (latency - e.rtt) / 64
+	}
+
+	if e.windowStart.IsZero() {
+		e.windowStart = now.Add(-latency)
+	}
+	e.windowBytes += bytes
+	elapsed := now.Sub(e.windowStart)
+	if elapsed < throughputWindow {
+		return
+	}
+	sample := float64(e.windowBytes) / elapsed.Seconds()
+	if e.throughput == 0 {
+		e.throughput = sample
+	} else {
+		e.throughput = 0.7*e.throughput + 0.3*sample
+	}
+	e.windowStart = now
+	e.windowBytes = 0
+}
+
+// depth returns twice the bandwidth-delay product in blocks. The measured throughput
+// is limited by the depth itself, so the headroom lets the pipeline grow until the path is saturated.
+func (e *pathEstimator) depth(blockSize int) int {
+	if e.throughput == 0 || e.rtt == 0 {
+		return MinBacklog
+	}
+	bdp := e.throughput * e.rtt.Seconds()
+	depth := int(math.Ceil(2 * bdp / float64(blockSize)))
+	if depth < MinBacklog {
+		return MinBacklog
+	}
+	if depth > MaxBacklog {
+		return MaxBacklog
+	}
+	return depth
+}
@@ -0,0 +1,197 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestScheduler queues pieces of the given lengths, filled with their index
+func newTestScheduler(lengths []int, hasPiece func(index int) bool) (*blockScheduler, [][]byte) {
+	workQueue := make(chan *pieceWork, len(lengths))
+	contents := make([][]byte, len(lengths))
+	for i, length := range lengths {
+		contents[i] = make([]byte, length)
+		for j := range contents[i] {
+			contents[i][j] = byte(i)
+		}
+		workQueue <- &pieceWork{index: i, hash: sha1.Sum(contents[i]), length: length}
+	}
+	return newBlockScheduler(workQueue, hasPiece, 4), contents
+}
+
+func hasAll(index int) bool {
+	return true
+}
+
+func TestSchedulerAssignsBlocks(t *testing.T) {
+	s, contents := newTestScheduler([]int{10, 4}, hasAll)
+	s.addPath("a")
+	s.addPath("b")
+
+	expected := []blockRequest{{0, 0, 4}, {0, 4, 4}, {0, 8, 2}, {1, 0, 4}}
+	for i, exp := range expected {
+		path := []string{"a", "b"}[i%2]
+		req, ok := s.next(path)
+		require.True(t, ok)
+		assert.Equal(t, exp, req)
+	}
+	_, ok := s.next("a")
+	assert.False(t, ok)
+	assert.Equal(t, 2, s.outstanding("a"))
+	assert.Equal(t, 2, s.outstanding("b"))
+
+	res, err := s.received("a", 0, 0, contents[0][0:4])
+	assert.Nil(t, err)
+	assert.Nil(t, res)
+	res, err = s.received("b", 0, 4, contents[0][4:8])
+	assert.Nil(t, err)
+	assert.Nil(t, res)
+	res, err = s.received("a", 0, 8, contents[0][8:10])
+	assert.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, 0, res.index)
+	assert.Equal(t, contents[0], res.buf)
+	assert.Equal(t, 0, s.outstanding("a"))
+
+	// Duplicates of completed pieces are ignored
+	res, err = s.received("b", 0, 4, contents[0][4:8])
+	assert.Nil(t, err)
+	assert.Nil(t, res)
+}
+
+func TestSchedulerRetriesCorruptPiece(t *testing.T) {
+	s, _ := newTestScheduler([]int{4}, hasAll)
+	s.addPath("a")
+	_, ok := s.next("a")
+	require.True(t, ok)
+
+	res, err := s.received("a", 0, 0, []byte{1, 2, 3, 4})
+	assert.Nil(t, err)
+	assert.Nil(t, res)
+
+	req, ok := s.next("a")
+	require.True(t, ok)
+	assert.Equal(t, blockRequest{0, 0, 4}, req)
+}
+
+func TestSchedulerReassignsStalledPath(t *testing.T) {
+	now := time.Now()
+	s, contents := newTestScheduler([]int{8}, hasAll)
+	s.now = func() time.Time { return now }
+	s.addPath("slow")
+	s.addPath("fast")
+
+	req, ok := s.next("slow")
+	require.True(t, ok)
+	_, ok = s.next("fast")
+	require.True(t, ok)
+	_, err := s.received("fast", 0, 4, contents[0][4:8])
+	require.Nil(t, err)
+
+	now = now.Add(DefaultStallTimeout)
+	assert.Equal(t, []string{"slow"}, s.checkStalls())
+	assert.Equal(t, 0, s.outstanding("slow"))
+	assert.Equal(t, 1, s.depth("slow"))
+
+	reassigned, ok := s.next("fast")
+	require.True(t, ok)
+	assert.Equal(t, req, reassigned)
+	res, err := s.received("fast", 0, 0, contents[0][0:4])
+	assert.Nil(t, err)
+	require.NotNil(t, res)
+	assert.False(t, s.done())
+}
+
+func TestSchedulerRemovePathReleasesBlocks(t *testing.T) {
+	s, _ := newTestScheduler([]int{4}, hasAll)
+	s.addPath("a")
+	s.addPath("b")
+	req, ok := s.next("a")
+	require.True(t, ok)
+	_, ok = s.next("b")
+	require.False(t, ok)
+
+	s.removePath("a")
+	reassigned, ok := s.next("b")
+	require.True(t, ok)
+	assert.Equal(t, req, reassigned)
+}
+
+func TestSchedulerSkipsMissingPieces(t *testing.T) {
+	s, _ := newTestScheduler([]int{4, 4}, func(index int) bool { return index == 1 })
+	s.addPath("a")
+	req, ok := s.next("a")
+	require.True(t, ok)
+	assert.Equal(t, 1, req.index)
+	_, ok = s.next("a")
+	assert.False(t, ok)
+	assert.Equal(t, 1, len(s.workQueue))
+
+	s.abort()
+	assert.Equal(t, 2, len(s.workQueue))
+	assert.True(t, s.done())
+}
+
+func TestSchedulerFinishesOnClosedQueue(t *testing.T) {
+	s, _ := newTestScheduler([]int{}, hasAll)
+	close(s.workQueue)
+	s.addPath("a")
+	_, ok := s.next("a")
+	assert.False(t, ok)
+	assert.True(t, s.done())
+}
+
+func TestPathEstimatorDepth(t *testing.T) {
+	e := newPathEstimator()
+	assert.Equal(t, MinBacklog, e.depth(16*KiB))
+
+	// 16 blocks of 16 KiB per 100ms with 40ms round trip time
+	now := time.Now()
+	for i := 0; i < 16*10; i++ {
+		now = now.Add(100 * time.Millisecond / 16)
+		e.onBlock(16*KiB, 40*time.Millisecond, now)
+	}
+	assert.Equal(t, 40*time.Millisecond, e.rtt)
+	assert.InEpsilon(t, 16*16*KiB*10, e.throughput, 0.1)
+	// Bandwidth-delay product is 6.4 blocks
+	assert.Equal(t, 13, e.depth(16*KiB))
+
+	// Very fast paths are limited
+	e.throughput = 1024 * 1024 * 1024
+	assert.Equal(t, MaxBacklog, e.depth(16*KiB))
+}
+
+func TestSchedulerKeepsBlocksOnAbort(t *testing.T) {
+	s, contents := newTestScheduler([]int{12}, hasAll)
+	s.addPath("a")
+	for i := 0; i < 3; i++ {
+		_, ok := s.next("a")
+		require.True(t, ok)
+	}
+	_, err := s.received("a", 0, 4, contents[0][4:8])
+	require.Nil(t, err)
+	s.abort()
+
+	// A new session only requests the missing blocks
+	resumed := newBlockScheduler(s.workQueue, hasAll, 4)
+	resumed.addPath("b")
+	req, ok := resumed.next("b")
+	require.True(t, ok)
+	assert.Equal(t, blockRequest{0, 0, 4}, req)
+	req, ok = resumed.next("b")
+	require.True(t, ok)
+	assert.Equal(t, blockRequest{0, 8, 4}, req)
+	_, ok = resumed.next("b")
+	assert.False(t, ok)
+
+	_, err = resumed.received("b", 0, 0, contents[0][0:4])
+	require.Nil(t, err)
+	res, err := resumed.received("b", 0, 8, contents[0][8:12])
+	require.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, contents[0], res.buf)
+}
@@ -0,0 +1,58 @@
+package main
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/anacrolix/tagflag"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/netsys-lab/bittorrent-over-scion/pathselection"
+)
+
+var pathsFlags = struct {
+	PathHistory string `help:"File in which the quality of used paths is recorded"`
+	IA          string `help:"Optional: Only show paths to this ISD-AS"`
+}{
+	PathHistory: pathselection.DefaultPathHistoryFile(),
+}
+
+// runPathsCommand prints the recorded quality of paths, grouped by the ISD-AS of the remote peers
+func runPathsCommand(args []string) {
+	tagflag.ParseArgs(&pathsFlags, args, tagflag.Program("bittorrent-over-scion paths"))
+
+	history, err := pathselection.OpenPathHistory(pathsFlags.PathHistory)
+	if err != nil {
+		log.Fatalf("Could not open path history %s: %s", pathsFlags.PathHistory, err)
+	}
+
+	ias := history.DestinationIAs()
+	if pathsFlags.IA != "" {
+		ias = []string{pathsFlags.IA}
+	}
+	if len(ias) == 0 {
+		fmt.Printf("No paths recorded in %s\n", pathsFlags.PathHistory)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, ia := range ias {
+		fmt.Fprintf(w, "%s\n", ia)
+		fmt.Fprintln(w, "  THROUGHPUT\tRTT\tOK\tFAILED\tLAST SEEN\tPATH")
+		for _, r := range history.Records(ia) {
+			rtt := "-"
+			if r.RTT > 0 {
+				rtt = r.RTT.Round(time.Millisecond).String()
+			}
+			fmt.Fprintf(w, "  %.2f Mbit/s\t%s\t%d\t%d\t%s\t%s\n",
+				float64(r.Throughput*8)/1024/1024, rtt, r.Successes, r.Failures,
+				r.LastSeen.Format("2006-01-02 15:04"), r.Path)
+		}
+	}
+	w.Flush()
+}
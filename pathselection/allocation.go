@@ -0,0 +1,83 @@
+package pathselection
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"fmt"
+)
+
+// AllocationStrategy weights peers when the PathSelectionStore distributes conflicting
+// paths. A peer takes a conflicting path from another peer if the other peer uses more
+// paths relative to its weight, so peers with twice the weight end up with about twice
+// as many disjoint paths.
+type AllocationStrategy interface {
+	// Weight returns a positive weight for the peer
+	Weight(entry PeerPathEntry) float64
+}
+
+// NewAllocationStrategy returns the strategy with the given name: equal, priority,
+// remaining or bandwidth. An empty name selects the equal strategy.
+func NewAllocationStrategy(name string) (AllocationStrategy, error) {
+	switch name {
+	case "", "equal":
+		return EqualAllocation{}, nil
+	case "priority":
+		return PriorityAllocation{}, nil
+	case "remaining":
+		return RemainingAllocation{}, nil
+	case "bandwidth":
+		return BandwidthAllocation{}, nil
+	}
+	return nil, fmt.Errorf("unknown path allocation strategy %q, available: equal, priority, remaining, bandwidth", name)
+}
+
+// EqualAllocation treats all peers equally
+type EqualAllocation struct{}
+
+func (EqualAllocation) Weight(entry PeerPathEntry) float64 {
+	return 1
+}
+
+// PriorityAllocation weights peers by their priority class, peers without priority get weight 1
+type PriorityAllocation struct{}
+
+func (PriorityAllocation) Weight(entry PeerPathEntry) float64 {
+	if entry.Priority < 1 {
+		return 1
+	}
+	return float64(entry.Priority)
+}
+
+// RemainingAllocation weights peers by the number of bytes they still need, in MiB.
+// Peers that are almost done get weight 1.
+type RemainingAllocation struct{}
+
+func (RemainingAllocation) Weight(entry PeerPathEntry) float64 {
+	mib := float64(entry.Left) / 1024 / 1024
+	if mib < 1 {
+		return 1
+	}
+	return mib
+}
+
+// BandwidthAllocation weights peers by the bandwidth measured over their paths in Mbit/s,
+// so that peers able to receive faster get more paths. Peers without measurements get weight 1.
+type BandwidthAllocation struct{}
+
+func (BandwidthAllocation) Weight(entry PeerPathEntry) float64 {
+	mbits := float64(entry.Bandwidth*8) / 1024 / 1024
+	if mbits < 1 {
+		return 1
+	}
+	return mbits
+}
+
+// normalizedUsage returns the number of used paths relative to the weight of the peer
+func normalizedUsage(strategy AllocationStrategy, entry PeerPathEntry, usedPaths int) float64 {
+	weight := strategy.Weight(entry)
+	if weight <= 0 {
+		weight = 1
+	}
+	return float64(usedPaths) / weight
+}
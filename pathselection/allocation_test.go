@@ -0,0 +1,79 @@
+package pathselection
+
+import (
+	"testing"
+
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// All paths to both peers leave the local AS s over one of four interfaces,
+// so each path of one peer conflicts with exactly one path of the other peer
+func addCompetingPeers(store *PathSelectionStore, casual, mirror PeerPathEntry) {
+	casual.AvailablePaths = []snet.Path{makePath("s#1", "x#1"), makePath("s#2", "x#2"), makePath("s#3", "x#3"), makePath("s#4", "x#4")}
+	mirror.AvailablePaths = []snet.Path{makePath("s#1", "y#1"), makePath("s#2", "y#2"), makePath("s#3", "y#3"), makePath("s#4", "y#4")}
+	store.AddPeerEntry(casual)
+	store.AddPeerEntry(mirror)
+}
+
+func TestEqualAllocation(t *testing.T) {
+	store := NewPathSelectionStore()
+	addCompetingPeers(store, PeerPathEntry{PeerAddrStr: "casual"}, PeerPathEntry{PeerAddrStr: "mirror", Priority: 3})
+	assert.Equal(t, 2, len(store.Get("casual").UsedPaths))
+	assert.Equal(t, 2, len(store.Get("mirror").UsedPaths))
+}
+
+func TestPriorityAllocation(t *testing.T) {
+	store := NewPathSelectionStore()
+	store.SetAllocationStrategy(PriorityAllocation{})
+	addCompetingPeers(store, PeerPathEntry{PeerAddrStr: "casual"}, PeerPathEntry{PeerAddrStr: "mirror", Priority: 3})
+	assert.Equal(t, 1, len(store.Get("casual").UsedPaths))
+	assert.Equal(t, 3, len(store.Get("mirror").UsedPaths))
+
+	// Once the mirror is gone, the casual peer gets all paths back
+	changed := store.RemovePeerEntry("mirror")
+	assert.Equal(t, []string{"casual"}, changed)
+	assert.Equal(t, 4, len(store.Get("casual").UsedPaths))
+}
+
+func TestRemainingAllocation(t *testing.T) {
+	store := NewPathSelectionStore()
+	store.SetAllocationStrategy(RemainingAllocation{})
+	addCompetingPeers(store,
+		PeerPathEntry{PeerAddrStr: "casual", Left: 1024 * 1024},
+		PeerPathEntry{PeerAddrStr: "mirror", Left: 3 * 1024 * 1024})
+	assert.Equal(t, 1, len(store.Get("casual").UsedPaths))
+	assert.Equal(t, 3, len(store.Get("mirror").UsedPaths))
+}
+
+func TestUpdatePeerStats(t *testing.T) {
+	store := NewPathSelectionStore()
+	store.SetAllocationStrategy(BandwidthAllocation{})
+	store.AddPeerEntry(PeerPathEntry{PeerAddrStr: "peer", AvailablePaths: []snet.Path{makePath("s#1", "x#1")}})
+	store.UpdatePeerStats("peer", 10, 1024*1024)
+	store.UpdatePeerStats("unknown", 10, 1024*1024)
+
+	entry := store.Get("peer")
+	assert.Equal(t, int64(10), entry.Left)
+	assert.Equal(t, int64(1024*1024), entry.Bandwidth)
+	assert.Equal(t, float64(8), BandwidthAllocation{}.Weight(entry))
+	assert.False(t, store.Contains("unknown"))
+}
+
+func TestNewAllocationStrategy(t *testing.T) {
+	for name, expected := range map[string]AllocationStrategy{
+		"":          EqualAllocation{},
+		"equal":     EqualAllocation{},
+		"priority":  PriorityAllocation{},
+		"remaining": RemainingAllocation{},
+		"bandwidth": BandwidthAllocation{},
+	} {
+		strategy, err := NewAllocationStrategy(name)
+		require.Nil(t, err)
+		assert.Equal(t, expected, strategy)
+	}
+
+	_, err := NewAllocationStrategy("unknown")
+	assert.NotNil(t, err)
+}
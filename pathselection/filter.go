@@ -0,0 +1,205 @@
+package pathselection
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	smppath "github.com/netsys-lab/scion-path-discovery/pathselection"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// ErrNoCompliantPath is returned if a PathFilter rejects all paths to a peer
+var ErrNoCompliantPath = errors.New("no path complies with the configured path filter")
+
+// PathFilterRule matches path interfaces by ISD, AS and interface ID. Zero values
+// act as wildcards, so a rule with only the ISD set matches every interface in this ISD.
+type PathFilterRule struct {
+	ISD  addr.ISD
+	AS   addr.AS
+	IfID common.IFIDType
+}
+
+// ParsePathFilterRule parses a rule of the form ISD (e.g. 17), ISD-AS (e.g. 17-ffaa:0:1101)
+// or ISD-AS#IfID (e.g. 17-ffaa:0:1101#2)
+func ParsePathFilterRule(s string) (PathFilterRule, error) {
+	s = strings.TrimSpace(s)
+	iaStr, ifidStr := s, ""
+	if i := strings.Index(s, "#"); i >= 0 {
+		iaStr, ifidStr = s[:i], s[i+1:]
+	}
+
+	rule := PathFilterRule{}
+	if strings.Contains(iaStr, "-") {
+		ia, err := addr.IAFromString(iaStr)
+		if err != nil {
+			return rule, fmt.Errorf("invalid path filter rule %q: %w", s, err)
+		}
+		rule.ISD, rule.AS = ia.I, ia.A
+	} else {
+		isd, err := addr.ISDFromString(iaStr)
+		if err != nil {
+			return rule, fmt.Errorf("invalid path filter rule %q: %w", s, err)
+		}
+		rule.ISD = isd
+	}
+
+	if ifidStr != "" {
+		if rule.AS == 0 {
+			return rule, fmt.Errorf("invalid path filter rule %q: interface IDs require an AS", s)
+		}
+		ifid, err := strconv.ParseUint(ifidStr, 10, 64)
+		if err != nil {
+			return rule, fmt.Errorf("invalid path filter rule %q: %w", s, err)
+		}
+		rule.IfID = common.IFIDType(ifid)
+	}
+	return rule, nil
+}
+
+func (r PathFilterRule) matches(intf snet.PathInterface) bool {
+	if r.ISD != 0 && r.ISD != intf.IA.I {
+		return false
+	}
+	if r.AS != 0 && r.AS != intf.IA.A {
+		return false
+	}
+	if r.IfID != 0 && r.IfID != intf.ID {
+		return false
+	}
+	return true
+}
+
+func (r PathFilterRule) String() string {
+	s := r.ISD.String()
+	if r.AS != 0 {
+		s = fmt.Sprintf("%s-%s", s, r.AS)
+	}
+	if r.IfID != 0 {
+		s = fmt.Sprintf("%s#%d", s, r.IfID)
+	}
+	return s
+}
+
+// PathFilter restricts the paths seeder and leecher may use. A path complies if none
+// of its interfaces matches a Deny rule and, if Allow rules exist, each of its
+// interfaces matches at least one Allow rule. The filter is applied to the
+// interfaces listed in the path metadata.
+type PathFilter struct {
+	Allow []PathFilterRule
+	Deny  []PathFilterRule
+}
+
+// NewPathFilter creates a PathFilter from comma separated lists of rules in the
+// format of ParsePathFilterRule. Returns nil if both lists are empty.
+func NewPathFilter(allow, deny string) (*PathFilter, error) {
+	allowRules, err := parsePathFilterRules(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyRules, err := parsePathFilterRules(deny)
+	if err != nil {
+		return nil, err
+	}
+	if len(allowRules) == 0 && len(denyRules) == 0 {
+		return nil, nil
+	}
+	return &PathFilter{
+		Allow: allowRules,
+		Deny:  denyRules,
+	}, nil
+}
+
+func parsePathFilterRules(list string) ([]PathFilterRule, error) {
+	rules := make([]PathFilterRule, 0)
+	for _, s := range strings.Split(list, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		rule, err := ParsePathFilterRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Complies returns true if the path may be used according to the filter
+func (f *PathFilter) Complies(path snet.Path) bool {
+	if f == nil {
+		return true
+	}
+	for _, intf := range path.Metadata().Interfaces {
+		for _, rule := range f.Deny {
+			if rule.matches(intf) {
+				return false
+			}
+		}
+
+		if len(f.Allow) == 0 {
+			continue
+		}
+		allowed := false
+		for _, rule := range f.Allow {
+			if rule.matches(intf) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterPaths returns the compliant paths, or ErrNoCompliantPath if there are none
+func (f *PathFilter) FilterPaths(paths []snet.Path) ([]snet.Path, error) {
+	if f == nil {
+		return paths, nil
+	}
+	compliant := make([]snet.Path, 0, len(paths))
+	for _, p := range paths {
+		if f.Complies(p) {
+			compliant = append(compliant, p)
+		}
+	}
+	if len(compliant) == 0 {
+		return nil, ErrNoCompliantPath
+	}
+	return compliant, nil
+}
+
+// FilterPathSet returns a new PathSet with the compliant paths, or ErrNoCompliantPath if there are none
+func (f *PathFilter) FilterPathSet(pathSet *smppath.PathSet) (*smppath.PathSet, error) {
+	if f == nil {
+		return pathSet, nil
+	}
+	filtered := &smppath.PathSet{
+		Address: pathSet.Address,
+		Paths:   make([]smppath.PathQuality, 0, len(pathSet.Paths)),
+	}
+	for _, p := range pathSet.Paths {
+		if f.Complies(p.Path) {
+			filtered.Paths = append(filtered.Paths, p)
+		}
+	}
+	if len(filtered.Paths) == 0 {
+		return nil, ErrNoCompliantPath
+	}
+	return filtered, nil
+}
+
+func (f *PathFilter) String() string {
+	if f == nil {
+		return "none"
+	}
+	return fmt.Sprintf("allow %v, deny %v", f.Allow, f.Deny)
+}
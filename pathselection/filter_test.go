@@ -0,0 +1,98 @@
+package pathselection
+
+import (
+	"testing"
+
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePathFilterRule(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output string
+		fails  bool
+	}{
+		"isd":            {input: "17", output: "17"},
+		"as":             {input: "17-ffaa:0:1101", output: "17-ffaa:0:1101"},
+		"interface":      {input: " 17-ffaa:0:1101#2 ", output: "17-ffaa:0:1101#2"},
+		"isd wildcard":   {input: "17-0", output: "17"},
+		"no as for ifid": {input: "17#2", fails: true},
+		"invalid isd":    {input: "abc", fails: true},
+		"invalid as":     {input: "17-xyz", fails: true},
+		"invalid ifid":   {input: "17-ffaa:0:1101#x", fails: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			rule, err := ParsePathFilterRule(test.input)
+			if test.fails {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, test.output, rule.String())
+		})
+	}
+}
+
+func TestPathFilter(t *testing.T) {
+	viaB := makePath("a#1", "b#1", "b#2", "c#1")
+	viaD := makePath("a#2", "d#1", "d#2", "c#2")
+	paths := []snet.Path{viaB, viaD}
+
+	t.Run("NoRules", func(t *testing.T) {
+		filter, err := NewPathFilter("", " ")
+		require.Nil(t, err)
+		assert.Nil(t, filter)
+		filtered, err := filter.FilterPaths(paths)
+		require.Nil(t, err)
+		assert.Equal(t, paths, filtered)
+	})
+
+	t.Run("DenyAS", func(t *testing.T) {
+		filter, err := NewPathFilter("", "1-ff00:0:b")
+		require.Nil(t, err)
+		filtered, err := filter.FilterPaths(paths)
+		require.Nil(t, err)
+		assert.Equal(t, []snet.Path{viaD}, filtered)
+	})
+
+	t.Run("DenyInterface", func(t *testing.T) {
+		filter, err := NewPathFilter("", "1-ff00:0:d#2")
+		require.Nil(t, err)
+		assert.True(t, filter.Complies(viaB))
+		assert.False(t, filter.Complies(viaD))
+	})
+
+	t.Run("AllowASes", func(t *testing.T) {
+		filter, err := NewPathFilter("1-ff00:0:a,1-ff00:0:d,1-ff00:0:c", "")
+		require.Nil(t, err)
+		filtered, err := filter.FilterPathSet(makePathSet(viaB, viaD))
+		require.Nil(t, err)
+		assert.Equal(t, []snet.Path{viaD}, selectedPaths(filtered))
+	})
+
+	t.Run("DenyISD", func(t *testing.T) {
+		filter, err := NewPathFilter("", "1")
+		require.Nil(t, err)
+		_, err = filter.FilterPaths(paths)
+		assert.Equal(t, ErrNoCompliantPath, err)
+		_, err = filter.FilterPathSet(makePathSet(viaB, viaD))
+		assert.Equal(t, ErrNoCompliantPath, err)
+	})
+
+	t.Run("DenyWinsOverAllow", func(t *testing.T) {
+		filter, err := NewPathFilter("1", "1-ff00:0:b")
+		require.Nil(t, err)
+		filtered, err := filter.FilterPaths(paths)
+		require.Nil(t, err)
+		assert.Equal(t, []snet.Path{viaD}, filtered)
+	})
+
+	t.Run("InvalidRule", func(t *testing.T) {
+		_, err := NewPathFilter("1-ff00:0:a,foo", "")
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,250 @@
+package pathselection
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	smppath "github.com/netsys-lab/scion-path-discovery/pathselection"
+)
+
+// PathHistoryMaxAge is the time after which records of paths that were not used are dropped
+const PathHistoryMaxAge = 30 * 24 * time.Hour
+
+// PathRecord holds the quality observed over a path during previous transfers
+type PathRecord struct {
+	Path       string        // Fingerprint of the path, see pathselection.PathToString
+	Throughput int64         // Average throughput in bytes per second
+	RTT        time.Duration // Average round trip time, 0 if unknown
+	Successes  int           // Number of transfers that completed over the path
+	Failures   int           // Number of transfers that failed over the path
+	LastSeen   time.Time
+}
+
+// PathObservation is the outcome of a single transfer over a path
+type PathObservation struct {
+	Throughput int64
+	RTT        time.Duration
+	Failed     bool
+}
+
+// Score ranks the record: paths that failed more often than they succeeded score below
+// zero, others score by their throughput
+func (r PathRecord) Score() float64 {
+	if r.Failures > r.Successes {
+		return -float64(r.Failures - r.Successes)
+	}
+	return float64(r.Throughput)
+}
+
+// PathHistory is a file-backed database of the quality of paths, grouped by the ISD-AS
+// of the remote peer. It is safe for concurrent use.
+type PathHistory struct {
+	sync.RWMutex
+	file         string
+	Destinations map[string]map[string]PathRecord `json:"destinations"`
+	now          func() time.Time
+}
+
+// DefaultPathHistoryFile returns the default location of the path history in the user's config directory
+func DefaultPathHistoryFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "bittorrent-over-scion", "paths.json")
+}
+
+// OpenPathHistory loads the history from the file. If the file does not exist yet,
+// an empty history is returned that is written to the file on Save.
+func OpenPathHistory(file string) (*PathHistory, error) {
+	h := &PathHistory{
+		file:         file,
+		Destinations: make(map[string]map[string]PathRecord),
+		now:          time.Now,
+	}
+	data, err := ioutil.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, h); err != nil {
+		return nil, err
+	}
+	if h.Destinations == nil {
+		h.Destinations = make(map[string]map[string]PathRecord)
+	}
+	h.expire()
+	return h, nil
+}
+
+// expire drops records older than PathHistoryMaxAge
+func (h *PathHistory) expire() {
+	for ia, records := range h.Destinations {
+		for path, record := range records {
+			if h.now().Sub(record.LastSeen) > PathHistoryMaxAge {
+				delete(records, path)
+			}
+		}
+		if len(records) == 0 {
+			delete(h.Destinations, ia)
+		}
+	}
+}
+
+// Save writes the history to its file
+func (h *PathHistory) Save() error {
+	if h == nil {
+		return nil
+	}
+	h.RLock()
+	data, err := json.MarshalIndent(h, "", "  ")
+	h.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(h.file), 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that the history is never left half written
+	tmp := h.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.file)
+}
+
+// Record adds an observation of the path to the remote ISD-AS
+func (h *PathHistory) Record(ia string, path string, o PathObservation) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	records, ok := h.Destinations[ia]
+	if !ok {
+		records = make(map[string]PathRecord)
+		h.Destinations[ia] = records
+	}
+	record, known := records[path]
+	record.Path = path
+	record.LastSeen = h.now()
+	if o.Failed {
+		record.Failures++
+	} else {
+		record.Successes++
+	}
+	if o.Throughput > 0 {
+		record.Throughput = average(record.Throughput, o.Throughput, known)
+	}
+	if o.RTT > 0 {
+		record.RTT = time.Duration(average(int64(record.RTT), int64(o.RTT), record.RTT > 0))
+	}
+	records[path] = record
+}
+
+// average weights the new value with 0.5 to adapt quickly to changes of the network
+func average(old int64, value int64, hasOld bool) int64 {
+	if !hasOld || old == 0 {
+		return value
+	}
+	return (old + value) / 2
+}
+
+// Get returns the record of the path to the remote ISD-AS
+func (h *PathHistory) Get(ia string, path string) (PathRecord, bool) {
+	if h == nil {
+		return PathRecord{}, false
+	}
+	h.RLock()
+	defer h.RUnlock()
+	record, ok := h.Destinations[ia][path]
+	return record, ok
+}
+
+// Records returns the records of all paths to the remote ISD-AS, best paths first
+func (h *PathHistory) Records(ia string) []PathRecord {
+	if h == nil {
+		return nil
+	}
+	h.RLock()
+	defer h.RUnlock()
+	records := make([]PathRecord, 0, len(h.Destinations[ia]))
+	for _, record := range h.Destinations[ia] {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Score() != records[j].Score() {
+			return records[i].Score() > records[j].Score()
+		}
+		return records[i].Path < records[j].Path
+	})
+	return records
+}
+
+// DestinationIAs returns the sorted ISD-ASes for which records exist
+func (h *PathHistory) DestinationIAs() []string {
+	if h == nil {
+		return nil
+	}
+	h.RLock()
+	defer h.RUnlock()
+	ias := make([]string, 0, len(h.Destinations))
+	for ia := range h.Destinations {
+		ias = append(ias, ia)
+	}
+	sort.Strings(ias)
+	return ias
+}
+
+// HistoryPathPolicy biases another policy towards paths that performed well before:
+// paths known to be good come first, ordered by their throughput, followed by unknown
+// paths in the order of the other policy and paths that failed more often than not.
+type HistoryPathPolicy struct {
+	Base    PathPolicy
+	History *PathHistory
+}
+
+// WithHistory wraps the policy in a HistoryPathPolicy, if a history is given
+func WithHistory(policy PathPolicy, history *PathHistory) PathPolicy {
+	if history == nil {
+		return policy
+	}
+	return &HistoryPathPolicy{Base: policy, History: history}
+}
+
+func (p *HistoryPathPolicy) Select(pathSet *smppath.PathSet, n int) *smppath.PathSet {
+	ordered := p.Base.Select(pathSet, 0)
+	ia := pathSet.Address.IA.String()
+	rank := func(q smppath.PathQuality) (int, float64) {
+		record, ok := p.History.Get(ia, smppath.PathToString(q.Path))
+		switch {
+		case !ok:
+			return 1, 0
+		case record.Score() < 0:
+			return 2, record.Score()
+		default:
+			return 0, record.Score()
+		}
+	}
+	paths := append([]smppath.PathQuality{}, ordered.Paths...)
+	sort.SliceStable(paths, func(i, j int) bool {
+		classI, scoreI := rank(paths[i])
+		classJ, scoreJ := rank(paths[j])
+		if classI != classJ {
+			return classI < classJ
+		}
+		return scoreI > scoreJ
+	})
+	return selectFirst(ordered.Address, paths, n)
+}
@@ -0,0 +1,92 @@
+package pathselection
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	smppath "github.com/netsys-lab/scion-path-discovery/pathselection"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathHistoryRecord(t *testing.T) {
+	h, err := OpenPathHistory(filepath.Join(t.TempDir(), "paths.json"))
+	require.Nil(t, err)
+
+	h.Record("1-ff00:0:1", "a", PathObservation{Throughput: 100, RTT: 40 * time.Millisecond})
+	h.Record("1-ff00:0:1", "a", PathObservation{Throughput: 300, RTT: 20 * time.Millisecond})
+	h.Record("1-ff00:0:1", "b", PathObservation{Failed: true})
+
+	a, ok := h.Get("1-ff00:0:1", "a")
+	require.True(t, ok)
+	assert.Equal(t, int64(200), a.Throughput)
+	assert.Equal(t, 30*time.Millisecond, a.RTT)
+	assert.Equal(t, 2, a.Successes)
+
+	b, ok := h.Get("1-ff00:0:1", "b")
+	require.True(t, ok)
+	assert.Equal(t, 1, b.Failures)
+	assert.True(t, b.Score() < 0)
+
+	_, ok = h.Get("1-ff00:0:2", "a")
+	assert.False(t, ok)
+}
+
+func TestPathHistoryPersistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dir", "paths.json")
+	h, err := OpenPathHistory(file)
+	require.Nil(t, err)
+	h.Record("1-ff00:0:1", "a", PathObservation{Throughput: 100})
+	h.Record("1-ff00:0:2", "b", PathObservation{Throughput: 50})
+	require.Nil(t, h.Save())
+
+	loaded, err := OpenPathHistory(file)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"1-ff00:0:1", "1-ff00:0:2"}, loaded.DestinationIAs())
+	records := loaded.Records("1-ff00:0:1")
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, "a", records[0].Path)
+	assert.Equal(t, int64(100), records[0].Throughput)
+}
+
+func TestPathHistoryExpiry(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "paths.json")
+	h, err := OpenPathHistory(file)
+	require.Nil(t, err)
+	h.now = func() time.Time { return time.Now().Add(-PathHistoryMaxAge - time.Hour) }
+	h.Record("1-ff00:0:1", "old", PathObservation{Throughput: 100})
+	h.now = time.Now
+	h.Record("1-ff00:0:1", "new", PathObservation{Throughput: 100})
+	require.Nil(t, h.Save())
+
+	loaded, err := OpenPathHistory(file)
+	require.Nil(t, err)
+	_, ok := loaded.Get("1-ff00:0:1", "old")
+	assert.False(t, ok)
+	_, ok = loaded.Get("1-ff00:0:1", "new")
+	assert.True(t, ok)
+}
+
+func TestHistoryPathPolicy(t *testing.T) {
+	unknown := makePath("1-ff00:0:1#1", "1-ff00:0:2#1")
+	slow := makePath("1-ff00:0:1#2", "1-ff00:0:2#2")
+	fast := makePath("1-ff00:0:1#3", "1-ff00:0:3#1", "1-ff00:0:3#2", "1-ff00:0:2#3")
+	failing := makePath("1-ff00:0:1#4", "1-ff00:0:2#4")
+	pathSet := makePathSet(failing, unknown, slow, fast)
+
+	h, err := OpenPathHistory(filepath.Join(t.TempDir(), "paths.json"))
+	require.Nil(t, err)
+	ia := pathSet.Address.IA.String()
+	h.Record(ia, smppath.PathToString(slow), PathObservation{Throughput: 10})
+	h.Record(ia, smppath.PathToString(fast), PathObservation{Throughput: 100})
+	h.Record(ia, smppath.PathToString(failing), PathObservation{Failed: true})
+
+	policy := WithHistory(&ShortestPathPolicy{}, h)
+	assert.Equal(t, []snet.Path{fast, slow, unknown, failing}, selectedPaths(policy.Select(pathSet, 0)))
+	assert.Equal(t, []snet.Path{fast}, selectedPaths(policy.Select(pathSet, 1)))
+
+	// Without history, the policy is used as is
+	assert.Equal(t, &ShortestPathPolicy{}, WithHistory(&ShortestPathPolicy{}, nil))
+}
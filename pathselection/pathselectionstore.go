@@ -1,9 +1,10 @@
 package pathselection
 
 import (
-	"fmt"
 	"sort"
+	"sync"
 
+	"github.com/netsys-lab/scion-path-discovery/pathselection"
 	"github.com/scionproto/scion/go/lib/snet"
 	log "github.com/sirupsen/logrus"
 )
@@ -13,6 +14,9 @@ type PeerPathEntry struct {
 	PeerAddr       snet.UDPAddr
 	AvailablePaths []snet.Path
 	UsedPaths      []snet.Path
+	Priority       int   // Priority class of the peer, used by the PriorityAllocation
+	Left           int64 // Bytes the peer still needs, used by the RemainingAllocation
+	Bandwidth      int64 // Bytes per second measured to the peer, used by the BandwidthAllocation
 }
 
 type ConflictingPathResult struct {
@@ -23,17 +27,74 @@ type ConflictingPathResult struct {
 	NumPathsAvailable int
 }
 
+// PathSelectionStore distributes the paths of the seeder to its peers, so that paths
+// used for different peers are disjoint if possible. It is safe for concurrent use.
 type PathSelectionStore struct {
-	Data map[string]PeerPathEntry
+	sync.RWMutex
+	data     map[string]PeerPathEntry
+	order    []string // Peers in the order they were added
+	strategy AllocationStrategy
 }
 
 func NewPathSelectionStore() *PathSelectionStore {
 	return &PathSelectionStore{
-		Data: make(map[string]PeerPathEntry, 0),
+		data:     make(map[string]PeerPathEntry, 0),
+		order:    make([]string, 0),
+		strategy: EqualAllocation{},
 	}
 }
 
+// SetAllocationStrategy changes how peers are weighted. It applies to all following
+// additions and removals of peers.
+func (p *PathSelectionStore) SetAllocationStrategy(strategy AllocationStrategy) {
+	p.Lock()
+	defer p.Unlock()
+	if strategy == nil {
+		strategy = EqualAllocation{}
+	}
+	p.strategy = strategy
+}
+
+// UpdatePeerStats updates the progress and the measured bandwidth of a peer, which are
+// considered by the allocation strategy the next time paths are distributed
+func (p *PathSelectionStore) UpdatePeerStats(id string, left int64, bandwidth int64) {
+	p.Lock()
+	defer p.Unlock()
+	entry, ok := p.data[id]
+	if !ok {
+		return
+	}
+	entry.Left = left
+	entry.Bandwidth = bandwidth
+	p.data[id] = entry
+}
+
+func (p *PathSelectionStore) usage(entry PeerPathEntry) float64 {
+	return normalizedUsage(p.strategy, entry, len(entry.UsedPaths))
+}
+
+// pathsConflict checks if paths of different peers share any interface
 func pathsConflict(path1, path2 snet.Path) bool {
+	for _, intP1 := range path1.Metadata().Interfaces {
+		for _, intP2 := range path2.Metadata().Interfaces {
+			if intP1.IA.Equal(intP2.IA) && intP1.ID == intP2.ID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ownPathsConflict checks if two paths to the same peer conflict. All paths to a peer
+// start in the local AS and end in the AS of the peer, so these interfaces are ignored
+func ownPathsConflict(path1, path2 snet.Path) bool {
+	return sharedInterfaces(path1, path2) > 0
+}
+
+// sharedInterfaces counts the interfaces both paths traverse, ignoring the
+// interfaces of the local and the remote AS that every path to a peer shares
+func sharedInterfaces(path1, path2 snet.Path) int {
+	shared := 0
 	path1Interfaces := path1.Metadata().Interfaces
 	path2Interfaces := path2.Metadata().Interfaces
 	for i, intP1 := range path1Interfaces {
@@ -45,11 +106,11 @@ func pathsConflict(path1, path2 snet.Path) bool {
 				continue
 			}
 			if intP1.IA.Equal(intP2.IA) && intP1.ID == intP2.ID {
-				return true
+				shared++
 			}
 		}
 	}
-	return false
+	return shared
 }
 
 // Returns the pathIndex of the first conflicting path, or -1 if no conflicts
@@ -68,7 +129,7 @@ func getConflictFreePaths(peer PeerPathEntry) []snet.Path {
 	for _, p1 := range peer.UsedPaths {
 		pathsConflicted := false
 		for _, p2 := range paths {
-			if pathsConflict(p1, p2) {
+			if ownPathsConflict(p1, p2) {
 				pathsConflicted = true
 				break
 			}
@@ -81,37 +142,95 @@ func getConflictFreePaths(peer PeerPathEntry) []snet.Path {
 	return paths
 }
 
-// Sorts descending by the number of paths used
-func sortPeerPathEntries(entries []PeerPathEntry) []PeerPathEntry {
-	sort.Slice(entries, func(i, j int) bool {
-		return len(entries[i].UsedPaths) < len(entries[j].UsedPaths)
+// Sorts descending by the number of paths used relative to the weight, peers added earlier first
+func (p *PathSelectionStore) sortPeerPathEntries(entries []PeerPathEntry) []PeerPathEntry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return p.usage(entries[i]) > p.usage(entries[j])
 	})
 
 	return entries
 }
 
+func copyPeerPathEntry(entry PeerPathEntry) PeerPathEntry {
+	entry.AvailablePaths = append([]snet.Path{}, entry.AvailablePaths...)
+	entry.UsedPaths = append([]snet.Path{}, entry.UsedPaths...)
+	return entry
+}
+
+// Get returns a copy of the entry of the peer, or an empty entry if the peer is unknown
 func (p *PathSelectionStore) Get(id string) PeerPathEntry {
-	return p.Data[id]
+	p.RLock()
+	defer p.RUnlock()
+	entry, ok := p.data[id]
+	if !ok {
+		return PeerPathEntry{}
+	}
+	return copyPeerPathEntry(entry)
+}
+
+// Contains returns true if the store has an entry for the peer
+func (p *PathSelectionStore) Contains(id string) bool {
+	p.RLock()
+	defer p.RUnlock()
+	_, ok := p.data[id]
+	return ok
+}
+
+// Len returns the number of peers in the store
+func (p *PathSelectionStore) Len() int {
+	p.RLock()
+	defer p.RUnlock()
+	return len(p.data)
+}
+
+// Snapshot returns a copy of all entries, which may be used without further locking
+func (p *PathSelectionStore) Snapshot() map[string]PeerPathEntry {
+	p.RLock()
+	defer p.RUnlock()
+	snapshot := make(map[string]PeerPathEntry, len(p.data))
+	for id, entry := range p.data {
+		snapshot[id] = copyPeerPathEntry(entry)
+	}
+	return snapshot
+}
+
+// entries returns the entries in the order they were added, callers must hold the lock
+func (p *PathSelectionStore) entries() []PeerPathEntry {
+	entries := make([]PeerPathEntry, 0, len(p.data))
+	for _, id := range p.order {
+		entries = append(entries, p.data[id])
+	}
+	return entries
 }
 
 func (p *PathSelectionStore) updatePeerEntryInStore(entry PeerPathEntry) {
-	p.Data[entry.PeerAddrStr] = entry
+	if _, ok := p.data[entry.PeerAddrStr]; !ok {
+		p.order = append(p.order, entry.PeerAddrStr)
+	}
+	p.data[entry.PeerAddrStr] = entry
 }
 
 func removePathFromEntry(entry PeerPathEntry, pathIndex int) PeerPathEntry {
-	log.Warn(entry.UsedPaths)
-	entry.UsedPaths = append(entry.UsedPaths[:pathIndex], entry.UsedPaths[pathIndex+1:]...)
-	log.Warn(entry.UsedPaths)
+	// Copy, so that we do not modify entries returned by Get or Snapshot
+	usedPaths := make([]snet.Path, 0, len(entry.UsedPaths)-1)
+	usedPaths = append(usedPaths, entry.UsedPaths[:pathIndex]...)
+	entry.UsedPaths = append(usedPaths, entry.UsedPaths[pathIndex+1:]...)
 	return entry
 }
 
+// AddPeerEntry assigns paths out of the AvailablePaths of the entry to the peer. Paths
+// conflicting with other peers are taken away from peers using more paths relative to
+// their weight.
 // Used paths should be empty here...
 func (p *PathSelectionStore) AddPeerEntry(entry PeerPathEntry) {
-	potentialConflictingPeers := make([]PeerPathEntry, len(p.Data))
-	for _, v := range p.Data {
-		potentialConflictingPeers = append(potentialConflictingPeers, v)
-	}
-	potentialConflictingPeers = sortPeerPathEntries(potentialConflictingPeers)
+	p.Lock()
+	defer p.Unlock()
+
+	// Replace a previous entry of the peer
+	p.removePeerEntry(entry.PeerAddrStr)
+
+	entry = copyPeerPathEntry(entry)
+	potentialConflictingPeers := p.sortPeerPathEntries(p.entries())
 	for _, path := range entry.AvailablePaths {
 
 		if len(potentialConflictingPeers) == 0 {
@@ -124,12 +243,12 @@ func (p *PathSelectionStore) AddPeerEntry(entry PeerPathEntry) {
 			conflictingPathIndex := getPeerConflictPaths(path, targetEntry)
 			if conflictingPathIndex >= 0 {
 
-				if len(targetEntry.UsedPaths) <= len(entry.UsedPaths) {
+				if p.usage(targetEntry) <= p.usage(entry) {
 					conflictButPeerHasNotEnoughPaths = true
 					break
 				}
 
-				fmt.Printf("Removing index %d from len %d\n", conflictingPathIndex, len(potentialConflictingPeers))
+				log.Debugf("Moving path %s from %s to %s", pathselection.PathToString(targetEntry.UsedPaths[conflictingPathIndex]), targetEntry.PeerAddrStr, entry.PeerAddrStr)
 				// Remove path from targetEntry
 				targetEntry = removePathFromEntry(targetEntry, conflictingPathIndex)
 
@@ -152,23 +271,133 @@ func (p *PathSelectionStore) AddPeerEntry(entry PeerPathEntry) {
 			entry.UsedPaths = append(entry.UsedPaths, path)
 		} else {
 			// Update the list, so that we do not steal paths always from the first peer
-			potentialConflictingPeers = p.filterByMinimumUsedPaths(potentialConflictingPeers, len(entry.UsedPaths))
+			potentialConflictingPeers = p.filterByMinimumUsage(potentialConflictingPeers, p.usage(entry))
 		}
 	}
 
 	// Filter self containing paths for conflicts
 	entry.UsedPaths = getConflictFreePaths(entry)
-	p.Data[entry.PeerAddrStr] = entry
+	p.updatePeerEntryInStore(entry)
+}
+
+// RemovePeerEntry removes the peer and hands the paths that do not conflict anymore
+// to the remaining peers, starting with the peers using the fewest paths relative to their weight.
+// Returns the ids of all peers whose used paths changed.
+func (p *PathSelectionStore) RemovePeerEntry(id string) []string {
+	p.Lock()
+	defer p.Unlock()
+	if !p.removePeerEntry(id) {
+		return nil
+	}
+	return p.redistributePaths()
+}
+
+// removePeerEntry removes the peer, callers must hold the lock
+func (p *PathSelectionStore) removePeerEntry(id string) bool {
+	if _, ok := p.data[id]; !ok {
+		return false
+	}
+	delete(p.data, id)
+	for i, v := range p.order {
+		if v == id {
+			p.order = append(p.order[:i:i], p.order[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// redistributePaths adds available paths to peers if they do not conflict with paths
+// in use, callers must hold the lock
+func (p *PathSelectionStore) redistributePaths() []string {
+	changed := make([]string, 0)
+	entries := p.entries()
+	sort.SliceStable(entries, func(i, j int) bool {
+		return p.usage(entries[i]) < p.usage(entries[j])
+	})
+
+	for _, entry := range entries {
+		// Use the entry stored in the map, paths may have been added to others meanwhile
+		entry = p.data[entry.PeerAddrStr]
+		added := false
+		for _, path := range entry.AvailablePaths {
+			if p.isUsable(entry, path) {
+				entry.UsedPaths = append(append([]snet.Path{}, entry.UsedPaths...), path)
+				added = true
+			}
+		}
+		if added {
+			p.updatePeerEntryInStore(entry)
+			changed = append(changed, entry.PeerAddrStr)
+		}
+	}
+	return changed
+}
+
+// isUsable returns true if the path is not used yet by the peer and does not conflict
+// with any path in use, callers must hold the lock
+func (p *PathSelectionStore) isUsable(entry PeerPathEntry, path snet.Path) bool {
+	pathStr := pathselection.PathToString(path)
+	for _, used := range entry.UsedPaths {
+		if pathselection.PathToString(used) == pathStr || ownPathsConflict(path, used) {
+			return false
+		}
+	}
+	for id, other := range p.data {
+		if id == entry.PeerAddrStr {
+			continue
+		}
+		if getPeerConflictPaths(path, other) >= 0 {
+			return false
+		}
+	}
+	return true
+}
 
+// ReplacePath releases the bad path of the peer for good and reserves the alternative in its
+// place. Returns false and leaves the peer untouched if the peer is unknown or the alternative
+// conflicts with the paths of other peers or the remaining paths of the peer. A nil alternative
+// only releases the bad path.
+func (p *PathSelectionStore) ReplacePath(id string, bad string, alternative snet.Path) bool {
+	p.Lock()
+	defer p.Unlock()
+	entry, ok := p.data[id]
+	if !ok {
+		return false
+	}
+	// Removing the bad path from the available paths keeps redistributePaths from handing
+	// it out again
+	entry = copyPeerPathEntry(entry)
+	entry.UsedPaths = withoutPath(entry.UsedPaths, bad)
+	entry.AvailablePaths = withoutPath(entry.AvailablePaths, bad)
+	if alternative != nil {
+		if !p.isUsable(entry, alternative) {
+			return false
+		}
+		entry.UsedPaths = append(entry.UsedPaths, alternative)
+		entry.AvailablePaths = append(withoutPath(entry.AvailablePaths, pathselection.PathToString(alternative)), alternative)
+	}
+	p.updatePeerEntryInStore(entry)
+	return true
+}
+
+// withoutPath returns the paths except the one with the given string representation
+func withoutPath(paths []snet.Path, path string) []snet.Path {
+	result := make([]snet.Path, 0, len(paths))
+	for _, v := range paths {
+		if pathselection.PathToString(v) != path {
+			result = append(result, v)
+		}
+	}
+	return result
 }
 
-func (p *PathSelectionStore) filterByMinimumUsedPaths(entries []PeerPathEntry, minUsedPath int) []PeerPathEntry {
-	newEntries := make([]PeerPathEntry, len(p.Data))
+func (p *PathSelectionStore) filterByMinimumUsage(entries []PeerPathEntry, minUsage float64) []PeerPathEntry {
+	newEntries := make([]PeerPathEntry, 0, len(entries))
 	for _, entry := range entries {
-		if len(entry.UsedPaths) >= minUsedPath {
+		if p.usage(entry) >= minUsage {
 			newEntries = append(newEntries, entry)
 		}
 	}
 	return newEntries
-	// return entries
 }
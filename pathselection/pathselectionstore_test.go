@@ -5,8 +5,10 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
+	smppath "github.com/netsys-lab/scion-path-discovery/pathselection"
 	"github.com/scionproto/scion/go/lib/addr"
 	"github.com/scionproto/scion/go/lib/common"
 	"github.com/scionproto/scion/go/lib/snet"
@@ -107,28 +109,124 @@ func TestMultiplePeers(t *testing.T) {
 
 	t.Run("TestAddFirstPeer", func(t *testing.T) {
 		store.AddPeerEntry(p)
-		assert.Equal(t, len(store.Data), 1)
-		assert.Equal(t, len(store.Data[addr].UsedPaths), 2)
+		assert.Equal(t, store.Len(), 1)
+		assert.Equal(t, len(store.Get(addr).UsedPaths), 2)
 	})
 
 	t.Run("TestNonConflictingPeer", func(t *testing.T) {
 		store.AddPeerEntry(p2)
-		assert.Equal(t, len(store.Data), 2)
-		assert.Equal(t, len(store.Data[addr].UsedPaths), 2)
-		assert.Equal(t, len(store.Data[addr].UsedPaths), len(store.Data[addr].AvailablePaths))
-		assert.Equal(t, len(store.Data[addr2].UsedPaths), 2)
+		assert.Equal(t, store.Len(), 2)
+		assert.Equal(t, len(store.Get(addr).UsedPaths), 2)
+		assert.Equal(t, len(store.Get(addr).UsedPaths), len(store.Get(addr).AvailablePaths))
+		assert.Equal(t, len(store.Get(addr2).UsedPaths), 2)
 	})
 
 	t.Run("TestConflictingPeer", func(t *testing.T) {
 		store.AddPeerEntry(p3)
-		assert.Equal(t, len(store.Data), 3)
-		assert.Equal(t, len(store.Data[addr].UsedPaths), 1)
-		assert.Equal(t, len(store.Data[addr].UsedPaths), len(store.Data[addr].AvailablePaths)-1)
-		assert.Equal(t, len(store.Data[addr2].UsedPaths), 2)
-		assert.Equal(t, len(store.Data[addr2].UsedPaths), len(store.Data[addr2].AvailablePaths))
-		assert.Equal(t, len(store.Data[addr3].UsedPaths), 1)
+		assert.Equal(t, store.Len(), 3)
+		assert.Equal(t, len(store.Get(addr).UsedPaths), 1)
+		assert.Equal(t, len(store.Get(addr).UsedPaths), len(store.Get(addr).AvailablePaths)-1)
+		assert.Equal(t, len(store.Get(addr2).UsedPaths), 2)
+		assert.Equal(t, len(store.Get(addr2).UsedPaths), len(store.Get(addr2).AvailablePaths))
+		assert.Equal(t, len(store.Get(addr3).UsedPaths), 1)
 	})
 
+	t.Run("TestRemoveConflictingPeer", func(t *testing.T) {
+		changed := store.RemovePeerEntry(addr3)
+		assert.Equal(t, []string{addr}, changed)
+		assert.Equal(t, store.Len(), 2)
+		assert.False(t, store.Contains(addr3))
+		assert.Equal(t, len(store.Get(addr).UsedPaths), 2)
+		assert.Equal(t, len(store.Get(addr2).UsedPaths), 2)
+	})
+
+	t.Run("TestRemoveUnknownPeer", func(t *testing.T) {
+		assert.Nil(t, store.RemovePeerEntry(addr3))
+		assert.Equal(t, store.Len(), 2)
+	})
+
+}
+
+func TestReplacePath(t *testing.T) {
+	store := NewPathSelectionStore()
+	addr := "19-ffaa:1:c3f,[141.44.25.148]:43000"
+	addr2 := "19-ffaa:1:c3f,[141.44.25.151]:43000"
+	bad := makePath("a#1", "b#1")
+	free := makePath("c#1", "d#1")
+	taken := makePath("e#1", "f#1")
+	store.AddPeerEntry(PeerPathEntry{PeerAddrStr: addr, AvailablePaths: []snet.Path{bad}})
+	store.AddPeerEntry(PeerPathEntry{PeerAddrStr: addr2, AvailablePaths: []snet.Path{taken}})
+
+	// The alternative is assigned to the other peer
+	assert.False(t, store.ReplacePath(addr, smppath.PathToString(bad), makePath("e#1", "g#1")))
+	assert.Equal(t, []snet.Path{bad}, store.Get(addr).UsedPaths)
+	assert.Equal(t, []snet.Path{taken}, store.Get(addr2).UsedPaths)
+
+	assert.True(t, store.ReplacePath(addr, smppath.PathToString(bad), free))
+	assert.Equal(t, []snet.Path{free}, store.Get(addr).UsedPaths)
+
+	// Joins and leaves of other peers neither undo the replacement nor hand out the bad path again
+	store.AddPeerEntry(PeerPathEntry{PeerAddrStr: "19-ffaa:1:c3f,[141.44.25.152]:43000", AvailablePaths: []snet.Path{makePath("h#1", "i#1")}})
+	store.RemovePeerEntry("19-ffaa:1:c3f,[141.44.25.152]:43000")
+	assert.Equal(t, []snet.Path{free}, store.Get(addr).UsedPaths)
+	assert.False(t, store.ReplacePath("unknown", smppath.PathToString(bad), free))
+
+	assert.True(t, store.ReplacePath(addr, smppath.PathToString(free), nil))
+	assert.Empty(t, store.Get(addr).UsedPaths)
+}
+
+// Entries returned by Get and Snapshot must not change when the store is modified
+func TestSnapshotIsolation(t *testing.T) {
+	store := NewPathSelectionStore()
+	store.AddPeerEntry(PeerPathEntry{
+		PeerAddrStr:    "peer1",
+		AvailablePaths: []snet.Path{makePath("a#1", "b#1"), makePath("a#2", "c#1")},
+	})
+	snapshot := store.Snapshot()
+	entry := store.Get("peer1")
+
+	store.AddPeerEntry(PeerPathEntry{
+		PeerAddrStr:    "peer2",
+		AvailablePaths: []snet.Path{makePath("a#1", "d#1")},
+	})
+	assert.Equal(t, 1, len(store.Get("peer1").UsedPaths))
+	assert.Equal(t, 2, len(snapshot["peer1"].UsedPaths))
+	assert.Equal(t, 2, len(entry.UsedPaths))
+	assert.Equal(t, 1, len(snapshot))
+}
+
+// Run with -race to detect unsynchronized access
+func TestConcurrentAccess(t *testing.T) {
+	store := NewPathSelectionStore()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("peer%d", i)
+			store.AddPeerEntry(PeerPathEntry{
+				PeerAddrStr: id,
+				AvailablePaths: []snet.Path{
+					makePath("a#1", fmt.Sprintf("b#%d", i+1)),
+					makePath(fmt.Sprintf("a#%d", i+2), "c#1"),
+				},
+			})
+			store.Get(id)
+			for _, entry := range store.Snapshot() {
+				_ = len(entry.UsedPaths)
+			}
+			if i%2 == 0 {
+				store.RemovePeerEntry(id)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 10, store.Len())
+	for id, entry := range store.Snapshot() {
+		assert.Equal(t, id, entry.PeerAddrStr)
+		assert.NotEqual(t, 0, len(entry.AvailablePaths))
+	}
 }
 
 // Test if adding a peer that does not conflict still uses all available paths
@@ -0,0 +1,265 @@
+package pathselection
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	smppath "github.com/netsys-lab/scion-path-discovery/pathselection"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// DefaultPathPolicy is used by seeder and leecher if no policy is configured
+const DefaultPathPolicy = "shortest"
+
+// PathPolicy decides which of the paths available to a peer are used for connections.
+// Custom policies can be made available to the CLI and the ServerConfig by passing a
+// factory to RegisterPathPolicy, e.g. in the init function of the package implementing it.
+type PathPolicy interface {
+	// Select returns at most n paths of pathSet in the order they should be used.
+	// If n <= 0, all paths are returned. Implementations must not modify pathSet.
+	Select(pathSet *smppath.PathSet, n int) *smppath.PathSet
+}
+
+// PathPolicyFactory creates a new instance of a PathPolicy. Every socket gets
+// its own instance, so policies may keep state between selections.
+type PathPolicyFactory func() PathPolicy
+
+var policyRegistry = struct {
+	sync.RWMutex
+	factories map[string]PathPolicyFactory
+}{
+	factories: make(map[string]PathPolicyFactory),
+}
+
+func init() {
+	RegisterPathPolicy("shortest", func() PathPolicy { return &ShortestPathPolicy{} })
+	RegisterPathPolicy("latency", func() PathPolicy { return &LatencyPathPolicy{} })
+	RegisterPathPolicy("bandwidth", func() PathPolicy { return &BandwidthPathPolicy{} })
+	RegisterPathPolicy("disjoint", func() PathPolicy { return &DisjointPathPolicy{} })
+	RegisterPathPolicy("roundrobin", func() PathPolicy { return &RoundRobinPathPolicy{} })
+	RegisterPathPolicy("random", func() PathPolicy { return &RandomPathPolicy{} })
+}
+
+// RegisterPathPolicy makes a policy available under the given name. Registering
+// a name twice returns an error.
+func RegisterPathPolicy(name string, factory PathPolicyFactory) error {
+	if name == "" || factory == nil {
+		return fmt.Errorf("invalid path policy registration %q", name)
+	}
+	policyRegistry.Lock()
+	defer policyRegistry.Unlock()
+	if _, ok := policyRegistry.factories[name]; ok {
+		return fmt.Errorf("path policy %q already registered", name)
+	}
+	policyRegistry.factories[name] = factory
+	return nil
+}
+
+// NewPathPolicy returns a new instance of the policy registered under name.
+// An empty name selects the DefaultPathPolicy.
+func NewPathPolicy(name string) (PathPolicy, error) {
+	if name == "" {
+		name = DefaultPathPolicy
+	}
+	policyRegistry.RLock()
+	factory, ok := policyRegistry.factories[name]
+	policyRegistry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown path policy %q, available: %v", name, PathPolicyNames())
+	}
+	return factory(), nil
+}
+
+// PathPolicyNames returns the sorted names of all registered policies
+func PathPolicyNames() []string {
+	policyRegistry.RLock()
+	defer policyRegistry.RUnlock()
+	names := make([]string, 0, len(policyRegistry.factories))
+	for name := range policyRegistry.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectFirst returns a new PathSet containing the first n paths, or all if n <= 0
+func selectFirst(address snet.UDPAddr, paths []smppath.PathQuality, n int) *smppath.PathSet {
+	if n <= 0 || n > len(paths) {
+		n = len(paths)
+	}
+	selected := make([]smppath.PathQuality, n)
+	copy(selected, paths[:n])
+	return &smppath.PathSet{
+		Address: address,
+		Paths:   selected,
+	}
+}
+
+// sortedCopy sorts a copy of the paths, keeping the original order for equal paths
+func sortedCopy(paths []smppath.PathQuality, less func(a, b smppath.PathQuality) bool) []smppath.PathQuality {
+	sorted := make([]smppath.PathQuality, len(paths))
+	copy(sorted, paths)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return less(sorted[i], sorted[j])
+	})
+	return sorted
+}
+
+func hopCount(p smppath.PathQuality) int {
+	return len(p.Path.Metadata().Interfaces)
+}
+
+// totalLatency returns the sum of the announced hop latencies, and false if the latency
+// of any hop is unknown
+func totalLatency(p smppath.PathQuality) (time.Duration, bool) {
+	meta := p.Path.Metadata()
+	known := len(meta.Latency) == len(meta.Interfaces)-1
+	var latency time.Duration
+	for _, l := range meta.Latency {
+		if l > 0 {
+			latency += l
+		} else {
+			known = false
+		}
+	}
+	return latency, known
+}
+
+// bottleneckBandwidth returns the smallest announced bandwidth in Kbit/s, or 0 if unknown
+func bottleneckBandwidth(p smppath.PathQuality) uint64 {
+	var bw uint64
+	for _, b := range p.Path.Metadata().Bandwidth {
+		if b > 0 && (bw == 0 || b < bw) {
+			bw = b
+		}
+	}
+	return bw
+}
+
+// ShortestPathPolicy prefers paths with the smallest number of hops
+type ShortestPathPolicy struct{}
+
+func (*ShortestPathPolicy) Select(pathSet *smppath.PathSet, n int) *smppath.PathSet {
+	sorted := sortedCopy(pathSet.Paths, func(a, b smppath.PathQuality) bool {
+		return hopCount(a) < hopCount(b)
+	})
+	return selectFirst(pathSet.Address, sorted, n)
+}
+
+// LatencyPathPolicy prefers paths with the lowest latency announced in the path metadata.
+// Paths with hops without announced latency follow all fully annotated paths, ties are
+// broken by hop count.
+type LatencyPathPolicy struct{}
+
+func (*LatencyPathPolicy) Select(pathSet *smppath.PathSet, n int) *smppath.PathSet {
+	sorted := sortedCopy(pathSet.Paths, func(a, b smppath.PathQuality) bool {
+		la, knownA := totalLatency(a)
+		lb, knownB := totalLatency(b)
+		if knownA != knownB {
+			return knownA
+		}
+		if la != lb {
+			return la < lb
+		}
+		return hopCount(a) < hopCount(b)
+	})
+	return selectFirst(pathSet.Address, sorted, n)
+}
+
+// BandwidthPathPolicy prefers paths with the highest bottleneck bandwidth announced
+// in the path metadata, falling back to the bandwidth measured on the path.
+type BandwidthPathPolicy struct{}
+
+func (*BandwidthPathPolicy) Select(pathSet *smppath.PathSet, n int) *smppath.PathSet {
+	sorted := sortedCopy(pathSet.Paths, func(a, b smppath.PathQuality) bool {
+		ba, bb := bottleneckBandwidth(a), bottleneckBandwidth(b)
+		if ba != bb {
+			return ba > bb
+		}
+		return a.MaxBandwidth > b.MaxBandwidth
+	})
+	return selectFirst(pathSet.Address, sorted, n)
+}
+
+// DisjointPathPolicy starts with the shortest path and then greedily adds the path
+// sharing the fewest interfaces with the paths selected so far.
+type DisjointPathPolicy struct{}
+
+func (*DisjointPathPolicy) Select(pathSet *smppath.PathSet, n int) *smppath.PathSet {
+	remaining := sortedCopy(pathSet.Paths, func(a, b smppath.PathQuality) bool {
+		return hopCount(a) < hopCount(b)
+	})
+	if n <= 0 || n > len(remaining) {
+		n = len(remaining)
+	}
+
+	selected := make([]smppath.PathQuality, 0, n)
+	for len(selected) < n {
+		best, bestShared := 0, -1
+		for i, candidate := range remaining {
+			shared := 0
+			for _, s := range selected {
+				shared += sharedInterfaces(candidate.Path, s.Path)
+			}
+			if bestShared < 0 || shared < bestShared {
+				best, bestShared = i, shared
+			}
+		}
+		selected = append(selected, remaining[best])
+		remaining = append(remaining[:best], remaining[best+1:]...)
+	}
+	return &smppath.PathSet{
+		Address: pathSet.Address,
+		Paths:   selected,
+	}
+}
+
+// RoundRobinPathPolicy rotates through the available paths, starting one path
+// further with every selection.
+type RoundRobinPathPolicy struct {
+	sync.Mutex
+	next int
+}
+
+func (r *RoundRobinPathPolicy) Select(pathSet *smppath.PathSet, n int) *smppath.PathSet {
+	sorted := sortedCopy(pathSet.Paths, func(a, b smppath.PathQuality) bool {
+		return hopCount(a) < hopCount(b)
+	})
+	if len(sorted) == 0 {
+		return selectFirst(pathSet.Address, sorted, n)
+	}
+
+	r.Lock()
+	offset := r.next % len(sorted)
+	r.next++
+	r.Unlock()
+
+	rotated := append(sorted[offset:], sorted[:offset]...)
+	return selectFirst(pathSet.Address, rotated, n)
+}
+
+// RandomPathPolicy selects paths uniformly at random
+type RandomPathPolicy struct {
+	sync.Mutex
+	rand *rand.Rand
+}
+
+func (r *RandomPathPolicy) Select(pathSet *smppath.PathSet, n int) *smppath.PathSet {
+	shuffled := make([]smppath.PathQuality, len(pathSet.Paths))
+	copy(shuffled, pathSet.Paths)
+	r.Lock()
+	if r.rand == nil {
+		r.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	r.rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	r.Unlock()
+	return selectFirst(pathSet.Address, shuffled, n)
+}
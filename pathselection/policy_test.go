@@ -0,0 +1,123 @@
+package pathselection
+
+import (
+	"testing"
+	"time"
+
+	smppath "github.com/netsys-lab/scion-path-discovery/pathselection"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makePathSet(paths ...snet.Path) *smppath.PathSet {
+	pathSet := &smppath.PathSet{
+		Paths: make([]smppath.PathQuality, 0),
+	}
+	for _, p := range paths {
+		pathSet.Paths = append(pathSet.Paths, smppath.PathQuality{Path: p})
+	}
+	return pathSet
+}
+
+func selectedPaths(pathSet *smppath.PathSet) []snet.Path {
+	paths := make([]snet.Path, 0)
+	for _, v := range pathSet.Paths {
+		paths = append(paths, v.Path)
+	}
+	return paths
+}
+
+func TestPathPolicyRegistry(t *testing.T) {
+	for _, name := range []string{"shortest", "latency", "bandwidth", "disjoint", "roundrobin", "random"} {
+		policy, err := NewPathPolicy(name)
+		require.Nil(t, err)
+		assert.NotNil(t, policy)
+	}
+
+	policy, err := NewPathPolicy("")
+	require.Nil(t, err)
+	assert.IsType(t, &ShortestPathPolicy{}, policy)
+
+	_, err = NewPathPolicy("unknown")
+	assert.NotNil(t, err)
+
+	err = RegisterPathPolicy("shortest", func() PathPolicy { return &ShortestPathPolicy{} })
+	assert.NotNil(t, err)
+
+	err = RegisterPathPolicy("test-custom", func() PathPolicy { return &ShortestPathPolicy{} })
+	assert.Nil(t, err)
+	assert.Contains(t, PathPolicyNames(), "test-custom")
+}
+
+func TestShortestPathPolicy(t *testing.T) {
+	long := makePath("a#1", "b#1", "b#2", "c#1")
+	short := makePath("a#2", "c#2")
+	pathSet := makePathSet(long, short)
+
+	selected := (&ShortestPathPolicy{}).Select(pathSet, 1)
+	assert.Equal(t, []snet.Path{short}, selectedPaths(selected))
+
+	// The input must stay untouched
+	assert.Equal(t, []snet.Path{long, short}, selectedPaths(pathSet))
+
+	selected = (&ShortestPathPolicy{}).Select(pathSet, 0)
+	assert.Equal(t, []snet.Path{short, long}, selectedPaths(selected))
+}
+
+func TestLatencyPathPolicy(t *testing.T) {
+	slow := makePath("a#1", "c#1")
+	slow.Metadata().Latency = []time.Duration{50 * time.Millisecond}
+	fast := makePath("a#2", "b#1", "b#2", "c#2")
+	fast.Metadata().Latency = []time.Duration{5 * time.Millisecond, 1 * time.Millisecond, 5 * time.Millisecond}
+
+	selected := (&LatencyPathPolicy{}).Select(makePathSet(slow, fast), 1)
+	assert.Equal(t, []snet.Path{fast}, selectedPaths(selected))
+
+	// Paths with unknown hop latencies come last, even if the known hops are fast
+	unknown := makePath("a#3", "b#3", "b#4", "c#3")
+	unknown.Metadata().Latency = []time.Duration{1 * time.Millisecond, 0, 1 * time.Millisecond}
+	missing := makePath("a#4", "c#4")
+	selected = (&LatencyPathPolicy{}).Select(makePathSet(unknown, missing, slow, fast), 0)
+	assert.Equal(t, []snet.Path{fast, slow, missing, unknown}, selectedPaths(selected))
+}
+
+func TestBandwidthPathPolicy(t *testing.T) {
+	narrow := makePath("a#1", "b#1", "b#2", "c#1")
+	narrow.Metadata().Bandwidth = []uint64{100000, 1000, 100000}
+	wide := makePath("a#2", "b#3", "b#4", "c#2")
+	wide.Metadata().Bandwidth = []uint64{10000, 10000, 10000}
+
+	selected := (&BandwidthPathPolicy{}).Select(makePathSet(narrow, wide), 2)
+	assert.Equal(t, []snet.Path{wide, narrow}, selectedPaths(selected))
+}
+
+func TestDisjointPathPolicy(t *testing.T) {
+	path1 := makePath("a#1", "b#1", "b#2", "c#1")
+	path2 := makePath("a#2", "b#1", "b#2", "c#2")
+	path3 := makePath("a#3", "d#1", "d#2", "c#3")
+
+	selected := (&DisjointPathPolicy{}).Select(makePathSet(path1, path2, path3), 2)
+	assert.Equal(t, []snet.Path{path1, path3}, selectedPaths(selected))
+}
+
+func TestRoundRobinPathPolicy(t *testing.T) {
+	path1 := makePath("a#1", "c#1")
+	path2 := makePath("a#2", "c#2")
+	path3 := makePath("a#3", "c#3")
+	pathSet := makePathSet(path1, path2, path3)
+
+	policy := &RoundRobinPathPolicy{}
+	assert.Equal(t, []snet.Path{path1}, selectedPaths(policy.Select(pathSet, 1)))
+	assert.Equal(t, []snet.Path{path2}, selectedPaths(policy.Select(pathSet, 1)))
+	assert.Equal(t, []snet.Path{path3, path1}, selectedPaths(policy.Select(pathSet, 2)))
+	assert.Equal(t, 0, len(policy.Select(makePathSet(), 1).Paths))
+}
+
+func TestRandomPathPolicy(t *testing.T) {
+	pathSet := makePathSet(makePath("a#1", "c#1"), makePath("a#2", "c#2"), makePath("a#3", "c#3"))
+
+	selected := (&RandomPathPolicy{}).Select(pathSet, 2)
+	assert.Equal(t, 2, len(selected.Paths))
+	assert.NotEqual(t, selected.Paths[0].Path, selected.Paths[1].Path)
+}
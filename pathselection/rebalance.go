@@ -0,0 +1,161 @@
+package pathselection
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"sync"
+	"time"
+)
+
+// RebalanceConfig configures how aggressively bad paths are replaced during a transfer
+type RebalanceConfig struct {
+	Interval              time.Duration // Time between two evaluations of the paths to a peer
+	Window                int           // Number of metric samples (one per second) averaged per evaluation
+	MinRelativeThroughput float64       // Paths below this fraction of the best path's throughput are bad
+	BadRounds             int           // Consecutive bad evaluations before a path is replaced
+	Cooldown              time.Duration // Minimum time between two path switches for the same peer
+	Penalty               time.Duration // Time a replaced path is not considered as alternative
+	MinPaths              int           // Never replace paths if the peer has this many paths or less
+}
+
+// DefaultRebalanceConfig returns a conservative configuration that needs a path to
+// perform badly for 30 seconds before it is replaced
+func DefaultRebalanceConfig() RebalanceConfig {
+	return RebalanceConfig{
+		Interval:              10 * time.Second,
+		Window:                5,
+		MinRelativeThroughput: 0.25,
+		BadRounds:             3,
+		Cooldown:              30 * time.Second,
+		Penalty:               5 * time.Minute,
+		MinPaths:              1,
+	}
+}
+
+// PathSample is the throughput of one path measured over the last evaluation window
+type PathSample struct {
+	Path       string // Fingerprint of the path as returned by PathToString
+	Throughput int64  // Bytes per second
+}
+
+// PathRebalancer decides which paths to a peer perform consistently worse than the others
+// and should be replaced. Hysteresis is implemented by requiring multiple consecutive bad
+// evaluations, a cooldown between switches and a penalty for replaced paths, so that
+// paths are not switched back and forth.
+type PathRebalancer struct {
+	sync.Mutex
+	config     RebalanceConfig
+	badRounds  map[string]int
+	replaced   map[string]time.Time
+	lastSwitch time.Time
+	now        func() time.Time
+}
+
+func NewPathRebalancer(config RebalanceConfig) *PathRebalancer {
+	return &PathRebalancer{
+		config:    config,
+		badRounds: make(map[string]int),
+		replaced:  make(map[string]time.Time),
+		now:       time.Now,
+	}
+}
+
+// Config returns the configuration of the rebalancer
+func (r *PathRebalancer) Config() RebalanceConfig {
+	return r.config
+}
+
+// Evaluate takes the current samples of all paths to a peer and returns the paths that
+// should be replaced. Only one path is replaced per call.
+func (r *PathRebalancer) Evaluate(samples []PathSample) []string {
+	r.Lock()
+	defer r.Unlock()
+
+	// Forget paths that are not in use anymore
+	current := make(map[string]bool, len(samples))
+	for _, s := range samples {
+		current[s.Path] = true
+	}
+	for path := range r.badRounds {
+		if !current[path] {
+			delete(r.badRounds, path)
+		}
+	}
+
+	var best int64
+	for _, s := range samples {
+		if s.Throughput > best {
+			best = s.Throughput
+		}
+	}
+	// Nothing is transferred, so we can not compare paths
+	if best == 0 || len(samples) <= r.config.MinPaths {
+		return nil
+	}
+
+	threshold := int64(float64(best) * r.config.MinRelativeThroughput)
+	worst, worstRounds := "", 0
+	for _, s := range samples {
+		if s.Throughput >= threshold {
+			r.badRounds[s.Path] = 0
+			continue
+		}
+		r.badRounds[s.Path]++
+		if r.badRounds[s.Path] > worstRounds {
+			worst, worstRounds = s.Path, r.badRounds[s.Path]
+		}
+	}
+
+	now := r.now()
+	if worstRounds < r.config.BadRounds || now.Sub(r.lastSwitch) < r.config.Cooldown {
+		return nil
+	}
+
+	r.lastSwitch = now
+	r.replaced[worst] = now
+	delete(r.badRounds, worst)
+	return []string{worst}
+}
+
+// Penalized returns true if the path was replaced recently and should not be used again yet
+func (r *PathRebalancer) Penalized(path string) bool {
+	r.Lock()
+	defer r.Unlock()
+	replacedAt, ok := r.replaced[path]
+	if !ok {
+		return false
+	}
+	if r.now().Sub(replacedAt) >= r.config.Penalty {
+		delete(r.replaced, path)
+		return false
+	}
+	return true
+}
+
+// PickAlternative returns the first of the candidates that is neither in use nor penalized
+func (r *PathRebalancer) PickAlternative(candidates []string, inUse []string) (string, bool) {
+	used := make(map[string]bool, len(inUse))
+	for _, p := range inUse {
+		used[p] = true
+	}
+	for _, c := range candidates {
+		if !used[c] && !r.Penalized(c) {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// AverageThroughput returns the average of the last window entries of a bandwidth
+// timeseries as collected in packets.PathMetrics, or false if there are not enough entries yet
+func AverageThroughput(bandwidth []int64, window int) (int64, bool) {
+	if window <= 0 || len(bandwidth) < window {
+		return 0, false
+	}
+	var sum int64
+	for _, b := range bandwidth[len(bandwidth)-window:] {
+		sum += b
+	}
+	return sum / int64(window), true
+}
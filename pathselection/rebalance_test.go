@@ -0,0 +1,80 @@
+package pathselection
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRebalancer(now *time.Time) *PathRebalancer {
+	r := NewPathRebalancer(RebalanceConfig{
+		MinRelativeThroughput: 0.5,
+		BadRounds:             2,
+		Cooldown:              time.Minute,
+		Penalty:               time.Hour,
+		MinPaths:              1,
+	})
+	r.now = func() time.Time { return *now }
+	return r
+}
+
+func TestPathRebalancerHysteresis(t *testing.T) {
+	now := time.Now()
+	r := newTestRebalancer(&now)
+
+	bad := []PathSample{{"good", 1000}, {"slow", 100}}
+	recovered := []PathSample{{"good", 1000}, {"slow", 900}}
+
+	// A single bad round is not enough
+	assert.Nil(t, r.Evaluate(bad))
+	// Recovering resets the counter
+	assert.Nil(t, r.Evaluate(recovered))
+	assert.Nil(t, r.Evaluate(bad))
+	assert.Equal(t, []string{"slow"}, r.Evaluate(bad))
+	assert.True(t, r.Penalized("slow"))
+
+	// Cooldown prevents switching again immediately
+	bad = []PathSample{{"good", 1000}, {"other", 100}}
+	assert.Nil(t, r.Evaluate(bad))
+	assert.Nil(t, r.Evaluate(bad))
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, []string{"other"}, r.Evaluate(bad))
+
+	now = now.Add(2 * time.Hour)
+	assert.False(t, r.Penalized("slow"))
+}
+
+func TestPathRebalancerIdleAndMinPaths(t *testing.T) {
+	now := time.Now()
+	r := newTestRebalancer(&now)
+
+	idle := []PathSample{{"a", 0}, {"b", 0}}
+	single := []PathSample{{"a", 1}}
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, r.Evaluate(idle))
+		assert.Nil(t, r.Evaluate(single))
+	}
+}
+
+func TestPathRebalancerPickAlternative(t *testing.T) {
+	now := time.Now()
+	r := newTestRebalancer(&now)
+	r.replaced["penalized"] = now
+
+	alt, ok := r.PickAlternative([]string{"used", "penalized", "free"}, []string{"used"})
+	assert.True(t, ok)
+	assert.Equal(t, "free", alt)
+
+	_, ok = r.PickAlternative([]string{"used", "penalized"}, []string{"used"})
+	assert.False(t, ok)
+}
+
+func TestAverageThroughput(t *testing.T) {
+	_, ok := AverageThroughput([]int64{1, 2}, 3)
+	assert.False(t, ok)
+
+	avg, ok := AverageThroughput([]int64{100, 1, 2, 3}, 3)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), avg)
+}
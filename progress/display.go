@@ -0,0 +1,154 @@
+package progress
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-isatty"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/netsys-lab/bittorrent-over-scion/p2p"
+)
+
+// RefreshInterval is the interval in which the terminal display is redrawn
+const RefreshInterval = 500 * time.Millisecond
+
+// LogInterval is the interval of the progress log lines if stdout is not a terminal
+const LogInterval = 5 * time.Second
+
+// logLines is the number of recent log lines shown below the progress
+const logLines = 5
+
+// Display shows the progress of a download, either as live view on a terminal or as periodic
+// log lines
+type Display struct {
+	out      io.Writer
+	source   func() p2p.Progress
+	terminal bool
+	width    int
+	rates    *rates
+	logs     *logBuffer
+	logOut   io.Writer // Log output before the display started
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Start shows the progress returned by source on out until Stop is called. If out is a
+// terminal, the view is redrawn in place and log messages are shown within the view.
+func Start(out *os.File, source func() p2p.Progress) *Display {
+	d := &Display{
+		out:      out,
+		source:   source,
+		terminal: isatty.IsTerminal(out.Fd()) || isatty.IsCygwinTerminal(out.Fd()),
+		width:    terminalWidth(),
+		rates:    newRates(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if d.terminal {
+		d.logs = newLogBuffer(logLines)
+		d.logOut = log.StandardLogger().Out
+		log.SetOutput(d.logs)
+		fmt.Fprint(d.out, hideCursor+clearScreen)
+	}
+	go d.run()
+	return d
+}
+
+// Stop draws the final state and restores the log output
+func (d *Display) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+		<-d.done
+		if d.terminal {
+			fmt.Fprint(d.out, showCursor)
+			log.SetOutput(d.logOut)
+		}
+	})
+}
+
+func (d *Display) run() {
+	defer close(d.done)
+	interval := LogInterval
+	if d.terminal {
+		interval = RefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.update()
+		case <-d.stop:
+			d.update()
+			return
+		}
+	}
+}
+
+func (d *Display) update() {
+	p := d.source()
+	d.rates.update(p, time.Now())
+	if !d.terminal {
+		log.Info(summary(p, d.rates))
+		return
+	}
+	var b strings.Builder
+	b.WriteString(cursorHome)
+	for _, line := range render(p, d.rates, d.logs.lines(), d.width) {
+		b.WriteString(line)
+		b.WriteString(clearLine + "\n")
+	}
+	b.WriteString(clearBelow)
+	fmt.Fprint(d.out, b.String())
+}
+
+// terminalWidth returns the width of the terminal from $COLUMNS, 120 per default
+func terminalWidth() int {
+	if width, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && width > 40 {
+		return width
+	}
+	return 120
+}
+
+// logBuffer keeps the most recent log lines
+type logBuffer struct {
+	sync.Mutex
+	max     int
+	recent  []string
+	partial string
+}
+
+func newLogBuffer(max int) *logBuffer {
+	return &logBuffer{max: max}
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	text := b.partial + string(p)
+	parts := strings.Split(text, "\n")
+	b.partial = parts[len(parts)-1]
+	for _, line := range parts[:len(parts)-1] {
+		b.recent = append(b.recent, line)
+	}
+	if len(b.recent) > b.max {
+		b.recent = b.recent[len(b.recent)-b.max:]
+	}
+	return len(p), nil
+}
+
+func (b *logBuffer) lines() []string {
+	b.Lock()
+	defer b.Unlock()
+	return append([]string{}, b.recent...)
+}
@@ -0,0 +1,272 @@
+package progress
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/netsys-lab/bittorrent-over-scion/p2p"
+)
+
+// ANSI escape sequences used to redraw the view in place
+const (
+	cursorHome  = "\x1b[H"
+	clearScreen = "\x1b[2J"
+	clearLine   = "\x1b[K"
+	clearBelow  = "\x1b[J"
+	hideCursor  = "\x1b[?25l"
+	showCursor  = "\x1b[?25h"
+)
+
+// pieceMapRows is the maximum number of rows of the piece map
+const pieceMapRows = 4
+
+// smoothing is the weight of the latest sample in the throughput averages
+const smoothing = 0.3
+
+// rates tracks the throughput of the download and of every path
+type rates struct {
+	last  time.Time
+	bytes map[string]int64   // Bytes per path at the last update
+	path  map[string]float64 // Smoothed throughput per path in bytes per second
+	total float64            // Smoothed throughput of all paths in bytes per second
+}
+
+func newRates() *rates {
+	return &rates{
+		bytes: make(map[string]int64),
+		path:  make(map[string]float64),
+	}
+}
+
+// pathKey identifies a path download, the same path can be used by several connections
+func pathKey(p p2p.PathProgress) string {
+	return p.ConnId + "|" + p.Remote + "|" + p.Path
+}
+
+// update adds a sample of the progress taken at now
+func (r *rates) update(p p2p.Progress, now time.Time) {
+	if r.last.IsZero() {
+		for _, path := range p.Paths {
+			r.bytes[pathKey(path)] = path.Bytes
+		}
+		r.last = now
+		return
+	}
+	secs := now.Sub(r.last).Seconds()
+	if secs <= 0 {
+		return
+	}
+	var total float64
+	for _, path := range p.Paths {
+		key := pathKey(path)
+		rate := float64(path.Bytes-r.bytes[key]) / secs
+		if _, ok := r.path[key]; ok {
+			rate = smoothing*rate + (1-smoothing)*r.path[key]
+		}
+		r.path[key] = rate
+		r.bytes[key] = path.Bytes
+		if path.Active {
+			total += rate
+		}
+	}
+	r.total = smoothing*total + (1-smoothing)*r.total
+	r.last = now
+}
+
+// eta returns the remaining time of the download at the current throughput, 0 if unknown
+func (r *rates) eta(p p2p.Progress) time.Duration {
+	remaining := int64(p.Length) - p.Bytes
+	if r.total <= 0 || remaining <= 0 {
+		return 0
+	}
+	return time.Duration(float64(remaining) / r.total * float64(time.Second)).Round(time.Second)
+}
+
+func mbits(bytesPerSec float64) float64 {
+	return bytesPerSec * 8 / 1024 / 1024
+}
+
+func mib(bytes int64) float64 {
+	return float64(bytes) / 1024 / 1024
+}
+
+func percent(p p2p.Progress) float64 {
+	if p.Pieces == 0 {
+		return 100
+	}
+	return float64(p.Done) / float64(p.Pieces) * 100
+}
+
+func formatEta(eta time.Duration) string {
+	if eta <= 0 {
+		return "-"
+	}
+	return eta.String()
+}
+
+func activePaths(p p2p.Progress) int {
+	active := 0
+	for _, path := range p.Paths {
+		if path.Active {
+			active++
+		}
+	}
+	return active
+}
+
+// summary returns the progress as a single log line
+func summary(p p2p.Progress, r *rates) string {
+	return fmt.Sprintf("%s: %.2f%% (%d/%d pieces, %.2f/%.2f MiB), %.2f Mbit/s over %d paths, ETA %s",
+		p.Name, percent(p), p.Done, p.Pieces, mib(p.Bytes), mib(int64(p.Length)), mbits(r.total), activePaths(p), formatEta(r.eta(p)))
+}
+
+// render returns the lines of the terminal view
+func render(p p2p.Progress, r *rates, logs []string, width int) []string {
+	lines := make([]string, 0, 32)
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, truncate(fmt.Sprintf(format, args...), width))
+	}
+
+	add("%s (%x)", p.Name, p.InfoHash[:4])
+	add("%s %6.2f%%  %d/%d pieces  %.2f/%.2f MiB", bar(percent(p), 30), percent(p), p.Done, p.Pieces, mib(p.Bytes), mib(int64(p.Length)))
+	elapsed := time.Duration(0)
+	if !p.StartDate.IsZero() {
+		elapsed = time.Since(p.StartDate).Round(time.Second)
+	}
+	add("%.2f Mbit/s  ETA %s  elapsed %s", mbits(r.total), formatEta(r.eta(p)), elapsed)
+
+	add("")
+	add("PEERS")
+	for _, peer := range peerSummaries(p, r) {
+		add("  %-40s %2d paths  %8.2f Mbit/s  %9.2f MiB", peer.addr, peer.paths, mbits(peer.rate), mib(peer.bytes))
+	}
+
+	add("")
+	add("PATHS (%d active)", activePaths(p))
+	add("  %-10s %4s %10s %10s  %s", "STATE", "HOPS", "MBIT/S", "MIB", "PATH")
+	for _, path := range p.Paths {
+		state := "active"
+		if path.Failed {
+			state = "failed"
+		} else if !path.Active {
+			state = "done"
+		}
+		rate := 0.0
+		if path.Active {
+			rate = r.path[pathKey(path)]
+		}
+		add("  %-10s %4d %10.2f %10.2f  %s", state, path.Hops, mbits(rate), mib(path.Bytes), path.Path)
+	}
+
+	add("")
+	add("PIECES")
+	for _, row := range pieceMap(p, width-4) {
+		add("  %s", row)
+	}
+
+	if p.Dht != nil {
+		add("")
+		add("DHT  nodes: %d (good: %d)  peers received: %d  announces: %d  outstanding queries: %d",
+			p.Dht.Nodes, p.Dht.GoodNodes, p.Dht.ReceivedPeersWhileTraversing, p.Dht.AnnouncesStarted, p.Dht.OutstandingTransactions)
+	}
+
+	if len(logs) > 0 {
+		add("")
+		for _, l := range logs {
+			add("%s", l)
+		}
+	}
+	return lines
+}
+
+// peerSummary sums up the paths to a peer
+type peerSummary struct {
+	addr  string
+	paths int // Active paths
+	rate  float64
+	bytes int64
+}
+
+func peerSummaries(p p2p.Progress, r *rates) []peerSummary {
+	byAddr := make(map[string]*peerSummary)
+	for _, path := range p.Paths {
+		s, ok := byAddr[path.Remote]
+		if !ok {
+			s = &peerSummary{addr: path.Remote}
+			byAddr[path.Remote] = s
+		}
+		s.bytes += path.Bytes
+		if path.Active {
+			s.paths++
+			s.rate += r.path[pathKey(path)]
+		}
+	}
+	summaries := make([]peerSummary, 0, len(byAddr))
+	for _, s := range byAddr {
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].addr < summaries[j].addr
+	})
+	return summaries
+}
+
+// bar returns a progress bar of width characters
+func bar(percent float64, width int) string {
+	full := int(percent / 100 * float64(width))
+	if full > width {
+		full = width
+	}
+	return "[" + strings.Repeat("#", full) + strings.Repeat(".", width-full) + "]"
+}
+
+// pieceMap returns rows of at most width cells, each cell covers one or more pieces: '█' if all
+// are complete, '▒' if some are, '·' if none is
+func pieceMap(p p2p.Progress, width int) []string {
+	if p.Pieces == 0 || width <= 0 {
+		return nil
+	}
+	cells := p.Pieces
+	if cells > width*pieceMapRows {
+		cells = width * pieceMapRows
+	}
+	rows := make([]string, 0, pieceMapRows)
+	var row strings.Builder
+	for c := 0; c < cells; c++ {
+		first := c * p.Pieces / cells
+		last := (c + 1) * p.Pieces / cells
+		done := 0
+		for i := first; i < last; i++ {
+			if p.Completed.HasPiece(i) {
+				done++
+			}
+		}
+		switch {
+		case done == last-first:
+			row.WriteString("█")
+		case done > 0:
+			row.WriteString("▒")
+		default:
+			row.WriteString("·")
+		}
+		if (c+1)%width == 0 || c == cells-1 {
+			rows = append(rows, row.String())
+			row.Reset()
+		}
+	}
+	return rows
+}
+
+// truncate cuts the line to width characters
+func truncate(line string, width int) string {
+	runes := []rune(line)
+	if width <= 0 || len(runes) <= width {
+		return line
+	}
+	return string(runes[:width])
+}
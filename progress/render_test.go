@@ -0,0 +1,103 @@
+package progress
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netsys-lab/bittorrent-over-scion/bitfield"
+	"github.com/netsys-lab/bittorrent-over-scion/dht_node"
+	"github.com/netsys-lab/bittorrent-over-scion/p2p"
+)
+
+func testProgress(pieces int, done []int) p2p.Progress {
+	p := p2p.Progress{
+		Name:      "dataset",
+		Length:    pieces * 1024 * 1024,
+		Pieces:    pieces,
+		Completed: make(bitfield.Bitfield, (pieces+7)/8),
+	}
+	for _, i := range done {
+		p.Completed.SetPiece(i)
+		p.Done++
+		p.Bytes += 1024 * 1024
+	}
+	return p
+}
+
+func TestPieceMap(t *testing.T) {
+	p := testProgress(8, []int{0, 1, 2, 5})
+	assert.Equal(t, []string{"███··█", "··"}, pieceMap(p, 6))
+
+	// Several pieces per cell if there are more pieces than cells
+	done := make([]int, 0, 30)
+	for i := 0; i < 30; i++ {
+		done = append(done, i)
+	}
+	p = testProgress(1000, done)
+	rows := pieceMap(p, 10)
+	assert.Equal(t, pieceMapRows, len(rows))
+	// 25 pieces per cell
+	assert.Equal(t, "█▒········", rows[0])
+}
+
+func TestRates(t *testing.T) {
+	r := newRates()
+	start := time.Now()
+	p := testProgress(100, []int{0})
+	path := p2p.PathProgress{Active: true}
+	path.ConnId = "1"
+	path.Remote = "19-ffaa:1:c3f,[10.0.0.2]:43000"
+	p.Paths = []p2p.PathProgress{path}
+	r.update(p, start)
+
+	p.Paths[0].Bytes = 10 * 1024 * 1024
+	r.update(p, start.Add(time.Second))
+	assert.Equal(t, 10*1024*1024.0, r.path[pathKey(p.Paths[0])])
+	assert.InDelta(t, smoothing*10*1024*1024, r.total, 1)
+	assert.True(t, r.eta(p) > 0)
+
+	// Finished paths do not count towards the total
+	p.Paths[0].Active = false
+	r.update(p, start.Add(2*time.Second))
+	assert.InDelta(t, (1-smoothing)*smoothing*10*1024*1024, r.total, 1)
+}
+
+func TestRender(t *testing.T) {
+	p := testProgress(10, []int{0, 1, 2, 3, 4})
+	path := p2p.PathProgress{Active: true}
+	path.Remote = "19-ffaa:1:c3f,[10.0.0.2]:43000"
+	path.Path = "19-ffaa:1:c3f 1>2 19-ffaa:1:c40"
+	path.Hops = 2
+	path.Bytes = 5 * 1024 * 1024
+	failed := p2p.PathProgress{}
+	failed.Remote = path.Remote
+	failed.Path = "19-ffaa:1:c3f 3>4 19-ffaa:1:c40"
+	failed.Failed = true
+	p.Paths = []p2p.PathProgress{path, failed}
+	p.Dht = &dht_node.Stats{Nodes: 12, GoodNodes: 10}
+
+	lines := render(p, newRates(), []string{"some log line"}, 120)
+	out := strings.Join(lines, "\n")
+	assert.Contains(t, out, " 50.00%  5/10 pieces  5.00/10.00 MiB")
+	assert.Regexp(t, `19-ffaa:1:c3f,\[10.0.0.2\]:43000\s+1 paths`, out)
+	assert.Regexp(t, `active\s+2\s+0.00\s+5.00  19-ffaa:1:c3f 1>2 19-ffaa:1:c40`, out)
+	assert.Regexp(t, `failed\s+0\s+0.00\s+0.00  19-ffaa:1:c3f 3>4 19-ffaa:1:c40`, out)
+	assert.Contains(t, out, "█████·····")
+	assert.Contains(t, out, "nodes: 12 (good: 10)")
+	assert.Equal(t, "some log line", lines[len(lines)-1])
+
+	for _, line := range render(p, newRates(), nil, 50) {
+		assert.True(t, len([]rune(line)) <= 50, line)
+	}
+}
+
+func TestLogBuffer(t *testing.T) {
+	b := newLogBuffer(2)
+	b.Write([]byte("first\nsecond\nthi"))
+	assert.Equal(t, []string{"first", "second"}, b.lines())
+	b.Write([]byte("rd\n"))
+	assert.Equal(t, []string{"second", "third"}, b.lines())
+}
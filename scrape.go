@@ -0,0 +1,69 @@
+package main
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/anacrolix/tagflag"
+	"github.com/netsys-lab/dht"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/netsys-lab/bittorrent-over-scion/torrentfile"
+)
+
+var scrapeFlags = struct {
+	Torrent   string        `help:"Torrent file to scrape"`
+	InfoHash  string        `help:"Optional: Hex encoded info-hash to scrape, instead of a torrent file"`
+	Local     string        `help:"Optional: Local SCION address of the dht node used to scrape, of format ISD-AS,[IP]:Port. Per default the local host on a random port"`
+	Bootstrap string        `help:"Optional: Semicolon separated SCION addresses of dht nodes to join, in addition to the nodes of the torrent file"`
+	Timeout   time.Duration `help:"Optional: Time to collect the estimates of the nodes"`
+	LogLevel  string        `help:"Optional: Change log level"`
+}{
+	Timeout:  30 * time.Second,
+	LogLevel: "WARN",
+}
+
+// runScrapeCommand prints the estimated number of seeds and peers of a torrent
+func runScrapeCommand(args []string) {
+	tagflag.ParseArgs(&scrapeFlags, args, tagflag.Program("bittorrent-over-scion scrape"))
+	setLogging(scrapeFlags.LogLevel)
+
+	var infoHash [20]byte
+	var nodes []dht.Addr
+	switch {
+	case scrapeFlags.Torrent != "":
+		tf, err := torrentfile.Open(scrapeFlags.Torrent)
+		if err != nil {
+			log.Fatal(err)
+		}
+		infoHash = tf.InfoHash
+		nodes = tf.Nodes
+	case scrapeFlags.InfoHash != "":
+		ih, err := hex.DecodeString(scrapeFlags.InfoHash)
+		if err != nil || len(ih) != len(infoHash) {
+			log.Fatal("invalid infoHash")
+		}
+		copy(infoHash[:], ih)
+	default:
+		log.Fatal("torrent or infoHash is required")
+	}
+
+	node := startItemNode(scrapeFlags.Local, scrapeFlags.Bootstrap, nodes...)
+	defer node.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), scrapeFlags.Timeout)
+	defer cancel()
+
+	res, err := node.Scrape(ctx, infoHash)
+	if err != nil {
+		log.Fatalf("Could not scrape %x: %s", infoHash, err)
+	}
+	fmt.Printf("info-hash: %x\n", infoHash)
+	fmt.Printf("seeds: %d\n", res.Seeds)
+	fmt.Printf("peers: %d\n", res.Peers)
+	fmt.Printf("answered by %d nodes\n", res.Nodes)
+}
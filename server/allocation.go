@@ -0,0 +1,99 @@
+package server
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/netsys-lab/bittorrent-over-scion/message"
+	"github.com/netsys-lab/scion-path-discovery/packets"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// ParsePeerPriorities parses a semicolon separated list of peer=priority pairs, where peer
+// is either a full SCION address (ISD-AS,[IP]:Port), a host (ISD-AS,IP) or an ISD-AS,
+// e.g. "19-ffaa:1:c3f=10;17-ffaa:0:1101,[10.0.0.2]:43000=2"
+func ParsePeerPriorities(value string) (map[string]int, error) {
+	priorities := make(map[string]int)
+	if strings.TrimSpace(value) == "" {
+		return priorities, nil
+	}
+	for _, v := range strings.Split(value, ";") {
+		v = strings.TrimSpace(v)
+		index := strings.LastIndex(v, "=")
+		if index <= 0 {
+			return nil, fmt.Errorf("invalid peer priority %q, expected peer=priority", v)
+		}
+		priority, err := strconv.Atoi(v[index+1:])
+		if err != nil || priority < 1 {
+			return nil, fmt.Errorf("invalid priority in %q, expected a positive number", v)
+		}
+		priorities[v[:index]] = priority
+	}
+	return priorities, nil
+}
+
+// peerPriority looks up the priority of the peer by its address, host and ISD-AS.
+// Peers without configured priority get priority 1
+func (s *Server) peerPriority(peer *snet.UDPAddr) int {
+	keys := []string{
+		peer.String(),
+		fmt.Sprintf("%s,%s", peer.IA, peer.Host.IP),
+		peer.IA.String(),
+	}
+	for _, key := range keys {
+		if priority, ok := s.PeerPriorities[key]; ok {
+			return priority
+		}
+	}
+	return 1
+}
+
+// onPeerHave counts the pieces the peer announced and updates its progress and
+// bandwidth in the store. The allocation strategy considers them the next time
+// paths are distributed among the peers.
+func (s *Server) onPeerHave(peerId string, msg *message.Message) {
+	index, err := message.ParseHave(msg)
+	if err != nil {
+		return
+	}
+
+	s.Lock()
+	pieces, ok := s.peerPieces[peerId]
+	if !ok {
+		pieces = make(map[int]bool)
+		s.peerPieces[peerId] = pieces
+	}
+	pieces[index] = true
+	numPieces := len(pieces)
+	var conns []packets.UDPConn
+	for _, p := range s.extPeers {
+		if p.id == peerId {
+			conns = p.sock.UnderlaySocket.GetConnections()
+		}
+	}
+	s.Unlock()
+
+	tf, _ := s.torrent()
+	left := int64(tf.Length - numPieces*tf.PieceLength)
+	if left < 0 {
+		left = 0
+	}
+	s.pathStore.UpdatePeerStats(peerId, left, currentUploadBandwidth(conns))
+}
+
+// currentUploadBandwidth sums up the bytes per second written over the last second
+func currentUploadBandwidth(conns []packets.UDPConn) int64 {
+	var bandwidth int64
+	for _, conn := range conns {
+		m := conn.GetMetrics()
+		if m == nil || conn.GetState() == packets.ConnectionStates.Closed || len(m.WrittenBandwidth) == 0 {
+			continue
+		}
+		bandwidth += m.WrittenBandwidth[len(m.WrittenBandwidth)-1]
+	}
+	return bandwidth
+}
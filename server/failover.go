@@ -0,0 +1,65 @@
+package server
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"github.com/netsys-lab/bittorrent-over-scion/monitoring"
+	"github.com/netsys-lab/scion-path-discovery/packets"
+	"github.com/netsys-lab/scion-path-discovery/pathselection"
+	"github.com/scionproto/scion/go/lib/snet"
+	log "github.com/sirupsen/logrus"
+)
+
+// replaceFailedPath brings up a replacement for a path whose connection failed, while
+// other connections to the peer are still running. The leecher requests the blocks of
+// the failed path over its remaining paths and picks up the new connection.
+func (s *Server) replaceFailedPath(peerId string, conn packets.UDPConn, failed string) {
+	s.Lock()
+	var peer *ExtPeer
+	for _, p := range s.extPeers {
+		if p.id == peerId {
+			p := p
+			peer = &p
+			break
+		}
+	}
+	s.Unlock()
+	if peer == nil {
+		return
+	}
+
+	inUse := make(map[string]bool)
+	for _, c := range peer.sock.UnderlaySocket.GetConnections() {
+		if c.GetId() == conn.GetId() || c.GetState() == packets.ConnectionStates.Closed || c.GetPath() == nil {
+			continue
+		}
+		inUse[pathselection.PathToString(*c.GetPath())] = true
+	}
+	if len(inUse) == 0 {
+		// The whole session is gone, e.g. because the leecher finished
+		return
+	}
+
+	alternatives, err := s.alternativePaths(*peer)
+	if err != nil {
+		log.Warnf("Could not get alternative paths to %s: %s", peerId, err)
+	}
+	var alternative snet.Path
+	for _, v := range alternatives {
+		pathStr := pathselection.PathToString(v)
+		if pathStr != failed && !inUse[pathStr] && s.replacePath(*peer, failed, v) {
+			alternative = v
+			break
+		}
+	}
+	if alternative != nil {
+		log.Infof("Path %s to %s failed, replacing it by %s", failed, peerId, pathselection.PathToString(alternative))
+		monitoring.PathChanged(monitoring.PathFailed)
+	} else {
+		log.Infof("Path %s to %s failed, no replacement available", failed, peerId)
+		monitoring.PathChanged(monitoring.PathDropped)
+		s.replacePath(*peer, failed, nil)
+	}
+	peer.sock.ForcePathSelection()
+}
@@ -0,0 +1,54 @@
+package server
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"errors"
+
+	"github.com/netsys-lab/bittorrent-over-scion/message"
+	"github.com/netsys-lab/bittorrent-over-scion/torrentfile"
+	"github.com/netsys-lab/scion-path-discovery/packets"
+	log "github.com/sirupsen/logrus"
+)
+
+// errUnknownTorrent is returned if a peer asks for a torrent the server does not seed
+var errUnknownTorrent = errors.New("not seeding torrent")
+
+// handleMetadataRequest sends the requested piece of the info dictionary of the torrent, so that
+// peers only knowing the info-hash can download the torrent
+func (s *Server) handleMetadataRequest(conn packets.UDPConn, tf *torrentfile.TorrentFile, msg *message.Message) error {
+	m, err := message.ParseMetadata(msg)
+	if err != nil {
+		log.Debugf("Ignoring extended message: %s", err)
+		return nil
+	}
+	if m.Type != message.MetadataRequest {
+		return nil
+	}
+
+	reply := &message.Metadata{Type: message.MetadataReject, Piece: m.Piece}
+	metadata, err := tf.Metadata()
+	if err != nil {
+		log.Errorf("Could not encode metadata of %x: %s", tf.InfoHash, err)
+	}
+	begin := m.Piece * message.MetadataPieceSize
+	if err == nil && m.Piece >= 0 && begin < len(metadata) {
+		end := begin + message.MetadataPieceSize
+		if end > len(metadata) {
+			end = len(metadata)
+		}
+		reply = &message.Metadata{
+			Type:      message.MetadataData,
+			Piece:     m.Piece,
+			TotalSize: len(metadata),
+			Data:      metadata[begin:end],
+		}
+	}
+	out, err := message.FormatMetadata(reply)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(out.Serialize())
+	return err
+}
@@ -19,7 +19,6 @@ type UploadConnMetrics struct {
 	Closed    bool
 	Path      string
 	Duration  time.Duration
-	ExportTo  string
 }
 
 type jsonMetrics struct {
@@ -36,7 +35,10 @@ type jsonMetrics struct {
 
 func (m *UploadConnMetrics) GetCsv() string {
 	secs := int64((m.Duration * time.Second) - 3*time.Second)
-	bw := (m.Metrics.WrittenBytes * 8 / 1024 / 1024) / secs
+	bw := int64(0)
+	if secs > 0 {
+		bw = (m.Metrics.WrittenBytes * 8 / 1024 / 1024) / secs
+	}
 	// id;remote;sessionId;uploadBw;startDate;endDate;closed;path;duration;
 	return fmt.Sprintf("%s;%s;%s;%d;%s;%s;%t;%s;%d;%s", m.ConnId, m.Remote, m.SessionId, bw, m.StartDate, m.EndDate, m.Closed, m.Path, m.Duration, m.Local)
 }
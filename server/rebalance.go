@@ -0,0 +1,178 @@
+package server
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"time"
+
+	"github.com/netsys-lab/bittorrent-over-scion/monitoring"
+	ps "github.com/netsys-lab/bittorrent-over-scion/pathselection"
+	"github.com/netsys-lab/scion-path-discovery/packets"
+	"github.com/netsys-lab/scion-path-discovery/pathselection"
+	"github.com/scionproto/scion/go/lib/snet"
+	log "github.com/sirupsen/logrus"
+)
+
+func (s *ServerSelection) setUsedPaths(paths []snet.Path) {
+	s.Lock()
+	defer s.Unlock()
+	s.usedPaths = paths
+}
+
+// withoutAvoidedPaths removes paths replaced by the rebalancer, unless no other path is left
+func (s *ServerSelection) withoutAvoidedPaths(pathSet *pathselection.PathSet) *pathselection.PathSet {
+	if len(s.avoidedPaths) == 0 {
+		return pathSet
+	}
+	filtered := &pathselection.PathSet{
+		Address: pathSet.Address,
+		Paths:   make([]pathselection.PathQuality, 0, len(pathSet.Paths)),
+	}
+	for _, v := range pathSet.Paths {
+		if !s.avoidedPaths[pathselection.PathToString(v.Path)] {
+			filtered.Paths = append(filtered.Paths, v)
+		}
+	}
+	if len(filtered.Paths) == 0 {
+		return pathSet
+	}
+	return filtered
+}
+
+// avoidPath excludes the bad path from future selections of the policy
+func (s *ServerSelection) avoidPath(bad string, alternative snet.Path) {
+	s.Lock()
+	defer s.Unlock()
+	s.avoidedPaths[bad] = true
+	if alternative != nil {
+		delete(s.avoidedPaths, pathselection.PathToString(alternative))
+	}
+}
+
+// replacePath releases the bad path of the peer in the PathSelectionStore and reserves the
+// alternative, if it does not conflict with paths of other peers. The selection of the peer
+// follows the store, the socket has to be updated afterwards with ForcePathSelection.
+// Returns false if the alternative was not reserved.
+func (s *Server) replacePath(p ExtPeer, bad string, alternative snet.Path) bool {
+	id := p.sock.Peer.String()
+	if !s.pathStore.ReplacePath(id, bad, alternative) {
+		return false
+	}
+	p.selection.avoidPath(bad, alternative)
+	p.selection.setUsedPaths(s.pathStore.Get(id).UsedPaths)
+	return true
+}
+
+// collectPathSamples returns the throughput of all open connections to the peer
+func collectPathSamples(conns []packets.UDPConn, window int) []ps.PathSample {
+	samples := make([]ps.PathSample, 0, len(conns))
+	for _, conn := range conns {
+		path := conn.GetPath()
+		m := conn.GetMetrics()
+		if path == nil || m == nil || conn.GetState() == packets.ConnectionStates.Closed {
+			continue
+		}
+		throughput, ok := ps.AverageThroughput(m.WrittenBandwidth, window)
+		if !ok {
+			// Not enough samples yet, new paths get time to ramp up
+			continue
+		}
+		samples = append(samples, ps.PathSample{
+			Path:       pathselection.PathToString(*path),
+			Throughput: throughput,
+		})
+	}
+	return samples
+}
+
+// rebalancePaths periodically evaluates the throughput of the paths to a peer and
+// replaces paths performing consistently worse than the others by alternative paths
+// Note: The path metrics of the sockets contain only transferred bytes, so paths are
+// compared by their throughput
+func (s *Server) rebalancePaths(p ExtPeer, rebalancer *ps.PathRebalancer, stop chan struct{}) {
+	ticker := time.NewTicker(rebalancer.Config().Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		samples := collectPathSamples(p.sock.UnderlaySocket.GetConnections(), rebalancer.Config().Window)
+		badPaths := rebalancer.Evaluate(samples)
+		if len(badPaths) == 0 {
+			continue
+		}
+
+		inUse := make([]string, 0, len(samples))
+		for _, v := range samples {
+			inUse = append(inUse, v.Path)
+		}
+		alternatives, err := s.alternativePaths(p)
+		if err != nil {
+			log.Warnf("Could not get alternative paths to %s: %s", p.id, err)
+		}
+		candidates := make([]string, 0, len(alternatives))
+		for _, v := range alternatives {
+			candidates = append(candidates, pathselection.PathToString(v))
+		}
+
+		for _, bad := range badPaths {
+			replaced := false
+			for !replaced {
+				altStr, ok := rebalancer.PickAlternative(candidates, inUse)
+				if !ok {
+					break
+				}
+				// Candidates conflicting with other peers are not tried again
+				inUse = append(inUse, altStr)
+				replaced = s.replacePath(p, bad, alternatives[indexOfPath(candidates, altStr)])
+				if replaced {
+					log.Infof("Replacing path %s to %s by %s", bad, p.id, altStr)
+					monitoring.PathChanged(monitoring.PathRebalanced)
+				}
+			}
+			if !replaced {
+				log.Infof("Dropping path %s to %s, no alternative available", bad, p.id)
+				monitoring.PathChanged(monitoring.PathDropped)
+				s.replacePath(p, bad, nil)
+			}
+		}
+		p.sock.ForcePathSelection()
+	}
+}
+
+// alternativePaths returns the compliant paths to the peer, ordered by the peer's policy
+func (s *Server) alternativePaths(p ExtPeer) ([]snet.Path, error) {
+	paths, err := p.sock.GetAvailablePaths()
+	if err != nil {
+		return nil, err
+	}
+	paths, err = s.PathFilter.FilterPaths(paths)
+	if err != nil {
+		return nil, err
+	}
+	pathSet := &pathselection.PathSet{
+		Address: *p.sock.Peer,
+		Paths:   make([]pathselection.PathQuality, 0, len(paths)),
+	}
+	for _, v := range paths {
+		pathSet.Paths = append(pathSet.Paths, pathselection.PathQuality{Path: v})
+	}
+	ordered := make([]snet.Path, 0, len(paths))
+	for _, v := range p.selection.policy.Select(pathSet, 0).Paths {
+		ordered = append(ordered, v.Path)
+	}
+	return ordered, nil
+}
+
+func indexOfPath(paths []string, path string) int {
+	for i, v := range paths {
+		if v == path {
+			return i
+		}
+	}
+	return -1
+}
@@ -4,24 +4,23 @@ package server
 // SPDX-License-Identifier: GPL-3.0-only
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
-	"net/http"
-	"os"
-	"strings"
 	"sync"
 	"time"
 
-	"github.com/netsec-ethz/scion-apps/pkg/shttp"
 	util "github.com/netsys-lab/bittorrent-over-scion/Utils"
 	"github.com/netsys-lab/bittorrent-over-scion/bitfield"
 	"github.com/netsys-lab/bittorrent-over-scion/config"
 	"github.com/netsys-lab/bittorrent-over-scion/dht_node"
+	"github.com/netsys-lab/bittorrent-over-scion/events"
+	"github.com/netsys-lab/bittorrent-over-scion/exporter"
 	"github.com/netsys-lab/bittorrent-over-scion/handshake"
 	"github.com/netsys-lab/bittorrent-over-scion/message"
+	"github.com/netsys-lab/bittorrent-over-scion/monitoring"
 	ps "github.com/netsys-lab/bittorrent-over-scion/pathselection"
 	"github.com/netsys-lab/bittorrent-over-scion/peers"
 	"github.com/netsys-lab/bittorrent-over-scion/torrentfile"
@@ -52,13 +51,22 @@ type Server struct {
 	listener          *net.Listener
 	Bitfield          bitfield.Bitfield
 	torrentFile       *torrentfile.TorrentFile
+	torrentLock       sync.RWMutex // Guards torrentFile and Bitfield, which are replaced by SetTorrent
 	NumPaths          int
 	DialBackStartPort int
 	discoveryConfig   *config.PeerDiscoveryConfig
 	dhtNode           *dht_node.DhtNode // dht note controlled by this server
+	sharedDht         bool              // dhtNode is shared with other torrents and not closed by this server
 	pathStore         *ps.PathSelectionStore
 	extPeers          []ExtPeer
-	CsvPath           string
+	exporter          exporter.Exporter // Receives the metrics of every upload connection
+	PathPolicy        string
+	PathFilter        *ps.PathFilter
+	RebalanceConfig   *ps.RebalanceConfig
+	PathHistory       *ps.PathHistory
+	PeerPriorities    map[string]int
+	peerPieces        map[string]map[int]bool // Pieces announced by each peer via HAVE
+	events            *events.Bus             // Receives the events of uploads, see Subscribe
 	sync.Mutex
 }
 
@@ -67,14 +75,25 @@ type ServerSelection struct {
 	lastSelectedPathSet pathselection.PathSet
 	numPaths            int
 	usedPaths           []snet.Path
+	policy              ps.PathPolicy
+	filter              *ps.PathFilter
+	avoidedPaths        map[string]bool // Paths replaced by the rebalancer
+	sync.Mutex
 }
 
 // We use server-side pathselection, meaning the server connects back to the client
 func (s *ServerSelection) CustomPathSelectAlg(pathSet *pathselection.PathSet) (*pathselection.PathSet, error) {
+	s.Lock()
+	defer s.Unlock()
 	// ps := pathSet.GetPathSmallHopCount(s.numPaths)
+	pathSet, err := s.filter.FilterPathSet(pathSet)
+	if err != nil {
+		return nil, err
+	}
+	pathSet = s.withoutAvoidedPaths(pathSet)
 
 	if s.numPaths > 0 {
-		ps := pathSet.GetPathSmallHopCount(s.numPaths)
+		ps := s.policy.Select(pathSet, s.numPaths)
 		for i, v := range ps.Paths {
 			log.Debugf("Got path %s for conn %d", pathselection.PathToString(v.Path), i+1)
 		}
@@ -88,13 +107,18 @@ func (s *ServerSelection) CustomPathSelectAlg(pathSet *pathselection.PathSet) (*
 		Paths:   make([]pathselection.PathQuality, 0),
 	}
 
-	for i, v := range s.usedPaths {
+	for _, v := range s.usedPaths {
 		pathQualityIndex := pathselection.FindIndexByPathString(pathSet.Paths, pathselection.PathToString(v))
+		if pathQualityIndex < 0 {
+			continue
+		}
 		ps.Paths = append(ps.Paths, pathSet.Paths[pathQualityIndex])
-		log.Debugf("Got path %s for conn %d", pathselection.PathToString(pathSet.Paths[pathQualityIndex].Path), i+1)
-		// if i == 1 {
-		//	break
-		// }
+	}
+
+	// The store decides which paths we use, the policy in which order
+	ps = s.policy.Select(ps, 0)
+	for i, v := range ps.Paths {
+		log.Debugf("Got path %s for conn %d", pathselection.PathToString(v.Path), i+1)
 	}
 
 	return ps, nil
@@ -107,7 +131,14 @@ type ServerConfig struct {
 	NumPaths                    int
 	DialBackPort                int
 	DiscoveryConfig             *config.PeerDiscoveryConfig
-	ExportMetricsTarget         string
+	ExportMetricsTarget         string                // Optional: Target of the upload metrics, see exporter.New
+	PathPolicy                  string                // Name of a registered pathselection.PathPolicy, defaults to shortest
+	PathFilter                  *ps.PathFilter        // Optional: Restricts the paths used to upload to leechers
+	RebalanceConfig             *ps.RebalanceConfig   // Optional: Replace badly performing paths during uploads
+	AllocationStrategy          ps.AllocationStrategy // Optional: Weights leechers competing for paths, defaults to equal
+	PeerPriorities              map[string]int        // Optional: Priority per peer address, host or ISD-AS, used by the priority strategy
+	PathHistory                 *ps.PathHistory       // Optional: Prefer paths that performed well before and record the observed quality
+	DhtNode                     *dht_node.DhtNode     // Optional: Dht node shared with other torrents, used instead of a node of this server if the dht is enabled
 }
 
 func NewServer(config *ServerConfig) (*Server, error) {
@@ -117,6 +148,11 @@ func NewServer(config *ServerConfig) (*Server, error) {
 		return nil, errors.New("client based pathselection not supported yet")
 	}
 
+	// Fail early on unknown policies, every peer gets its own instance later
+	if _, err := ps.NewPathPolicy(config.PathPolicy); err != nil {
+		return nil, err
+	}
+
 	var localAddr *snet.UDPAddr
 	var err error
 	if config.LAddr == "" {
@@ -128,6 +164,11 @@ func NewServer(config *ServerConfig) (*Server, error) {
 		}
 	}
 
+	metricsExporter, err := exporter.New(config.ExportMetricsTarget, exporter.DefaultOptions())
+	if err != nil {
+		return nil, err
+	}
+
 	s := &Server{
 		peers:             peers.NewPeerSet(0),
 		Conns:             make([]packets.UDPConn, 0),
@@ -138,34 +179,97 @@ func NewServer(config *ServerConfig) (*Server, error) {
 		DialBackStartPort: config.DialBackPort,
 		discoveryConfig:   config.DiscoveryConfig,
 		pathStore:         ps.NewPathSelectionStore(),
+		exporter:          metricsExporter,
 		extPeers:          make([]ExtPeer, 0),
-		CsvPath:           config.ExportMetricsTarget,
+		events:            &events.Bus{},
+		PathPolicy:        config.PathPolicy,
+		PathFilter:        config.PathFilter,
+		RebalanceConfig:   config.RebalanceConfig,
+		PeerPriorities:    config.PeerPriorities,
+		PathHistory:       config.PathHistory,
+		peerPieces:        make(map[string]map[int]bool),
 	}
+	s.pathStore.SetAllocationStrategy(config.AllocationStrategy)
 
-	s.Bitfield = make([]byte, len(config.TorrentFile.PieceHashes))
-	for i := range config.TorrentFile.PieceHashes {
-		s.Bitfield.SetPiece(i)
-	}
+	s.Bitfield = fullBitfield(config.TorrentFile)
 
-	if config.DiscoveryConfig.EnableDht {
+	if config.DiscoveryConfig.EnableDht && config.DhtNode != nil {
+		s.dhtNode = config.DhtNode
+		s.sharedDht = true
+		s.dhtNode.SeedTorrent(config.TorrentFile.InfoHash, uint16(localAddr.Host.Port), s.onDhtPeer)
+	} else if config.DiscoveryConfig.EnableDht {
 		nodeAddr := localAddr.Copy()
 		nodeAddr.Host.Port = int(config.DiscoveryConfig.DhtPort)
 
 		startingNodes := append(config.TorrentFile.Nodes, config.DiscoveryConfig.DhtNodes...)
-		node, err := dht_node.New(nodeAddr, config.TorrentFile.InfoHash, startingNodes, uint16(localAddr.Host.Port), func(peer peers.Peer) {
-			log.Infof("received peer via dht: %s, peer already known: %t", peer, s.hasPeer(peer))
-			s.peers.Add(peer)
+		// Seeders have to be found by leechers, so they are never read-only
+		node, err := dht_node.NewNode(nodeAddr, dht_node.NodeConfig{
+			StateDir:         config.DiscoveryConfig.DhtNodeStateDir(),
+			StartingNodes:    startingNodes,
+			AnnounceInterval: config.DiscoveryConfig.DhtAnnounceInterval,
+			RetryInterval:    config.DiscoveryConfig.DhtRetryInterval,
 		})
 		if err != nil {
 			return nil, err
 		}
+		node.SeedTorrent(config.TorrentFile.InfoHash, uint16(localAddr.Host.Port), s.onDhtPeer)
 		s.dhtNode = node
+		if err := monitoring.RegisterDhtNode(node, nodeAddr.String()); err != nil {
+			log.Warnf("Could not expose metrics of dht node %s: %s", nodeAddr, err)
+		}
 	}
+	monitoring.AddTorrent(config.TorrentFile.InfoHash, config.TorrentFile.Name)
 
 	return s, nil
 }
 
-func (s *Server) updateDisjointPathselection(p ExtPeer) {
+func (s *Server) onDhtPeer(peer peers.Peer) {
+	log.Infof("received peer via dht: %s, peer already known: %t", peer, s.hasPeer(peer))
+	s.peers.Add(peer)
+}
+
+// fullBitfield returns the bitfield of a seeder of the torrent
+func fullBitfield(tf *torrentfile.TorrentFile) bitfield.Bitfield {
+	bf := make(bitfield.Bitfield, len(tf.PieceHashes))
+	for i := range tf.PieceHashes {
+		bf.SetPiece(i)
+	}
+	return bf
+}
+
+// torrent returns the torrent served to new connections and its bitfield
+func (s *Server) torrent() (*torrentfile.TorrentFile, bitfield.Bitfield) {
+	s.torrentLock.RLock()
+	defer s.torrentLock.RUnlock()
+	return s.torrentFile, s.Bitfield
+}
+
+// SetTorrent replaces the torrent served by the server, e.g. by the latest version of an update
+// feed. Connections established before are served with the previous torrent until they close,
+// leechers of the previous torrent can not connect anymore.
+func (s *Server) SetTorrent(tf *torrentfile.TorrentFile) {
+	s.torrentLock.Lock()
+	old := s.torrentFile
+	s.torrentFile = tf
+	s.Bitfield = fullBitfield(tf)
+	s.torrentLock.Unlock()
+
+	if old == nil || old.InfoHash != tf.InfoHash {
+		if old != nil {
+			monitoring.RemoveTorrent(old.InfoHash)
+		}
+		if s.dhtNode != nil {
+			if old != nil {
+				s.dhtNode.RemoveTorrent(old.InfoHash)
+			}
+			s.dhtNode.SeedTorrent(tf.InfoHash, uint16(s.localAddr.Host.Port), s.onDhtPeer)
+		}
+	}
+	monitoring.AddTorrent(tf.InfoHash, tf.Name)
+	log.Infof("Seeding %s (%x)", tf.Name, tf.InfoHash)
+}
+
+func (s *Server) updateDisjointPathselection(p ExtPeer) error {
 	// Create a PeerPathEntry, add it to the store
 	// Beforehand, fill available paths
 	/*paths := make([]snet.Path, 0)
@@ -175,33 +279,80 @@ func (s *Server) updateDisjointPathselection(p ExtPeer) {
 			paths = append(paths, *v)
 		}
 	}*/
-	// TODO: Error handling
-	paths, _ := p.sock.GetAvailablePaths()
+	tf, _ := s.torrent()
+	paths, err := p.sock.GetAvailablePaths()
+	if err != nil {
+		return err
+	}
+	paths, err = s.PathFilter.FilterPaths(paths)
+	if err != nil {
+		return fmt.Errorf("can not upload to %s: %w", p.sock.Peer, err)
+	}
 	// paths = append(paths[:1], paths[1])
 	pp := ps.PeerPathEntry{
 		PeerAddrStr:    p.sock.Peer.String(),
 		PeerAddr:       *p.sock.Peer,
 		AvailablePaths: paths, // TODO: Get available paths from socket
 		UsedPaths:      make([]snet.Path, 0),
+		Priority:       s.peerPriority(p.sock.Peer),
+		Left:           int64(tf.Length),
 	}
 
 	s.pathStore.AddPeerEntry(pp)
-	p.selection.usedPaths = s.pathStore.Get(pp.PeerAddrStr).UsedPaths
+	p.selection.setUsedPaths(s.pathStore.Get(pp.PeerAddrStr).UsedPaths)
+
+	s.Lock()
+	otherPeers := append([]ExtPeer{}, s.extPeers...)
+	s.extPeers = append(s.extPeers, p)
+	s.Unlock()
+
+	// Adding the peer may have taken paths from the others
+	s.updatePeerSelections(otherPeers)
+	return nil
+}
 
-	for _, v := range s.extPeers {
-		// After adding, we get the used Paths, which we save in the selection
+// removeFromDisjointPathselection removes the peer from the store and hands its
+// paths to the remaining peers
+func (s *Server) removeFromDisjointPathselection(id string) {
+	s.Lock()
+	newPeers := make([]ExtPeer, 0)
+	for _, p := range s.extPeers {
+		if p.id != id {
+			newPeers = append(newPeers, p)
+		} else {
+			log.Debugf("Remove peer %s from list", id)
+		}
+	}
+	s.extPeers = newPeers
+	delete(s.peerPieces, id)
+	s.Unlock()
+
+	changed := s.pathStore.RemovePeerEntry(id)
+	updatedPeers := make([]ExtPeer, 0, len(changed))
+	for _, p := range newPeers {
+		for _, c := range changed {
+			if p.sock.Peer.String() == c {
+				updatedPeers = append(updatedPeers, p)
+			}
+		}
+	}
+	s.updatePeerSelections(updatedPeers)
+}
+
+func (s *Server) updatePeerSelections(peers []ExtPeer) {
+	for _, v := range peers {
+		// We get the used Paths from the store, which we save in the selection
 		// We need a unique identifier for paths to map them to PathQualities
 		paths := s.pathStore.Get(v.sock.Peer.String()).UsedPaths
-		v.selection.usedPaths = paths
+		v.selection.setUsedPaths(paths)
 
 		// Update pathselection in socket
-		// TODO: We need this later
 		v.sock.ForcePathSelection()
+		monitoring.PathChanged(monitoring.PathsAllocated)
 	}
-	s.extPeers = append(s.extPeers, p)
 }
 
-func (s *Server) measureConnMetrics(conn packets.UDPConn, sessionId string, wg *sync.WaitGroup) {
+func (s *Server) measureConnMetrics(ctx context.Context, conn packets.UDPConn, peerId string, sessionId string, wg *sync.WaitGroup) {
 	defer wg.Done()
 	p := conn.GetPath()
 	metrics := UploadConnMetrics{
@@ -209,7 +360,6 @@ func (s *Server) measureConnMetrics(conn packets.UDPConn, sessionId string, wg *
 		SessionId: sessionId,
 		Remote:    conn.GetRemote().String(),
 		StartDate: time.Now(),
-		ExportTo:  s.CsvPath,
 		Local:     s.lAddr,
 	}
 
@@ -218,74 +368,45 @@ func (s *Server) measureConnMetrics(conn packets.UDPConn, sessionId string, wg *
 	}
 
 	// TODO: Retry?
-	err := s.handleConnection(conn, true)
-	m := conn.GetMetrics()
-	if m != nil {
+	monitoring.ConnectionOpened(monitoring.Seeder)
+	s.publish(events.Event{Type: events.PathAdded, Peer: peerId, ConnId: metrics.ConnId, Path: metrics.Path})
+	err := s.handleConnection(conn, peerId, true)
+	monitoring.ConnectionClosed(monitoring.Seeder)
+	s.publish(events.Event{Type: events.PathRemoved, Peer: peerId, ConnId: metrics.ConnId, Path: metrics.Path, Err: err})
+	if m := conn.GetMetrics(); m != nil {
 		metrics.Metrics = *m
 	}
+	if p != nil {
+		s.recordPathQuality(ctx, conn, metrics.Path, err)
+	}
 	if err == nil {
 		metrics.Closed = true
+	} else if p != nil && ctx.Err() == nil {
+		go s.replaceFailedPath(peerId, conn, metrics.Path)
 	}
 
 	metrics.EndDate = time.Now()
 	metrics.Duration = time.Since(metrics.StartDate)
-	log.Debugf("Exporting metrics to %s", metrics.ExportTo)
-	if strings.Index(metrics.ExportTo, ".csv") >= 0 {
-		csv := metrics.GetCsv()
-		s.Lock()
-		var f *os.File
-		if _, err = os.Stat(s.CsvPath); err != nil {
-			f, err = os.OpenFile(s.CsvPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				log.Error(err)
-				return
-			}
-			f.WriteString(metrics.GetCsvHeader())
-			f.WriteString("\n")
-		} else {
-			f, err = os.OpenFile(s.CsvPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				log.Error(err)
-				return
-			}
-		}
-
-		f.WriteString(csv)
-		f.WriteString("\n")
-		err = f.Close()
-		if err != nil {
-			log.Error(err)
-			return
-		}
-
-		err = conn.Close()
-		if err != nil {
-			log.Error(err)
-			return
-		}
-		s.Unlock()
-	} else if strings.Index(metrics.ExportTo, "http") >= 0 {
-		// TODO: shttp support
-		url := metrics.ExportTo
-		fmt.Println("URL:>", url)
-
-		json := metrics.GetJSON()
-		c := &http.Client{
-			Transport: shttp.DefaultTransport,
-		}
-
-		resp, err := c.Post(shttp.MangleSCIONAddrURL(url), "application/json", bytes.NewBuffer(json))
-		if err != nil {
-			log.Error(err)
-			return
-		}
+	s.exporter.Export(&metrics)
+}
 
-		log.Debugf("Metrics post resulted in %d", resp.StatusCode)
+// recordPathQuality adds the outcome of the connection over the path to the history. Connections
+// closed because the server shuts down do not count as failed.
+func (s *Server) recordPathQuality(ctx context.Context, conn packets.UDPConn, path string, err error) {
+	remote := conn.GetRemote()
+	if remote == nil {
+		return
 	}
-
+	o := ps.PathObservation{Failed: err != nil && ctx.Err() == nil}
+	if m := conn.GetMetrics(); m != nil {
+		o.Throughput, _ = ps.AverageThroughput(m.WrittenBandwidth, len(m.WrittenBandwidth))
+	}
+	s.PathHistory.Record(remote.IA.String(), path, o)
 }
 
-func (s *Server) ListenHandshake() error {
+// ListenHandshake accepts leechers and uploads to them until ctx is done. Then the connections to
+// all leechers are closed and ctx.Err() is returned once their uploads stopped.
+func (s *Server) ListenHandshake(ctx context.Context) error {
 	var err error
 
 	mpListener := smp.NewMPListener(s.lAddr, &smp.MPListenerOptions{
@@ -296,17 +417,50 @@ func (s *Server) ListenHandshake() error {
 	if err != nil {
 		return err
 	}
+
+	// TODO: The listener of the path discovery library can not be closed, so its port stays
+	// bound and the accepting goroutine blocked after ctx is done
+	type dialIn struct {
+		remote *snet.UDPAddr
+		err    error
+	}
+	dialIns := make(chan dialIn)
+	go func() {
+		for {
+			remote, err := mpListener.WaitForMPPeerSockConnect()
+			select {
+			case dialIns <- dialIn{remote: remote, err: err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var leechers sync.WaitGroup
 	startPort := s.DialBackStartPort
 	for {
 		log.Info("waiting for MPPeer socket connect")
-		remote, err := mpListener.WaitForMPPeerSockConnect()
+		var in dialIn
+		select {
+		case in = <-dialIns:
+		case <-ctx.Done():
+			log.Info("Stopping seeder, disconnecting leechers")
+			leechers.Wait()
+			return ctx.Err()
+		}
+		remote, err := in.remote, in.err
 		if err != nil {
 			return err
 		}
 		log.Debugf("Got new Client, dialing back")
 		sessionId := util.RandStringBytes(16)
 		startPort = util.EnsureBetweenRandom(startPort+101, 1025, 65000) // Just increase by a random number to avoid using often used ports (e.g. 50000)
+		leechers.Add(1)
 		go func(remote *snet.UDPAddr, startPort int) {
+			defer leechers.Done()
 			ladr := s.localAddr.Copy()
 			ladr.Host.Port = startPort
 			mpSock := smp.NewMPPeerSock(ladr.String(), remote, &smp.MPSocketOptions{
@@ -319,20 +473,36 @@ func (s *Server) ListenHandshake() error {
 			if err != nil {
 
 				log.Errorf("Failed to listen %v", err)
+				s.publish(events.Event{Type: events.Error, Peer: remote.String(), Err: err})
 				return
 			}
 			log.Debugf("Connecting to %s", remote.String())
 			// TODO: We need to make this server selection editable
 			// And maybe we need a method to force pathselection being done
 			// (And a method to get all available paths)
+			policy, err := ps.NewPathPolicy(s.PathPolicy)
+			if err != nil {
+				log.Error(err)
+				return
+			}
 			sel := &ServerSelection{
-				numPaths: s.NumPaths,
+				numPaths:     s.NumPaths,
+				policy:       ps.WithHistory(policy, s.PathHistory),
+				filter:       s.PathFilter,
+				avoidedPaths: make(map[string]bool),
 			}
-			s.updateDisjointPathselection(ExtPeer{
+			extPeer := ExtPeer{
 				sock:      mpSock,
 				selection: sel,
 				id:        remote.String(),
-			})
+			}
+			err = s.updateDisjointPathselection(extPeer)
+			if err != nil {
+				log.Error(err)
+				s.publish(events.Event{Type: events.Error, Peer: remote.String(), Err: err})
+				mpSock.UnderlaySocket.CloseAll()
+				return
+			}
 
 			err = mpSock.Connect(sel, &socket.ConnectOptions{
 				SendAddrPacket:      true,
@@ -340,8 +510,26 @@ func (s *Server) ListenHandshake() error {
 			})
 			if err != nil {
 				log.Error(err)
+				s.publish(events.Event{Type: events.Error, Peer: remote.String(), Err: err})
 				return
 			}
+			s.publish(events.Event{Type: events.PeerConnected, Peer: remote.String()})
+
+			// Disconnecting closes the connections, which ends the uploads to the leecher
+			peerDone := make(chan struct{})
+			defer close(peerDone)
+			go func() {
+				select {
+				case <-ctx.Done():
+					mpSock.Disconnect()
+				case <-peerDone:
+				}
+			}()
+
+			stopRebalancing := make(chan struct{})
+			if s.RebalanceConfig != nil {
+				go s.rebalancePaths(extPeer, ps.NewPathRebalancer(*s.RebalanceConfig), stopRebalancing)
+			}
 
 			conns := mpSock.UnderlaySocket.GetConnections()
 			log.Debugf("Got new connections %d", len(conns))
@@ -353,13 +541,18 @@ func (s *Server) ListenHandshake() error {
 				}
 				s.Conns = append(s.Conns, conn)
 				wg.Add(1)
-				go s.measureConnMetrics(conn, sessionId, &wg)
+				go s.measureConnMetrics(ctx, conn, remote.String(), sessionId, &wg)
 
 			}
 			go func() {
 				for {
 					// Filter for new connections
-					conns := <-mpSock.OnConnectionsChange
+					var conns []packets.UDPConn
+					select {
+					case conns = <-mpSock.OnConnectionsChange:
+					case <-peerDone:
+						return
+					}
 
 					// Close old connections
 					newConns := make([]packets.UDPConn, 0)
@@ -382,37 +575,44 @@ func (s *Server) ListenHandshake() error {
 						if !connAlreadyOpen {
 							s.Conns = append(s.Conns, conn)
 							wg.Add(1)
-							go s.measureConnMetrics(conn, sessionId, &wg)
+							go s.measureConnMetrics(ctx, conn, remote.String(), sessionId, &wg)
 						}
 					}
 				}
 			}()
 			wg.Wait()
+			close(stopRebalancing)
 			mpSock.Disconnect()
 			log.Infof("Disconnected %s", remote.String())
-			s.Lock()
-			// TODO: Update pathselection
-			delete(s.pathStore.Data, remote.String())
-			newPeers := make([]ExtPeer, 0)
-			for _, p := range s.extPeers {
-				if p.id != remote.String() {
-					newPeers = append(newPeers, p)
-				} else {
-					log.Debugf("Remove peer %s from list", remote.String())
-				}
+			s.publish(events.Event{Type: events.PeerDisconnected, Peer: remote.String()})
+			tf, _ := s.torrent()
+			monitoring.RemovePeer(tf.InfoHash, remote.String())
+			s.removeFromDisjointPathselection(remote.String())
+			if err := s.PathHistory.Save(); err != nil {
+				log.Warnf("Could not save path history: %s", err)
 			}
-			s.extPeers = newPeers
-			s.Unlock()
 		}(remote, startPort)
 
 	}
 }
 
-func (s *Server) handleConnection(conn packets.UDPConn, waitForHandshake bool) error {
+func (s *Server) handleConnection(conn packets.UDPConn, peerId string, waitForHandshake bool) error {
+	tf, bf := s.torrent()
 	if waitForHandshake {
-		s.handleIncomingHandshake(conn)
+		err := s.handleIncomingHandshake(conn, tf, bf)
+		if errors.Is(err, errUnknownTorrent) {
+			log.Infof("Closing connection %s: %s", conn.GetId(), err)
+			conn.Close()
+			return nil
+		}
 	}
 
+	path := "unknown"
+	if p := conn.GetPath(); p != nil {
+		path = pathselection.PathToString(*p)
+	}
+	transfer := monitoring.NewTransfer(monitoring.Upload, tf.InfoHash, peerId, path)
+
 	for {
 		msg, err := message.Read(conn)
 		if err != nil {
@@ -430,6 +630,7 @@ func (s *Server) handleConnection(conn packets.UDPConn, waitForHandshake bool) e
 			if err != nil {
 				return err
 			}
+			s.publish(events.Event{Type: events.Unchoked, Peer: peerId, ConnId: conn.GetId(), Path: path})
 		case message.MsgRequest:
 			index, begin, length, err := message.ParseRequest(msg)
 			if err != nil {
@@ -438,12 +639,19 @@ func (s *Server) handleConnection(conn packets.UDPConn, waitForHandshake bool) e
 			buf := make([]byte, 8)
 			binary.BigEndian.PutUint32(buf[0:4], uint32(index))
 			binary.BigEndian.PutUint32(buf[4:8], uint32(begin))
-			buf = append(buf, s.torrentFile.Content[(index*s.torrentFile.PieceLength)+begin:(index*s.torrentFile.PieceLength)+begin+length]...)
+			buf = append(buf, tf.Content[(index*tf.PieceLength)+begin:(index*tf.PieceLength)+begin+length]...)
 			retMsg := message.Message{ID: message.MsgPiece, Payload: buf}
 			_, err = conn.Write(retMsg.Serialize())
 			if err != nil {
 				return err
 			}
+			transfer.Add(length)
+		case message.MsgHave:
+			s.onPeerHave(peerId, msg)
+		case message.MsgExtended:
+			if err := s.handleMetadataRequest(conn, tf, msg); err != nil {
+				return err
+			}
 		case message.MsgPort:
 			log.Debug("got port message")
 			if !s.discoveryConfig.EnableDht ||
@@ -470,18 +678,21 @@ func (s *Server) handleConnection(conn packets.UDPConn, waitForHandshake bool) e
 	}
 }
 
-func (s *Server) handleIncomingHandshake(conn packets.UDPConn) error {
+func (s *Server) handleIncomingHandshake(conn packets.UDPConn, tf *torrentfile.TorrentFile, bf bitfield.Bitfield) error {
 	hs, err := handshake.Read(conn)
 	if err != nil {
 		return err
 	}
+	if hs.InfoHash != tf.InfoHash {
+		return fmt.Errorf("%w %x", errUnknownTorrent, hs.InfoHash)
+	}
 
 	_, err = conn.Write(hs.Serialize())
 	if err != nil {
 		return err
 	}
 
-	msg := message.Message{ID: message.MsgBitfield, Payload: s.Bitfield}
+	msg := message.Message{ID: message.MsgBitfield, Payload: bf}
 	_, err = conn.Write(msg.Serialize())
 	if err != nil {
 		return err
@@ -498,12 +709,61 @@ func (s *Server) handleIncomingHandshake(conn packets.UDPConn) error {
 	return nil
 }
 
+// Subscribe returns a channel receiving the events of the uploads, see events.Bus. The channel is
+// closed by Close.
+func (s *Server) Subscribe(buffer int) (<-chan events.Event, func()) {
+	return s.events.Subscribe(buffer)
+}
+
+// publish publishes an event of the torrent of the server
+func (s *Server) publish(e events.Event) {
+	tf, _ := s.torrent()
+	e.InfoHash = tf.InfoHash
+	s.events.Publish(e)
+}
+
+// LeecherPath is a path used to upload to a leecher
+type LeecherPath struct {
+	Path  snet.Path
+	Bytes int64 // Bytes written over the path in the current session
+}
+
+// Leechers returns the paths used to upload to each connected leecher, by leecher address
+func (s *Server) Leechers() map[string][]LeecherPath {
+	s.Lock()
+	extPeers := append([]ExtPeer{}, s.extPeers...)
+	s.Unlock()
+	leechers := make(map[string][]LeecherPath, len(extPeers))
+	for _, p := range extPeers {
+		written := make(map[string]int64)
+		for _, c := range p.sock.UnderlaySocket.GetConnections() {
+			if m := c.GetMetrics(); m != nil && c.GetPath() != nil {
+				written[pathselection.PathToString(*c.GetPath())] += m.WrittenBytes
+			}
+		}
+		addr := p.sock.Peer.String()
+		paths := make([]LeecherPath, 0)
+		for _, path := range s.pathStore.Get(addr).UsedPaths {
+			paths = append(paths, LeecherPath{Path: path, Bytes: written[pathselection.PathToString(path)]})
+		}
+		leechers[addr] = paths
+	}
+	return leechers
+}
+
 func (s Server) hasPeer(peer peers.Peer) bool {
 	return s.peers.Contains(peer)
 }
 
 func (s Server) Close() {
-	if s.dhtNode != nil {
+	if err := s.exporter.Close(); err != nil {
+		log.Error(err)
+	}
+	s.events.Close()
+	if s.dhtNode != nil && s.sharedDht {
+		tf, _ := s.torrent()
+		s.dhtNode.RemoveTorrent(tf.InfoHash)
+	} else if s.dhtNode != nil {
 		s.dhtNode.Close()
 	}
 }
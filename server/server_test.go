@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/netsys-lab/scion-path-discovery/packets"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ps "github.com/netsys-lab/bittorrent-over-scion/pathselection"
+)
+
+// testConn provides the remote and the metrics of a connection, other methods are not used
+type testConn struct {
+	packets.UDPConn
+	remote  *snet.UDPAddr
+	metrics *packets.PathMetrics
+}
+
+func (c *testConn) GetRemote() *snet.UDPAddr {
+	return c.remote
+}
+
+func (c *testConn) GetMetrics() *packets.PathMetrics {
+	return c.metrics
+}
+
+func TestRecordPathQuality(t *testing.T) {
+	history, err := ps.OpenPathHistory(filepath.Join(t.TempDir(), "paths.json"))
+	require.NoError(t, err)
+	s := &Server{PathHistory: history}
+	remote, err := snet.ParseUDPAddr("19-ffaa:1:c3f,[10.0.0.2]:43000")
+	require.NoError(t, err)
+	conn := &testConn{remote: remote, metrics: &packets.PathMetrics{WrittenBandwidth: []int64{100, 300}}}
+
+	s.recordPathQuality(context.Background(), conn, "failed", errors.New("timeout"))
+	record, ok := history.Get("19-ffaa:1:c3f", "failed")
+	require.True(t, ok)
+	assert.Equal(t, 1, record.Failures)
+	assert.Equal(t, 0, record.Successes, "a failed connection is no success")
+	assert.True(t, record.Score() < 0)
+
+	s.recordPathQuality(context.Background(), conn, "closed", nil)
+	record, _ = history.Get("19-ffaa:1:c3f", "closed")
+	assert.Equal(t, 1, record.Successes)
+	assert.Equal(t, int64(200), record.Throughput)
+
+	// Connections closed by the shutdown did not fail
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.recordPathQuality(ctx, conn, "stopped", errors.New("closed"))
+	record, _ = history.Get("19-ffaa:1:c3f", "stopped")
+	assert.Equal(t, 0, record.Failures)
+}
@@ -0,0 +1,43 @@
+package main
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultShutdownTimeout is the time commands get to shut down cleanly after SIGINT or SIGTERM
+const defaultShutdownTimeout = 10 * time.Second
+
+// exitStopped is the exit code of a leecher whose download was stopped by SIGINT or SIGTERM
+// before it completed. It differs from the exit code 1 of errors, so that scripts can resume
+// the download by running the command again.
+const exitStopped = 3
+
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM to shut down cleanly.
+// The process exits if the shutdown takes longer than timeout or on a second signal.
+func signalContext(timeout time.Duration) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Infof("Received %s, shutting down. Send it again to exit immediately", sig)
+		cancel()
+		select {
+		case <-signals:
+			log.Warn("Exiting without shutting down")
+		case <-time.After(timeout):
+			log.Warnf("Shutdown did not finish within %s, exiting", timeout)
+		}
+		os.Exit(1)
+	}()
+	return ctx
+}
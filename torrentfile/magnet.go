@@ -0,0 +1,90 @@
+package torrentfile
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/scionproto/scion/go/lib/snet"
+
+	"github.com/netsys-lab/bittorrent-over-scion/peers"
+)
+
+// Magnet is a magnet link as specified in BEP 9. Peers are SCION addresses given with x.pe.
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string
+	Peers    []peers.Peer
+}
+
+// ParseMagnet parses a magnet link with a hex or base32 encoded BitTorrent info-hash
+func ParseMagnet(uri string) (Magnet, error) {
+	var m Magnet
+	u, err := url.Parse(uri)
+	if err != nil {
+		return m, err
+	}
+	if u.Scheme != "magnet" {
+		return m, fmt.Errorf("%q is not a magnet link", uri)
+	}
+	q := u.Query()
+
+	found := false
+	for _, xt := range q["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		encoded := strings.TrimPrefix(xt, "urn:btih:")
+		var ih []byte
+		switch len(encoded) {
+		case 40:
+			ih, err = hex.DecodeString(encoded)
+		case 32:
+			ih, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+		default:
+			err = fmt.Errorf("invalid info-hash length %d", len(encoded))
+		}
+		if err != nil {
+			return m, fmt.Errorf("invalid info-hash in magnet link: %w", err)
+		}
+		copy(m.InfoHash[:], ih)
+		found = true
+		break
+	}
+	if !found {
+		return m, errors.New("magnet link contains no BitTorrent info-hash")
+	}
+
+	m.Name = q.Get("dn")
+	for _, pe := range q["x.pe"] {
+		if _, err := snet.ParseUDPAddr(pe); err != nil {
+			return m, fmt.Errorf("invalid peer %q in magnet link: %w", pe, err)
+		}
+		m.Peers = append(m.Peers, peers.Peer{Addr: pe})
+	}
+	return m, nil
+}
+
+// String returns the magnet link
+func (m Magnet) String() string {
+	q := url.Values{}
+	q.Set("xt", "urn:btih:"+hex.EncodeToString(m.InfoHash[:]))
+	if m.Name != "" {
+		q.Set("dn", m.Name)
+	}
+	for _, p := range m.Peers {
+		q.Add("x.pe", p.Addr)
+	}
+	return "magnet:?" + q.Encode()
+}
+
+// Magnet returns the magnet link of the torrent
+func (t *TorrentFile) Magnet() Magnet {
+	return Magnet{InfoHash: t.InfoHash, Name: t.Name}
+}
@@ -0,0 +1,39 @@
+package torrentfile
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsys-lab/bittorrent-over-scion/peers"
+)
+
+func TestParseMagnet(t *testing.T) {
+	m, err := ParseMagnet("magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&dn=dataset&x.pe=19-ffaa:1:c3f,[10.0.0.2]:43000")
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789abcdef0123456789abcdef01234567", fmt.Sprintf("%x", m.InfoHash))
+	assert.Equal(t, "dataset", m.Name)
+	assert.Equal(t, []peers.Peer{{Addr: "19-ffaa:1:c3f,[10.0.0.2]:43000"}}, m.Peers)
+
+	parsed, err := ParseMagnet(m.String())
+	require.NoError(t, err)
+	assert.Equal(t, m, parsed)
+
+	// base32 encoded info-hash
+	b32, err := ParseMagnet("magnet:?xt=urn:btih:AERUKZ4JVPG66AJDIVTYTK6N54ASGRLH")
+	require.NoError(t, err)
+	assert.Equal(t, m.InfoHash, b32.InfoHash)
+
+	for _, invalid := range []string{
+		"http://example.com",
+		"magnet:?dn=dataset",
+		"magnet:?xt=urn:btih:0123",
+		"magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&x.pe=invalid",
+	} {
+		_, err := ParseMagnet(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
@@ -0,0 +1,115 @@
+package torrentfile
+
+// SPDX-FileCopyrightText:  2019 NetSys Lab
+// SPDX-License-Identifier: GPL-3.0-only
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+
+	"github.com/jackpal/bencode-go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/netsys-lab/bittorrent-over-scion/client"
+	"github.com/netsys-lab/bittorrent-over-scion/config"
+	"github.com/netsys-lab/bittorrent-over-scion/dht_node"
+	"github.com/netsys-lab/bittorrent-over-scion/peers"
+)
+
+// Metadata returns the bencoded info dictionary of the torrent, whose hash is the info-hash
+func (t *TorrentFile) Metadata() ([]byte, error) {
+	var pieces bytes.Buffer
+	for _, v := range t.PieceHashes {
+		pieces.Write(v[:])
+	}
+	info := bencodeInfo{
+		Pieces:      pieces.String(),
+		PieceLength: t.PieceLength,
+		Length:      t.Length,
+		Name:        t.Name,
+	}
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, info); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// FromMetadata creates the torrent of an info dictionary received from peers
+func FromMetadata(infoHash [20]byte, metadata []byte) (TorrentFile, error) {
+	if sha1.Sum(metadata) != infoHash {
+		return TorrentFile{}, fmt.Errorf("metadata does not match the info-hash %x", infoHash)
+	}
+	bto := bencodeTorrent{}
+	if err := bencode.Unmarshal(bytes.NewReader(metadata), &bto.Info); err != nil {
+		return TorrentFile{}, err
+	}
+	t, err := bto.toTorrentFile()
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	if t.InfoHash != infoHash {
+		return TorrentFile{}, fmt.Errorf("info dictionary of %x contains unsupported fields", infoHash)
+	}
+	return t, nil
+}
+
+// FetchMetadata connects to the peer and fetches the metadata of the torrent with the info-hash
+func FetchMetadata(infoHash [20]byte, peer peers.Peer, local string, pc *config.PeerDiscoveryConfig) (TorrentFile, error) {
+	var peerID [20]byte
+	if _, err := rand.Read(peerID[:]); err != nil {
+		return TorrentFile{}, err
+	}
+
+	mpC := client.NewMPClient()
+	clients, err := mpC.DialAndWaitForConnectBack(local, peer, peerID, infoHash, pc, nil)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	defer mpC.GetSocket().Disconnect()
+	if len(clients) == 0 {
+		return TorrentFile{}, fmt.Errorf("no connection to %s", peer)
+	}
+
+	metadata, err := clients[0].FetchMetadata()
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	return FromMetadata(infoHash, metadata)
+}
+
+// FindMetadata fetches the metadata of the torrent from the first peer that delivers it. The
+// given peers are tried first, then the peers looked up via the dht node, if it is set. It gives
+// up once ctx is done.
+func FindMetadata(ctx context.Context, infoHash [20]byte, candidates []peers.Peer, node *dht_node.DhtNode, local string, pc *config.PeerDiscoveryConfig) (TorrentFile, peers.Peer, error) {
+	found := make(chan peers.Peer, 16+len(candidates))
+	for _, peer := range candidates {
+		found <- peer
+	}
+	if node != nil {
+		node.AddTorrent(infoHash, 0, func(peer peers.Peer) {
+			select {
+			case found <- peer:
+			default:
+			}
+		})
+		defer node.RemoveTorrent(infoHash)
+	}
+
+	for {
+		select {
+		case peer := <-found:
+			tf, err := FetchMetadata(infoHash, peer, local, pc)
+			if err != nil {
+				log.Warnf("Could not fetch metadata of %x from %s: %s", infoHash, peer, err)
+				continue
+			}
+			return tf, peer, nil
+		case <-ctx.Done():
+			return TorrentFile{}, peers.Peer{}, fmt.Errorf("found no peer with the metadata of %x: %w", infoHash, ctx.Err())
+		}
+	}
+}
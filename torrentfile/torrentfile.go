@@ -4,10 +4,13 @@ package torrentfile
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 
 	"github.com/jackpal/bencode-go"
@@ -18,7 +21,10 @@ import (
 	"github.com/netsys-lab/scion-path-discovery/packets"
 
 	"github.com/netsys-lab/bittorrent-over-scion/config"
+	"github.com/netsys-lab/bittorrent-over-scion/dht_node"
+	"github.com/netsys-lab/bittorrent-over-scion/exporter"
 	"github.com/netsys-lab/bittorrent-over-scion/p2p"
+	ps "github.com/netsys-lab/bittorrent-over-scion/pathselection"
 	"github.com/netsys-lab/bittorrent-over-scion/peers"
 )
 
@@ -36,6 +42,13 @@ type TorrentFile struct {
 	Name         string
 	Content      []byte
 	PrintMetrics bool
+	PathPolicy   string
+	PathFilter   *ps.PathFilter
+	PathHistory  *ps.PathHistory
+	DhtNode      *dht_node.DhtNode                        // Optional: Dht node shared with other torrents, used instead of a new node if the dht is enabled
+	Previous     []byte                                   // Optional: Content of a previous version, unchanged pieces are not downloaded
+	ExportTarget string                                   // Optional: Target the per-path metrics of downloads are exported to, see exporter.New
+	OnDownload   func(torrent *p2p.Torrent) (done func()) // Optional: Called when the download starts, e.g. to display its progress, done is called when it ends
 }
 
 type bencodeInfo struct {
@@ -51,27 +64,59 @@ type bencodeTorrent struct {
 	Info     bencodeInfo     `bencode:"info"`
 }
 
+// DownloadOptions configure DownloadToFile
+type DownloadOptions struct {
+	Peer                        string                      // Optional: SCION address of a peer to download from, besides those found via the dht
+	Local                       string                      // Local SCION address
+	PathSelectionResponsibility string                      // Optional: Only "server" is supported, which is the default
+	DiscoveryConfig             *config.PeerDiscoveryConfig // Optional: Defaults to config.DefaultPeerDisoveryConfig
+}
+
 // DownloadToFile downloads a torrent and writes it to a file
 // This function leeches all pieces of a torrent but never starts seeding. When DHT is enabled in the
 // PeerDiscoveryConfig, the peer will still announce its presence to receive other peers. We therefore announces our
 // presence on a port we are not listening to.
-func (t *TorrentFile) DownloadToFile(path string, peer string, local string, pathSelectionResponsibility string, pc *config.PeerDiscoveryConfig) (*p2p.Torrent, error) {
+// If ctx is done or the download is stopped, the metrics of the paths so far are exported, the
+// pieces downloaded so far are written to PartialPath(path), the connections and the dht node
+// created for the download are closed and p2p.ErrStopped is returned with the torrent. The file
+// at path is only written once the download is complete. On other errors, the dht node created
+// for the download is closed as well.
+func (t *TorrentFile) DownloadToFile(ctx context.Context, path string, opts DownloadOptions) (*p2p.Torrent, error) {
+	if opts.PathSelectionResponsibility == "" {
+		opts.PathSelectionResponsibility = "server"
+	}
+	pc := opts.DiscoveryConfig
+	if pc == nil {
+		defaultConfig := config.DefaultPeerDisoveryConfig()
+		pc = &defaultConfig
+	}
+
 	var peerID [20]byte
 	_, err := rand.Read(peerID[:])
 	if err != nil {
 		return nil, err
 	}
 
+	metricsExporter, err := exporter.New(t.ExportTarget, exporter.DefaultOptions())
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := metricsExporter.Close(); err != nil {
+			log.Error(err)
+		}
+	}()
+
 	targetPeers := peers.NewPeerSet(0)
-	if peer != "" {
-		_, err := snet.ParseUDPAddr(peer)
+	if opts.Peer != "" {
+		_, err := snet.ParseUDPAddr(opts.Peer)
 		if err != nil {
-			log.Fatal(err)
+			return nil, fmt.Errorf("invalid peer: %w", err)
 		}
 		// pAddr, _ := net.ResolveTCPAddr("tcp", peer)
 
 		p := peers.Peer{
-			Addr:  peer,
+			Addr:  opts.Peer,
 			Index: 0,
 		}
 		targetPeers.Add(p)
@@ -86,14 +131,22 @@ func (t *TorrentFile) DownloadToFile(path string, peer string, local string, pat
 		PieceLength:                 t.PieceLength,
 		Length:                      t.Length,
 		Name:                        t.Name,
-		Local:                       local,
-		PathSelectionResponsibility: pathSelectionResponsibility,
+		Local:                       opts.Local,
+		PathSelectionResponsibility: opts.PathSelectionResponsibility,
+		PathPolicy:                  t.PathPolicy,
+		PathFilter:                  t.PathFilter,
+		PathHistory:                 t.PathHistory,
 		DiscoveryConfig:             pc,
 		Conns:                       make([]packets.UDPConn, 0),
+		Previous:                    t.Previous,
 	}
 
-	if pc.EnableDht {
-		peerAddr, err := snet.ParseUDPAddr(local)
+	if pc.EnableDht && t.DhtNode != nil {
+		// Only look up peers, we are not seeding this torrent
+		torrent.JoinDht(t.DhtNode, 0)
+		defer t.DhtNode.RemoveTorrent(t.InfoHash)
+	} else if pc.EnableDht {
+		peerAddr, err := snet.ParseUDPAddr(opts.Local)
 		peerPort := uint16(peerAddr.Host.Port)
 		nodeAddr := peerAddr.Copy()
 		nodeAddr.Host.Port = int(pc.DhtPort)
@@ -102,33 +155,99 @@ func (t *TorrentFile) DownloadToFile(path string, peer string, local string, pat
 			log.Println("could not enable dht")
 		}
 	}
+	// The dht node created for the download is only handed to the caller if the download
+	// completes
+	complete := false
+	defer func() {
+		if !complete && torrent.DhtNode != nil && torrent.DhtNode != t.DhtNode {
+			torrent.DhtNode.Close()
+		}
+	}()
 
-	buf, err := torrent.Download()
-	if err != nil {
+	var downloadDone func()
+	if t.OnDownload != nil {
+		downloadDone = t.OnDownload(&torrent)
+	}
+	buf, err := torrent.Download(ctx)
+	if downloadDone != nil {
+		downloadDone()
+	}
+	stopped := errors.Is(err, p2p.ErrStopped)
+	if err != nil && !stopped {
 		return nil, err
 	}
 
+	metrics := torrent.ConnMetrics()
+	for i := range metrics {
+		metricsExporter.Export(&metrics[i])
+	}
 	if t.PrintMetrics {
-		// TODO: Implement metrics
-		// for i,v := range torrent.Conns {
-		//	log.Infof("Average download bandwidth ")
-		//}
+		p2p.PrintConnMetrics(os.Stdout, metrics)
+	}
+
+	if stopped {
+		// Keep the pieces downloaded so far, so that they are reused if the download is
+		// started again with ReadPrevious
+		partial := PartialPath(path)
+		log.Infof("Writing partial download to %s", partial)
+		if err := writeFile(partial, buf); err != nil {
+			return &torrent, err
+		}
+		return &torrent, p2p.ErrStopped
 	}
 
 	log.Infof("Writing output file %s", path)
-	outFile, err := os.Create(path)
-	if err != nil {
+	if err := writeFile(path, buf); err != nil {
 		return nil, err
 	}
-	defer outFile.Close()
-	_, err = outFile.Write(buf)
-	if err != nil {
-		return nil, err
+	if err := os.Remove(PartialPath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Warnf("Could not remove partial download: %s", err)
 	}
 	log.Infof("Done writing output file, download complete")
+	complete = true
 	return &torrent, nil
 }
 
+// PartialPath returns the path the pieces of a stopped download to path are kept at until the
+// download is complete
+func PartialPath(path string) string {
+	return path + ".part"
+}
+
+// ReadPrevious returns the pieces of a stopped download to path or, if there are none, the
+// content of the file at path, e.g. an older version. Set as Previous, the download continues
+// from them. It returns nil if neither has the length of the torrent.
+func (t *TorrentFile) ReadPrevious(path string) []byte {
+	for _, p := range []string{PartialPath(path), path} {
+		if previous, err := ioutil.ReadFile(p); err == nil && len(previous) == t.Length {
+			return previous
+		}
+	}
+	return nil
+}
+
+// writeFile replaces the file with the data, so that an interrupted write never leaves a
+// truncated file behind
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 // Open parses a torrent file
 func Open(path string) (TorrentFile, error) {
 	file, err := os.Open(path)
@@ -138,9 +257,13 @@ func Open(path string) (TorrentFile, error) {
 		return TorrentFile{}, err
 	}
 	defer file.Close()
+	return Read(file)
+}
 
+// Read parses the content of a torrent file
+func Read(r io.Reader) (TorrentFile, error) {
 	bto := bencodeTorrent{}
-	err = bencode.Unmarshal(file, &bto)
+	err := bencode.Unmarshal(r, &bto)
 	if err != nil {
 		return TorrentFile{}, err
 	}
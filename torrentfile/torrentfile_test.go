@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"flag"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -88,3 +90,31 @@ func TestToTorrentFile(t *testing.T) {
 		assert.Equal(t, test.output, to)
 	}
 }
+
+func TestWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out")
+	require.NoError(t, ioutil.WriteFile(path, []byte("partial"), 0644))
+	require.NoError(t, writeFile(path, []byte("complete")))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "complete", string(data))
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReadPrevious(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out")
+	tf := TorrentFile{Length: 7}
+	assert.Nil(t, tf.ReadPrevious(path))
+
+	// An older version of the file is reused until a download was stopped
+	require.NoError(t, ioutil.WriteFile(path, []byte("version"), 0644))
+	assert.Equal(t, "version", string(tf.ReadPrevious(path)))
+	require.NoError(t, ioutil.WriteFile(PartialPath(path), []byte("partial"), 0644))
+	assert.Equal(t, "partial", string(tf.ReadPrevious(path)))
+
+	// Files of other torrents are ignored
+	tf.Length = 8
+	assert.Nil(t, tf.ReadPrevious(path))
+}